@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/state"
+)
+
+// newSummary condenses the merge statistics of a range for the state file.
+func newSummary(startDate, endDate string, stats map[string]interface{}) *state.Summary {
+	summary := &state.Summary{
+		StartDate:     startDate,
+		EndDate:       endDate,
+		TotalRequests: stats["total_requests"].(int),
+		UniqueDomains: stats["unique_domains"].(int),
+		Servers:       make(map[string]state.ServerSummary),
+	}
+	for _, s := range stats["sources"].([]merger.SourceStats) {
+		summary.Servers[s.Source] = state.ServerSummary{
+			Requests:      s.Requests,
+			UniqueDomains: s.UniqueDomains,
+		}
+	}
+	return summary
+}
+
+// detectAnomalies compares cur with the summary of the previously uploaded
+// range and returns the values that changed by more than threshold percent.
+// Servers missing from either summary are not compared; a server that failed
+// to fetch is already reported as an error.
+func detectAnomalies(prev, cur *state.Summary, threshold float64) []report.Anomaly {
+	var anomalies []report.Anomaly
+	check := func(server, metric string, previous, current int) {
+		if previous == 0 {
+			return
+		}
+		change := float64(current-previous) * 100 / float64(previous)
+		if math.Abs(change) > threshold {
+			anomalies = append(anomalies, report.Anomaly{
+				Server:        server,
+				Metric:        metric,
+				Previous:      previous,
+				Current:       current,
+				ChangePercent: math.Round(change*10) / 10,
+			})
+		}
+	}
+
+	check("", "total_requests", prev.TotalRequests, cur.TotalRequests)
+	check("", "unique_domains", prev.UniqueDomains, cur.UniqueDomains)
+
+	servers := make([]string, 0, len(cur.Servers))
+	for server := range cur.Servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	for _, server := range servers {
+		before, ok := prev.Servers[server]
+		if !ok {
+			continue
+		}
+		now := cur.Servers[server]
+		check(server, "requests", before.Requests, now.Requests)
+		check(server, "unique_domains", before.UniqueDomains, now.UniqueDomains)
+	}
+
+	return anomalies
+}
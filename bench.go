@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+)
+
+// benchResult is the measurement of one merge of the sample data.
+type benchResult struct {
+	engine   string
+	run      int
+	lines    int
+	requests int
+	domains  int
+
+	merge time.Duration
+	save  time.Duration
+
+	// Bytes allocated during the run, and held by the heap after the merge
+	allocated uint64
+	heap      uint64
+	gcs       uint32
+}
+
+// runBench implements `gihftp bench`: it merges local sample logs with each
+// merge engine, saves the result in a temporary directory and prints the
+// timings and memory use, so that engines and settings can be compared on
+// the hardware at hand. CPU and heap profiles can be written for `go tool
+// pprof`. No config file is read and nothing is uploaded.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	inputDir := fs.String("input-dir", "", "Log files to merge: a directory or a glob pattern (required)")
+	engines := fs.String("merge-engine", "memory,disk", "Merge engines to compare, comma separated")
+	columns := fs.String("output-columns", "domain,count", "Columns of the merged file; qtype and clients enable the query type breakdown and client estimation")
+	runs := fs.Int("runs", 1, "Number of merges per engine")
+	maxMemoryMB := fs.Int("max-memory-mb", 0, "Soft memory limit in MB, as for a run: merge data beyond half of it is spilled to disk (0 = unlimited)")
+	workDir := fs.String("work-dir", "", "Directory for the disk engine and the merged files (default: a temporary directory)")
+	cpuProfile := fs.String("cpuprofile", "", "Write a CPU profile of all merges to this file")
+	memProfile := fs.String("memprofile", "", "Write a heap profile to this file, taken after the last merge before its data is released")
+	logLevel := fs.String("log-level", "error", "Log level of the merges (debug, info, error)")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if *inputDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: --input-dir is required\n")
+		return ExitConfigError
+	}
+	if *runs < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --runs must be at least 1\n")
+		return ExitConfigError
+	}
+	if *maxMemoryMB < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-memory-mb cannot be negative\n")
+		return ExitConfigError
+	}
+	engineList := splitFlagList(*engines)
+	for _, engine := range engineList {
+		if engine != merger.EngineMemory && engine != merger.EngineDisk {
+			fmt.Fprintf(os.Stderr, "Error: unsupported merge engine: %s\n", engine)
+			return ExitConfigError
+		}
+	}
+	if len(engineList) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --merge-engine is empty\n")
+		return ExitConfigError
+	}
+	layout := merger.Layout{Columns: splitFlagList(*columns)}
+	if err := layout.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+
+	if err := logger.Init(*logLevel, logger.Options{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Logger initialization failed: %v\n", err)
+		return ExitConfigError
+	}
+
+	paths, err := inputFiles(*inputDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot list input files: %v\n", err)
+		return ExitConfigError
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no input files found in %s\n", *inputDir)
+		return ExitConfigError
+	}
+	var inputBytes int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			inputBytes += info.Size()
+		}
+	}
+
+	dir := *workDir
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "gihftp-bench-"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitConfigError
+		}
+		defer os.RemoveAll(dir)
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+
+	if *cpuProfile != "" {
+		file, err := os.Create(*cpuProfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return ExitConfigError
+		}
+		defer file.Close()
+		if err := pprof.StartCPUProfile(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to start CPU profile: %v\n", err)
+			return ExitConfigError
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	// Like setMemoryLimit, but every merge gets a budget of its own
+	budget := int64(*maxMemoryMB) << 20 / 2
+	if budget > 0 {
+		debug.SetMemoryLimit(2 * budget)
+	}
+
+	fmt.Printf("Merging %d files (%s) from %s\n\n", len(paths), formatBytes(inputBytes), *inputDir)
+
+	var results []benchResult
+	for _, engine := range engineList {
+		for run := 1; run <= *runs; run++ {
+			// The heap profile shows the data of the very last merge
+			profile := ""
+			if engine == engineList[len(engineList)-1] && run == *runs {
+				profile = *memProfile
+			}
+			result, err := benchMerge(engine, layout, budget, paths, dir, profile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s engine: %v\n", engine, err)
+				return ExitMergeError
+			}
+			result.run = run
+			results = append(results, result)
+		}
+	}
+
+	printBench(results)
+	if *cpuProfile != "" {
+		fmt.Printf("\nCPU profile written to %s\n", *cpuProfile)
+	}
+	if *memProfile != "" {
+		fmt.Printf("Heap profile written to %s\n", *memProfile)
+	}
+	return ExitSuccess
+}
+
+// benchMerge merges paths once with engine, within budget bytes of merge
+// data unless 0, and saves the result in dir. With memProfile set a heap
+// profile is written before the merged data is released.
+func benchMerge(engine string, layout merger.Layout, budget int64, paths []string, dir, memProfile string) (benchResult, error) {
+	result := benchResult{engine: engine}
+
+	m := merger.New(dir)
+	if err := m.SetEngine(engine); err != nil {
+		return result, err
+	}
+	m.SetLayout(layout)
+	m.SetQTypeBreakdown(slices.Contains(layout.Columns, merger.ColumnQType))
+	m.SetClientTracking(slices.Contains(layout.Columns, merger.ColumnClients))
+	if budget > 0 {
+		m.SetMemoryBudget(merger.NewMemoryBudget(budget))
+	}
+	defer m.Close()
+
+	// Leave the garbage of the previous run out of this one
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	for _, path := range paths {
+		if err := mergeLocalFile(m, path); err != nil {
+			return result, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	result.merge = time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	result.allocated = after.TotalAlloc - before.TotalAlloc
+	result.gcs = after.NumGC - before.NumGC
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	result.heap = after.HeapAlloc
+
+	if memProfile != "" {
+		if err := writeHeapProfile(memProfile); err != nil {
+			return result, err
+		}
+	}
+
+	start = time.Now()
+	output, err := m.SaveAs(filepath.Join(dir, "gihftp-bench-"+engine+".txt"), merger.FormatPipe)
+	if err != nil {
+		return result, err
+	}
+	result.save = time.Since(start)
+	os.Remove(output)
+
+	for _, source := range m.Sources() {
+		result.lines += source.Lines
+		result.requests += source.Requests
+	}
+	result.domains = m.GetDomainCount()
+	return result, nil
+}
+
+func writeHeapProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write heap profile: %w", err)
+	}
+	return file.Close()
+}
+
+func printBench(results []benchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENGINE\tRUN\tLINES\tREQUESTS\tDOMAINS\tMERGE\tSAVE\tLINES/S\tALLOCATED\tHEAP\tGC")
+	for _, r := range results {
+		rate := 0.0
+		if r.merge > 0 {
+			rate = float64(r.lines) / r.merge.Seconds()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%.0f\t%s\t%s\t%d\n",
+			r.engine,
+			r.run,
+			r.lines,
+			r.requests,
+			r.domains,
+			r.merge.Round(time.Millisecond),
+			r.save.Round(time.Millisecond),
+			rate,
+			formatBytes(int64(r.allocated)),
+			formatBytes(int64(r.heap)),
+			r.gcs,
+		)
+	}
+	w.Flush()
+}
+
+// splitFlagList splits a comma-separated flag value, dropping empty entries.
+func splitFlagList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/scheduler"
+)
+
+// waitUploadWindow holds a daemon's upload back while the upload blackout
+// (--upload-blackout) is active. It returns false when ctx ends first.
+// One-shot runs are started deliberately and upload right away.
+func waitUploadWindow(ctx context.Context, cfg *config.Config) bool {
+	if !cfg.Daemon || cfg.UploadBlackout == "" {
+		return true
+	}
+	blackout, err := scheduler.ParseBlackout(cfg.UploadBlackout)
+	if err != nil {
+		// Validated with the configuration
+		return true
+	}
+
+	for {
+		until := blackout.Until(time.Now())
+		if until.IsZero() {
+			return true
+		}
+
+		logger.Info("Upload deferred by blackout window",
+			"until", until.Format(time.RFC3339),
+			"in", time.Until(until).Round(time.Second).String(),
+		)
+
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gih-ftp/internal/config"
+	ftpclient "gih-ftp/internal/ftp"
+	"gih-ftp/internal/gihapi"
+	"gih-ftp/internal/httpupload"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/redact"
+	sftpclient "gih-ftp/internal/sftp"
+)
+
+type checkResult struct {
+	target string
+	check  string
+	err    error
+}
+
+// runCheck verifies that every configured GIH server answers API requests
+// and that every upload target accepts a login and a write into the remote
+// log directory. Results are printed as a table on stdout.
+func runCheck(ctx context.Context, cfg *config.Config) int {
+	var results []checkResult
+
+	apiClient, err := newAPIClient(cfg)
+	if err != nil {
+		logger.Error("Failed to create GIH API client", "error", err)
+		return ExitConfigError
+	}
+	defer apiClient.Close()
+	apiClient.SetRetryPolicy(gihapi.RetryPolicy{Attempts: 1})
+
+	servers, err := gihServers(ctx, cfg)
+	if err != nil {
+		results = append(results, checkResult{target: "GIH servers", check: "discovery", err: err})
+	}
+
+	startDate, endDate := gihapi.GetDateRange(1)
+	for _, server := range servers {
+		_, err := apiClient.FetchLogFiles(ctx, server, startDate, endDate)
+		results = append(results, checkResult{
+			target: server.BaseURL(),
+			check:  "GIH API",
+			err:    err,
+		})
+	}
+
+	for _, target := range cfg.UploadTargets {
+		var uploadErr error
+		check := fmt.Sprintf("%s login + write %s", target.Protocol, target.LogDir)
+		switch target.Protocol {
+		case "sftp":
+			var client *sftpclient.Client
+			if client, uploadErr = newSFTPClient(cfg, target); uploadErr == nil {
+				uploadErr = client.VerifyWritable(ctx, target.LogDir)
+			}
+		case "rsync":
+			check = "rsync login + list " + target.LogDir
+			uploadErr = newRsyncClient(cfg, target).VerifyReachable(ctx, target.LogDir)
+		case "https":
+			// Sending a probe file could replace a real one
+			check = "https connect"
+			var client *httpupload.Client
+			if client, uploadErr = newHTTPUploadClient(cfg, target); uploadErr == nil {
+				uploadErr = client.VerifyReachable(ctx, target.UploadURL("check", time.Now()))
+			}
+		default:
+			var client *ftpclient.Client
+			if client, uploadErr = newFTPClient(cfg, target); uploadErr == nil {
+				uploadErr = client.VerifyWritable(ctx, target.LogDir)
+			}
+		}
+		results = append(results, checkResult{
+			target: fmt.Sprintf("%s (%s)", target.Host, target.Name),
+			check:  check,
+			err:    uploadErr,
+		})
+	}
+
+	if failed := printResults(results); failed > 0 {
+		logger.Error("Preflight check failed", "failed", failed, "total", len(results))
+		return ExitCheckError
+	}
+
+	logger.Info("Preflight check passed", "total", len(results))
+	return ExitSuccess
+}
+
+// printResults prints results as a PASS/FAIL table on stdout and returns
+// the number of failed checks.
+func printResults(results []checkResult) int {
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tCHECK\tRESULT\tDETAIL")
+	for _, r := range results {
+		status, detail := "PASS", ""
+		if r.err != nil {
+			status, detail = "FAIL", redact.String(r.err.Error())
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.target, r.check, status, detail)
+	}
+	w.Flush()
+	return failed
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/metrics"
+	"gih-ftp/internal/redact"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/scheduler"
+)
+
+// runDaemon repeats the fetch/merge/upload cycle on cfg.Schedule until ctx
+// is cancelled by SIGINT or SIGTERM. A signal that arrives while a cycle is
+// running aborts that cycle, which cleans up its partial transfers. SIGHUP
+// reloads the configuration before the next cycle.
+func runDaemon(ctx context.Context, cfg *config.Config) int {
+	schedule, err := scheduler.Parse(cfg.Schedule)
+	if err != nil {
+		logger.Error("Invalid schedule", "schedule", cfg.Schedule, "error", err)
+		return ExitConfigError
+	}
+
+	status := newDaemonStatus(cfg.Schedule)
+	serveDaemonHTTP(cfg, status)
+
+	reload, stopReload := notifyReload()
+	defer stopReload()
+
+	logger.Info("Daemon mode started", "schedule", cfg.Schedule)
+
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			logger.Error("Schedule never fires", "schedule", cfg.Schedule)
+			return ExitConfigError
+		}
+		status.waiting(next)
+
+		logger.Info("Next scheduled run",
+			"at", next.Format(time.RFC3339),
+			"in", time.Until(next).Round(time.Second).String(),
+		)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			status.stopping()
+			logger.Info("Daemon shutting down")
+			return ExitSuccess
+		case <-reload:
+			timer.Stop()
+			if newCfg, newSchedule, err := reloadConfig(cfg); err != nil {
+				logger.Error("Failed to reload configuration, keeping the current one", "error", err)
+			} else {
+				cfg, schedule = newCfg, newSchedule
+				status.setSchedule(cfg.Schedule)
+			}
+			continue
+		case <-timer.C:
+		}
+
+		status.running()
+		rep := runOnce(ctx, cfg, "run")
+		status.finished(rep)
+		exitCode := rep.ExitCode
+		if interrupted(ctx) {
+			status.stopping()
+			logger.Info("Daemon shutting down after interrupted run")
+			return ExitInterrupted
+		}
+		switch exitCode {
+		case ExitSuccess:
+			logger.Info("Scheduled run completed successfully")
+		case ExitAnomaly:
+			logger.Warn("Scheduled run completed with anomaly warnings", "exit_code", exitCode)
+		case ExitNoData:
+			logger.Warn("Scheduled run found no data for the date range", "exit_code", exitCode)
+		default:
+			logger.Error("Scheduled run completed with errors", "exit_code", exitCode)
+		}
+	}
+}
+
+// reloadConfig loads and validates the configuration again. Settings that
+// only take effect at startup (work directory, logging, the HTTP endpoints
+// and the memory limit) keep their current values.
+func reloadConfig(cfg *config.Config) (*config.Config, scheduler.Schedule, error) {
+	logger.Info("Reloading configuration", "file", cfg.ConfigFile)
+
+	newCfg, err := config.Reload()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := newCfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	schedule, err := scheduler.Parse(newCfg.Schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule %q: %w", newCfg.Schedule, err)
+	}
+
+	fixed := []struct {
+		name     string
+		old, new *string
+	}{
+		{"work-dir", &cfg.WorkDir, &newCfg.WorkDir},
+		{"log-level", &cfg.LogLevel, &newCfg.LogLevel},
+		{"log-format", &cfg.LogFormat, &newCfg.LogFormat},
+		{"log-file", &cfg.LogFile, &newCfg.LogFile},
+		{"metrics-listen", &cfg.MetricsListen, &newCfg.MetricsListen},
+		{"health-listen", &cfg.HealthListen, &newCfg.HealthListen},
+	}
+	for _, setting := range fixed {
+		if *setting.new != *setting.old {
+			logger.Warn("Setting only changes on restart, keeping the current value",
+				"setting", setting.name, "current", *setting.old, "configured", *setting.new)
+			*setting.new = *setting.old
+		}
+	}
+
+	if newCfg.MaxMemoryMB != cfg.MaxMemoryMB {
+		logger.Warn("Setting only changes on restart, keeping the current value",
+			"setting", "max-memory-mb", "current", cfg.MaxMemoryMB, "configured", newCfg.MaxMemoryMB)
+		newCfg.MaxMemoryMB = cfg.MaxMemoryMB
+	}
+
+	redact.SetSecrets(newCfg.Secrets())
+	for _, warning := range newCfg.Deprecated {
+		logger.Warn(warning)
+	}
+
+	logger.Info("Configuration reloaded",
+		"gih_servers", fmt.Sprintf("%v", newCfg.GIHServers),
+		"gih_discover", fmt.Sprintf("%v", newCfg.GIHDiscover),
+		"upload_targets", len(newCfg.UploadTargets),
+		"schedule", newCfg.Schedule,
+	)
+	return newCfg, schedule, nil
+}
+
+// serveDaemonHTTP starts the metrics and health endpoints. Both may share
+// one address.
+func serveDaemonHTTP(cfg *config.Config, status *daemonStatus) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if cfg.MetricsListen != "" {
+		mux(cfg.MetricsListen).Handle("/metrics", metrics.Default.Handler())
+		logger.Info("Serving metrics", "address", cfg.MetricsListen)
+	}
+	if cfg.HealthListen != "" {
+		m := mux(cfg.HealthListen)
+		m.HandleFunc("/healthz", status.handleHealthz)
+		m.HandleFunc("/readyz", status.handleReadyz)
+		m.HandleFunc("/status", status.handleStatus)
+		logger.Info("Serving health endpoints", "address", cfg.HealthListen)
+	}
+
+	for addr, m := range muxes {
+		go func() {
+			if err := http.ListenAndServe(addr, m); err != nil {
+				logger.Error("HTTP endpoint stopped", "address", addr, "error", err)
+			}
+		}()
+	}
+}
+
+// lastRun is the outcome of the most recent scheduled run in /status.
+type lastRun struct {
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	StartDate       string    `json:"start_date,omitempty"`
+	EndDate         string    `json:"end_date,omitempty"`
+	ExitCode        int       `json:"exit_code"`
+}
+
+// daemonStatus is what the health endpoints report about the daemon loop.
+type daemonStatus struct {
+	mu        sync.Mutex
+	schedule  string
+	startedAt time.Time
+	state     string // starting, waiting, running, stopping
+	nextRun   time.Time
+	lastRun   *lastRun
+}
+
+func newDaemonStatus(schedule string) *daemonStatus {
+	return &daemonStatus{schedule: schedule, startedAt: time.Now().UTC(), state: "starting"}
+}
+
+func (s *daemonStatus) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+func (s *daemonStatus) waiting(next time.Time) {
+	s.set(func() { s.state, s.nextRun = "waiting", next })
+}
+
+func (s *daemonStatus) setSchedule(schedule string) {
+	s.set(func() { s.schedule = schedule })
+}
+
+func (s *daemonStatus) running() {
+	s.set(func() { s.state, s.nextRun = "running", time.Time{} })
+}
+
+func (s *daemonStatus) finished(rep *report.Report) {
+	s.set(func() {
+		s.lastRun = &lastRun{
+			StartedAt:       rep.StartedAt,
+			FinishedAt:      rep.FinishedAt,
+			DurationSeconds: rep.DurationSeconds,
+			StartDate:       rep.StartDate,
+			EndDate:         rep.EndDate,
+			ExitCode:        rep.ExitCode,
+		}
+	})
+}
+
+func (s *daemonStatus) stopping() {
+	s.set(func() { s.state = "stopping" })
+}
+
+// handleHealthz reports that the process is alive.
+func (s *daemonStatus) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the scheduler loop is up, i.e. waiting for
+// or executing a run, and not shutting down.
+func (s *daemonStatus) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	if state != "waiting" && state != "running" {
+		http.Error(w, state, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// handleStatus returns the daemon state, the next scheduled run and the
+// outcome of the last run as JSON.
+func (s *daemonStatus) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	body := struct {
+		State     string     `json:"state"`
+		Version   string     `json:"version"`
+		Schedule  string     `json:"schedule"`
+		StartedAt time.Time  `json:"started_at"`
+		NextRun   *time.Time `json:"next_run,omitempty"`
+		LastRun   *lastRun   `json:"last_run,omitempty"`
+	}{
+		State:     s.state,
+		Version:   version,
+		Schedule:  s.schedule,
+		StartedAt: s.startedAt,
+		LastRun:   s.lastRun,
+	}
+	if !s.nextRun.IsZero() {
+		next := s.nextRun
+		body.NextRun = &next
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
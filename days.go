@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/state"
+)
+
+// dayCounts returns what the log files of each date contributed to sm.
+// Files are added with their date as the merge source.
+func dayCounts(sm *dayMergers) map[string]state.DayCount {
+	if sm.counts != nil {
+		return sm.counts
+	}
+	days := make(map[string]state.DayCount)
+	for _, m := range sm.byDay {
+		addDayCounts(days, m)
+	}
+	return days
+}
+
+// addDayCounts adds what the sources (dates) of m contributed to days.
+func addDayCounts(days map[string]state.DayCount, m *merger.Merger) {
+	for _, s := range m.Sources() {
+		day := days[s.Source]
+		day.Lines += s.Lines
+		day.Requests += s.Requests
+		day.UniqueDomains += s.UniqueDomains
+		day.Skipped += s.Skipped
+		days[s.Source] = day
+	}
+}
+
+// setServerDays records the day counts of a server in its report, ordered
+// by date, along with its line totals. Nothing is set when the counts are
+// not known.
+func setServerDays(result *report.Server, days map[string]state.DayCount) {
+	if days == nil {
+		return
+	}
+
+	result.Days = make([]report.ServerDay, 0, len(days))
+	for date, day := range days {
+		result.Days = append(result.Days, report.ServerDay{
+			Date:          date,
+			Lines:         day.Lines,
+			Requests:      day.Requests,
+			UniqueDomains: day.UniqueDomains,
+			SkippedLines:  day.Skipped,
+		})
+		result.Lines += day.Lines
+		result.SkippedLines += day.Skipped
+	}
+	sort.Slice(result.Days, func(i, k int) bool { return result.Days[i].Date < result.Days[k].Date })
+}
+
+// dayBreakdown sums the day counts of the fetched servers for every date of
+// the job's range and logs them. Servers whose day counts are unknown are
+// left out; failed servers are already reported as such.
+func (j *job) dayBreakdown() []report.Day {
+	var servers []*report.Server
+	for _, s := range j.rep.Servers {
+		if s.Error == "" && s.Days != nil {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+
+	var days []report.Day
+	for _, date := range rangeDays(j.startDate, j.endDate) {
+		day := report.Day{Date: date}
+		for _, s := range servers {
+			requests := 0
+			for _, d := range s.Days {
+				if d.Date == date {
+					requests = d.Requests
+				}
+			}
+			if requests == 0 {
+				day.Missing = append(day.Missing, s.Host)
+				continue
+			}
+			day.Requests += requests
+			day.Servers++
+		}
+		days = append(days, day)
+
+		logger.Info("Day statistics",
+			"date", day.Date,
+			"requests", day.Requests,
+			"servers", day.Servers,
+		)
+		if len(day.Missing) > 0 {
+			logger.Warn("No data for day from some servers",
+				"date", day.Date,
+				"servers", strings.Join(day.Missing, ","),
+			)
+		}
+	}
+	return days
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/metrics"
+	"gih-ftp/internal/report"
+)
+
+// delivery is the outcome of uploading to every upload target.
+type delivery struct {
+	// failures holds the error of each failed target; optional counts
+	// those of optional targets
+	failures []error
+	optional int
+}
+
+// requiredFailed returns the number of failed required targets.
+func (d delivery) requiredFailed() int {
+	return len(d.failures) - d.optional
+}
+
+// deliver uploads files to every upload target, concurrently with
+// --upload-parallel. A target stops at its first failed file and is tried
+// again from there under its retry policy. Targets an earlier run of the
+// range delivered to are skipped unless --force is set, and the targets
+// delivered to are recorded in the state.
+func (j *job) deliver(ctx context.Context, files []string) delivery {
+	cfg, rep := j.cfg, j.rep
+	start := time.Now()
+
+	// The report lists the targets in configuration order, whichever
+	// finishes first
+	results := make([]*report.Upload, len(cfg.UploadTargets))
+	for i, target := range cfg.UploadTargets {
+		results[i] = rep.AddUpload(target.Name, target.Protocol, target.Host)
+		results[i].Optional = !target.Required
+		if j.st != nil && !cfg.Force && j.st.DeliveredTo(j.startDate, j.endDate, target.Name) {
+			results[i].Skipped = true
+			logger.Info("Target already received the merged file, skipping",
+				"target", target.Name,
+				"start_date", j.startDate,
+				"end_date", j.endDate,
+			)
+		}
+	}
+
+	errs := make([]error, len(cfg.UploadTargets))
+	var wg sync.WaitGroup
+	for i, target := range cfg.UploadTargets {
+		if results[i].Skipped {
+			continue
+		}
+		if !cfg.UploadParallel {
+			errs[i] = j.deliverTarget(ctx, target, files, results[i])
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = j.deliverTarget(ctx, target, files, results[i])
+		}()
+	}
+	wg.Wait()
+	rep.Timings.Upload += time.Since(start).Seconds()
+
+	var d delivery
+	for i, err := range errs {
+		if err == nil {
+			if j.st != nil && !results[i].Skipped {
+				j.st.RecordDelivery(j.startDate, j.endDate, cfg.UploadTargets[i].Name)
+			}
+			continue
+		}
+		d.failures = append(d.failures, err)
+		if !cfg.UploadTargets[i].Required {
+			d.optional++
+		}
+	}
+	return d
+}
+
+// deliverTarget uploads files to target, falling back to the other
+// protocol with --upload-fallback when target cannot be reached, and
+// retrying the files not yet delivered under the retry policy of target,
+// then prunes old remote files.
+func (j *job) deliverTarget(ctx context.Context, target config.UploadTarget, files []string, result *report.Upload) error {
+	cfg := j.cfg
+	uploadStart := time.Now()
+
+	delivered := func(target config.UploadTarget, paths []string) {
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				metrics.Add(metrics.UploadedBytes, float64(info.Size()))
+			}
+			result.RemotePaths = append(result.RemotePaths, remotePathFor(target, path))
+			result.Transport = target.Protocol
+		}
+	}
+
+	used := target
+	rest := files
+	err := ctx.Err()
+	for attempt := 1; err == nil; attempt++ {
+		result.Attempts = attempt
+
+		used = target
+		n, uploadErr := upload(ctx, cfg, target, rest)
+		delivered(target, rest[:n])
+		rest = rest[n:]
+
+		// The fallback continues with the file that failed
+		if uploadErr != nil && cfg.UploadFallback && ctx.Err() == nil && fallbackWanted(target, uploadErr) {
+			if fallback, ok := fallbackTarget(target); ok {
+				if fallback.Protocol == "ftp" {
+					logger.Warn("Falling back from SFTP to cleartext FTP: the login and the files are sent unencrypted",
+						"target", target.Name,
+						"host", fallback.Host)
+				}
+				logger.Warn("Upload failed, retrying with fallback protocol",
+					"target", target.Name,
+					"protocol", fallback.Protocol,
+					"host", fallback.Host,
+					"error", uploadErr)
+				m, fallbackErr := upload(ctx, cfg, fallback, rest)
+				delivered(fallback, rest[:m])
+				rest = rest[m:]
+				if fallbackErr != nil {
+					uploadErr = fmt.Errorf("%w (fallback %s: %v)", uploadErr, fallback.Protocol, fallbackErr)
+				} else {
+					used, uploadErr = fallback, nil
+				}
+			} else if target.Protocol == "sftp" {
+				logger.Warn("Not falling back from SFTP to cleartext FTP without fallbackinsecure",
+					"target", target.Name)
+			}
+		}
+
+		if uploadErr == nil {
+			break
+		}
+		if attempt >= target.RetryAttempts || ctx.Err() != nil {
+			err = uploadErr
+			break
+		}
+
+		delay := target.RetryDelayAfter(attempt)
+		logger.Warn("Upload failed, retrying",
+			"target", target.Name,
+			"attempt", attempt,
+			"attempts", target.RetryAttempts,
+			"delay", delay,
+			"error", uploadErr)
+		select {
+		case <-ctx.Done():
+			err = uploadErr
+		case <-time.After(delay):
+		}
+	}
+
+	result.DurationSeconds = time.Since(uploadStart).Seconds()
+	metrics.Set(metrics.UploadDuration, result.DurationSeconds, "target", target.Name)
+	if err != nil {
+		result.Error = err.Error()
+		result.ErrorCode = errorCode(err)
+		if target.Required {
+			logger.Error("Upload failed",
+				"target", target.Name,
+				"file", rest[0],
+				"error", err)
+		} else {
+			logger.Warn("Upload to optional target failed",
+				"target", target.Name,
+				"file", rest[0],
+				"error", err)
+		}
+		return err
+	}
+
+	if cfg.RemoteRetentionWeeks > 0 {
+		pruned, err := pruneRemote(ctx, cfg, used)
+		result.RemotePruned = len(pruned)
+		if err != nil {
+			logger.Warn("Failed to prune old remote files", "target", target.Name, "error", err)
+		}
+		for _, remotePath := range pruned {
+			logger.Info("Old remote file pruned",
+				"target", target.Name,
+				"remote_path", remotePath,
+				"action", cfg.RemoteRetentionAction)
+		}
+	}
+	return nil
+}
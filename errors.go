@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"gih-ftp/internal/diskspace"
+	ftpclient "gih-ftp/internal/ftp"
+	"gih-ftp/internal/gihapi"
+	"gih-ftp/internal/rsync"
+	sftpclient "gih-ftp/internal/sftp"
+)
+
+// Error codes recorded in the run report next to the error text, so that
+// scripts do not have to parse log messages.
+const (
+	errorCodeAuth    = "auth"
+	errorCodeHostKey = "host_key"
+	errorCodeNetwork = "network"
+	errorCodeVerify  = "verify"
+	errorCodeNoSpace = "no_space"
+	errorCodeTimeout = "timeout"
+)
+
+// errorExitCodes maps an error code to the exit code used when every server
+// or every upload target failed with it.
+var errorExitCodes = map[string]int{
+	errorCodeAuth:    ExitAuthError,
+	errorCodeHostKey: ExitHostKeyError,
+	errorCodeNetwork: ExitNetworkError,
+	errorCodeVerify:  ExitVerifyError,
+	errorCodeTimeout: ExitTimeout,
+}
+
+// errorCode classifies err by the typed errors of the client packages. It
+// returns "" for errors without a code of their own.
+func errorCode(err error) string {
+	var certErr *tls.CertificateVerificationError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ftpclient.ErrVerifyFailed), errors.Is(err, sftpclient.ErrVerifyFailed):
+		return errorCodeVerify
+	case errors.Is(err, gihapi.ErrUnauthorized), errors.Is(err, ftpclient.ErrLogin), errors.Is(err, sftpclient.ErrAuth), errors.Is(err, rsync.ErrAuth):
+		return errorCodeAuth
+	case errors.Is(err, sftpclient.ErrHostKeyMismatch), errors.Is(err, rsync.ErrHostKey):
+		return errorCodeHostKey
+	case errors.Is(err, diskspace.ErrNoSpace), errors.Is(err, sftpclient.ErrNoSpace), errors.Is(err, rsync.ErrNoSpace):
+		return errorCodeNoSpace
+	case errors.Is(err, context.DeadlineExceeded):
+		// --server-timeout or --run-deadline ran out. It is a net.Error
+		// too, but the network may be fine.
+		return errorCodeTimeout
+	case errors.As(err, &certErr):
+		// Reported through url.Error, which is a net.Error, but retrying
+		// will not help
+		return ""
+	case errors.As(err, &netErr):
+		return errorCodeNetwork
+	}
+	return ""
+}
+
+// connectFailed reports whether err is a failure to reach the server (name
+// resolution or dialing) rather than one after the connection was made.
+func connectFailed(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// exitCodeFor returns the exit code of the error code shared by all errs,
+// or fallback when they failed for different or unclassified reasons.
+func exitCodeFor(errs []error, fallback int) int {
+	code := ""
+	for i, err := range errs {
+		c := errorCode(err)
+		if c == "" || (i > 0 && c != code) {
+			return fallback
+		}
+		code = c
+	}
+	if exitCode, ok := errorExitCodes[code]; ok {
+		return exitCode
+	}
+	return fallback
+}
@@ -2,17 +2,26 @@ module gih-ftp
 
 go 1.23.1
 
-require github.com/pkg/sftp v1.13.10
+require (
+	filippo.io/age v1.2.1
+	github.com/ProtonMail/go-crypto v1.5.2
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.10
+	golang.org/x/net v0.43.0
+	golang.org/x/term v0.34.0
+)
 
 require (
+	github.com/cloudflare/circl v1.6.3 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
 
 require (
 	github.com/jlaffaye/ftp v0.2.0
 	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/crypto v0.41.0
-	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/sys v0.35.0
 	gopkg.in/ini.v1 v1.67.0
 )
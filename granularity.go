@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/state"
+)
+
+// dayMergers holds the mergers of one aggregate: a single merger for weekly
+// granularity, or one per day of the log files for daily granularity.
+type dayMergers struct {
+	daily  bool
+	create func() (*merger.Merger, error)
+	byDay  map[string]*merger.Merger
+
+	// With --stream the files of source go straight into out instead of
+	// byDay, and counts keeps what each date contributed
+	out    *dayMergers
+	source string
+	counts map[string]state.DayCount
+}
+
+func newDayMergers(daily bool, create func() (*merger.Merger, error)) *dayMergers {
+	return &dayMergers{
+		daily:  daily,
+		create: create,
+		byDay:  make(map[string]*merger.Merger),
+	}
+}
+
+// newStreamMergers returns mergers that add each verified file of source to
+// the combined result in out as source, so that only the file being read is
+// held apart from it. create makes the scratch merger of a file.
+func newStreamMergers(out *dayMergers, source string, create func() (*merger.Merger, error)) *dayMergers {
+	d := newDayMergers(out.daily, create)
+	d.out, d.source = out, source
+	d.counts = make(map[string]state.DayCount)
+	return d
+}
+
+// add adds scratch, a verified file of day, to the merger of day, or with
+// --stream to the combined result.
+func (d *dayMergers) add(day string, scratch *merger.Merger) error {
+	if d.out == nil {
+		m, err := d.get(day)
+		if err != nil {
+			return err
+		}
+		return m.Merge(scratch)
+	}
+
+	m, err := d.out.get(day)
+	if err != nil {
+		return err
+	}
+	if err := m.MergeSource(d.source, scratch); err != nil {
+		return err
+	}
+	addDayCounts(d.counts, scratch)
+	return nil
+}
+
+// get returns the merger for day (YYYYMMDD), creating it on first use. For
+// weekly granularity every day shares one merger.
+func (d *dayMergers) get(day string) (*merger.Merger, error) {
+	if !d.daily {
+		day = ""
+	} else if _, err := time.Parse(config.DateLayout, day); err != nil {
+		return nil, fmt.Errorf("invalid log file date %q", day)
+	}
+
+	if m, ok := d.byDay[day]; ok {
+		return m, nil
+	}
+	m, err := d.create()
+	if err != nil {
+		return nil, err
+	}
+	d.byDay[day] = m
+	return m, nil
+}
+
+// days returns the days that have a merger, in order. For weekly
+// granularity it is the single empty day once the merger exists.
+func (d *dayMergers) days() []string {
+	days := make([]string, 0, len(d.byDay))
+	for day := range d.byDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
+
+func (d *dayMergers) Close() {
+	for _, m := range d.byDay {
+		m.Close()
+	}
+}
+
+// newOutputMergers creates the mergers for the combined result of all
+// servers. The domain filter is loaded once and shared by every day.
+func newOutputMergers(cfg *config.Config) (*dayMergers, error) {
+	filter, err := loadDomainFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	out := newDayMergers(cfg.Granularity == "daily", func() (*merger.Merger, error) {
+		return newOutputMerger(cfg, filter)
+	})
+	if !out.daily {
+		if _, err := out.get(""); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// savePartial saves the fetched data of host below dir and returns the path
+// recorded in the state file: <host>.txt for weekly granularity, or the
+// directory <host>/ holding one <day>.txt per day for daily granularity.
+func savePartial(sm *dayMergers, dir, host string) (string, error) {
+	if !sm.daily {
+		m, err := sm.get("")
+		if err != nil {
+			return "", err
+		}
+		return m.SaveToFile(safeFilename(host) + ".txt")
+	}
+
+	hostDir := filepath.Join(dir, safeFilename(host))
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return "", err
+	}
+	for _, day := range sm.days() {
+		if _, err := sm.byDay[day].SaveToFile(filepath.Join(safeFilename(host), day+".txt")); err != nil {
+			return "", err
+		}
+	}
+	return hostDir, nil
+}
+
+// mergePartial adds the partial result of source saved by savePartial to
+// out. Daily partials can also be merged into a weekly result, but not the
+// other way round.
+func mergePartial(out *dayMergers, source, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if out.daily {
+			return fmt.Errorf("%s was fetched with weekly granularity (fetch again for daily files)", path)
+		}
+		m, err := out.get("")
+		if err != nil {
+			return err
+		}
+		return mergeFile(m, source, path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		day, ok := strings.CutSuffix(entry.Name(), ".txt")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		m, err := out.get(day)
+		if err != nil {
+			return err
+		}
+		if err := mergeFile(m, source, filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
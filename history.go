@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/history"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/report"
+)
+
+// runHistory implements `gihftp history`, which lists past runs from the
+// history file. Only the work directory settings of the config are needed.
+func runHistory() int {
+	cfg, err := config.LoadLocal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		return ExitConfigError
+	}
+
+	path := historyFilePath(cfg)
+	entries, skipped, err := history.Read(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %d unreadable line(s) in %s\n", skipped, path)
+	}
+	entries = history.Last(entries, cfg.HistoryLast)
+
+	if cfg.HistoryJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return ExitConfigError
+			}
+		}
+		return ExitSuccess
+	}
+
+	if len(entries) == 0 {
+		fmt.Printf("No runs recorded in %s\n", path)
+		return ExitSuccess
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tCOMMAND\tRANGE\tOUTCOME\tEXIT\tSERVERS\tDOWNLOADED\tREQUESTS\tDOMAINS\tDELIVERED")
+	for _, e := range entries {
+		dateRange := "-"
+		if e.StartDate != "" {
+			dateRange = e.StartDate + ".." + e.EndDate
+		}
+		servers := fmt.Sprintf("%d", e.Servers)
+		if e.ServersFailed > 0 {
+			servers = fmt.Sprintf("%d (%d failed)", e.Servers, e.ServersFailed)
+		}
+		delivered := "-"
+		if len(e.Delivered) > 0 {
+			delivered = strings.Join(e.Delivered, ",")
+		}
+		if len(e.FailedTargets) > 0 {
+			delivered += " (failed: " + strings.Join(e.FailedTargets, ",") + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%d\t%d\t%s\n",
+			e.StartedAt.Local().Format("2006-01-02 15:04"),
+			e.Command,
+			dateRange,
+			e.Outcome,
+			e.ExitCode,
+			servers,
+			formatBytes(e.DownloadedBytes),
+			e.TotalRequests,
+			e.UniqueDomains,
+			delivered,
+		)
+	}
+	w.Flush()
+	return ExitSuccess
+}
+
+// recordHistory appends the finished run to the history file.
+func recordHistory(cfg *config.Config, command string, rep *report.Report) {
+	e := history.Entry{
+		StartedAt:       rep.StartedAt.UTC().Truncate(time.Second),
+		DurationSeconds: rep.DurationSeconds,
+		Command:         command,
+		StartDate:       rep.StartDate,
+		EndDate:         rep.EndDate,
+		ExitCode:        rep.ExitCode,
+		Outcome:         string(runEvent(rep.ExitCode)),
+		Servers:         len(rep.Servers),
+	}
+	for _, server := range rep.Servers {
+		e.DownloadedBytes += server.Bytes
+		if server.Error != "" {
+			e.ServersFailed++
+		}
+	}
+	if rep.Merge != nil {
+		e.TotalRequests = rep.Merge.TotalRequests
+		e.UniqueDomains = rep.Merge.UniqueDomains
+	}
+	if rep.Output != nil {
+		e.Output = filepath.Base(rep.Output.Path)
+		e.OutputBytes = rep.Output.Size
+		e.OutputSHA256 = rep.Output.SHA256
+	}
+	for _, output := range rep.Outputs {
+		e.Outputs = append(e.Outputs, filepath.Base(output.Path))
+		e.OutputBytes += output.Size
+	}
+	for _, upload := range rep.Uploads {
+		if upload.Error != "" {
+			e.FailedTargets = append(e.FailedTargets, upload.Target)
+		} else {
+			e.Delivered = append(e.Delivered, upload.Target)
+		}
+	}
+
+	path := historyFilePath(cfg)
+	if err := history.Append(path, e); err != nil {
+		logger.Warn("Failed to record run history", "file", path, "error", err)
+	}
+}
+
+func historyFilePath(cfg *config.Config) string {
+	if cfg.HistoryFile != "" {
+		return cfg.HistoryFile
+	}
+	return filepath.Join(cfg.WorkDir, history.DefaultFilename)
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
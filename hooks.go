@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"gih-ftp/internal/hook"
+	"gih-ftp/internal/logger"
+)
+
+// runHook runs the hook command of the given name (pre-upload or
+// post-upload) for files. Hooks see the run in GIHFTP_* variables: the
+// files, the date range and the merge totals, plus extra.
+func (j *job) runHook(ctx context.Context, name, command string, files []string, extra map[string]string) error {
+	h := hook.Hook{
+		Name:    name,
+		Command: command,
+		Dir:     j.cfg.WorkDir,
+		Timeout: j.cfg.HookTimeout,
+	}
+
+	env := map[string]string{
+		"GIHFTP_HOOK":       name,
+		"GIHFTP_FILES":      strings.Join(files, "\n"),
+		"GIHFTP_START_DATE": j.startDate,
+		"GIHFTP_END_DATE":   j.endDate,
+		"GIHFTP_WORK_DIR":   j.cfg.WorkDir,
+	}
+	for _, path := range files {
+		if !isSidecar(path) {
+			env["GIHFTP_FILE"] = path
+			break
+		}
+	}
+	if j.rep.Output != nil && j.rep.Output.SHA256 != "" {
+		env["GIHFTP_SHA256"] = j.rep.Output.SHA256
+	}
+	if j.rep.Merge != nil {
+		env["GIHFTP_TOTAL_REQUESTS"] = strconv.Itoa(j.rep.Merge.TotalRequests)
+		env["GIHFTP_UNIQUE_DOMAINS"] = strconv.Itoa(j.rep.Merge.UniqueDomains)
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+
+	return h.Run(ctx, env)
+}
+
+// preUploadHook runs --pre-upload-hook before files are delivered. A failed
+// hook stops the upload unless --hook-abort-on-failure=false.
+func (j *job) preUploadHook(ctx context.Context, files []string, complete bool) int {
+	if j.cfg.PreUploadHook == "" {
+		return ExitSuccess
+	}
+
+	err := j.runHook(ctx, "pre-upload", j.cfg.PreUploadHook, files, map[string]string{
+		"GIHFTP_COMPLETE": strconv.FormatBool(complete),
+	})
+	if err == nil {
+		return ExitSuccess
+	}
+	if interrupted(ctx) {
+		logger.Error("Run interrupted during pre-upload hook")
+		return ExitInterrupted
+	}
+	if !j.cfg.HookAbortOnFailure {
+		logger.Warn("Pre-upload hook failed, uploading anyway", "error", err)
+		return ExitSuccess
+	}
+	logger.Error("Pre-upload hook failed, not uploading", "error", err)
+	return ExitHookError
+}
+
+// postUploadHook runs --post-upload-hook once the delivery to every target
+// was attempted. Its failure is only logged; the files are already out.
+func (j *job) postUploadHook(ctx context.Context, files []string) {
+	if j.cfg.PostUploadHook == "" {
+		return
+	}
+
+	var delivered, failed []string
+	requiredFailed := false
+	for _, upload := range j.rep.Uploads {
+		if upload.Error != "" {
+			failed = append(failed, upload.Target)
+			requiredFailed = requiredFailed || !upload.Optional
+		} else {
+			delivered = append(delivered, upload.Target)
+		}
+	}
+	// Failed optional targets are listed but do not make the upload partial
+	status := "success"
+	switch {
+	case len(delivered) == 0:
+		status = "failed"
+	case requiredFailed:
+		status = "partial"
+	}
+
+	err := j.runHook(ctx, "post-upload", j.cfg.PostUploadHook, files, map[string]string{
+		"GIHFTP_UPLOAD_STATUS":     status,
+		"GIHFTP_TARGETS_DELIVERED": strings.Join(delivered, ","),
+		"GIHFTP_TARGETS_FAILED":    strings.Join(failed, ","),
+	})
+	if err != nil {
+		logger.Warn("Post-upload hook failed", "error", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package age encrypts files in the age format (age-encryption.org/v1) to
+// X25519 recipients with filippo.io/age, so they can be decrypted with the
+// age or rage tools.
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	agelib "filippo.io/age"
+)
+
+// Suffix is appended to the name of an encrypted file.
+const Suffix = ".age"
+
+// Recipient is an X25519 public key, written as age1...
+type Recipient = agelib.X25519Recipient
+
+// IsRecipient reports whether s is written like an age public key (age1...)
+// rather than the name of a recipients file.
+func IsRecipient(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "age1")
+}
+
+// ParseRecipient parses a recipient in the Bech32 age1... form printed by
+// age-keygen.
+func ParseRecipient(s string) (*Recipient, error) {
+	r, err := agelib.ParseX25519Recipient(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// ReadRecipientsFile reads a recipients file as accepted by age -R: one
+// age1... public key per line, with blank lines and # comments ignored.
+func ReadRecipientsFile(path string) ([]*Recipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age recipients: %w", err)
+	}
+
+	var recipients []*Recipient
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRecipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%s contains no age recipients", path)
+	}
+	return recipients, nil
+}
+
+// EncryptFile encrypts path to path+Suffix for every recipient and returns
+// the new file. A partially written file is removed on failure.
+func EncryptFile(path string, recipients []*Recipient) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	target := path + Suffix
+	dst, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	err = Encrypt(dst, src, recipients)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	return target, nil
+}
+
+// Encrypt writes the age encryption of src for recipients to dst.
+func Encrypt(dst io.Writer, src io.Reader, recipients []*Recipient) error {
+	if len(recipients) == 0 {
+		return errors.New("no age recipients")
+	}
+
+	rs := make([]agelib.Recipient, len(recipients))
+	for i, r := range recipients {
+		rs[i] = r
+	}
+	w, err := agelib.Encrypt(dst, rs...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dateLayout names the dated directories, e.g. dir/2025-01-06.
+const dateLayout = "2006-01-02"
+
+// Archive keeps a local copy of uploaded files in one directory per day and
+// removes days older than the retention.
+type Archive struct {
+	dir           string
+	retentionDays int
+}
+
+// New returns an archive rooted at dir. A zero retentionDays keeps archived
+// files forever.
+func New(dir string, retentionDays int) *Archive {
+	return &Archive{dir: dir, retentionDays: retentionDays}
+}
+
+// Store moves files into the directory for day and returns their new paths.
+func (a *Archive) Store(day time.Time, files []string) ([]string, error) {
+	dir := filepath.Join(a.dir, day.Format(dateLayout))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	var archived []string
+	for _, path := range files {
+		target := filepath.Join(dir, filepath.Base(path))
+		if err := move(path, target); err != nil {
+			return archived, fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+		archived = append(archived, target)
+	}
+	return archived, nil
+}
+
+// Prune removes dated directories older than the retention and returns the
+// number of directories removed. Other entries in the archive directory are
+// left alone.
+func (a *Archive) Prune(now time.Time) (int, error) {
+	if a.retentionDays <= 0 {
+		return 0, nil
+	}
+
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	cutoff := now.AddDate(0, 0, -a.retentionDays)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		day, err := time.ParseInLocation(dateLayout, entry.Name(), now.Location())
+		if err != nil || !day.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// move renames src to dst, copying when they are on different file systems.
+func move(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
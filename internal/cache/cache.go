@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDirname is the cache directory name inside the work directory.
+const DefaultDirname = "cache"
+
+// Cache keeps downloaded log files on disk so that a repeated run can reuse
+// them instead of downloading again. Entries are keyed by server, file name
+// and the size reported by the server, and expire after ttl. An expired
+// entry stored with the server's validators (Meta) can be revalidated with
+// a conditional request instead of being downloaded again.
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// Meta holds the ETag and Last-Modified headers an entry was downloaded
+// with. It is kept next to the entry in a file with metaSuffix.
+type Meta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+const metaSuffix = ".meta"
+
+// New returns a cache rooted at dir. A zero ttl keeps entries forever.
+func New(dir string, ttl time.Duration) *Cache {
+	return &Cache{dir: dir, ttl: ttl}
+}
+
+// path returns the location of an entry, e.g. dir/host/20250101.log-1234.
+func (c *Cache) path(server, filename string, size int) string {
+	return filepath.Join(c.dir, safeName(server), fmt.Sprintf("%s-%d", safeName(filepath.Base(filename)), size))
+}
+
+// Open returns the cached file for the given key, or ok=false when there is
+// no fresh entry.
+func (c *Cache) Open(server, filename string, size int) (file *os.File, ok bool) {
+	path := c.path(server, filename, size)
+	info, err := os.Stat(path)
+	if err != nil || c.expired(info) {
+		return nil, false
+	}
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	return file, true
+}
+
+// Has reports whether an entry for the given key is on disk, fresh or
+// expired.
+func (c *Cache) Has(server, filename string, size int) bool {
+	_, err := os.Stat(c.path(server, filename, size))
+	return err == nil
+}
+
+// Stale returns the Meta of an expired entry that has one, so the entry
+// can be revalidated with the server. ok is false for fresh, missing and
+// entries stored without validators.
+func (c *Cache) Stale(server, filename string, size int) (meta Meta, ok bool) {
+	path := c.path(server, filename, size)
+	info, err := os.Stat(path)
+	if err != nil || !c.expired(info) {
+		return Meta{}, false
+	}
+	data, err := os.ReadFile(path + metaSuffix)
+	if err != nil || json.Unmarshal(data, &meta) != nil || meta == (Meta{}) {
+		return Meta{}, false
+	}
+	return meta, true
+}
+
+// Refresh opens an expired entry that the server reported unchanged and
+// makes it fresh again for another ttl.
+func (c *Cache) Refresh(server, filename string, size int) (*os.File, error) {
+	path := c.path(server, filename, size)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return nil, err
+	}
+	os.Chtimes(path+metaSuffix, now, now)
+	return os.Open(path)
+}
+
+// Store copies r into the cache and returns the path of the new entry. The
+// entry only becomes visible once r has been read completely. meta is kept
+// for revalidating the entry once it expires; it may be empty.
+func (c *Cache) Store(server, filename string, size int, meta Meta, r io.Reader) (string, error) {
+	path := c.path(server, filename, size)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to store cache file: %w", err)
+	}
+
+	// Without the metadata the entry is simply downloaded again once it
+	// expires
+	os.Remove(path + metaSuffix)
+	if meta != (Meta{}) {
+		if data, err := json.Marshal(meta); err == nil {
+			os.WriteFile(path+metaSuffix, data, 0600)
+		}
+	}
+
+	return path, nil
+}
+
+// Prune removes expired entries (and their metadata) and leftovers of
+// interrupted downloads, and returns the number of files removed.
+func (c *Cache) Prune() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(c.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if c.expired(info) || strings.HasPrefix(d.Name(), ".download-") {
+			if err := os.Remove(path); err == nil && !strings.HasSuffix(d.Name(), metaSuffix) {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (c *Cache) expired(info os.FileInfo) bool {
+	return c.ttl > 0 && time.Since(info.ModTime()) > c.ttl
+}
+
+// safeName replaces characters that are not safe in file names.
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,45 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestSuffix is appended to a file name to form its checksum manifest.
+const ManifestSuffix = ".sha256"
+
+// File calculates the SHA256 checksum of a file
+func File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// WriteManifest writes a sha256sum-compatible manifest next to path and
+// returns the manifest path together with the digest.
+func WriteManifest(path string) (manifestPath, digest string, err error) {
+	digest, err = File(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to compute checksum: %w", err)
+	}
+
+	manifestPath = path + ManifestSuffix
+	line := fmt.Sprintf("%s  %s\n", digest, filepath.Base(path))
+	if err := os.WriteFile(manifestPath, []byte(line), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write checksum manifest: %w", err)
+	}
+
+	return manifestPath, digest, nil
+}
@@ -3,66 +3,604 @@ package config
 import (
 	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gih-ftp/internal/age"
+	"gih-ftp/internal/gihapi"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/notify"
+	"gih-ftp/internal/scheduler"
+	"gih-ftp/internal/secrets"
 
 	"gopkg.in/ini.v1"
 )
 
 type Config struct {
-	// GIH Server settings
-	GIHServers []string
+	// Config file that was loaded, if any
+	ConfigFile string
+
+	// Warnings about deprecated settings in use, logged at startup
+	Deprecated []string
+
+	// GIH Server settings. Entries may carry their own port and scheme;
+	// GIHAPIPort and GIHScheme (https or http) are the defaults.
+	GIHServers []gihapi.Server
 	GIHAPIPort string
+	GIHScheme  string
+
+	// Plain HTTP GIH servers (listed, discovered or by scheme default) are
+	// refused unless this is set
+	GIHAllowHTTP bool
+
+	// DNS records (SRV or TXT) resolved into further GIH servers at the
+	// start of every run
+	GIHDiscover []string
+
+	// Consul service name and Kubernetes label selector whose instances
+	// become GIH servers at the start of every run
+	GIHDiscoverConsul string
+	GIHDiscoverK8s    string
+	ConsulAddr        string
+	ConsulToken       string
+	ConsulDatacenter  string
+	ConsulTag         string
+	ConsulCACert      string
+	K8sNamespace      string
+	K8sPortName       string
+
+	// GIH API authentication. GIHServerTokens maps a host to its own token.
+	GIHAPIToken     string
+	GIHAPIKeyHeader string
+	GIHServerTokens map[string]string
+
+	// [server <host>] sections keyed by lower-cased host; their tokens
+	// are also in GIHServerTokens
+	GIHServerOverrides map[string]ServerOverride
+
+	// GIH API TLS: extra CA bundle (or directory of them) and client
+	// certificate for mutual TLS
+	GIHCACert     string
+	GIHCADir      string
+	GIHClientCert string
+	GIHClientKey  string
+
+	// GIH API connection timeouts. Downloads have no overall timeout; they
+	// are bounded by ServerTimeout and RunDeadline.
+	GIHDialTimeout     time.Duration
+	GIHTLSTimeout      time.Duration
+	GIHResponseTimeout time.Duration
+	GIHIdleTimeout     time.Duration
 
 	// FTP/SFTP settings
-	FTPHost     string
-	FTPUser     string
-	FTPPassword string
-	FTPLogDir   string
+	UploadProtocol string
+	FTPHost        string
+	FTPUser        string
+	FTPPassword    string
+	FTPLogDir      string
+
+	// Retry a failed upload with the other protocol (sftp <-> ftp) when the
+	// target cannot be reached. Falling back from SFTP to cleartext FTP also
+	// needs UploadFallbackInsecure.
+	UploadFallback         bool
+	UploadFallbackInsecure bool
+
+	// Upload to all targets at once instead of one after the other
+	UploadParallel bool
+
+	// Attributes given to uploaded files: octal mode, numeric "uid:gid"
+	// owner (SFTP only) and the local modification time. Empty leaves
+	// them to the server.
+	RemoteFileMode  string
+	RemoteFileOwner string
+	PreserveMTime   bool
+
+	// Default retry policy of the upload targets: attempts per target
+	// (1 = no retry) and the delay before the first retry, doubled up to
+	// the maximum delay
+	UploadRetryAttempts int
+	UploadRetryDelay    time.Duration
+	UploadRetryMaxDelay time.Duration
+
+	// FTP data connections: passive or active mode, PASV only instead of
+	// EPSV, the local port range listened on in active mode ("min-max")
+	// and the idle timeout
+	FTPMode        string
+	FTPDisableEPSV bool
+	FTPActivePorts string
+	FTPDataTimeout time.Duration
+
+	// Remote path below FTPLogDir as a text/template (see UploadTarget)
+	RemotePathTemplate string
+
+	// Merged files of earlier runs older than RemoteRetentionWeeks are
+	// removed from the log directory after an upload (delete or archive)
+	RemoteRetentionWeeks  int
+	RemoteRetentionAction string
+
+	// SSH settings. SSHKeyPath may list several keys, comma-separated,
+	// which are offered in order.
+	SSHKeyPath           string
+	SSHKeyPassphraseFile string
+
+	// Passphrase of encrypted SSH keys (SSH_KEY_PASSPHRASE or a secret
+	// reference in the config file)
+	SSHKeyPassphrase string
+
+	// Host keys trusted on first use (default: <work-dir>/gihftp-known-hosts)
+	SSHHostKeyCache string
+
+	// known_hosts file (default: $HOME/.ssh/known_hosts) and a pinned host
+	// key fingerprint for the default upload target
+	SSHKnownHosts      string
+	SSHHostFingerprint string
+
+	// Destinations for the merged file: the top-level FTP/SFTP settings
+	// above plus any [upload.<name>] sections
+	UploadTargets []UploadTarget
+
+	// Working directory and the cap on the bytes stored under it (zero
+	// for none)
+	WorkDir         string
+	MaxWorkDirBytes int64
+
+	// State file (default: <work-dir>/gihftp-state.json) and whether to
+	// ignore it and redo completed work
+	StateFile string
+	Force     bool
+
+	// Fetch days that earlier runs already delivered instead of excluding
+	// them from the date range
+	AllowOverlap bool
 
-	// SSH settings
-	SSHKeyPath string
+	// Run history file (default: <work-dir>/gihftp-history.jsonl) and the
+	// output of `gihftp history`
+	HistoryFile string
+	HistoryLast int
+	HistoryJSON bool
 
-	// Working directory
-	WorkDir string
+	// Local input (directory or glob pattern) and output file of
+	// `gihftp merge --input-dir`
+	InputDir string
+	Output   string
+
+	// Existing local file pushed by `gihftp upload --file` instead of the
+	// merged file recorded in the state
+	UploadFile string
+
+	// Download cache under <work-dir>/cache; entries older than CacheTTL
+	// are ignored and pruned
+	NoCache  bool
+	CacheTTL time.Duration
+
+	// Merge downloads into the result as they arrive, without the cache or
+	// per-server partial files; implies NoCache
+	Stream bool
+
+	// Date range (YYYYMMDD). Empty dates and a zero DaysBack mean last week.
+	StartDate string
+	EndDate   string
+	DaysBack  int
 
 	// Logging
-	LogLevel string
+	LogLevel      string
+	LogFormat     string
+	LogFile       string
+	LogMaxSizeMB  int
+	LogMaxBackups int
+
+	// Progress draws progress bars and a summary table on stdout when it is
+	// a terminal; logs then go to stderr
+	Progress bool
+
+	// HTTPDebug logs every GIH API request with its status, timings and
+	// attempt; --log-level=trace turns it on too
+	HTTPDebug bool
 
 	// Cleanup
 	CleanupAfter bool
 
-	// Security
-	InsecureSkipVerify bool
+	// Uploaded files are moved to dated directories under ArchiveDir; those
+	// older than ArchiveRetentionDays are pruned (0 = keep forever)
+	ArchiveDir           string
+	ArchiveRetentionDays int
+
+	// Upload a .sha256 manifest next to the merged file
+	Checksum bool
+
+	// Merged files larger than SplitSizeMB are uploaded as numbered parts
+	// with a manifest (0 = never split)
+	SplitSizeMB int
+
+	// Recipients to encrypt the merged file to: age public keys (age1...)
+	// and age recipient files (upload <file>.age), or OpenPGP public key
+	// files (upload <file>.gpg)
+	EncryptRecipients []string
+
+	// Secret key for a detached signature (<file>.asc) of the uploaded file,
+	// and the file holding its passphrase
+	GPGSignKey        string
+	GPGPassphraseFile string
+
+	// Passphrase of the GPG key (GPG_PASSPHRASE or a secret reference in
+	// the config file)
+	GPGPassphrase string
+
+	// Upload to a temporary name and rename when complete
+	AtomicUpload bool
+
+	// Continue partial remote files instead of starting over (FTP)
+	UploadResume bool
+
+	// Post-upload verification
+	VerifyUpload         bool
+	VerifyRemoteChecksum bool
+
+	// Merged output compression (none, gzip, zstd)
+	Compress string
+
+	// Merged output format (pipe, csv, jsonl)
+	OutputFormat string
+
+	// Columns of the merged file (domain, qtype, count, pct, cumpct,
+	// clients)
+	OutputColumns []string
+
+	// Layout of pipe and csv records: column separator, thousands
+	// separator of counts, column widths, header line and whether the file
+	// ends with a line break
+	OutputSeparator    string
+	OutputThousands    string
+	OutputDomainWidth  int
+	OutputCountWidth   int
+	OutputHeader       bool
+	OutputFinalNewline bool
+
+	// One merged file for the whole date range (weekly) or one per day
+	// (daily)
+	Granularity string
+
+	// Where domain counts are kept while merging (memory, disk)
+	MergeEngine string
+
+	// How domains are normalized before counting (none, basic, idna)
+	NormalizeDomains string
+
+	// Only count lines of these query types from logs with a query type
+	// column (empty = all)
+	QTypes []string
+
+	// Domains with fewer requests are left out of the merged file
+	MinCount int
+
+	// Warn when totals or a server's share change by more than this many
+	// percent compared with the last uploaded range (0 = off)
+	AnomalyThreshold float64
+
+	// Compare the top N domains with the last uploaded range and report
+	// domains that entered, dropped out or moved more than TopDiffRankChange
+	// places (0 = off)
+	TopDiff           int
+	TopDiffRankChange int
+
+	// Stop before uploading when the merged range has no requests; otherwise
+	// the empty file is uploaded and the run only warns (exit code 11)
+	FailOnEmpty bool
+
+	// Directory receiving one file per run with the malformed input lines
+	// that were skipped (empty = not kept)
+	QuarantineDir string
+
+	// Fail the merge when more than this many percent of a server's (or an
+	// input file's) lines are malformed (0 = off)
+	MaxSkippedPercent float64
+
+	// Domain filter rule files
+	DomainAllowlist string
+	DomainBlocklist string
+
+	// Security: skip TLS verification of the GIH API or SSH host key
+	// checking (NOT RECOMMENDED)
+	GIHInsecureTLS     bool
+	SSHInsecureHostKey bool
+
+	// Encrypted secrets file resolving secret:<name> references, and the
+	// file holding its passphrase (or GIHFTP_SECRETS_PASSPHRASE)
+	SecretsFile           string
+	SecretsPassphraseFile string
+
+	// HashiCorp Vault resolving vault:<path>#<field> references
+	VaultAddr      string
+	VaultTokenFile string
+	VaultNamespace string
+	VaultCACert    string
+
+	// Proxies for the GIH API and FTP/SFTP connections (at most one)
+	HTTPProxy  string
+	SOCKSProxy string
+
+	// Daemon mode. HealthListen serves /healthz, /readyz and /status.
+	// Uploads wait while UploadBlackout (scheduler.ParseBlackout) is active.
+	Daemon         bool
+	Schedule       string
+	HealthListen   string
+	UploadBlackout string
+
+	// Bandwidth limits in MB/s (zero disables)
+	MaxDownloadRate float64
+	MaxUploadRate   float64
+
+	// Soft memory limit of the process in MB; merge data beyond half of it
+	// is spilled to disk (zero disables)
+	MaxMemoryMB int
+
+	// Log files downloaded at the same time from one server
+	DownloadConcurrency int
+
+	// Timeouts (zero disables)
+	ServerTimeout time.Duration
+	RunDeadline   time.Duration
+
+	// How long to wait for another instance to release the work directory
+	// lock (zero fails immediately)
+	WaitLock time.Duration
+
+	// JSON run report path
+	Report string
+
+	// Notifications
+	NotifyOn       string
+	NotifyWebhook  string
+	NotifySMTPHost string
+	NotifySMTPFrom string
+	NotifySMTPTo   []string
+	NotifySMTPUser string
+	NotifySMTPPass string
+
+	// Merge statistics published to Kafka and/or NATS after each merge
+	PublishKafkaBrokers []string
+	PublishKafkaTopic   string
+	PublishKafkaTLS     bool
+	PublishKafkaUser    string
+	PublishKafkaPass    string
+	PublishNATSURL      string
+	PublishNATSSubject  string
+	PublishTopDomains   int
+
+	// Metrics
+	MetricsListen   string
+	MetricsTextfile string
+
+	// GIH API retry policy
+	RetryAttempts     int
+	RetryInitialDelay time.Duration
+	RetryMaxDelay     time.Duration
+	RetryJitter       float64
+
+	// Shell commands run before and after the upload, the time they may
+	// take, and whether a failed pre-upload hook stops the upload
+	PreUploadHook      string
+	PostUploadHook     string
+	HookTimeout        time.Duration
+	HookAbortOnFailure bool
 }
 
 func Load() (*Config, error) {
+	return load(false)
+}
+
+// LoadLocal is Load for commands that only read files in the work directory,
+// such as `gihftp history`: GIH servers and upload targets are not required
+// and secret references are left unresolved.
+func LoadLocal() (*Config, error) {
+	return load(true)
+}
+
+// Reload is Load for a running daemon: the command line is parsed again
+// and the config file, which may have changed, read again. Errors are
+// returned instead of exiting, and the flags of the running config are
+// kept, so that the daemon can go on with it.
+func Reload() (*Config, error) {
+	previous := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	cfg, err := load(false)
+	if err != nil {
+		flag.CommandLine = previous
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func load(local bool) (*Config, error) {
 	cfg := &Config{}
 
 	// Define flags
 	gihServers := flag.String("gih-servers", "", "Comma-separated list of GIH server addresses (e.g., dns1.example.com,dns2.example.com)")
 	gihAPIPort := flag.String("gih-api-port", "2035", "GIH API port")
+	gihDiscover := flag.String("gih-discover", "", "Comma-separated DNS records resolved into GIH servers on every run: SRV (_gihapi._tcp.example.com) or TXT listing server entries")
+	gihDiscoverConsul := flag.String("gih-discover-consul", "", "Consul service whose healthy instances are used as GIH servers on every run")
+	gihDiscoverK8s := flag.String("gih-discover-k8s", "", "Kubernetes label selector of services whose ready endpoints are used as GIH servers on every run (in-cluster only)")
+	consulAddr := flag.String("consul-addr", "", "Consul agent address (default: CONSUL_HTTP_ADDR env var, then http://127.0.0.1:8500)")
+	consulToken := flag.String("consul-token", "", "Consul ACL token (default: CONSUL_HTTP_TOKEN env var)")
+	consulDatacenter := flag.String("consul-datacenter", "", "Consul datacenter of the GIH service (default: that of the agent)")
+	consulTag := flag.String("consul-tag", "", "Only use Consul service instances with this tag")
+	consulCACert := flag.String("consul-ca-cert", "", "CA certificate for the Consul agent (default: CONSUL_CACERT env var)")
+	k8sNamespace := flag.String("k8s-namespace", "", "Kubernetes namespace of the GIH services (default: that of the pod)")
+	k8sPortName := flag.String("k8s-port-name", "", "Name of the GIH API port in the Kubernetes endpoints (needed when they have several ports)")
+	gihScheme := flag.String("gih-scheme", "https", "Scheme of GIH servers given without one (https, or http for lab servers without TLS; NOT RECOMMENDED)")
+	gihAllowHTTP := flag.Bool("gih-allow-http", false, "Allow GIH servers reached over plain HTTP, which sends DNS logs and API tokens unencrypted (NOT RECOMMENDED)")
 	ftpHost := flag.String("ftp-host", "", "FTP/SFTP server address")
 	ftpUser := flag.String("ftp-user", "root", "FTP/SFTP username")
 	ftpPassword := flag.String("ftp-password", "", "FTP/SFTP password (or use FTP_PASSWORD env var)")
 	ftpLogDir := flag.String("ftp-log-dir", "/var/log/uploads/", "Remote directory for log files")
-	sshKeyPath := flag.String("ssh-key", "$HOME/.ssh/id_rsa", "Path to SSH private key")
+	sshKeyPath := flag.String("ssh-key", "$HOME/.ssh/id_rsa", "Path to SSH private key (comma-separated list to try several keys in order)")
+	sshKeyPassphraseFile := flag.String("ssh-key-passphrase-file", "", "File containing the passphrase of an encrypted SSH key (or use SSH_KEY_PASSPHRASE env var)")
+	sshHostKeyCache := flag.String("ssh-host-key-cache", "", "File storing SSH host keys trusted on first use when the host is not in known_hosts (default: <work-dir>/gihftp-known-hosts)")
+	sshKnownHosts := flag.String("ssh-known-hosts", "", "known_hosts file used to verify SFTP host keys (default: $HOME/.ssh/known_hosts)")
+	sshHostFingerprint := flag.String("ssh-host-fingerprint", "", "Expected SFTP host key fingerprint (SHA256:...); replaces known_hosts checks")
 	workDir := flag.String("work-dir", "", "Working directory for temporary files (default: current directory)")
-	logLevel := flag.String("log-level", "info", "Log level (debug, info, error)")
+	maxWorkDirBytes := flag.Int("max-workdir-bytes", 0, "Abort the fetch before the work directory grows beyond this many bytes (0 for no cap)")
+	logLevel := flag.String("log-level", "info", "Log level (trace, debug, info, error); trace adds HTTP request tracing")
+	stateFile := flag.String("state-file", "", "State file recording completed work (default: <work-dir>/gihftp-state.json)")
+	historyFile := flag.String("history-file", "", "File recording every run (default: <work-dir>/gihftp-history.jsonl)")
+	historyLast := flag.Int("last", 20, "history subcommand: show the last N runs (0 for all)")
+	historyJSON := flag.Bool("json", false, "history subcommand: print the runs as JSON lines")
+	inputDir := flag.String("input-dir", "", "merge subcommand: merge local log files from this directory or glob pattern instead of fetched data")
+	output := flag.String("output", "", "merge subcommand with --input-dir: write the merged result to this file")
+	uploadFile := flag.String("file", "", "upload subcommand: push this existing local file instead of the last merged file")
+	force := flag.Bool("force", false, "Fetch and upload again even if the state file shows the range was already done")
+	allowOverlap := flag.Bool("allow-overlap", false, "Fetch days of the date range that earlier runs already delivered")
+	startDate := flag.String("start-date", "", "First day to fetch (YYYYMMDD or YYYY-MM-DD)")
+	endDate := flag.String("end-date", "", "Last day to fetch (YYYYMMDD or YYYY-MM-DD, default: yesterday)")
+	daysBack := flag.Int("days-back", 0, "Fetch the N days up to and including yesterday (default: 7)")
+	logFormat := flag.String("log-format", "text", "Log output format (text, json)")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stdout (rotated by size)")
+	logMaxSize := flag.Int("log-max-size", 100, "Rotate the log file after it reaches this size in MB")
+	logMaxBackups := flag.Int("log-max-backups", 5, "Number of rotated log files to keep")
+	httpDebug := flag.Bool("http-debug", false, "Trace GIH API requests: method, URL, status, timings and retries (bodies are size-capped)")
+	progress := flag.Bool("progress", false, "Show progress bars and a summary table when stdout is a terminal (logs go to stderr)")
 	cleanupAfter := flag.Bool("cleanup", true, "Remove temporary files after upload")
-	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "Skip TLS/SSH certificate verification (NOT RECOMMENDED)")
+	archiveDir := flag.String("archive-dir", "", "Move uploaded files into dated subdirectories of this directory")
+	archiveRetentionDays := flag.Int("archive-retention-days", 0, "Remove archive directories older than this many days (0 = keep forever)")
+	gihInsecureTLS := flag.Bool("gih-insecure-tls", false, "Skip TLS certificate verification for the GIH API (NOT RECOMMENDED)")
+	sshInsecureHostKey := flag.Bool("ssh-insecure-host-key", false, "Skip SSH host key verification (NOT RECOMMENDED)")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "Deprecated: same as --gih-insecure-tls --ssh-insecure-host-key")
 	configFile := flag.String("config", "", "Path to config file (optional, for backward compatibility)")
+	uploadProtocol := flag.String("upload-protocol", "ftp", "Upload protocol (ftp, sftp, rsync)")
+	gihAPIToken := flag.String("gih-api-token", "", "GIH API token (or use GIH_API_TOKEN env var)")
+	gihAPITokenFile := flag.String("gih-api-token-file", "", "File containing the GIH API token")
+	gihAPIKeyHeader := flag.String("gih-api-key-header", "", "Send the token in this header instead of Authorization: Bearer (e.g. X-API-Key)")
+	gihCACert := flag.String("gih-ca-cert", "", "PEM CA bundle trusted for GIH API connections (in addition to system CAs)")
+	flag.StringVar(gihCACert, "gih-ca-file", "", "Same as --gih-ca-cert")
+	gihCADir := flag.String("gih-ca-dir", "", "Directory of PEM CA certificates trusted for GIH API connections (in addition to system CAs)")
+	gihClientCert := flag.String("gih-client-cert", "", "Client certificate (PEM) for mutual TLS to the GIH API")
+	gihClientKey := flag.String("gih-client-key", "", "Client private key (PEM) for mutual TLS to the GIH API")
+	gihDialTimeout := flag.Duration("gih-dial-timeout", 10*time.Second, "Timeout for connecting to a GIH server")
+	gihTLSTimeout := flag.Duration("gih-tls-timeout", 10*time.Second, "Timeout for the TLS handshake with a GIH server")
+	gihResponseTimeout := flag.Duration("gih-response-timeout", 30*time.Second, "Timeout for a GIH server to start responding to a request")
+	gihIdleTimeout := flag.Duration("gih-idle-timeout", 90*time.Second, "How long idle keep-alive connections to GIH servers are kept open")
+	compress := flag.String("compress", "none", "Compress the merged file (none, gzip, zstd)")
+	outputFormat := flag.String("output-format", "pipe", "Format of the merged file: pipe (domain|count), csv or jsonl")
+	outputColumns := flag.String("output-columns", "domain,count", "Columns of the merged file in order: domain, qtype (count per query type, from logs with a query type column), count, pct (share of all requests in percent), cumpct (cumulative share), clients (estimated distinct client IPs, from logs with a client IP column)")
+	outputSeparator := flag.String("output-separator", "", "Separator between columns (default | for pipe, , for csv; \"tab\" and \"space\" are accepted)")
+	outputThousands := flag.String("output-thousands-separator", "", "Group the digits of counts with this separator, e.g. , or . (\"space\" is accepted; default none)")
+	outputDomainWidth := flag.Int("output-domain-width", 0, "Pad domains to this width for fixed-width columns, pipe format only (0 = no padding)")
+	outputCountWidth := flag.Int("output-count-width", 0, "Right align counts to this width for fixed-width columns, pipe format only (0 = no padding)")
+	outputHeader := flag.Bool("output-header", false, "Start pipe output with a domain|count header line (csv always has one)")
+	outputFinalNewline := flag.Bool("output-final-newline", true, "End the merged file with a line break after the last record")
+	granularity := flag.String("granularity", "weekly", "Merged output: weekly (one file for the date range) or daily (one file per day)")
+	mergeEngine := flag.String("merge-engine", "memory", "Merge engine: memory, or disk to spill sorted runs to the work directory for very large domain sets")
+	qtypes := flag.String("qtypes", "", "Only count these query types (e.g. A,AAAA) from logs with a query type column (default: all)")
+	normalizeDomains := flag.String("normalize-domains", "none", "Normalize domains before counting: none, basic (lowercase, strip trailing dot) or idna (basic plus punycode)")
+	minCount := flag.Int("min-count", 0, "Drop domains with fewer than N requests from the merged file (0 keeps all)")
+	anomalyThreshold := flag.Float64("anomaly-threshold", 0, "Warn (exit code 9) when total or per-server requests or unique domains differ from the last uploaded range by more than this many percent (0 = off)")
+	topDiff := flag.Int("top-diff", 0, "Report domains that entered or left the top N compared with the last uploaded range, in <work-dir>/gihftp-topdiff-<start>-<end>.json and notifications (0 = off)")
+	topDiffRankChange := flag.Int("top-diff-rank-change", 5, "With --top-diff, also report domains of the top N that moved more than this many places")
+	failOnEmpty := flag.Bool("fail-on-empty", false, "Do not upload when the merged range has no requests (both cases exit with code 11)")
+	quarantineDir := flag.String("quarantine-dir", "", "Write the malformed input lines skipped during a run to a file in this directory")
+	maxSkippedPercent := flag.Float64("max-skipped-percent", 0, "Fail the merge (exit code 3) when more than this many percent of a server's lines are malformed (0 = off)")
+	domainAllowlist := flag.String("domain-allowlist", "", "File with domain rules; only matching domains are kept")
+	domainBlocklist := flag.String("domain-blocklist", "", "File with domain rules; matching domains are dropped")
+	remotePathTemplate := flag.String("remote-path-template", "", "Remote path below ftp-log-dir, e.g. {{.Year}}/{{.Week}}/{{.Hostname}}/{{.Filename}}")
+	remoteRetentionWeeks := flag.Int("remote-retention-weeks", 0, "After uploading, prune merged files older than this many weeks from the remote log directory (0 = keep all)")
+	remoteRetentionAction := flag.String("remote-retention-action", "delete", "What to do with old remote files: delete or archive (move to <log-dir>/archive)")
+	uploadFallback := flag.Bool("upload-fallback", false, "Retry an upload whose target cannot be reached with the other protocol (sftp <-> ftp) on its default port")
+	uploadFallbackInsecure := flag.Bool("upload-fallback-insecure", false, "Allow --upload-fallback to switch the default target from SFTP to cleartext FTP")
+	remoteFileMode := flag.String("remote-file-mode", "", "Octal mode given to uploaded files, e.g. 0640 (SFTP chmod, FTP SITE CHMOD where supported; default: the server's)")
+	remoteFileOwner := flag.String("remote-file-owner", "", "SFTP and rsync only: numeric uid:gid given to uploaded files (usually needs a privileged login)")
+	preserveMTime := flag.Bool("preserve-mtime", false, "Give uploaded files the modification time of the local file (SFTP, FTP MFMT where supported)")
+	uploadParallel := flag.Bool("upload-parallel", true, "Upload to all targets concurrently instead of one after the other")
+	uploadRetryAttempts := flag.Int("upload-retry-attempts", 1, "Attempts per upload target before it fails (1 = no retry)")
+	uploadRetryDelay := flag.Duration("upload-retry-delay", 30*time.Second, "Delay before the first upload retry; doubled for each further retry")
+	uploadRetryMaxDelay := flag.Duration("upload-retry-max-delay", 5*time.Minute, "Upper bound of the delay between upload retries")
+	ftpMode := flag.String("ftp-mode", "passive", "FTP data connection mode: passive or active (the server connects back)")
+	ftpDisableEPSV := flag.Bool("ftp-disable-epsv", false, "Passive FTP: use PASV only, for servers or firewalls that mishandle EPSV")
+	ftpActivePorts := flag.String("ftp-active-ports", "", "Active FTP: local port range to listen on, e.g. 50000-50100 (default: any free port)")
+	ftpDataTimeout := flag.Duration("ftp-data-timeout", 60*time.Second, "Abort an FTP data connection idle this long; also bounds waiting for the server in active mode (0 = no limit)")
+	atomicUpload := flag.Bool("atomic-upload", true, "Upload to <name>.part and rename to the final name when complete")
+	uploadResume := flag.Bool("upload-resume", false, "FTP: continue a partial remote file (REST) left by a broken transfer instead of starting over")
+	verifyUpload := flag.Bool("verify-upload", true, "Compare the remote file size with the local file after upload")
+	verifyRemoteChecksum := flag.Bool("verify-remote-checksum", false, "SFTP only: run sha256sum on the remote host and compare after upload")
+	checksum := flag.Bool("checksum", false, "Upload a SHA256 manifest (<file>.sha256) alongside the merged file")
+	splitSize := flag.Int("split-size", 0, "Upload merged files larger than this many MB as <file>-part01, -part02, ... with a <file>.parts.sha256 manifest (0 = never split)")
+	ageRecipients := flag.String("age-recipients", "", "Deprecated: same as --encrypt-recipient")
+	encryptRecipient := flag.String("encrypt-recipient", "", "Encrypt the merged file to these comma-separated recipients: age public keys (age1...) or age recipient files (uploads <file>.age), or OpenPGP public key files (gpg --export, uploads <file>.gpg)")
+	gpgSignKey := flag.String("gpg-sign-key", "", "OpenPGP secret key file (gpg --export-secret-keys) for a detached signature (<file>.asc) uploaded alongside the merged file")
+	gpgPassphraseFile := flag.String("gpg-passphrase-file", "", "File containing the passphrase of the GPG signing key (or use GPG_PASSPHRASE env var)")
+	daemon := flag.Bool("daemon", false, "Run continuously and repeat the job on the configured schedule")
+	healthListen := flag.String("health-listen", "", "Serve /healthz, /readyz and /status on this address in daemon mode (e.g. :8080)")
+	schedule := flag.String("schedule", "weekly@monday-03:00", "Daemon schedule: cron expression (e.g. \"0 3 * * 1\") or weekly@<day>-HH:MM / daily@HH:MM")
+	uploadBlackout := flag.String("upload-blackout", "", "Daemon mode: comma-separated windows during which uploads wait, e.g. \"mon-fri 08:00-20:00\"")
+	noCache := flag.Bool("no-cache", false, "Do not cache downloaded log files in the work directory")
+	stream := flag.Bool("stream", false, "Merge each verified download straight into the combined result, without cache, per-server aggregates or partial files (implies --no-cache; fetches cannot be resumed)")
+	cacheTTL := flag.Duration("cache-ttl", 72*time.Hour, "How long cached log files are reused before they are downloaded again and pruned (0 = forever)")
+	downloadConcurrency := flag.Int("download-concurrency", 1, "Download up to this many log files of a server at the same time (needs the download cache)")
+	maxDownloadRate := flag.Float64("max-download-rate", 0, "Limit log file downloads to this many MB/s in total (0 = unlimited)")
+	maxUploadRate := flag.Float64("max-upload-rate", 0, "Limit uploads to this many MB/s (0 = unlimited)")
+	maxMemoryMB := flag.Int("max-memory-mb", 0, "Soft memory limit in MB: the garbage collector works harder near it and merge data beyond half of it is spilled to disk (0 = unlimited)")
+	serverTimeout := flag.Duration("server-timeout", 0, "Maximum time spent fetching from a single GIH server (0 = no limit)")
+	runDeadline := flag.Duration("run-deadline", 0, "Maximum time for the whole fetch/merge/upload run (0 = no limit)")
+	waitLock := flag.Duration("wait-lock", 0, "Wait this long for a running instance to finish instead of failing immediately")
+	reportPath := flag.String("report", "", "Write a JSON run summary to this file at exit")
+	notifyOn := flag.String("notify-on", "failure,partial,anomaly,empty", "Comma-separated events that trigger notifications (success, partial, failure, anomaly, empty)")
+	notifyWebhook := flag.String("notify-webhook", "", "Webhook URL (Slack/Teams compatible) for run notifications")
+	notifySMTPHost := flag.String("notify-smtp-host", "", "SMTP server (host:port) for e-mail notifications")
+	notifySMTPFrom := flag.String("notify-smtp-from", "", "Sender address for e-mail notifications")
+	notifySMTPTo := flag.String("notify-smtp-to", "", "Comma-separated recipients for e-mail notifications")
+	notifySMTPUser := flag.String("notify-smtp-user", "", "SMTP username (password via NOTIFY_SMTP_PASSWORD env var)")
+	publishKafkaBrokers := flag.String("publish-kafka-brokers", "", "Comma-separated Kafka brokers (host:port) to publish merge statistics to")
+	publishKafkaTopic := flag.String("publish-kafka-topic", "", "Kafka topic for merge statistics")
+	publishKafkaTLS := flag.Bool("publish-kafka-tls", false, "Connect to the Kafka brokers with TLS")
+	publishKafkaUser := flag.String("publish-kafka-user", "", "Kafka SASL/PLAIN username (password via PUBLISH_KAFKA_PASSWORD env var)")
+	publishNATSURL := flag.String("publish-nats-url", "", "NATS server (nats://[user:pass@]host:4222 or tls://...) to publish merge statistics to")
+	publishNATSSubject := flag.String("publish-nats-subject", "", "NATS subject for merge statistics")
+	publishTopDomains := flag.Int("publish-top-domains", 0, "Include the N domains with the most requests in published statistics (0 = none)")
+	metricsListen := flag.String("metrics-listen", "", "Serve Prometheus metrics on this address in daemon mode (e.g. :9273)")
+	metricsTextfile := flag.String("metrics-textfile", "", "Write Prometheus metrics to this node_exporter textfile after each run")
+	secretsFile := flag.String("secrets-file", "", "Encrypted secrets file resolving secret:<name> passwords and tokens (see gihftp secrets)")
+	secretsPassphraseFile := flag.String("secrets-passphrase-file", "", "File holding the secrets file passphrase (or use GIHFTP_SECRETS_PASSPHRASE env var)")
+	vaultAddr := flag.String("vault-addr", "", "Vault address resolving vault:<path>#<field> passwords and tokens (default: VAULT_ADDR env var)")
+	vaultTokenFile := flag.String("vault-token-file", "", "File holding the Vault token (default: VAULT_TOKEN env var, then ~/.vault-token)")
+	vaultNamespace := flag.String("vault-namespace", "", "Vault Enterprise namespace (default: VAULT_NAMESPACE env var)")
+	vaultCACert := flag.String("vault-ca-cert", "", "CA certificate for the Vault server (default: VAULT_CACERT env var)")
+	httpProxy := flag.String("http-proxy", "", "HTTP proxy URL (http://[user:pass@]host:port) for the GIH API and FTP/SFTP via CONNECT")
+	socksProxy := flag.String("socks-proxy", "", "SOCKS5 proxy URL (socks5://[user:pass@]host:port) for the GIH API and FTP/SFTP")
+	retryAttempts := flag.Int("retry-attempts", 3, "Total attempts for each GIH API request (1 disables retries)")
+	retryInitialDelay := flag.Duration("retry-initial-delay", 1*time.Second, "Delay before the first GIH API retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", 30*time.Second, "Upper bound for the exponential retry delay")
+	retryJitter := flag.Float64("retry-jitter", 0.2, "Random jitter applied to retry delays, as a fraction (0-1)")
+	preUploadHook := flag.String("pre-upload-hook", "", "Shell command run before uploading, with the merged file and run details in GIHFTP_* environment variables")
+	postUploadHook := flag.String("post-upload-hook", "", "Shell command run after uploading, with the upload result in GIHFTP_* environment variables")
+	hookTimeout := flag.Duration("hook-timeout", 5*time.Minute, "Kill a hook command running longer than this (0 = no limit)")
+	hookAbortOnFailure := flag.Bool("hook-abort-on-failure", true, "Do not upload when the pre-upload hook fails (exit code 15); otherwise only warn")
+
+	// Exits on errors, except for Reload
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
 
-	flag.Parse()
+	if err := applyEnv(); err != nil {
+		return nil, err
+	}
 
 	// Try to load from config file first (backward compatibility)
 	var iniCfg *ini.File
 	var err error
 
-	if *configFile != "" {
-		iniCfg, err = ini.Load(*configFile)
+	configPath := *configFile
+	if configPath != "" {
+		iniCfg, err = ini.Load(configPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load config file %s: %w", *configFile, err)
+			return nil, fmt.Errorf("failed to load config file %s: %w", configPath, err)
 		}
 	} else {
 		// Try default locations if no flags provided
@@ -70,58 +608,135 @@ func Load() (*Config, error) {
 		for _, path := range defaultConfigs {
 			if _, err := os.Stat(path); err == nil {
 				iniCfg, _ = ini.Load(path)
+				configPath = path
 				break
 			}
 		}
 	}
 
-	// Priority: flags > env vars > config file > defaults
+	if err := validateSchema(iniCfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s:\n%w", configPath, err)
+	}
+	cfg.ConfigFile = configPath
+
+	src := newSource(iniCfg)
+	if err := checkConfigPermissions(configPath, iniCfg, src); err != nil {
+		return nil, err
+	}
+
+	// Priority: flags > env vars > config file > defaults. GIHFTP_* variables
+	// were applied to the flags above and count as explicitly set.
 
 	// GIH Servers
+	var serverEntries []string
 	if *gihServers != "" {
-		cfg.GIHServers = strings.Split(*gihServers, ",")
-		for i := range cfg.GIHServers {
-			cfg.GIHServers[i] = strings.TrimSpace(cfg.GIHServers[i])
+		serverEntries = strings.Split(*gihServers, ",")
+		for i := range serverEntries {
+			serverEntries[i] = strings.TrimSpace(serverEntries[i])
 		}
+	} else if servers, ok := src.lookup("gihservers"); ok {
+		serverEntries = splitList(servers)
 	} else if iniCfg != nil {
-		dns1 := iniCfg.Section("").Key("gihdns1").String()
-		dns2 := iniCfg.Section("").Key("gihdns2").String()
+		dns1 := src.value("gihdns1")
+		dns2 := src.value("gihdns2")
 		if dns1 != "" {
-			cfg.GIHServers = append(cfg.GIHServers, dns1)
+			serverEntries = append(serverEntries, dns1)
 		}
 		if dns2 != "" {
-			cfg.GIHServers = append(cfg.GIHServers, dns2)
+			serverEntries = append(serverEntries, dns2)
 		}
 	}
 
 	// GIH API Port
-	if *gihAPIPort != "2035" {
-		cfg.GIHAPIPort = *gihAPIPort
-	} else if iniCfg != nil {
-		port := iniCfg.Section("").Key("gihapiport").String()
-		if port != "" {
-			cfg.GIHAPIPort = port
-		} else {
-			cfg.GIHAPIPort = "2035"
+	cfg.GIHAPIPort = src.str("gih-api-port", *gihAPIPort, "gihapiport")
+
+	cfg.GIHScheme = strings.ToLower(src.str("gih-scheme", *gihScheme, "gihscheme"))
+	if cfg.GIHScheme != "https" && cfg.GIHScheme != "http" {
+		return nil, fmt.Errorf("invalid gih-scheme %q (must be https or http)", cfg.GIHScheme)
+	}
+	cfg.GIHAllowHTTP = src.boolean("gih-allow-http", *gihAllowHTTP, "gihallowhttp")
+	if cfg.GIHServerOverrides, err = loadServerOverrides(iniCfg); err != nil {
+		return nil, err
+	}
+	for _, entry := range serverEntries {
+		server, err := gihapi.ParseServerWith(entry, cfg.ServerDefaults)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		cfg.GIHAPIPort = "2035"
+		cfg.GIHServers = append(cfg.GIHServers, server)
+	}
+	cfg.GIHDiscover = splitList(src.str("gih-discover", *gihDiscover, "gihdiscover"))
+	cfg.GIHDiscoverConsul = src.str("gih-discover-consul", *gihDiscoverConsul, "gihdiscoverconsul")
+	cfg.GIHDiscoverK8s = src.str("gih-discover-k8s", *gihDiscoverK8s, "gihdiscoverk8s")
+	cfg.ConsulAddr = src.str("consul-addr", *consulAddr, "consuladdr")
+	if cfg.ConsulAddr == "" {
+		cfg.ConsulAddr = os.Getenv("CONSUL_HTTP_ADDR")
 	}
+	cfg.ConsulToken = src.str("consul-token", *consulToken, "consultoken")
+	if cfg.ConsulToken == "" {
+		cfg.ConsulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	cfg.ConsulDatacenter = src.str("consul-datacenter", *consulDatacenter, "consuldatacenter")
+	cfg.ConsulTag = src.str("consul-tag", *consulTag, "consultag")
+	cfg.ConsulCACert = src.str("consul-ca-cert", *consulCACert, "consulcacert")
+	if cfg.ConsulCACert == "" {
+		cfg.ConsulCACert = os.Getenv("CONSUL_CACERT")
+	}
+	cfg.K8sNamespace = src.str("k8s-namespace", *k8sNamespace, "k8snamespace")
+	cfg.K8sPortName = src.str("k8s-port-name", *k8sPortName, "k8sportname")
 
-	// FTP Host
-	if *ftpHost != "" {
-		cfg.FTPHost = *ftpHost
+	// GIH API token (env var preferred for security)
+	if envToken := os.Getenv("GIH_API_TOKEN"); envToken != "" {
+		cfg.GIHAPIToken = envToken
+	} else if *gihAPIToken != "" {
+		cfg.GIHAPIToken = *gihAPIToken
+	} else if tokenFile := src.str("gih-api-token-file", *gihAPITokenFile, "gihapitokenfile"); tokenFile != "" {
+		token, err := secrets.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GIH API token file: %w", err)
+		}
+		cfg.GIHAPIToken = strings.TrimSpace(string(token))
 	} else if iniCfg != nil {
-		cfg.FTPHost = iniCfg.Section("").Key("ftpserver").String()
+		cfg.GIHAPIToken = src.value("gihapitoken")
 	}
+	cfg.GIHAPIKeyHeader = src.str("gih-api-key-header", *gihAPIKeyHeader, "gihapikeyheader")
 
-	// FTP User
-	cfg.FTPUser = *ftpUser
-	if cfg.FTPUser == "root" && iniCfg != nil {
-		if user := iniCfg.Section("").Key("ftpuser").String(); user != "" {
-			cfg.FTPUser = user
+	// GIH API TLS
+	src.alias("gih-ca-cert", "gih-ca-file")
+	cfg.GIHCACert = src.str("gih-ca-cert", *gihCACert, "gihcacert")
+	cfg.GIHCADir = src.str("gih-ca-dir", *gihCADir, "gihcadir")
+	cfg.GIHClientCert = src.str("gih-client-cert", *gihClientCert, "gihclientcert")
+	cfg.GIHClientKey = src.str("gih-client-key", *gihClientKey, "gihclientkey")
+
+	// GIH API timeouts
+	cfg.GIHDialTimeout = src.duration("gih-dial-timeout", *gihDialTimeout, "gihdialtimeout")
+	cfg.GIHTLSTimeout = src.duration("gih-tls-timeout", *gihTLSTimeout, "gihtlstimeout")
+	cfg.GIHResponseTimeout = src.duration("gih-response-timeout", *gihResponseTimeout, "gihresponsetimeout")
+	cfg.GIHIdleTimeout = src.duration("gih-idle-timeout", *gihIdleTimeout, "gihidletimeout")
+
+	// Per-server tokens from the [tokens] section (host = token) and the
+	// [server <host>] sections, which win
+	if iniCfg != nil && iniCfg.HasSection("tokens") {
+		cfg.GIHServerTokens = make(map[string]string)
+		for _, key := range iniCfg.Section("tokens").Keys() {
+			cfg.GIHServerTokens[key.Name()] = key.String()
 		}
 	}
+	for host, override := range cfg.GIHServerOverrides {
+		if override.Token == "" {
+			continue
+		}
+		if cfg.GIHServerTokens == nil {
+			cfg.GIHServerTokens = make(map[string]string)
+		}
+		cfg.GIHServerTokens[host] = override.Token
+	}
+
+	// FTP Host
+	cfg.FTPHost = src.str("ftp-host", *ftpHost, "ftpserver")
+
+	// FTP User
+	cfg.FTPUser = src.str("ftp-user", *ftpUser, "ftpuser")
 
 	// FTP Password (env var preferred for security)
 	if envPass := os.Getenv("FTP_PASSWORD"); envPass != "" {
@@ -129,77 +744,854 @@ func Load() (*Config, error) {
 	} else if *ftpPassword != "" {
 		cfg.FTPPassword = *ftpPassword
 	} else if iniCfg != nil {
-		cfg.FTPPassword = iniCfg.Section("").Key("ftppassword").String()
+		cfg.FTPPassword = src.value("ftppassword")
 	}
 
 	// FTP Log Directory
-	if *ftpLogDir != "/var/log/uploads/" {
-		cfg.FTPLogDir = *ftpLogDir
-	} else if iniCfg != nil {
-		if dir := iniCfg.Section("").Key("ftplogdir").String(); dir != "" {
-			cfg.FTPLogDir = dir
-		} else {
-			cfg.FTPLogDir = "/var/log/uploads/"
-		}
-	} else {
-		cfg.FTPLogDir = "/var/log/uploads/"
-	}
+	cfg.FTPLogDir = src.str("ftp-log-dir", *ftpLogDir, "ftplogdir")
 
 	// SSH Key Path
-	if *sshKeyPath != "$HOME/.ssh/id_rsa" {
-		cfg.SSHKeyPath = *sshKeyPath
-	} else if iniCfg != nil {
-		if key := iniCfg.Section("").Key("sshkey").String(); key != "" {
-			cfg.SSHKeyPath = key
-		} else {
-			cfg.SSHKeyPath = "$HOME/.ssh/id_rsa"
-		}
+	cfg.SSHKeyPath = src.str("ssh-key", *sshKeyPath, "sshkey")
+
+	cfg.SSHKeyPassphraseFile = src.str("ssh-key-passphrase-file", *sshKeyPassphraseFile, "sshkeypassphrasefile")
+	if envPass := os.Getenv("SSH_KEY_PASSPHRASE"); envPass != "" {
+		cfg.SSHKeyPassphrase = envPass
 	} else {
-		cfg.SSHKeyPath = "$HOME/.ssh/id_rsa"
+		cfg.SSHKeyPassphrase = src.value("sshkeypassphrase")
 	}
+	cfg.SSHHostKeyCache = src.str("ssh-host-key-cache", *sshHostKeyCache, "sshhostkeycache")
+	cfg.SSHKnownHosts = src.str("ssh-known-hosts", *sshKnownHosts, "sshknownhosts")
+	cfg.SSHHostFingerprint = src.str("ssh-host-fingerprint", *sshHostFingerprint, "sshhostfingerprint")
 
 	// Working Directory
-	if *workDir != "" {
-		cfg.WorkDir = *workDir
+	if dir := src.str("work-dir", *workDir, "workdir"); dir != "" {
+		cfg.WorkDir = dir
 	} else {
 		cfg.WorkDir = "."
 	}
+	cfg.MaxWorkDirBytes = int64(src.integer("max-workdir-bytes", *maxWorkDirBytes, "maxworkdirbytes"))
 
 	// Other settings
-	cfg.LogLevel = *logLevel
-	cfg.CleanupAfter = *cleanupAfter
-	cfg.InsecureSkipVerify = *insecureSkipVerify
+	cfg.LogLevel = src.str("log-level", *logLevel, "loglevel")
+	cfg.CleanupAfter = src.boolean("cleanup", *cleanupAfter, "cleanup")
+	cfg.ArchiveDir = src.str("archive-dir", *archiveDir, "archivedir")
+	cfg.ArchiveRetentionDays = src.integer("archive-retention-days", *archiveRetentionDays, "archiveretentiondays")
+	// The old setting turns off both checks
+	insecure := src.boolean("insecure-skip-verify", *insecureSkipVerify, "insecureskipverify")
+	if insecure {
+		cfg.Deprecated = append(cfg.Deprecated, "insecure-skip-verify is deprecated, use gih-insecure-tls and ssh-insecure-host-key")
+	}
+	cfg.GIHInsecureTLS = src.boolean("gih-insecure-tls", *gihInsecureTLS, "gihinsecuretls") || insecure
+	cfg.SSHInsecureHostKey = src.boolean("ssh-insecure-host-key", *sshInsecureHostKey, "sshinsecurehostkey") || insecure
+
+	cfg.UploadProtocol = strings.ToLower(src.str("upload-protocol", *uploadProtocol, "uploadprotocol"))
+	// State
+	cfg.StateFile = src.str("state-file", *stateFile, "statefile")
+	cfg.HistoryFile = src.str("history-file", *historyFile, "historyfile")
+	cfg.HistoryLast = *historyLast
+	cfg.HistoryJSON = *historyJSON
+	cfg.Force = *force
+	cfg.AllowOverlap = *allowOverlap
+	cfg.UploadFile = *uploadFile
+	cfg.InputDir = *inputDir
+	cfg.Output = *output
+
+	// Date range
+	cfg.StartDate = normalizeDate(src.str("start-date", *startDate, "startdate"))
+	cfg.EndDate = normalizeDate(src.str("end-date", *endDate, "enddate"))
+	cfg.DaysBack = src.integer("days-back", *daysBack, "daysback")
+
+	// Logging
+	cfg.LogFormat = strings.ToLower(src.str("log-format", *logFormat, "logformat"))
+	cfg.LogFile = src.str("log-file", *logFile, "logfile")
+	cfg.LogMaxSizeMB = src.integer("log-max-size", *logMaxSize, "logmaxsize")
+	cfg.LogMaxBackups = src.integer("log-max-backups", *logMaxBackups, "logmaxbackups")
+	cfg.Progress = src.boolean("progress", *progress, "progress")
+	cfg.HTTPDebug = src.boolean("http-debug", *httpDebug, "httpdebug") || strings.EqualFold(cfg.LogLevel, "trace")
+
+	cfg.Compress = strings.ToLower(src.str("compress", *compress, "compress"))
+	cfg.OutputFormat = strings.ToLower(src.str("output-format", *outputFormat, "outputformat"))
+	cfg.OutputColumns = splitList(strings.ToLower(src.str("output-columns", *outputColumns, "outputcolumns")))
+	cfg.OutputSeparator = separatorValue(src.str("output-separator", *outputSeparator, "outputseparator"))
+	cfg.OutputThousands = separatorValue(src.str("output-thousands-separator", *outputThousands, "outputthousands"))
+	cfg.OutputDomainWidth = src.integer("output-domain-width", *outputDomainWidth, "outputdomainwidth")
+	cfg.OutputCountWidth = src.integer("output-count-width", *outputCountWidth, "outputcountwidth")
+	cfg.OutputHeader = src.boolean("output-header", *outputHeader, "outputheader")
+	cfg.OutputFinalNewline = src.boolean("output-final-newline", *outputFinalNewline, "outputfinalnewline")
+	cfg.Granularity = strings.ToLower(src.str("granularity", *granularity, "granularity"))
+	cfg.MergeEngine = strings.ToLower(src.str("merge-engine", *mergeEngine, "mergeengine"))
+	cfg.DomainAllowlist = src.str("domain-allowlist", *domainAllowlist, "domainallowlist")
+	cfg.NormalizeDomains = strings.ToLower(src.str("normalize-domains", *normalizeDomains, "normalizedomains"))
+	cfg.QTypes = splitList(strings.ToUpper(src.str("qtypes", *qtypes, "qtypes")))
+	cfg.MinCount = src.integer("min-count", *minCount, "mincount")
+	cfg.AnomalyThreshold = src.float("anomaly-threshold", *anomalyThreshold, "anomalythreshold")
+	cfg.TopDiff = src.integer("top-diff", *topDiff, "topdiff")
+	cfg.TopDiffRankChange = src.integer("top-diff-rank-change", *topDiffRankChange, "topdiffrankchange")
+	cfg.FailOnEmpty = src.boolean("fail-on-empty", *failOnEmpty, "failonempty")
+	cfg.QuarantineDir = src.str("quarantine-dir", *quarantineDir, "quarantinedir")
+	cfg.MaxSkippedPercent = src.float("max-skipped-percent", *maxSkippedPercent, "maxskippedpercent")
+	cfg.DomainBlocklist = src.str("domain-blocklist", *domainBlocklist, "domainblocklist")
+	cfg.AtomicUpload = src.boolean("atomic-upload", *atomicUpload, "atomicupload")
+	cfg.RemotePathTemplate = src.str("remote-path-template", *remotePathTemplate, "remotepathtemplate")
+	cfg.RemoteRetentionWeeks = src.integer("remote-retention-weeks", *remoteRetentionWeeks, "remoteretentionweeks")
+	cfg.RemoteRetentionAction = strings.ToLower(src.str("remote-retention-action", *remoteRetentionAction, "remoteretentionaction"))
+	cfg.UploadFallback = src.boolean("upload-fallback", *uploadFallback, "uploadfallback")
+	cfg.UploadFallbackInsecure = src.boolean("upload-fallback-insecure", *uploadFallbackInsecure, "uploadfallbackinsecure")
+	cfg.RemoteFileMode = src.str("remote-file-mode", *remoteFileMode, "remotefilemode")
+	cfg.RemoteFileOwner = src.str("remote-file-owner", *remoteFileOwner, "remotefileowner")
+	cfg.PreserveMTime = src.boolean("preserve-mtime", *preserveMTime, "preservemtime")
+	cfg.UploadParallel = src.boolean("upload-parallel", *uploadParallel, "uploadparallel")
+	cfg.UploadRetryAttempts = src.integer("upload-retry-attempts", *uploadRetryAttempts, "uploadretryattempts")
+	cfg.UploadRetryDelay = src.duration("upload-retry-delay", *uploadRetryDelay, "uploadretrydelay")
+	cfg.UploadRetryMaxDelay = src.duration("upload-retry-max-delay", *uploadRetryMaxDelay, "uploadretrymaxdelay")
+	cfg.FTPMode = strings.ToLower(src.str("ftp-mode", *ftpMode, "ftpmode"))
+	cfg.FTPDisableEPSV = src.boolean("ftp-disable-epsv", *ftpDisableEPSV, "ftpdisableepsv")
+	cfg.FTPActivePorts = src.str("ftp-active-ports", *ftpActivePorts, "ftpactiveports")
+	cfg.FTPDataTimeout = src.duration("ftp-data-timeout", *ftpDataTimeout, "ftpdatatimeout")
+	cfg.UploadResume = src.boolean("upload-resume", *uploadResume, "uploadresume")
+	cfg.VerifyUpload = src.boolean("verify-upload", *verifyUpload, "verifyupload")
+	cfg.VerifyRemoteChecksum = src.boolean("verify-remote-checksum", *verifyRemoteChecksum, "verifyremotechecksum")
+	cfg.Checksum = src.boolean("checksum", *checksum, "checksum")
+	cfg.SplitSizeMB = src.integer("split-size", *splitSize, "splitsize")
+
+	// Encryption and signing
+	cfg.EncryptRecipients = splitList(src.str("encrypt-recipient", *encryptRecipient, "encryptrecipient"))
+	// encrypt-recipient takes the age public keys of the old setting too
+	if recipients := splitList(src.str("age-recipients", *ageRecipients, "agerecipients")); len(recipients) > 0 {
+		cfg.Deprecated = append(cfg.Deprecated, "age-recipients is deprecated, use encrypt-recipient")
+		cfg.EncryptRecipients = append(cfg.EncryptRecipients, recipients...)
+	}
+	cfg.GPGSignKey = src.str("gpg-sign-key", *gpgSignKey, "gpgsignkey")
+	cfg.GPGPassphraseFile = src.str("gpg-passphrase-file", *gpgPassphraseFile, "gpgpassphrasefile")
+	if envPass := os.Getenv("GPG_PASSPHRASE"); envPass != "" {
+		cfg.GPGPassphrase = envPass
+	} else {
+		cfg.GPGPassphrase = src.value("gpgpassphrase")
+	}
+
+	// Daemon mode
+	cfg.Daemon = src.boolean("daemon", *daemon, "daemon")
+	cfg.Schedule = src.str("schedule", *schedule, "schedule")
+	cfg.HealthListen = src.str("health-listen", *healthListen, "healthlisten")
+	cfg.UploadBlackout = src.str("upload-blackout", *uploadBlackout, "uploadblackout")
+
+	cfg.NoCache = src.boolean("no-cache", *noCache, "nocache")
+	cfg.Stream = src.boolean("stream", *stream, "stream")
+	if cfg.Stream {
+		cfg.NoCache = true
+	}
+	cfg.CacheTTL = src.duration("cache-ttl", *cacheTTL, "cachettl")
+
+	cfg.MaxDownloadRate = src.float("max-download-rate", *maxDownloadRate, "maxdownloadrate")
+	cfg.DownloadConcurrency = src.integer("download-concurrency", *downloadConcurrency, "downloadconcurrency")
+	cfg.MaxUploadRate = src.float("max-upload-rate", *maxUploadRate, "maxuploadrate")
+	cfg.MaxMemoryMB = src.integer("max-memory-mb", *maxMemoryMB, "maxmemorymb")
+
+	// Timeouts
+	cfg.ServerTimeout = src.duration("server-timeout", *serverTimeout, "servertimeout")
+	cfg.RunDeadline = src.duration("run-deadline", *runDeadline, "rundeadline")
+	cfg.WaitLock = src.duration("wait-lock", *waitLock, "waitlock")
+
+	cfg.Report = src.str("report", *reportPath, "report")
+
+	// Notifications
+	cfg.NotifyOn = src.str("notify-on", *notifyOn, "notifyon")
+	cfg.NotifyWebhook = src.str("notify-webhook", *notifyWebhook, "notifywebhook")
+	cfg.NotifySMTPHost = src.str("notify-smtp-host", *notifySMTPHost, "notifysmtphost")
+	cfg.NotifySMTPFrom = src.str("notify-smtp-from", *notifySMTPFrom, "notifysmtpfrom")
+	cfg.NotifySMTPTo = splitList(src.str("notify-smtp-to", *notifySMTPTo, "notifysmtpto"))
+	cfg.NotifySMTPUser = src.str("notify-smtp-user", *notifySMTPUser, "notifysmtpuser")
+	if envPass := os.Getenv("NOTIFY_SMTP_PASSWORD"); envPass != "" {
+		cfg.NotifySMTPPass = envPass
+	} else if iniCfg != nil {
+		cfg.NotifySMTPPass = src.value("notifysmtppassword")
+	}
+
+	// Statistics publishing
+	cfg.PublishKafkaBrokers = splitList(src.str("publish-kafka-brokers", *publishKafkaBrokers, "publishkafkabrokers"))
+	cfg.PublishKafkaTopic = src.str("publish-kafka-topic", *publishKafkaTopic, "publishkafkatopic")
+	cfg.PublishKafkaTLS = src.boolean("publish-kafka-tls", *publishKafkaTLS, "publishkafkatls")
+	cfg.PublishKafkaUser = src.str("publish-kafka-user", *publishKafkaUser, "publishkafkauser")
+	if envPass := os.Getenv("PUBLISH_KAFKA_PASSWORD"); envPass != "" {
+		cfg.PublishKafkaPass = envPass
+	} else if iniCfg != nil {
+		cfg.PublishKafkaPass = src.value("publishkafkapassword")
+	}
+	cfg.PublishNATSURL = src.str("publish-nats-url", *publishNATSURL, "publishnatsurl")
+	cfg.PublishNATSSubject = src.str("publish-nats-subject", *publishNATSSubject, "publishnatssubject")
+	cfg.PublishTopDomains = src.integer("publish-top-domains", *publishTopDomains, "publishtopdomains")
+
+	// Metrics
+	cfg.MetricsListen = src.str("metrics-listen", *metricsListen, "metricslisten")
+	cfg.MetricsTextfile = src.str("metrics-textfile", *metricsTextfile, "metricstextfile")
+
+	// Proxies
+	cfg.HTTPProxy = src.str("http-proxy", *httpProxy, "httpproxy")
+	cfg.SOCKSProxy = src.str("socks-proxy", *socksProxy, "socksproxy")
+
+	// GIH API retry policy
+	cfg.RetryAttempts = src.integer("retry-attempts", *retryAttempts, "retryattempts")
+	cfg.RetryInitialDelay = src.duration("retry-initial-delay", *retryInitialDelay, "retryinitialdelay")
+	cfg.RetryMaxDelay = src.duration("retry-max-delay", *retryMaxDelay, "retrymaxdelay")
+	cfg.RetryJitter = src.float("retry-jitter", *retryJitter, "retryjitter")
+
+	// Hooks
+	cfg.PreUploadHook = src.str("pre-upload-hook", *preUploadHook, "preuploadhook")
+	cfg.PostUploadHook = src.str("post-upload-hook", *postUploadHook, "postuploadhook")
+	cfg.HookTimeout = src.duration("hook-timeout", *hookTimeout, "hooktimeout")
+	cfg.HookAbortOnFailure = src.boolean("hook-abort-on-failure", *hookAbortOnFailure, "hookabortonfailure")
+
+	cfg.UploadTargets = loadUploadTargets(cfg, iniCfg)
+
+	// Secrets
+	cfg.SecretsFile = src.str("secrets-file", *secretsFile, "secretsfile")
+	cfg.SecretsPassphraseFile = src.str("secrets-passphrase-file", *secretsPassphraseFile, "secretspassphrasefile")
+	cfg.VaultAddr = src.str("vault-addr", *vaultAddr, "vaultaddr")
+	if cfg.VaultAddr == "" {
+		cfg.VaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	cfg.VaultTokenFile = src.str("vault-token-file", *vaultTokenFile, "vaulttokenfile")
+	cfg.VaultNamespace = src.str("vault-namespace", *vaultNamespace, "vaultnamespace")
+	if cfg.VaultNamespace == "" {
+		cfg.VaultNamespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	cfg.VaultCACert = src.str("vault-ca-cert", *vaultCACert, "vaultcacert")
+	if cfg.VaultCACert == "" {
+		cfg.VaultCACert = os.Getenv("VAULT_CACERT")
+	}
+	if local {
+		return cfg, nil
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
 
-	// Validate required fields
-	if len(cfg.GIHServers) == 0 {
-		return nil, fmt.Errorf("no GIH servers specified (use --gih-servers flag or config file)")
+	// Validate required fields. Merging local files needs neither servers
+	// nor targets; uploading an existing file needs no servers.
+	if !cfg.hasGIHServers() && cfg.InputDir == "" && cfg.UploadFile == "" {
+		return nil, fmt.Errorf("no GIH servers specified (use --gih-servers, a --gih-discover flag or config file)")
 	}
 
-	if cfg.FTPHost == "" {
-		return nil, fmt.Errorf("FTP host not specified (use --ftp-host flag or config file)")
+	if len(cfg.UploadTargets) == 0 && cfg.InputDir == "" {
+		return nil, fmt.Errorf("FTP host not specified (use --ftp-host flag, or ftpserver / [upload.<name>] in config file)")
 	}
 
 	return cfg, nil
 }
 
+// validateGIHScheme refuses plain HTTP GIH servers without GIHAllowHTTP.
+// Discovered servers are checked when they are found.
+func (c *Config) validateGIHScheme() error {
+	if c.GIHAllowHTTP {
+		return nil
+	}
+	if c.GIHScheme == "http" {
+		return fmt.Errorf("gih-scheme http sends DNS logs and API tokens unencrypted; set gih-allow-http to use it")
+	}
+	for _, host := range slices.Sorted(maps.Keys(c.GIHServerOverrides)) {
+		if c.GIHServerOverrides[host].Scheme == "http" {
+			return fmt.Errorf("[%s%s]: scheme http sends DNS logs and API tokens unencrypted; set gih-allow-http to use it", serverSectionPrefix, host)
+		}
+	}
+	for _, server := range c.GIHServers {
+		if server.Scheme == "http" {
+			return fmt.Errorf("GIH server %s uses plain HTTP, which sends DNS logs and API tokens unencrypted; set gih-allow-http to use it", server.Name)
+		}
+	}
+	return nil
+}
+
+// hasGIHServers reports whether servers are listed or discovered.
+func (c *Config) hasGIHServers() bool {
+	return len(c.GIHServers) > 0 || len(c.GIHDiscover) > 0 || c.GIHDiscoverConsul != "" || c.GIHDiscoverK8s != ""
+}
+
 func (c *Config) Validate() error {
-	if len(c.GIHServers) == 0 {
+	if !c.hasGIHServers() && c.InputDir == "" && c.UploadFile == "" {
 		return fmt.Errorf("at least one GIH server is required")
 	}
 
-	if c.FTPHost == "" {
-		return fmt.Errorf("FTP host is required")
+	if len(c.UploadTargets) == 0 && c.InputDir == "" {
+		return fmt.Errorf("at least one upload target is required")
+	}
+
+	names := make(map[string]bool)
+	for _, target := range c.UploadTargets {
+		if names[target.Name] {
+			return fmt.Errorf("duplicate upload target: %s", target.Name)
+		}
+		names[target.Name] = true
+
+		if err := target.validate(); err != nil {
+			return err
+		}
 	}
 
 	if c.GIHAPIPort == "" {
 		return fmt.Errorf("GIH API port is required")
 	}
 
+	if err := c.validateGIHScheme(); err != nil {
+		return err
+	}
+
 	// Validate log level
-	validLevels := map[string]bool{"debug": true, "info": true, "error": true}
+	validLevels := map[string]bool{"trace": true, "debug": true, "info": true, "error": true}
 	if !validLevels[strings.ToLower(c.LogLevel)] {
-		return fmt.Errorf("invalid log level: %s (must be debug, info, or error)", c.LogLevel)
+		return fmt.Errorf("invalid log level: %s (must be trace, debug, info, or error)", c.LogLevel)
+	}
+
+	if (c.GIHClientCert == "") != (c.GIHClientKey == "") {
+		return fmt.Errorf("gih-client-cert and gih-client-key must be given together")
+	}
+
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("invalid log format: %s (must be text or json)", c.LogFormat)
+	}
+
+	if err := c.validateProxy(); err != nil {
+		return err
+	}
+
+	if err := c.validateFTPMode(); err != nil {
+		return err
+	}
+
+	if c.DownloadConcurrency < 1 {
+		return fmt.Errorf("download-concurrency must be at least 1")
+	}
+
+	if c.MaxDownloadRate < 0 || c.MaxUploadRate < 0 {
+		return fmt.Errorf("transfer rate limits must not be negative")
+	}
+
+	if c.MaxMemoryMB < 0 {
+		return fmt.Errorf("max-memory-mb must not be negative")
+	}
+
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("cache-ttl must not be negative")
+	}
+
+	if c.MaxWorkDirBytes < 0 {
+		return fmt.Errorf("max-workdir-bytes must not be negative")
+	}
+	if c.SplitSizeMB < 0 {
+		return fmt.Errorf("split-size must not be negative")
+	}
+
+	if c.RemoteRetentionWeeks < 0 {
+		return fmt.Errorf("remote-retention-weeks must not be negative")
+	}
+	if c.RemoteRetentionAction != "delete" && c.RemoteRetentionAction != "archive" {
+		return fmt.Errorf("invalid remote retention action: %s (must be delete or archive)", c.RemoteRetentionAction)
+	}
+
+	if c.ArchiveRetentionDays < 0 {
+		return fmt.Errorf("archive-retention-days must not be negative")
+	}
+	if c.ArchiveRetentionDays > 0 && c.ArchiveDir == "" {
+		return fmt.Errorf("archive-retention-days requires archive-dir")
+	}
+
+	if c.ServerTimeout < 0 || c.RunDeadline < 0 || c.WaitLock < 0 ||
+		c.GIHDialTimeout < 0 || c.GIHTLSTimeout < 0 || c.GIHResponseTimeout < 0 || c.GIHIdleTimeout < 0 ||
+		c.FTPDataTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+
+	switch c.Compress {
+	case "none", "gzip", "zstd":
+	default:
+		return fmt.Errorf("invalid compression: %s (must be none, gzip or zstd)", c.Compress)
+	}
+
+	switch c.OutputFormat {
+	case "pipe", "csv", "jsonl":
+	default:
+		return fmt.Errorf("invalid output format: %s (must be pipe, csv or jsonl)", c.OutputFormat)
+	}
+	if err := c.validateLayout(); err != nil {
+		return err
+	}
+
+	if c.Granularity != "weekly" && c.Granularity != "daily" {
+		return fmt.Errorf("invalid granularity: %s (must be weekly or daily)", c.Granularity)
+	}
+
+	if c.MergeEngine != "memory" && c.MergeEngine != "disk" {
+		return fmt.Errorf("invalid merge engine: %s (must be memory or disk)", c.MergeEngine)
+	}
+
+	switch c.NormalizeDomains {
+	case "none", "basic", "idna":
+	default:
+		return fmt.Errorf("invalid domain normalization: %s (must be none, basic or idna)", c.NormalizeDomains)
+	}
+
+	for _, qtype := range c.QTypes {
+		if !merger.ValidQType(qtype) {
+			return fmt.Errorf("invalid query type in qtypes: %s", qtype)
+		}
+	}
+
+	if c.Output != "" && c.InputDir == "" {
+		return fmt.Errorf("output requires input-dir")
+	}
+
+	if c.AnomalyThreshold < 0 {
+		return fmt.Errorf("anomaly-threshold must not be negative")
+	}
+
+	if c.TopDiff < 0 || c.TopDiffRankChange < 0 {
+		return fmt.Errorf("top-diff and top-diff-rank-change must not be negative")
+	}
+
+	if c.MaxSkippedPercent < 0 || c.MaxSkippedPercent > 100 {
+		return fmt.Errorf("max-skipped-percent must be between 0 and 100")
+	}
+
+	if c.MinCount < 0 {
+		return fmt.Errorf("min-count must not be negative")
+	}
+
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1")
+	}
+
+	if c.RetryJitter < 0 || c.RetryJitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+
+	if c.HookTimeout < 0 {
+		return fmt.Errorf("hook-timeout must not be negative")
+	}
+
+	for _, recipient := range c.EncryptRecipients {
+		if age.IsRecipient(recipient) {
+			if _, err := age.ParseRecipient(recipient); err != nil {
+				return err
+			}
+		} else if _, err := os.Stat(recipient); err != nil {
+			return fmt.Errorf("encrypt-recipient: %w", err)
+		}
+	}
+
+	if err := c.validateDateRange(time.Now()); err != nil {
+		return err
+	}
+
+	if _, err := notify.ParseEvents(c.NotifyOn); err != nil {
+		return fmt.Errorf("invalid notify-on: %w", err)
+	}
+
+	if c.NotifySMTPHost != "" && (c.NotifySMTPFrom == "" || len(c.NotifySMTPTo) == 0) {
+		return fmt.Errorf("e-mail notifications require notify-smtp-from and notify-smtp-to")
+	}
+
+	if err := c.validatePublish(); err != nil {
+		return err
+	}
+
+	if c.Daemon {
+		if _, err := scheduler.Parse(c.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+	if _, err := scheduler.ParseBlackout(c.UploadBlackout); err != nil {
+		return fmt.Errorf("invalid upload-blackout: %w", err)
+	}
+
+	return nil
+}
+
+// validateLayout checks the output layout options against the output
+// format.
+func (c *Config) validateLayout() error {
+	seen := make(map[string]bool, len(c.OutputColumns))
+	for _, column := range c.OutputColumns {
+		switch column {
+		case "domain", "qtype", "count", "pct", "cumpct", "clients":
+		default:
+			return fmt.Errorf("invalid output column: %s (must be domain, qtype, count, pct, cumpct or clients)", column)
+		}
+		if seen[column] {
+			return fmt.Errorf("output column %s is given twice", column)
+		}
+		seen[column] = true
+	}
+	if !seen["domain"] || !seen["count"] {
+		return fmt.Errorf("output-columns must include domain and count")
 	}
 
+	if c.OutputDomainWidth < 0 || c.OutputCountWidth < 0 {
+		return fmt.Errorf("output column widths must not be negative")
+	}
+	for _, sep := range []string{c.OutputSeparator, c.OutputThousands} {
+		if strings.ContainsAny(sep, "\r\n0123456789") {
+			return fmt.Errorf("output separators must not contain digits or line breaks: %q", sep)
+		}
+	}
+
+	switch c.OutputFormat {
+	case "jsonl":
+		if c.OutputSeparator != "" || c.OutputThousands != "" || c.OutputDomainWidth > 0 || c.OutputCountWidth > 0 || c.OutputHeader {
+			return fmt.Errorf("output separators, widths and header do not apply to jsonl output")
+		}
+	case "csv":
+		if c.OutputDomainWidth > 0 || c.OutputCountWidth > 0 {
+			return fmt.Errorf("output column widths only apply to pipe output")
+		}
+		if c.OutputSeparator != "" && (utf8.RuneCountInString(c.OutputSeparator) != 1 || c.OutputSeparator == `"`) {
+			return fmt.Errorf("csv output separator must be a single character other than a quote: %q", c.OutputSeparator)
+		}
+	default:
+		sep := c.OutputSeparator
+		if sep == "" {
+			sep = "|"
+		}
+		if c.OutputThousands != "" && (strings.Contains(sep, c.OutputThousands) || strings.Contains(c.OutputThousands, sep)) {
+			return fmt.Errorf("output thousands separator %q must differ from the separator %q", c.OutputThousands, sep)
+		}
+	}
 	return nil
 }
+
+func (c *Config) validateProxy() error {
+	if c.HTTPProxy != "" && c.SOCKSProxy != "" {
+		return fmt.Errorf("http-proxy and socks-proxy cannot be used together")
+	}
+
+	if c.HTTPProxy != "" {
+		if u, err := url.Parse(c.HTTPProxy); err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid http-proxy: %s (expected http://host:port)", c.HTTPProxy)
+		}
+	}
+
+	if c.SOCKSProxy != "" {
+		if u, err := url.Parse(c.SOCKSProxy); err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+			return fmt.Errorf("invalid socks-proxy: %s (expected socks5://host:port)", c.SOCKSProxy)
+		}
+	}
+
+	// rsync runs the ssh command, which does not know the proxy
+	if c.ProxyURL() != "" {
+		for _, target := range c.UploadTargets {
+			if target.Protocol == "rsync" {
+				return fmt.Errorf("upload target %s: rsync cannot be used with a proxy", target.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validatePublish() error {
+	if (len(c.PublishKafkaBrokers) == 0) != (c.PublishKafkaTopic == "") {
+		return fmt.Errorf("publish-kafka-brokers and publish-kafka-topic must be given together")
+	}
+	for _, broker := range c.PublishKafkaBrokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			return fmt.Errorf("invalid publish-kafka-brokers: %s (expected host:port)", broker)
+		}
+	}
+
+	if (c.PublishNATSURL == "") != (c.PublishNATSSubject == "") {
+		return fmt.Errorf("publish-nats-url and publish-nats-subject must be given together")
+	}
+	if c.PublishNATSURL != "" {
+		if u, err := url.Parse(c.PublishNATSURL); err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			return fmt.Errorf("invalid publish-nats-url: %s (expected nats://host:port)", c.PublishNATSURL)
+		}
+	}
+	if strings.ContainsAny(c.PublishNATSSubject, " \t\r\n") {
+		return fmt.Errorf("invalid publish-nats-subject: %q (must not contain whitespace)", c.PublishNATSSubject)
+	}
+
+	if c.PublishTopDomains < 0 {
+		return fmt.Errorf("publish-top-domains must not be negative")
+	}
+	return nil
+}
+
+// validateFTPMode checks the FTP data connection mode and the port range of
+// active mode, which cannot be used through a proxy.
+func (c *Config) validateFTPMode() error {
+	switch c.FTPMode {
+	case "passive", "active":
+	default:
+		return fmt.Errorf("invalid ftp mode: %s (must be passive or active)", c.FTPMode)
+	}
+
+	if _, _, err := c.FTPActivePortRange(); err != nil {
+		return err
+	}
+
+	// The server cannot connect back through a proxy
+	if c.FTPMode == "active" && c.ProxyURL() != "" {
+		for _, target := range c.UploadTargets {
+			if target.Protocol == "ftp" {
+				return fmt.Errorf("active ftp mode cannot be used with a proxy")
+			}
+		}
+	}
+	return nil
+}
+
+// FTPActivePortRange parses FTPActivePorts; zeros mean any port.
+func (c *Config) FTPActivePortRange() (min, max int, err error) {
+	if c.FTPActivePorts == "" {
+		return 0, 0, nil
+	}
+
+	low, high, found := strings.Cut(c.FTPActivePorts, "-")
+	if !found {
+		high = low
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(low))
+	max, err2 := strconv.Atoi(strings.TrimSpace(high))
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid ftp-active-ports: %s (expected min-max within 1-65535)", c.FTPActivePorts)
+	}
+	return min, max, nil
+}
+
+// TrackClients reports whether the distinct clients of each domain are
+// counted, which the clients output column needs.
+func (c *Config) TrackClients() bool {
+	return slices.Contains(c.OutputColumns, "clients")
+}
+
+// QTypeBreakdown reports whether domains are counted per query type, which
+// the qtype output column needs.
+func (c *Config) QTypeBreakdown() bool {
+	return slices.Contains(c.OutputColumns, "qtype")
+}
+
+// ProxyURL returns the configured proxy, or "" when none is set.
+func (c *Config) ProxyURL() string {
+	if c.SOCKSProxy != "" {
+		return c.SOCKSProxy
+	}
+	return c.HTTPProxy
+}
+
+// separatorValue resolves the names accepted for separators that are hard
+// to write in a config file or on the command line.
+func separatorValue(value string) string {
+	switch strings.ToLower(value) {
+	case "tab":
+		return "\t"
+	case "space":
+		return " "
+	}
+	return value
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DateLayout is the date format used by the GIH API and in Config.
+const DateLayout = "20060102"
+
+// normalizeDate accepts YYYY-MM-DD as a convenience and returns YYYYMMDD.
+func normalizeDate(date string) string {
+	return strings.ReplaceAll(strings.TrimSpace(date), "-", "")
+}
+
+func (c *Config) validateDateRange(now time.Time) error {
+	if c.DaysBack < 0 {
+		return fmt.Errorf("days-back must be positive")
+	}
+
+	if c.DaysBack > 0 && (c.StartDate != "" || c.EndDate != "") {
+		return fmt.Errorf("days-back cannot be combined with start-date/end-date")
+	}
+
+	if c.Daemon && (c.StartDate != "" || c.EndDate != "") {
+		return fmt.Errorf("start-date/end-date cannot be used in daemon mode (use days-back instead)")
+	}
+
+	if c.EndDate != "" && c.StartDate == "" {
+		return fmt.Errorf("end-date requires start-date")
+	}
+
+	if c.StartDate == "" {
+		return nil
+	}
+
+	start, err := time.ParseInLocation(DateLayout, c.StartDate, now.Location())
+	if err != nil {
+		return fmt.Errorf("invalid start date %q (expected YYYYMMDD)", c.StartDate)
+	}
+
+	end := now.AddDate(0, 0, -1)
+	if c.EndDate != "" {
+		if end, err = time.ParseInLocation(DateLayout, c.EndDate, now.Location()); err != nil {
+			return fmt.Errorf("invalid end date %q (expected YYYYMMDD)", c.EndDate)
+		}
+	}
+
+	if start.After(end) {
+		return fmt.Errorf("start date %s is after end date %s", c.StartDate, end.Format(DateLayout))
+	}
+
+	// Today's logs are still being written
+	if end.Format(DateLayout) >= now.Format(DateLayout) {
+		return fmt.Errorf("end date %s must be before today", c.EndDate)
+	}
+
+	return nil
+}
+
+// EnvPrefix prefixes the environment variable of every flag.
+const EnvPrefix = "GIHFTP_"
+
+// EnvName returns the environment variable for a flag, e.g.
+// GIHFTP_WORK_DIR for --work-dir.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag that was not given on the command line from its
+// environment variable, so that the environment overrides the config file
+// but not explicit flags.
+func applyEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if setErr := flag.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, EnvName(f.Name), setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// source resolves every option from its flag and config file key. A flag
+// given on the command line or through its GIHFTP_* variable wins over the
+// config file, which wins over the flag default, even when the given value
+// equals the default.
+type source struct {
+	ini *ini.File
+	set map[string]bool
+}
+
+func newSource(iniCfg *ini.File) *source {
+	s := &source{ini: iniCfg, set: make(map[string]bool)}
+	// Flags set by applyEnv are visited like those on the command line
+	flag.Visit(func(f *flag.Flag) {
+		s.set[f.Name] = true
+	})
+	return s
+}
+
+// lookup returns the config file value for key, if present. The key is
+// looked up in the root section first and then at its place in the
+// sectioned format.
+func (s *source) lookup(key string) (string, bool) {
+	if s.ini == nil {
+		return "", false
+	}
+
+	section, name := s.ini.Section(""), key
+	if !section.HasKey(key) {
+		setting, ok := settingByKey(key)
+		if !ok || setting.section == "" || !s.ini.HasSection(setting.section) {
+			return "", false
+		}
+		section, name = s.ini.Section(setting.section), setting.name
+	}
+
+	value := strings.TrimSpace(section.Key(name).String())
+	return value, value != ""
+}
+
+// value returns the config file value for key, or "".
+func (s *source) value(key string) string {
+	value, _ := s.lookup(key)
+	return value
+}
+
+// alias makes a flag given under its alias name count as given under name.
+// Both names must be bound to the same variable.
+func (s *source) alias(name, alias string) {
+	if s.set[alias] {
+		s.set[name] = true
+	}
+}
+
+func (s *source) str(flagName, flagValue, key string) string {
+	if s.set[flagName] {
+		return flagValue
+	}
+	if value, ok := s.lookup(key); ok {
+		return value
+	}
+	return flagValue
+}
+
+func (s *source) boolean(flagName string, flagValue bool, key string) bool {
+	if s.set[flagName] {
+		return flagValue
+	}
+	if value, ok := s.lookup(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return flagValue
+}
+
+func (s *source) integer(flagName string, flagValue int, key string) int {
+	if s.set[flagName] {
+		return flagValue
+	}
+	if value, ok := s.lookup(key); ok {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return flagValue
+}
+
+func (s *source) float(flagName string, flagValue float64, key string) float64 {
+	if s.set[flagName] {
+		return flagValue
+	}
+	if value, ok := s.lookup(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return flagValue
+}
+
+func (s *source) duration(flagName string, flagValue time.Duration, key string) time.Duration {
+	if s.set[flagName] {
+		return flagValue
+	}
+	if value, ok := s.lookup(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return flagValue
+}
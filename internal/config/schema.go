@@ -0,0 +1,323 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration
+)
+
+// setting maps a key of the flat (root section) config format to its place
+// in the sectioned format. Both formats may be mixed; a root key wins.
+type setting struct {
+	key     string
+	section string
+	name    string
+	kind    kind
+}
+
+var settings = []setting{
+	// Flat format only
+	{"gihdns1", "", "", kindString},
+	{"gihdns2", "", "", kindString},
+
+	{"gihservers", "gih", "servers", kindString},
+	{"gihdiscover", "gih", "discover", kindString},
+	{"gihdiscoverconsul", "gih", "discoverconsul", kindString},
+	{"gihdiscoverk8s", "gih", "discoverk8s", kindString},
+	{"gihapiport", "gih", "port", kindString},
+	{"gihscheme", "gih", "scheme", kindString},
+	{"gihallowhttp", "gih", "allowhttp", kindBool},
+	{"gihapitoken", "gih", "token", kindString},
+	{"gihapitokenfile", "gih", "tokenfile", kindString},
+	{"gihapikeyheader", "gih", "keyheader", kindString},
+	{"gihcacert", "gih", "cacert", kindString},
+	{"gihcadir", "gih", "cadir", kindString},
+	{"gihinsecuretls", "gih", "insecuretls", kindBool},
+	{"gihclientcert", "gih", "clientcert", kindString},
+	{"gihclientkey", "gih", "clientkey", kindString},
+	{"gihdialtimeout", "gih", "dialtimeout", kindDuration},
+	{"gihtlstimeout", "gih", "tlstimeout", kindDuration},
+	{"gihresponsetimeout", "gih", "responsetimeout", kindDuration},
+	{"gihidletimeout", "gih", "idletimeout", kindDuration},
+
+	{"uploadprotocol", "upload", "protocol", kindString},
+	{"ftpserver", "upload", "host", kindString},
+	{"ftpuser", "upload", "user", kindString},
+	{"ftppassword", "upload", "password", kindString},
+	{"ftplogdir", "upload", "logdir", kindString},
+	{"sshkey", "upload", "sshkey", kindString},
+	{"sshhostfingerprint", "upload", "hostfingerprint", kindString},
+	{"atomicupload", "upload", "atomic", kindBool},
+	{"uploadfallback", "upload", "fallback", kindBool},
+	{"uploadfallbackinsecure", "upload", "fallbackinsecure", kindBool},
+	{"uploadparallel", "upload", "parallel", kindBool},
+	{"remotefilemode", "upload", "filemode", kindString},
+	{"remotefileowner", "upload", "fileowner", kindString},
+	{"preservemtime", "upload", "preservemtime", kindBool},
+	{"uploadretryattempts", "upload", "retryattempts", kindInt},
+	{"uploadretrydelay", "upload", "retrydelay", kindDuration},
+	{"uploadretrymaxdelay", "upload", "retrymaxdelay", kindDuration},
+	{"ftpmode", "upload", "ftpmode", kindString},
+	{"ftpdisableepsv", "upload", "ftpdisableepsv", kindBool},
+	{"ftpactiveports", "upload", "ftpactiveports", kindString},
+	{"ftpdatatimeout", "upload", "ftpdatatimeout", kindDuration},
+	{"remotepathtemplate", "upload", "pathtemplate", kindString},
+	{"remoteretentionweeks", "upload", "retentionweeks", kindInt},
+	{"remoteretentionaction", "upload", "retentionaction", kindString},
+	{"uploadresume", "upload", "resume", kindBool},
+	{"verifyupload", "upload", "verify", kindBool},
+	{"verifyremotechecksum", "upload", "verifyremotechecksum", kindBool},
+	{"checksum", "upload", "checksum", kindBool},
+	{"splitsize", "upload", "splitsize", kindInt},
+
+	{"sshkeypassphrasefile", "ssh", "keypassphrasefile", kindString},
+	{"sshkeypassphrase", "ssh", "keypassphrase", kindString},
+	{"sshhostkeycache", "ssh", "hostkeycache", kindString},
+	{"sshknownhosts", "ssh", "knownhosts", kindString},
+	{"sshinsecurehostkey", "ssh", "insecurehostkey", kindBool},
+
+	{"workdir", "run", "workdir", kindString},
+	{"maxworkdirbytes", "run", "maxworkdirbytes", kindInt},
+	{"statefile", "run", "statefile", kindString},
+	{"historyfile", "run", "historyfile", kindString},
+	{"daysback", "run", "daysback", kindInt},
+	{"startdate", "run", "startdate", kindString},
+	{"enddate", "run", "enddate", kindString},
+	{"cleanup", "run", "cleanup", kindBool},
+	{"archivedir", "run", "archivedir", kindString},
+	{"archiveretentiondays", "run", "archiveretentiondays", kindInt},
+	{"report", "run", "report", kindString},
+	{"nocache", "run", "nocache", kindBool},
+	{"stream", "run", "stream", kindBool},
+	{"cachettl", "run", "cachettl", kindDuration},
+	{"maxdownloadrate", "run", "maxdownloadrate", kindFloat},
+	{"downloadconcurrency", "run", "downloadconcurrency", kindInt},
+	{"maxuploadrate", "run", "maxuploadrate", kindFloat},
+	{"maxmemorymb", "run", "maxmemorymb", kindInt},
+	{"servertimeout", "run", "servertimeout", kindDuration},
+	{"rundeadline", "run", "rundeadline", kindDuration},
+	{"waitlock", "run", "waitlock", kindDuration},
+	{"insecureskipverify", "run", "insecureskipverify", kindBool},
+
+	{"compress", "merge", "compress", kindString},
+	{"outputformat", "merge", "format", kindString},
+	{"outputcolumns", "merge", "columns", kindString},
+	{"outputseparator", "merge", "separator", kindString},
+	{"outputthousands", "merge", "thousandsseparator", kindString},
+	{"outputdomainwidth", "merge", "domainwidth", kindInt},
+	{"outputcountwidth", "merge", "countwidth", kindInt},
+	{"outputheader", "merge", "header", kindBool},
+	{"outputfinalnewline", "merge", "finalnewline", kindBool},
+	{"granularity", "merge", "granularity", kindString},
+	{"mergeengine", "merge", "engine", kindString},
+	{"normalizedomains", "merge", "normalize", kindString},
+	{"qtypes", "merge", "qtypes", kindString},
+	{"mincount", "merge", "mincount", kindInt},
+	{"anomalythreshold", "merge", "anomalythreshold", kindFloat},
+	{"topdiff", "merge", "topdiff", kindInt},
+	{"topdiffrankchange", "merge", "topdiffrankchange", kindInt},
+	{"failonempty", "merge", "failonempty", kindBool},
+	{"quarantinedir", "merge", "quarantinedir", kindString},
+	{"maxskippedpercent", "merge", "maxskippedpercent", kindFloat},
+	{"domainallowlist", "merge", "allowlist", kindString},
+	{"domainblocklist", "merge", "blocklist", kindString},
+
+	{"loglevel", "log", "level", kindString},
+	{"logformat", "log", "format", kindString},
+	{"logfile", "log", "file", kindString},
+	{"logmaxsize", "log", "maxsize", kindInt},
+	{"logmaxbackups", "log", "maxbackups", kindInt},
+	{"progress", "log", "progress", kindBool},
+	{"httpdebug", "log", "httpdebug", kindBool},
+
+	{"daemon", "daemon", "enabled", kindBool},
+	{"schedule", "daemon", "schedule", kindString},
+	{"healthlisten", "daemon", "healthlisten", kindString},
+	{"uploadblackout", "daemon", "uploadblackout", kindString},
+
+	{"notifyon", "notify", "on", kindString},
+	{"notifywebhook", "notify", "webhook", kindString},
+	{"notifysmtphost", "notify", "smtphost", kindString},
+	{"notifysmtpfrom", "notify", "smtpfrom", kindString},
+	{"notifysmtpto", "notify", "smtpto", kindString},
+	{"notifysmtpuser", "notify", "smtpuser", kindString},
+	{"notifysmtppassword", "notify", "smtppassword", kindString},
+	{"publishkafkabrokers", "publish", "kafkabrokers", kindString},
+	{"publishkafkatopic", "publish", "kafkatopic", kindString},
+	{"publishkafkatls", "publish", "kafkatls", kindBool},
+	{"publishkafkauser", "publish", "kafkauser", kindString},
+	{"publishkafkapassword", "publish", "kafkapassword", kindString},
+	{"publishnatsurl", "publish", "natsurl", kindString},
+	{"publishnatssubject", "publish", "natssubject", kindString},
+	{"publishtopdomains", "publish", "topdomains", kindInt},
+	{"secretsfile", "secrets", "file", kindString},
+	{"secretspassphrasefile", "secrets", "passphrasefile", kindString},
+	{"vaultaddr", "vault", "addr", kindString},
+	{"vaulttokenfile", "vault", "tokenfile", kindString},
+	{"vaultnamespace", "vault", "namespace", kindString},
+	{"vaultcacert", "vault", "cacert", kindString},
+	{"consuladdr", "consul", "addr", kindString},
+	{"consultoken", "consul", "token", kindString},
+	{"consuldatacenter", "consul", "datacenter", kindString},
+	{"consultag", "consul", "tag", kindString},
+	{"consulcacert", "consul", "cacert", kindString},
+	{"k8snamespace", "kubernetes", "namespace", kindString},
+	{"k8sportname", "kubernetes", "portname", kindString},
+
+	{"metricslisten", "metrics", "listen", kindString},
+	{"metricstextfile", "metrics", "textfile", kindString},
+
+	{"httpproxy", "proxy", "http", kindString},
+	{"socksproxy", "proxy", "socks", kindString},
+
+	{"retryattempts", "retry", "attempts", kindInt},
+	{"retryinitialdelay", "retry", "initialdelay", kindDuration},
+	{"retrymaxdelay", "retry", "maxdelay", kindDuration},
+	{"retryjitter", "retry", "jitter", kindFloat},
+
+	{"preuploadhook", "hooks", "preupload", kindString},
+	{"postuploadhook", "hooks", "postupload", kindString},
+	{"hooktimeout", "hooks", "timeout", kindDuration},
+	{"hookabortonfailure", "hooks", "abortonfailure", kindBool},
+
+	{"gpgsignkey", "sign", "gpgkey", kindString},
+	{"gpgpassphrasefile", "sign", "gpgpassphrasefile", kindString},
+	{"gpgpassphrase", "sign", "gpgpassphrase", kindString},
+	{"agerecipients", "sign", "agerecipients", kindString},
+	{"encryptrecipient", "sign", "encryptrecipient", kindString},
+}
+
+// targetKeys are the keys accepted in [upload.<name>] sections.
+var targetKeys = map[string]kind{
+	"protocol":         kindString,
+	"host":             kindString,
+	"user":             kindString,
+	"password":         kindString,
+	"logdir":           kindString,
+	"sshkey":           kindString,
+	"hostfingerprint":  kindString,
+	"pathtemplate":     kindString,
+	"filemode":         kindString,
+	"fileowner":        kindString,
+	"preservemtime":    kindBool,
+	"required":         kindBool,
+	"fallbackinsecure": kindBool,
+	"retryattempts":    kindInt,
+	"retrydelay":       kindDuration,
+	"retrymaxdelay":    kindDuration,
+	"url":              kindString,
+	"method":           kindString,
+	"headers":          kindString,
+	"multipart":        kindBool,
+	"multipartfield":   kindString,
+	"successcodes":     kindString,
+}
+
+func settingByKey(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// validateSchema reports unknown sections and keys and values that do not
+// parse as the expected type.
+func validateSchema(iniCfg *ini.File) error {
+	if iniCfg == nil {
+		return nil
+	}
+
+	sectionKeys := map[string]map[string]kind{"": {}}
+	for _, s := range settings {
+		sectionKeys[""][s.key] = s.kind
+		if s.section == "" {
+			continue
+		}
+		if sectionKeys[s.section] == nil {
+			sectionKeys[s.section] = make(map[string]kind)
+		}
+		sectionKeys[s.section][s.name] = s.kind
+	}
+
+	var errs []error
+	for _, section := range iniCfg.Sections() {
+		name := section.Name()
+		if name == ini.DefaultSection {
+			name = ""
+		}
+
+		var known map[string]kind
+		switch {
+		case name == "tokens":
+			continue
+		case strings.HasPrefix(name, "upload."):
+			known = targetKeys
+		case strings.HasPrefix(name, serverSectionPrefix):
+			known = serverKeys
+		default:
+			var ok bool
+			if known, ok = sectionKeys[name]; !ok {
+				errs = append(errs, fmt.Errorf("unknown section [%s]", name))
+				continue
+			}
+		}
+
+		for _, key := range section.Keys() {
+			k, ok := known[key.Name()]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key %q", sectionLabel(name), key.Name()))
+				continue
+			}
+			if err := checkKind(k, strings.TrimSpace(key.String())); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", sectionLabel(name), key.Name(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func sectionLabel(name string) string {
+	if name == "" {
+		return "root section"
+	}
+	return "[" + name + "]"
+}
+
+func checkKind(k kind, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	var err error
+	switch k {
+	case kindBool:
+		_, err = strconv.ParseBool(value)
+	case kindInt:
+		_, err = strconv.Atoi(value)
+	case kindFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case kindDuration:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
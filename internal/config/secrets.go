@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/secrets"
+
+	"gopkg.in/ini.v1"
+)
+
+// secretKeys are the flat config keys that hold passwords or tokens.
+var secretKeys = []string{"ftppassword", "gihapitoken", "notifysmtppassword", "publishkafkapassword", "sshkeypassphrase", "gpgpassphrase", "consultoken"}
+
+// resolveSecrets replaces keyring:, secret: and vault: references in
+// passwords, tokens and the SSH and GPG key passphrases with the values from the OS
+// keyring, the encrypted secrets file or Vault.
+func (c *Config) resolveSecrets() error {
+	resolver := secrets.NewResolver()
+	resolver.Register(secrets.KeyringPrefix, secrets.Keyring{})
+	if c.SecretsFile != "" {
+		passphrase, err := secrets.Passphrase(c.SecretsPassphraseFile)
+		if err != nil {
+			return err
+		}
+		file, err := secrets.OpenFile(c.SecretsFile, passphrase)
+		if err != nil {
+			return err
+		}
+		resolver.Register(secrets.FilePrefix, file)
+	}
+	if c.VaultAddr != "" {
+		vault, err := secrets.NewVault(secrets.VaultOptions{
+			Addr:      c.VaultAddr,
+			TokenFile: c.VaultTokenFile,
+			Namespace: c.VaultNamespace,
+			CACert:    c.VaultCACert,
+			Timeout:   10 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		resolver.Register(secrets.VaultPrefix, vault)
+	}
+
+	values := []*string{&c.FTPPassword, &c.GIHAPIToken, &c.NotifySMTPPass, &c.PublishKafkaPass, &c.SSHKeyPassphrase, &c.GPGPassphrase, &c.ConsulToken}
+	for i := range c.UploadTargets {
+		values = append(values, &c.UploadTargets[i].Password)
+	}
+	for _, value := range values {
+		resolved, err := resolver.Resolve(*value)
+		if err != nil {
+			return fmt.Errorf("failed to resolve secret: %w", err)
+		}
+		*value = resolved
+	}
+
+	// Header values of HTTPS targets, e.g. Authorization: secret:receiver
+	for _, target := range c.UploadTargets {
+		for i, header := range target.Headers {
+			name, value, _ := strings.Cut(header, ":")
+			resolved, err := resolver.Resolve(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("failed to resolve secret: %w", err)
+			}
+			target.Headers[i] = name + ": " + resolved
+		}
+	}
+
+	for host, token := range c.GIHServerTokens {
+		resolved, err := resolver.Resolve(token)
+		if err != nil {
+			return fmt.Errorf("failed to resolve secret: %w", err)
+		}
+		c.GIHServerTokens[host] = resolved
+	}
+	return nil
+}
+
+// Secrets returns the resolved passwords, tokens and passphrases, for
+// masking them in logs and reports.
+func (c *Config) Secrets() []string {
+	secrets := []string{c.FTPPassword, c.GIHAPIToken, c.NotifySMTPPass, c.PublishKafkaPass, c.SSHKeyPassphrase, c.GPGPassphrase, c.ConsulToken}
+	for _, target := range c.UploadTargets {
+		secrets = append(secrets, target.Password)
+		for _, header := range target.Headers {
+			if name, value, _ := strings.Cut(header, ":"); credentialHeader(name) {
+				secrets = append(secrets, strings.TrimSpace(value))
+			}
+		}
+	}
+	for _, token := range c.GIHServerTokens {
+		secrets = append(secrets, token)
+	}
+	return secrets
+}
+
+// checkConfigPermissions refuses a config file that holds plaintext
+// passwords or tokens (not keyring:, secret: or vault: references) when other users
+// can read it.
+func checkConfigPermissions(path string, iniCfg *ini.File, src *source) error {
+	if iniCfg == nil {
+		return nil
+	}
+
+	var plaintext []string
+	for _, key := range secretKeys {
+		if value := src.value(key); value != "" && !secrets.IsReference(value) {
+			plaintext = append(plaintext, key)
+		}
+	}
+	for _, section := range iniCfg.Sections() {
+		name := section.Name()
+		switch {
+		case name == "tokens":
+			for _, key := range section.Keys() {
+				if !secrets.IsReference(key.String()) {
+					plaintext = append(plaintext, "[tokens] "+key.Name())
+				}
+			}
+		case strings.HasPrefix(name, "upload."):
+			if value := section.Key("password").String(); value != "" && !secrets.IsReference(value) {
+				plaintext = append(plaintext, "["+name+"] password")
+			}
+			for _, header := range splitLines(section.Key("headers").String()) {
+				if field, value, _ := strings.Cut(header, ":"); credentialHeader(field) && !secrets.IsReference(strings.TrimSpace(value)) {
+					plaintext = append(plaintext, "["+name+"] headers")
+					break
+				}
+			}
+		case strings.HasPrefix(name, serverSectionPrefix):
+			if value := section.Key("token").String(); value != "" && !secrets.IsReference(value) {
+				plaintext = append(plaintext, "["+name+"] token")
+			}
+		}
+	}
+	if len(plaintext) == 0 {
+		return nil
+	}
+
+	if err := secrets.CheckPermissions(path); err != nil {
+		return fmt.Errorf("config file holds secrets (%s): %w; or move them to the OS keyring or a secrets file", strings.Join(plaintext, ", "), err)
+	}
+	return nil
+}
+
+// credentialHeader reports whether an HTTP header carries credentials, e.g.
+// Authorization or X-API-Key.
+func credentialHeader(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	return strings.Contains(name, "token") || strings.Contains(name, "key") || strings.Contains(name, "secret")
+}
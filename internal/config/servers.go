@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// serverSectionPrefix starts the name of a per-server section, e.g.
+// [server dns1.example.com].
+const serverSectionPrefix = "server "
+
+// ServerOverride holds the settings of a [server <host>] section. Empty
+// fields fall back to the global gih* settings.
+type ServerOverride struct {
+	Token  string
+	Port   string
+	Scheme string
+	CACert string
+}
+
+// serverKeys are the keys accepted in [server <host>] sections.
+var serverKeys = map[string]kind{
+	"token":  kindString,
+	"port":   kindInt,
+	"scheme": kindString,
+	"cacert": kindString,
+}
+
+// loadServerOverrides returns the [server <host>] sections keyed by the
+// lower-cased host.
+func loadServerOverrides(iniCfg *ini.File) (map[string]ServerOverride, error) {
+	if iniCfg == nil {
+		return nil, nil
+	}
+
+	var overrides map[string]ServerOverride
+	for _, section := range iniCfg.Sections() {
+		host, ok := strings.CutPrefix(section.Name(), serverSectionPrefix)
+		if !ok {
+			continue
+		}
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return nil, fmt.Errorf("[%s]: missing host", section.Name())
+		}
+
+		override := ServerOverride{
+			Token:  section.Key("token").String(),
+			Port:   section.Key("port").String(),
+			Scheme: strings.ToLower(section.Key("scheme").String()),
+			CACert: section.Key("cacert").String(),
+		}
+		if override.Scheme != "" && override.Scheme != "https" && override.Scheme != "http" {
+			return nil, fmt.Errorf("[%s]: invalid scheme %q (must be https or http)", section.Name(), override.Scheme)
+		}
+		if overrides == nil {
+			overrides = make(map[string]ServerOverride)
+		}
+		if _, dup := overrides[host]; dup {
+			return nil, fmt.Errorf("duplicate section [%s%s]", serverSectionPrefix, host)
+		}
+		overrides[host] = override
+	}
+	return overrides, nil
+}
+
+// ServerDefaults returns the scheme and port of a server on host whose
+// entry names neither: those of its [server <host>] section, or else
+// --gih-scheme and --gih-api-port.
+func (c *Config) ServerDefaults(host string) (scheme, port string) {
+	scheme, port = c.GIHScheme, c.GIHAPIPort
+	if override, ok := c.GIHServerOverrides[strings.ToLower(host)]; ok {
+		if override.Scheme != "" {
+			scheme = override.Scheme
+		}
+		if override.Port != "" {
+			port = override.Port
+		}
+	}
+	return scheme, port
+}
@@ -0,0 +1,380 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gih-ftp/internal/remotepath"
+
+	"gopkg.in/ini.v1"
+)
+
+// DefaultTargetName names the upload target built from the top-level
+// ftp-host/ftp-user/... options.
+const DefaultTargetName = "default"
+
+// httpMultipartField is the form field of multipart HTTPS uploads unless a
+// section names another.
+const httpMultipartField = "file"
+
+// UploadTarget is one destination the merged file is delivered to.
+type UploadTarget struct {
+	Name       string
+	Protocol   string
+	Host       string
+	User       string
+	Password   string
+	LogDir     string
+	SSHKeyPath string
+
+	// HostFingerprint pins the SFTP host key (SHA256:...)
+	HostFingerprint string
+
+	// PathTemplate is the remote path below LogDir, e.g.
+	// "{{.Year}}/{{.Week}}/{{.Filename}}". Empty means just the file name.
+	PathTemplate string
+
+	// FileMode (octal) and FileOwner ("uid:gid") are given to uploaded
+	// files when set, and the local modification time with PreserveMTime
+	FileMode      string
+	FileOwner     string
+	PreserveMTime bool
+
+	// HTTPS targets send each file with Method (PUT or POST) to URL, a
+	// template like PathTemplate (a presigned URL is used as is), with the
+	// Headers ("Name: value"). The body is the raw file or, with
+	// MultipartField, a multipart form. SuccessCodes is a comma-separated
+	// list of statuses; empty accepts any 2xx.
+	URL            string
+	Method         string
+	Headers        []string
+	MultipartField string
+	SuccessCodes   string
+
+	// Required targets must all succeed for the run to succeed. A failed
+	// optional target (required = false) is only reported.
+	Required bool
+
+	// InsecureFallback lets --upload-fallback switch an SFTP target to
+	// cleartext FTP. It is set per target and never inherited.
+	InsecureFallback bool
+
+	// A failed upload is tried RetryAttempts times in total, waiting
+	// RetryDelay before the first retry and doubling it up to RetryMaxDelay
+	RetryAttempts int
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+}
+
+// Mode returns the parsed FileMode, or 0 when it is not set.
+func (t UploadTarget) Mode() (os.FileMode, error) {
+	if t.FileMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(t.FileMode, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("upload target %s: invalid file mode: %s (expected octal permissions such as 0640)", t.Name, t.FileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Owner returns the parsed FileOwner; ok is false when it is not set.
+func (t UploadTarget) Owner() (uid, gid int, ok bool, err error) {
+	if t.FileOwner == "" {
+		return 0, 0, false, nil
+	}
+	user, group, found := strings.Cut(t.FileOwner, ":")
+	uid, err1 := strconv.Atoi(strings.TrimSpace(user))
+	gid, err2 := strconv.Atoi(strings.TrimSpace(group))
+	if !found || err1 != nil || err2 != nil || uid < 0 || gid < 0 {
+		return 0, 0, false, fmt.Errorf("upload target %s: invalid file owner: %s (expected numeric uid:gid)", t.Name, t.FileOwner)
+	}
+	return uid, gid, true, nil
+}
+
+// RetryDelayAfter returns the delay before retry n (from 1). A maximum
+// below RetryDelay keeps the delay fixed.
+func (t UploadTarget) RetryDelayAfter(n int) time.Duration {
+	delay := t.RetryDelay
+	for i := 1; i < n && delay < t.RetryMaxDelay; i++ {
+		delay = min(2*delay, t.RetryMaxDelay)
+	}
+	return delay
+}
+
+// RemotePathData holds the fields available to a remote path template.
+// Dates are those of the upload; Week is the ISO week of WeekYear.
+type RemotePathData struct {
+	Year     string
+	Month    string
+	Day      string
+	Week     string
+	WeekYear string
+	Hostname string
+	Filename string
+}
+
+func newRemotePathData(filename string, now time.Time) RemotePathData {
+	hostname, _ := os.Hostname()
+	weekYear, week := now.ISOWeek()
+	return RemotePathData{
+		Year:     now.Format("2006"),
+		Month:    now.Format("01"),
+		Day:      now.Format("02"),
+		Week:     fmt.Sprintf("%02d", week),
+		WeekYear: fmt.Sprintf("%04d", weekYear),
+		Hostname: hostname,
+		Filename: filename,
+	}
+}
+
+// renderPath executes the path template for filename.
+func (t UploadTarget) renderPath(filename string, now time.Time) (string, error) {
+	if t.PathTemplate == "" {
+		return filename, nil
+	}
+	return t.render(t.PathTemplate, filename, now)
+}
+
+func (t UploadTarget) render(text, filename string, now time.Time) (string, error) {
+	tmpl, err := template.New(t.Name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, newRemotePathData(filename, now)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// RemotePath returns where filename is uploaded at time now: LogDir joined
+// with the rendered path template. The template is checked by Validate, so
+// rendering only fails for an unvalidated target, which then falls back to
+// LogDir/filename. For HTTPS targets it is the upload URL without its
+// query string, which may hold a signature.
+func (t UploadTarget) RemotePath(filename string, now time.Time) string {
+	if t.Protocol == "https" {
+		u, err := url.Parse(t.UploadURL(filename, now))
+		if err != nil {
+			return ""
+		}
+		u.RawQuery, u.Fragment = "", ""
+		return u.Redacted()
+	}
+
+	rel, err := t.renderPath(filename, now)
+	if err != nil {
+		rel = filename
+	}
+	return remotepath.Join(t.LogDir, rel)
+}
+
+// UploadURL returns the URL an HTTPS target receives filename at at time
+// now. Like RemotePath it falls back to the unrendered URL.
+func (t UploadTarget) UploadURL(filename string, now time.Time) string {
+	rendered, err := t.render(t.URL, filename, now)
+	if err != nil {
+		return t.URL
+	}
+	return rendered
+}
+
+// SingleURL reports whether every file of an HTTPS target goes to the same
+// URL, e.g. a presigned one.
+func (t UploadTarget) SingleURL() bool {
+	return !strings.Contains(t.URL, "{{")
+}
+
+// Statuses returns the parsed SuccessCodes.
+func (t UploadTarget) Statuses() ([]int, error) {
+	var codes []int
+	for _, field := range splitList(t.SuccessCodes) {
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("upload target %s: invalid success code: %s", t.Name, field)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// loadUploadTargets returns the default target (when ftp-host is set)
+// followed by one target per [upload.<name>] section. Section keys that are
+// left out inherit the top-level values, except host, hostfingerprint and
+// fallbackinsecure.
+// Every target is required unless its section says otherwise.
+// The password of a section may also come from FTP_PASSWORD_<NAME>.
+func loadUploadTargets(cfg *Config, iniCfg *ini.File) []UploadTarget {
+	var targets []UploadTarget
+
+	if cfg.FTPHost != "" {
+		targets = append(targets, UploadTarget{
+			Name:       DefaultTargetName,
+			Protocol:   cfg.UploadProtocol,
+			Host:       cfg.FTPHost,
+			User:       cfg.FTPUser,
+			Password:   cfg.FTPPassword,
+			LogDir:     cfg.FTPLogDir,
+			SSHKeyPath: cfg.SSHKeyPath,
+
+			HostFingerprint: cfg.SSHHostFingerprint,
+			PathTemplate:    cfg.RemotePathTemplate,
+
+			FileMode:      cfg.RemoteFileMode,
+			FileOwner:     cfg.RemoteFileOwner,
+			PreserveMTime: cfg.PreserveMTime,
+
+			Required:         true,
+			InsecureFallback: cfg.UploadFallbackInsecure,
+			RetryAttempts:    cfg.UploadRetryAttempts,
+			RetryDelay:       cfg.UploadRetryDelay,
+			RetryMaxDelay:    cfg.UploadRetryMaxDelay,
+		})
+	}
+
+	if iniCfg == nil {
+		return targets
+	}
+
+	for _, section := range iniCfg.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), "upload.")
+		if !ok {
+			continue
+		}
+
+		password := os.Getenv("FTP_PASSWORD_" + envName(name))
+		if password == "" {
+			password = section.Key("password").String()
+		}
+
+		protocol := strings.ToLower(section.Key("protocol").MustString(cfg.UploadProtocol))
+		host := section.Key("host").String()
+		multipartField := ""
+		if section.Key("multipart").MustBool(false) {
+			multipartField = section.Key("multipartfield").MustString(httpMultipartField)
+		}
+		method := "PUT"
+		if multipartField != "" {
+			method = "POST"
+		}
+		if protocol == "https" && host == "" {
+			if u, err := url.Parse(section.Key("url").String()); err == nil {
+				host = u.Host
+			}
+		}
+
+		targets = append(targets, UploadTarget{
+			Name:       name,
+			Protocol:   protocol,
+			Host:       host,
+			User:       section.Key("user").MustString(cfg.FTPUser),
+			Password:   password,
+			LogDir:     section.Key("logdir").MustString(cfg.FTPLogDir),
+			SSHKeyPath: section.Key("sshkey").MustString(cfg.SSHKeyPath),
+
+			HostFingerprint: section.Key("hostfingerprint").String(),
+			PathTemplate:    section.Key("pathtemplate").MustString(cfg.RemotePathTemplate),
+
+			FileMode:      section.Key("filemode").MustString(cfg.RemoteFileMode),
+			FileOwner:     section.Key("fileowner").MustString(cfg.RemoteFileOwner),
+			PreserveMTime: section.Key("preservemtime").MustBool(cfg.PreserveMTime),
+
+			URL:            section.Key("url").String(),
+			Method:         strings.ToUpper(section.Key("method").MustString(method)),
+			Headers:        splitLines(section.Key("headers").String()),
+			MultipartField: multipartField,
+			SuccessCodes:   section.Key("successcodes").String(),
+
+			Required:         section.Key("required").MustBool(true),
+			InsecureFallback: section.Key("fallbackinsecure").MustBool(false),
+			RetryAttempts:    section.Key("retryattempts").MustInt(cfg.UploadRetryAttempts),
+			RetryDelay:       section.Key("retrydelay").MustDuration(cfg.UploadRetryDelay),
+			RetryMaxDelay:    section.Key("retrymaxdelay").MustDuration(cfg.UploadRetryMaxDelay),
+		})
+	}
+
+	return targets
+}
+
+// splitLines splits a multi-line value, dropping blank lines.
+func splitLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// envName turns a target name into the suffix of its password variable.
+func envName(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func (t UploadTarget) validate() error {
+	if t.RetryAttempts < 1 {
+		return fmt.Errorf("upload target %s: retry attempts must be at least 1", t.Name)
+	}
+	if t.RetryDelay < 0 || t.RetryMaxDelay < 0 {
+		return fmt.Errorf("upload target %s: retry delays must not be negative", t.Name)
+	}
+	if t.Protocol == "https" {
+		return t.validateHTTPS()
+	}
+	if t.Host == "" {
+		return fmt.Errorf("upload target %s: host is required", t.Name)
+	}
+	if t.Protocol != "ftp" && t.Protocol != "sftp" && t.Protocol != "rsync" {
+		return fmt.Errorf("upload target %s: invalid protocol: %s (must be ftp, sftp, rsync or https)", t.Name, t.Protocol)
+	}
+	if _, err := t.Mode(); err != nil {
+		return err
+	}
+	if _, _, ok, err := t.Owner(); err != nil {
+		return err
+	} else if ok && t.Protocol == "ftp" {
+		return fmt.Errorf("upload target %s: file owner requires sftp or rsync", t.Name)
+	}
+	if t.HostFingerprint != "" && t.Protocol != "sftp" {
+		return fmt.Errorf("upload target %s: host fingerprint requires sftp", t.Name)
+	}
+	if rel, err := t.renderPath("file.txt", time.Now()); err != nil {
+		return fmt.Errorf("upload target %s: invalid path template: %w", t.Name, err)
+	} else if !strings.Contains(rel, "file.txt") {
+		return fmt.Errorf("upload target %s: path template must contain {{.Filename}}", t.Name)
+	}
+	return nil
+}
+
+// validateHTTPS checks the settings of an https target. The FTP/SFTP
+// settings it inherits are ignored.
+func (t UploadTarget) validateHTTPS() error {
+	if t.URL == "" {
+		return fmt.Errorf("upload target %s: url is required for https (set in an [upload.<name>] section)", t.Name)
+	}
+	rendered, err := t.render(t.URL, "file.txt", time.Now())
+	if err != nil {
+		return fmt.Errorf("upload target %s: invalid url template: %w", t.Name, err)
+	}
+	u, err := url.Parse(rendered)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("upload target %s: invalid url: %s (expected https://host/...)", t.Name, t.URL)
+	}
+	if t.Method != "PUT" && t.Method != "POST" {
+		return fmt.Errorf("upload target %s: invalid method: %s (must be PUT or POST)", t.Name, t.Method)
+	}
+	for _, header := range t.Headers {
+		if name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("upload target %s: invalid header %q (expected Name: value)", t.Name, header)
+		}
+	}
+	_, err = t.Statuses()
+	return err
+}
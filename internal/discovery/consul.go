@@ -0,0 +1,88 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gih-ftp/internal/gihapi"
+)
+
+// DefaultConsulAddr is the address of the local Consul agent.
+const DefaultConsulAddr = "http://127.0.0.1:8500"
+
+// ConsulOptions configures the Consul catalog lookup.
+type ConsulOptions struct {
+	Addr       string
+	Token      string
+	Datacenter string
+	// Tag limits the lookup to service instances carrying it
+	Tag    string
+	CACert string
+}
+
+// Consul returns the instances of service that pass their health checks.
+// An instance registered without a service address is reached at the
+// address of its node.
+func Consul(ctx context.Context, opts ConsulOptions, service string, defaults gihapi.Defaults) ([]gihapi.Server, error) {
+	client, err := newHTTPClient(opts.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = DefaultConsulAddr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	query := url.Values{"passing": {"true"}}
+	if opts.Datacenter != "" {
+		query.Set("dc", opts.Datacenter)
+	}
+	if opts.Tag != "" {
+		query.Set("tag", opts.Tag)
+	}
+	endpoint := strings.TrimRight(addr, "/") + "/v1/health/service/" + url.PathEscape(service) + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token != "" {
+		req.Header.Set("X-Consul-Token", opts.Token)
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := getJSON(client, req, "Consul", &entries); err != nil {
+		return nil, err
+	}
+
+	var addrs []hostPort
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		if host == "" {
+			continue
+		}
+		addrs = append(addrs, hostPort{host: host, port: entry.Service.Port})
+	}
+	result, err := servers(addrs, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("Consul service %s: %w", service, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,95 @@
+// Package discovery looks up GIH servers in a Consul catalog or among the
+// endpoints of Kubernetes services, for deployments where the DNS servers
+// come and go with their containers.
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/gihapi"
+)
+
+// Timeout bounds one request to Consul or the Kubernetes API.
+const Timeout = 10 * time.Second
+
+// newHTTPClient returns a client that trusts only caCert when it is set
+// and the system roots otherwise.
+func newHTTPClient(caCert string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: Timeout}, nil
+}
+
+// getJSON sends req and decodes the JSON response into v. what names the
+// service in errors.
+func getJSON(client *http.Client, req *http.Request, what string, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", what, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", what, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid %s response: %w", what, err)
+	}
+	return nil
+}
+
+// servers parses host:port pairs into GIH servers sorted by name. The port
+// is left out of the name when it is zero or the default port of the host,
+// so a server keeps the name it has in --gih-servers.
+func servers(addrs []hostPort, defaults gihapi.Defaults) ([]gihapi.Server, error) {
+	seen := make(map[string]bool)
+	var result []gihapi.Server
+	for _, addr := range addrs {
+		entry := addr.host
+		_, defaultPort := defaults(addr.host)
+		if port := strconv.Itoa(addr.port); addr.port != 0 && port != defaultPort {
+			entry = net.JoinHostPort(addr.host, port)
+		} else if strings.Contains(entry, ":") {
+			// A bare IPv6 address
+			entry = "[" + entry + "]"
+		}
+		server, err := gihapi.ParseServerWith(entry, defaults)
+		if err != nil {
+			return nil, err
+		}
+		if seen[server.Name] {
+			continue
+		}
+		seen[server.Name] = true
+		result = append(result, server)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].Name < result[k].Name })
+	return result, nil
+}
+
+type hostPort struct {
+	host string
+	port int
+}
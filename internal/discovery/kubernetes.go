@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gih-ftp/internal/gihapi"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesOptions configures the Kubernetes endpoints lookup. The API
+// server and credentials are those of the pod's service account.
+type KubernetesOptions struct {
+	// Namespace defaults to the namespace of the pod
+	Namespace string
+	// PortName picks the endpoint port; it may be empty when the
+	// endpoints have a single port
+	PortName string
+}
+
+// Kubernetes returns the ready addresses of the endpoints of the services
+// matching the label selector. It works only inside a cluster, with a
+// service account allowed to list endpoints in the namespace.
+func Kubernetes(ctx context.Context, opts KubernetesOptions, selector string, defaults gihapi.Defaults) ([]gihapi.Server, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Kubernetes discovery only works inside a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	client, err := newHTTPClient(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("https://%s/api/v1/namespaces/%s/endpoints?%s",
+		net.JoinHostPort(host, port), url.PathEscape(namespace), url.Values{"labelSelector": {selector}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Subsets []struct {
+				Addresses []struct {
+					IP string `json:"ip"`
+				} `json:"addresses"`
+				Ports []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"ports"`
+			} `json:"subsets"`
+		} `json:"items"`
+	}
+	if err := getJSON(client, req, "Kubernetes API", &list); err != nil {
+		return nil, err
+	}
+
+	var addrs []hostPort
+	for _, item := range list.Items {
+		for _, subset := range item.Subsets {
+			port := -1
+			for _, p := range subset.Ports {
+				if p.Name == opts.PortName || len(subset.Ports) == 1 && opts.PortName == "" {
+					port = p.Port
+					break
+				}
+			}
+			if port < 0 && opts.PortName == "" {
+				return nil, fmt.Errorf("endpoints %s/%s have %d ports; choose one with --k8s-port-name", namespace, item.Metadata.Name, len(subset.Ports))
+			}
+			if port < 0 {
+				return nil, fmt.Errorf("endpoints %s/%s have no port named %q", namespace, item.Metadata.Name, opts.PortName)
+			}
+			// Addresses lists ready pods only; NotReadyAddresses is ignored
+			for _, address := range subset.Addresses {
+				addrs = append(addrs, hostPort{host: address.IP, port: port})
+			}
+		}
+	}
+	result, err := servers(addrs, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes endpoints %s: %w", selector, err)
+	}
+	return result, nil
+}
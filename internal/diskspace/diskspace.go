@@ -0,0 +1,231 @@
+// Package diskspace checks that the work directory has room for a run:
+// enough free space on its filesystem and, optionally, a cap on the bytes
+// stored under it.
+package diskspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrNoSpace is returned when data would not fit in the directory.
+var ErrNoSpace = errors.New("not enough space in work directory")
+
+// writeStep is the space a Writer reserves at a time.
+const writeStep = 1 << 20
+
+// Guard checks a directory before data is written to it. Every writer of a
+// run shares one Guard: space is reserved atomically, and space reserved
+// but not yet written counts as used, so concurrent writers cannot overrun
+// the space each of them checked. The bytes under the directory are
+// measured once and then tracked from what is written and released. A nil
+// Guard accepts everything.
+type Guard struct {
+	dir string
+	// max caps the bytes stored under dir; zero disables the cap
+	max int64
+
+	mu       sync.Mutex
+	measured bool
+	used     int64
+	pending  int64
+}
+
+// New returns a Guard for dir with a cap of max bytes, or none when max is
+// zero.
+func New(dir string, max int64) *Guard {
+	return &Guard{dir: dir, max: max}
+}
+
+// Contains reports whether path lies under the directory of g. A nil Guard
+// contains nothing.
+func (g *Guard) Contains(path string) bool {
+	if g == nil {
+		return false
+	}
+	dir, err := filepath.Abs(g.dir)
+	if err != nil {
+		return false
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Check returns an error wrapping ErrNoSpace when n more bytes do not fit
+// in the free space of the filesystem or under the cap, without reserving
+// them. Free space is not checked on platforms where it cannot be read.
+func (g *Guard) Check(n int64) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.check(n)
+}
+
+// check is Check with g.mu held.
+func (g *Guard) check(n int64) error {
+	free, err := Free(g.dir)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+	case err != nil:
+		return fmt.Errorf("failed to check free space in %s: %w", g.dir, err)
+	case n > 0 && n+g.pending > int64(min(free, 1<<62)):
+		return fmt.Errorf("%w: %d bytes needed, %d bytes free in %s", ErrNoSpace, n+g.pending, free, g.dir)
+	}
+
+	if g.max <= 0 {
+		return nil
+	}
+	if !g.measured {
+		used, err := Usage(g.dir)
+		if err != nil {
+			return fmt.Errorf("failed to measure %s: %w", g.dir, err)
+		}
+		g.used, g.measured = used, true
+	}
+	if g.used+g.pending+n > g.max {
+		return fmt.Errorf("%w: %s holds %d bytes, %d more would exceed the cap of %d bytes", ErrNoSpace, g.dir, g.used+g.pending, n, g.max)
+	}
+	return nil
+}
+
+// reserve checks n bytes and holds them as pending.
+func (g *Guard) reserve(n int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check(n); err != nil {
+		return err
+	}
+	g.pending += n
+	return nil
+}
+
+// settle ends a reservation of reserved bytes of which written were stored.
+func (g *Guard) settle(reserved, written int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending -= reserved
+	g.used += written
+}
+
+// Release records that n bytes were removed from the directory.
+func (g *Guard) Release(n int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.used = max(g.used-n, 0)
+}
+
+// Reservation holds space for a file of known size while it is written.
+type Reservation struct {
+	g        *Guard
+	reserved int64
+}
+
+// Reserve reserves n bytes and returns an error wrapping ErrNoSpace when
+// they do not fit (see Check). The reservation ends with Done.
+func (g *Guard) Reserve(n int64) (*Reservation, error) {
+	if g == nil {
+		return nil, nil
+	}
+	if err := g.reserve(n); err != nil {
+		return nil, err
+	}
+	return &Reservation{g: g, reserved: n}, nil
+}
+
+// Done ends the reservation after written bytes were stored; the rest of
+// the reserved space is given back.
+func (r *Reservation) Done(written int64) {
+	if r == nil {
+		return
+	}
+	r.g.settle(r.reserved, written)
+	r.reserved = 0
+}
+
+// Writer passes writes to an underlying writer, reserving the space in
+// steps before the bytes are written, for files whose size is not known in
+// advance. A write that does not fit fails with an error wrapping
+// ErrNoSpace.
+type Writer struct {
+	g        *Guard
+	w        io.Writer
+	reserved int64
+}
+
+// Writer returns a Writer to w. Done must be called once writing ends.
+func (g *Guard) Writer(w io.Writer) *Writer {
+	return &Writer{g: g, w: w}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.g == nil {
+		return w.w.Write(p)
+	}
+	if need := int64(len(p)) - w.reserved; need > 0 {
+		// Near the limit only what is written is reserved
+		step := max(need, writeStep)
+		if err := w.g.reserve(step); err != nil {
+			if step == need {
+				return 0, err
+			}
+			if err := w.g.reserve(need); err != nil {
+				return 0, err
+			}
+			step = need
+		}
+		w.reserved += step
+	}
+	n, err := w.w.Write(p)
+	w.g.settle(int64(n), int64(n))
+	w.reserved -= int64(n)
+	return n, err
+}
+
+// Done gives back the space reserved but not written.
+func (w *Writer) Done() {
+	if w.g == nil {
+		return
+	}
+	w.g.settle(w.reserved, 0)
+	w.reserved = 0
+}
+
+// Usage returns the total size of the regular files under dir. Files
+// removed while it walks are skipped.
+func Usage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
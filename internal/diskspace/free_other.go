@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !windows
+
+package diskspace
+
+import "errors"
+
+// Free is not implemented on this platform; it returns
+// errors.ErrUnsupported.
+func Free(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+package diskspace
+
+import "golang.org/x/sys/windows"
+
+// Free returns the bytes available to the current user on the volume
+// holding path.
+func Free(path string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
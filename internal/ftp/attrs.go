@@ -0,0 +1,65 @@
+package ftpclient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+
+	"gih-ftp/internal/logger"
+)
+
+// SetFileMode makes Upload change the mode of the uploaded file with SITE
+// CHMOD. Zero leaves the mode to the server.
+func (c *Client) SetFileMode(mode os.FileMode) {
+	c.fileMode = mode
+}
+
+// SetPreserveMTime makes Upload give the uploaded file the modification
+// time of the local file (MFMT).
+func (c *Client) SetPreserveMTime(enabled bool) {
+	c.preserveMTime = enabled
+}
+
+// setAttributes applies the configured mode and modification time of file
+// to remotePath. Servers without SITE CHMOD or MFMT are only warned about;
+// a refused change fails the upload.
+func (c *Client) setAttributes(conn *ftp.ServerConn, control net.Conn, file *os.File, remotePath string) error {
+	if c.fileMode != 0 {
+		cmd := fmt.Sprintf("SITE CHMOD %o %s", c.fileMode.Perm(), remotePath)
+		if _, err := fmt.Fprintf(control, "%s\r\n", cmd); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", remotePath, err)
+		}
+		code, reply, err := readReply(control)
+		switch {
+		case err != nil:
+			return fmt.Errorf("failed to set mode of %s: %w", remotePath, err)
+		case code == 500 || code == 502 || code == 504:
+			logger.Warn("FTP server does not support SITE CHMOD, mode not set",
+				"remote_path", remotePath,
+				"reply", strings.TrimSpace(string(reply)))
+		case code/100 != 2:
+			return fmt.Errorf("failed to set mode of %s: %s", remotePath, strings.TrimSpace(string(reply)))
+		default:
+			logger.Debug("Remote file mode set", "remote_path", remotePath, "mode", fmt.Sprintf("%04o", c.fileMode.Perm()))
+		}
+	}
+
+	if c.preserveMTime {
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat local file: %w", err)
+		}
+		if !conn.IsSetTimeSupported() {
+			logger.Warn("FTP server does not support MFMT, modification time not set", "remote_path", remotePath)
+			return nil
+		}
+		if err := conn.SetTime(remotePath, info.ModTime()); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", remotePath, err)
+		}
+		logger.Debug("Remote modification time set", "remote_path", remotePath, "mtime", info.ModTime())
+	}
+	return nil
+}
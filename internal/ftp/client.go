@@ -1,20 +1,51 @@
 package ftpclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"gih-ftp/internal/logger"
+	"gih-ftp/internal/proxy"
+	"gih-ftp/internal/remotepath"
+	"gih-ftp/internal/transfer"
 
 	"github.com/jlaffaye/ftp"
 )
 
+// ErrVerifyFailed is returned when the uploaded file does not match the
+// local file.
+var ErrVerifyFailed = errors.New("upload verification failed")
+
+// ErrLogin is returned when the server rejects the user or password.
+var ErrLogin = errors.New("FTP login failed")
+
+// TempSuffix is appended to the remote name while an atomic upload is in
+// progress.
+const TempSuffix = ".part"
+
 type Client struct {
-	host     string
-	user     string
-	password string
+	host       string
+	user       string
+	password   string
+	verifySize bool
+	atomic     bool
+	resume     bool
+	dialer     proxy.Dialer
+	limiter    *transfer.Limiter
+
+	mode        string
+	disableEPSV bool
+	activePorts [2]int
+	dataTimeout time.Duration
+
+	fileMode      os.FileMode
+	preserveMTime bool
 }
 
 func NewClient(host, user, password string) *Client {
@@ -22,27 +53,48 @@ func NewClient(host, user, password string) *Client {
 		host:     host,
 		user:     user,
 		password: password,
+		mode:     ModePassive,
 	}
 }
 
-func (c *Client) Upload(localPath, remotePath string) error {
+// SetDialer routes the control and data connections through d, e.g. a
+// proxy dialer.
+func (c *Client) SetDialer(d proxy.Dialer) {
+	c.dialer = d
+}
+
+// SetRateLimiter paces uploads with l; nil disables the limit.
+func (c *Client) SetRateLimiter(l *transfer.Limiter) {
+	c.limiter = l
+}
+
+// SetVerifySize makes Upload compare the remote file size (FTP SIZE) with
+// the local file after the transfer.
+func (c *Client) SetVerifySize(enabled bool) {
+	c.verifySize = enabled
+}
+
+// SetAtomic makes Upload write to <remotePath>.part and rename it to the
+// final name only after the transfer (and verification) succeeded, so
+// consumers never see a truncated file under the final name.
+func (c *Client) SetAtomic(enabled bool) {
+	c.atomic = enabled
+}
+
+// Upload copies localPath to remotePath. When ctx is done the transfer is
+// aborted and the partially stored remote file is deleted.
+func (c *Client) Upload(ctx context.Context, localPath, remotePath string) error {
 	logger.Info("Starting FTP upload",
 		"local_file", localPath,
 		"remote_path", remotePath,
 		"host", c.host,
 	)
 
-	conn, err := ftp.Dial(c.host,
-		ftp.DialWithTimeout(10*time.Second),
-	)
+	conn, control, err := c.login(ctx)
 	if err != nil {
-		return fmt.Errorf("FTP connect failed: %w", err)
-	}
-	defer conn.Quit()
-
-	if err := conn.Login(c.user, c.password); err != nil {
-		return fmt.Errorf("FTP login failed: %w", err)
+		return err
 	}
+	defer func() { conn.Quit() }()
 
 	file, err := os.Open(localPath)
 	if err != nil {
@@ -50,11 +102,88 @@ func (c *Client) Upload(localPath, remotePath string) error {
 	}
 	defer file.Close()
 
-	remoteDir := remotePath[:len(remotePath)-len(filepath.Base(remotePath))]
-	conn.MakeDir(remoteDir)
+	remoteDir := remotepath.Dir(remotePath)
+	if err := ensureDir(conn, remoteDir); err != nil {
+		return err
+	}
+
+	uploadPath := remotePath
+	if c.atomic {
+		uploadPath = remotePath + TempSuffix
+	}
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	var offset int64
+	if c.resume {
+		offset = resumeOffset(conn, file, uploadPath, size)
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.store(ctx, conn, file, uploadPath, offset, size)
+		if err == nil {
+			break
+		}
+		if offset > 0 && restUnsupported(err) {
+			logger.Warn("FTP server does not support resuming, starting over", "remote_path", uploadPath, "error", err)
+			offset = 0
+			continue
+		}
+		if !c.resume || ctx.Err() != nil || attempt > resumeAttempts {
+			if !c.resume && (c.atomic || ctx.Err() != nil) {
+				conn.Delete(uploadPath)
+			}
+			return fmt.Errorf("FTP upload failed: %w", err)
+		}
+
+		logger.Warn("FTP upload interrupted, resuming",
+			"remote_path", uploadPath,
+			"attempt", attempt,
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("FTP upload failed: %w", err)
+		case <-time.After(resumeDelay):
+		}
 
-	if err := conn.Stor(remotePath, file); err != nil {
-		return fmt.Errorf("FTP upload failed: %w", err)
+		// conn is only replaced on success: the deferred Quit needs a
+		// connection
+		conn.Quit()
+		newConn, newControl, err := c.login(ctx)
+		if err != nil {
+			return err
+		}
+		conn, control = newConn, newControl
+		offset = resumeOffset(conn, file, uploadPath, size)
+	}
+
+	if c.verifySize {
+		if err := verifySize(conn, file, uploadPath); err != nil {
+			if c.atomic {
+				conn.Delete(uploadPath)
+			}
+			return err
+		}
+	}
+
+	// Before the rename, so the final name never has other attributes
+	if err := c.setAttributes(conn, control, file, uploadPath); err != nil {
+		if c.atomic {
+			conn.Delete(uploadPath)
+		}
+		return err
+	}
+
+	if c.atomic {
+		// Many servers refuse to rename over an existing file
+		conn.Delete(remotePath)
+		if err := conn.Rename(uploadPath, remotePath); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", uploadPath, remotePath, err)
+		}
+		logger.Debug("Renamed temporary upload", "from", uploadPath, "to", remotePath)
 	}
 
 	logger.Info("FTP upload completed successfully",
@@ -63,3 +192,209 @@ func (c *Client) Upload(localPath, remotePath string) error {
 
 	return nil
 }
+
+// store sends file from offset on to remotePath, appending to the partial
+// remote file when offset is not zero.
+func (c *Client) store(ctx context.Context, conn *ftp.ServerConn, file *os.File, remotePath string, offset, size int64) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	var src io.Reader = &contextReader{ctx: ctx, r: file}
+	src = transfer.Progress(c.limiter.Reader(src), file.Name(), size-offset)
+
+	if offset == 0 {
+		return conn.Stor(remotePath, src)
+	}
+	logger.Info("Resuming FTP upload",
+		"remote_path", remotePath,
+		"offset", offset,
+		"remaining_bytes", size-offset,
+	)
+	return conn.StorFrom(remotePath, src, uint64(offset))
+}
+
+func verifySize(conn *ftp.ServerConn, file *os.File, remotePath string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	remoteSize, err := conn.FileSize(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to get remote file size: %w", err)
+	}
+	if remoteSize != info.Size() {
+		return fmt.Errorf("%w: remote size %d, local size %d", ErrVerifyFailed, remoteSize, info.Size())
+	}
+
+	logger.Debug("Remote file size verified", "size_bytes", remoteSize)
+	return nil
+}
+
+// ensureDir creates dir and its missing parents. FTP has no recursive
+// MKD, so every segment is created in turn. A segment whose MKD fails is
+// accepted only if it can be entered, i.e. it already exists as a
+// directory; otherwise the error names the segment.
+func ensureDir(conn *ftp.ServerConn, dir string) error {
+	cwd, err := conn.CurrentDir()
+	if err != nil {
+		return fmt.Errorf("failed to get remote working directory: %w", err)
+	}
+
+	for _, current := range remotepath.Prefixes(dir) {
+		mkdirErr := conn.MakeDir(current)
+		if mkdirErr == nil {
+			continue
+		}
+		if err := conn.ChangeDir(current); err != nil {
+			return fmt.Errorf("failed to create remote directory %s: %w", current, mkdirErr)
+		}
+		if err := conn.ChangeDir(cwd); err != nil {
+			return fmt.Errorf("failed to return to remote directory %s: %w", cwd, err)
+		}
+	}
+	return nil
+}
+
+// VerifyWritable logs in and checks that remoteDir accepts uploads by
+// storing and deleting a small probe file.
+func (c *Client) VerifyWritable(ctx context.Context, remoteDir string) error {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	if err := ensureDir(conn, remoteDir); err != nil {
+		return err
+	}
+
+	probePath := remotepath.Join(remoteDir, fmt.Sprintf(".gihftp-check-%d", time.Now().UnixNano()))
+	probe := &contextReader{ctx: ctx, r: strings.NewReader("gihftp connectivity check\n")}
+	if err := conn.Stor(probePath, probe); err != nil {
+		return fmt.Errorf("remote directory not writable: %w", err)
+	}
+
+	if err := conn.Delete(probePath); err != nil {
+		return fmt.Errorf("failed to remove probe file %s: %w", probePath, err)
+	}
+
+	logger.Info("FTP connection verified successfully", "host", c.host)
+	return nil
+}
+
+// Prune walks remoteDir and deletes every file for which expired returns
+// true, or moves it into archiveDir when archiveDir is set. archiveDir
+// itself is not walked. It returns the paths of the files handled.
+func (c *Client) Prune(ctx context.Context, remoteDir string, expired func(name string) bool, archiveDir string) ([]string, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	var old []string
+	walker := conn.Walk(remoteDir)
+	for walker.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", walker.Path(), err)
+		}
+		entry := walker.Stat()
+		if entry.Type == ftp.EntryTypeFolder {
+			if archiveDir != "" && remotepath.Clean(walker.Path()) == remotepath.Clean(archiveDir) {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if entry.Type == ftp.EntryTypeFile && expired(entry.Name) {
+			old = append(old, walker.Path())
+		}
+	}
+
+	if archiveDir != "" && len(old) > 0 {
+		if err := ensureDir(conn, archiveDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var pruned []string
+	for _, remotePath := range old {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		if archiveDir != "" {
+			err = conn.Rename(remotePath, remotepath.Join(archiveDir, remotepath.Base(remotePath)))
+		} else {
+			err = conn.Delete(remotePath)
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune %s: %w", remotePath, err)
+		}
+		pruned = append(pruned, remotePath)
+	}
+
+	return pruned, nil
+}
+
+// connect dials and logs in. ctx bounds the control and data connections
+// dialed for the session.
+func (c *Client) connect(ctx context.Context) (*ftp.ServerConn, error) {
+	conn, _, err := c.login(ctx)
+	return conn, err
+}
+
+// login is connect that also returns the control connection, for commands
+// the library has no method for. They may only be sent while the library
+// waits for no reply.
+func (c *Client) login(ctx context.Context) (*ftp.ServerConn, net.Conn, error) {
+	dialer := &connDialer{ctx: ctx, client: c}
+	options := []ftp.DialOption{
+		ftp.DialWithDialFunc(dialer.dial),
+		ftp.DialWithDisabledEPSV(c.disableEPSV || c.mode == ModeActive),
+		ftp.DialWithShutTimeout(c.dataTimeout),
+	}
+
+	conn, err := ftp.Dial(c.host, options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("FTP connect failed: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Quit()
+		return nil, nil, fmt.Errorf("FTP connect failed: %w", err)
+	}
+
+	if err := conn.Login(c.user, c.password); err != nil {
+		conn.Quit()
+		return nil, nil, fmt.Errorf("%w: %w", ErrLogin, err)
+	}
+
+	return conn, dialer.conn, nil
+}
+
+// dialTCP opens a connection to address, through the proxy if one is set.
+func (c *Client) dialTCP(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if c.dialer != nil {
+		return c.dialer.DialContext(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// contextReader returns ctx.Err() once ctx is done, so Stor closes the data
+// connection instead of sending the rest of the file.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
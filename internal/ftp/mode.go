@@ -0,0 +1,351 @@
+package ftpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gih-ftp/internal/logger"
+)
+
+// Data connection modes.
+const (
+	ModePassive = "passive"
+	ModeActive  = "active"
+)
+
+// activeCloseWait bounds how long closing an unused active data connection
+// waits for the server to connect, e.g. after storing an empty file.
+const activeCloseWait = 5 * time.Second
+
+// SetMode selects passive (the client connects to the server) or active
+// (the server connects back to the client) data connections.
+func (c *Client) SetMode(mode string) {
+	c.mode = mode
+}
+
+// SetDisableEPSV makes passive mode use PASV only, for servers or
+// firewalls that mishandle EPSV.
+func (c *Client) SetDisableEPSV(disabled bool) {
+	c.disableEPSV = disabled
+}
+
+// SetActivePorts restricts the local ports listened on in active mode to
+// [min, max]; zero means any free port.
+func (c *Client) SetActivePorts(min, max int) {
+	c.activePorts = [2]int{min, max}
+}
+
+// SetDataTimeout aborts a data connection that makes no progress for d and
+// bounds how long active mode waits for the server to connect. Zero
+// disables the limit.
+func (c *Client) SetDataTimeout(d time.Duration) {
+	c.dataTimeout = d
+}
+
+// connDialer is the dial function of one FTP session. The library dials the
+// control connection first and every data connection after it. In active
+// mode the control connection turns PASV into PORT/EPRT and the data "dial"
+// returns the connection the server opens to our listener.
+type connDialer struct {
+	ctx     context.Context
+	client  *Client
+	dialed  bool
+	conn    net.Conn
+	control *activeControl
+}
+
+func (d *connDialer) dial(network, address string) (net.Conn, error) {
+	c := d.client
+	if !d.dialed {
+		conn, err := c.dialTCP(d.ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		d.dialed = true
+		d.conn = conn
+		if c.mode == ModeActive {
+			d.control = &activeControl{Conn: conn, client: c}
+			d.conn = d.control
+		}
+		return d.conn, nil
+	}
+
+	if d.control != nil {
+		return d.control.dataConn()
+	}
+	conn, err := c.dialTCP(d.ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return newDeadlineConn(conn, c.dataTimeout), nil
+}
+
+// activeControl is the control connection in active mode. The library only
+// speaks PASV (EPSV is disabled), so each PASV is answered locally: we
+// listen, announce the listener with PORT or EPRT and hand the library a 227
+// reply. The address in that reply is ignored by dataConn.
+type activeControl struct {
+	net.Conn
+	client *Client
+
+	reply   []byte
+	pending *activeDataConn
+}
+
+func (a *activeControl) Write(p []byte) (int, error) {
+	if !strings.EqualFold(strings.TrimSpace(string(p)), "PASV") {
+		return a.Conn.Write(p)
+	}
+
+	reply, err := a.port()
+	if err != nil {
+		return 0, err
+	}
+	a.reply = reply
+	return len(p), nil
+}
+
+func (a *activeControl) Read(p []byte) (int, error) {
+	if len(a.reply) > 0 {
+		n := copy(p, a.reply)
+		a.reply = a.reply[n:]
+		return n, nil
+	}
+	return a.Conn.Read(p)
+}
+
+// port opens a listener and announces it to the server. It returns the reply
+// the library reads in place of the PASV reply: a 227 on success or the
+// server's own error reply, which the library then reports.
+func (a *activeControl) port() ([]byte, error) {
+	local, ok := a.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("active FTP needs a direct TCP connection")
+	}
+	server, _ := a.Conn.RemoteAddr().(*net.TCPAddr)
+
+	listener, err := a.client.listen(local.IP)
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	var cmd string
+	if ip := local.IP.To4(); ip != nil {
+		cmd = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	} else {
+		cmd = fmt.Sprintf("EPRT |2|%s|%d|", local.IP, port)
+	}
+	if _, err := fmt.Fprintf(a.Conn, "%s\r\n", cmd); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	code, reply, err := readReply(a.Conn)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if code/100 != 2 {
+		listener.Close()
+		return reply, nil
+	}
+
+	logger.Debug("Waiting for active FTP data connection", "address", listener.Addr().String())
+	a.pending = &activeDataConn{listener: listener, timeout: a.client.dataTimeout}
+	if server != nil {
+		a.pending.server = server.IP
+	}
+	return []byte(fmt.Sprintf("227 Entering Passive Mode (0,0,0,0,%d,%d)\r\n", port>>8, port&0xff)), nil
+}
+
+func (a *activeControl) dataConn() (net.Conn, error) {
+	if a.pending == nil {
+		return nil, fmt.Errorf("active FTP data connection was not announced")
+	}
+	conn := a.pending
+	a.pending = nil
+	return conn, nil
+}
+
+// readReply reads one (possibly multi-line) reply byte by byte, so nothing
+// after it is consumed from the connection the library reads next.
+func readReply(r io.Reader) (int, []byte, error) {
+	var reply, line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		line = append(line, b[0])
+		if b[0] != '\n' {
+			continue
+		}
+
+		reply = append(reply, line...)
+		if len(line) >= 4 && line[3] == ' ' && string(line[:3]) == string(reply[:3]) {
+			break
+		}
+		line = line[:0]
+	}
+
+	code, err := strconv.Atoi(string(reply[:3]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid FTP reply: %q", strings.TrimSpace(string(reply)))
+	}
+	return code, reply, nil
+}
+
+// listen opens the active mode listener on ip, within the configured port
+// range if any. The range is probed from a random offset so consecutive
+// transfers do not wait on the same port.
+func (c *Client) listen(ip net.IP) (net.Listener, error) {
+	min, max := c.activePorts[0], c.activePorts[1]
+	if min == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+
+	size := max - min + 1
+	offset := rand.IntN(size)
+	for i := 0; i < size; i++ {
+		port := min + (offset+i)%size
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port for active FTP in %d-%d", min, max)
+}
+
+// activeDataConn is an active mode data connection. The server connects
+// only after the transfer command, so the connection is accepted on first
+// use.
+type activeDataConn struct {
+	listener net.Listener
+	server   net.IP
+	timeout  time.Duration
+
+	once sync.Once
+	conn net.Conn
+	err  error
+}
+
+func (a *activeDataConn) accept(wait time.Duration) error {
+	a.once.Do(func() {
+		defer a.listener.Close()
+		if l, ok := a.listener.(*net.TCPListener); ok && wait > 0 {
+			l.SetDeadline(time.Now().Add(wait))
+		}
+
+		for {
+			conn, err := a.listener.Accept()
+			if err != nil {
+				a.err = fmt.Errorf("waiting for active FTP data connection: %w", err)
+				return
+			}
+			// Only the server may connect; anyone else could inject or
+			// steal the file
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && a.server != nil && !addr.IP.Equal(a.server) {
+				logger.Warn("Rejected FTP data connection from unexpected address", "address", addr.String())
+				conn.Close()
+				continue
+			}
+			a.conn = newDeadlineConn(conn, a.timeout)
+			return
+		}
+	})
+	return a.err
+}
+
+func (a *activeDataConn) Read(p []byte) (int, error) {
+	if err := a.accept(a.timeout); err != nil {
+		return 0, err
+	}
+	return a.conn.Read(p)
+}
+
+func (a *activeDataConn) Write(p []byte) (int, error) {
+	if err := a.accept(a.timeout); err != nil {
+		return 0, err
+	}
+	return a.conn.Write(p)
+}
+
+// Close accepts a connection nothing was read from or written to (an empty
+// file), since the server does not finish the transfer until it connected.
+func (a *activeDataConn) Close() error {
+	wait := activeCloseWait
+	if a.timeout > 0 && a.timeout < wait {
+		wait = a.timeout
+	}
+	if err := a.accept(wait); err != nil {
+		return err
+	}
+	return a.conn.Close()
+}
+
+func (a *activeDataConn) LocalAddr() net.Addr {
+	return a.listener.Addr()
+}
+
+func (a *activeDataConn) RemoteAddr() net.Addr {
+	if a.conn != nil {
+		return a.conn.RemoteAddr()
+	}
+	return &net.TCPAddr{IP: a.server}
+}
+
+func (a *activeDataConn) SetDeadline(t time.Time) error {
+	if err := a.accept(a.timeout); err != nil {
+		return err
+	}
+	return a.conn.SetDeadline(t)
+}
+
+func (a *activeDataConn) SetReadDeadline(t time.Time) error {
+	if err := a.accept(a.timeout); err != nil {
+		return err
+	}
+	return a.conn.SetReadDeadline(t)
+}
+
+func (a *activeDataConn) SetWriteDeadline(t time.Time) error {
+	if err := a.accept(a.timeout); err != nil {
+		return err
+	}
+	return a.conn.SetWriteDeadline(t)
+}
+
+// deadlineConn fails a Read or Write that makes no progress for timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newDeadlineConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, timeout: timeout}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,84 @@
+package ftpclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+	"os"
+	"time"
+
+	"gih-ftp/internal/logger"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// resumeAttempts is how often one upload reconnects and continues after
+// the transfer broke off; resumeDelay is the pause before each attempt.
+const (
+	resumeAttempts = 3
+	resumeDelay    = 2 * time.Second
+)
+
+// resumeCheckSize is how many bytes before the resume offset are compared
+// with the local file, so a partial upload of a different file is not
+// continued.
+const resumeCheckSize = 64 * 1024
+
+// SetResume makes Upload continue a partial remote file (REST + STOR)
+// instead of starting over: a partial left by an earlier run, and the
+// current transfer when the connection drops. Partial files are kept on
+// failure so a later run can continue them.
+func (c *Client) SetResume(enabled bool) {
+	c.resume = enabled
+}
+
+// resumeOffset returns how many bytes of the local file are already stored
+// in remotePath, or 0 when the upload has to start over.
+func resumeOffset(conn *ftp.ServerConn, file *os.File, remotePath string, size int64) int64 {
+	remoteSize, err := conn.FileSize(remotePath)
+	if err != nil || remoteSize <= 0 {
+		return 0
+	}
+	if remoteSize >= size {
+		logger.Debug("Remote partial upload is not shorter than the local file, starting over",
+			"remote_path", remotePath,
+			"remote_size", remoteSize,
+			"local_size", size,
+		)
+		return 0
+	}
+
+	checkSize := min(remoteSize, resumeCheckSize)
+	local := make([]byte, checkSize)
+	if _, err := file.ReadAt(local, remoteSize-checkSize); err != nil {
+		return 0
+	}
+
+	resp, err := conn.RetrFrom(remotePath, uint64(remoteSize-checkSize))
+	if err != nil {
+		logger.Debug("Failed to read remote partial upload, starting over", "remote_path", remotePath, "error", err)
+		return 0
+	}
+	remote, err := io.ReadAll(io.LimitReader(resp, checkSize))
+	resp.Close()
+	if err != nil || !bytes.Equal(local, remote) {
+		logger.Warn("Remote partial upload differs from the local file, starting over", "remote_path", remotePath)
+		return 0
+	}
+
+	return remoteSize
+}
+
+// restUnsupported reports whether err is a server rejecting REST.
+func restUnsupported(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	switch protoErr.Code {
+	case ftp.StatusBadCommand, ftp.StatusNotImplemented, ftp.StatusNotImplementedParameter:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package gihapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Auth describes credentials sent with every API request. With an empty
+// Header the token is sent as "Authorization: Bearer <token>"; otherwise it
+// is sent verbatim in the named header (e.g. X-API-Key).
+type Auth struct {
+	Token  string
+	Header string
+}
+
+func (a Auth) apply(req *http.Request) {
+	if a.Token == "" {
+		return
+	}
+	if a.Header == "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		return
+	}
+	req.Header.Set(a.Header, a.Token)
+}
+
+// SetAuth sets the credentials used for servers without their own override.
+func (c *Client) SetAuth(auth Auth) {
+	c.auth = auth
+}
+
+// SetServerAuth overrides the credentials used for a single host.
+func (c *Client) SetServerAuth(host string, auth Auth) {
+	if c.serverAuth == nil {
+		c.serverAuth = make(map[string]Auth)
+	}
+	c.serverAuth[strings.ToLower(host)] = auth
+}
+
+func (c *Client) authFor(host string) Auth {
+	if auth, ok := c.serverAuth[strings.ToLower(host)]; ok {
+		return auth
+	}
+	return c.auth
+}
@@ -1,16 +1,24 @@
 package gihapi
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"gih-ftp/internal/logger"
+	"gih-ftp/internal/transfer"
 )
 
 type LogFile struct {
@@ -18,12 +26,16 @@ type LogFile struct {
 	Filename    string `json:"filename"`
 	DownloadURL string `json:"download_url"`
 	Size        int    `json:"size"`
+
+	// Checksum is "sha256:<hex>", reported from schema version 2 on
+	Checksum string `json:"checksum,omitempty"`
 }
 
 type APIResponse struct {
-	Status  bool   `json:"status"`
-	Message string `json:"message"`
-	Data    struct {
+	Status        bool   `json:"status"`
+	Message       string `json:"message"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	Data          struct {
 		Count     int       `json:"count"`
 		StartDate string    `json:"start_date"`
 		EndDate   string    `json:"end_date"`
@@ -33,16 +45,94 @@ type APIResponse struct {
 
 type Client struct {
 	httpClient         *http.Client
+	opts               Options
+	serverClients      map[string]*http.Client
 	insecureSkipVerify bool
+	retry              RetryPolicy
+	auth               Auth
+	serverAuth         map[string]Auth
+	limiter            *transfer.Limiter
+	trace              bool
+}
+
+// Options configures the HTTP transport used to reach GIH servers.
+type Options struct {
+	InsecureSkipVerify bool
+
+	// CACert is a PEM bundle and CADir a directory of PEM files appended
+	// to the system roots.
+	CACert string
+	CADir  string
+
+	// ClientCert and ClientKey enable mutual TLS when both are set.
+	ClientCert string
+	ClientKey  string
+
+	// Proxy is an http://, https:// or socks5:// proxy URL. When empty the
+	// HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables apply.
+	Proxy string
+
+	// Connection timeouts; zero disables each one. There is no overall
+	// request timeout, so a large download is only bounded by its context.
+	DialTimeout     time.Duration
+	TLSTimeout      time.Duration
+	ResponseTimeout time.Duration
+	IdleTimeout     time.Duration
 }
 
-func NewClient(insecureSkipVerify bool) *Client {
+func NewClient(opts Options) (*Client, error) {
+	if opts.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification is DISABLED - this is insecure!")
+	}
+
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+		opts:               opts,
+		insecureSkipVerify: opts.InsecureSkipVerify,
+		retry:              DefaultRetryPolicy(),
+	}, nil
+}
+
+// SetServerCACert makes requests to host trust the PEM bundle caCert, on
+// top of the system roots, instead of Options.CACert and CADir. The other
+// options are shared with the rest of the servers.
+func (c *Client) SetServerCACert(host, caCert string) error {
+	opts := c.opts
+	opts.CACert, opts.CADir = caCert, ""
+	transport, err := newTransport(opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", host, err)
+	}
+	if c.serverClients == nil {
+		c.serverClients = make(map[string]*http.Client)
+	}
+	c.serverClients[strings.ToLower(host)] = &http.Client{Transport: transport}
+	return nil
+}
+
+// httpClientFor returns the client for requests to host.
+func (c *Client) httpClientFor(host string) *http.Client {
+	if client, ok := c.serverClients[strings.ToLower(host)]; ok {
+		return client
+	}
+	return c.httpClient
+}
+
+// newTransport returns the HTTP transport configured by opts.
+func newTransport(opts Options) (*http.Transport, error) {
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: insecureSkipVerify,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
 	}
 
 	// Try to load system CA certificates if not skipping verification
-	if !insecureSkipVerify {
+	if !opts.InsecureSkipVerify {
 		if certPool, err := x509.SystemCertPool(); err == nil {
 			tlsConfig.RootCAs = certPool
 		} else {
@@ -50,35 +140,126 @@ func NewClient(insecureSkipVerify bool) *Client {
 		}
 	}
 
-	if insecureSkipVerify {
-		logger.Warn("TLS certificate verification is DISABLED - this is insecure!")
+	if opts.CACert != "" || opts.CADir != "" {
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+	}
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CACert)
+		}
+		logger.Debug("Loaded custom CA bundle", "file", opts.CACert)
+	}
+	if opts.CADir != "" {
+		if err := appendCADir(tlsConfig.RootCAs, opts.CADir); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		if opts.ClientCert == "" || opts.ClientKey == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		logger.Debug("Loaded client certificate for mutual TLS", "file", opts.ClientCert)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
 	}
 
+	// A custom TLS config turns off HTTP/2 unless it is asked for; servers
+	// without it still get HTTP/1.1 through ALPN.
 	transport := &http.Transport{
-		TLSClientConfig:     tlsConfig,
-		MaxIdleConns:        10,
-		IdleConnTimeout:     30 * time.Second,
-		DisableCompression:  false,
-		DisableKeepAlives:   false,
-		MaxIdleConnsPerHost: 2,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   opts.TLSTimeout,
+		ResponseHeaderTimeout: opts.ResponseTimeout,
+		IdleConnTimeout:       opts.IdleTimeout,
+		MaxIdleConns:          10,
+		MaxIdleConnsPerHost:   8,
+		DisableCompression:    false,
+		DisableKeepAlives:     false,
+		Proxy:                 http.ProxyFromEnvironment,
 	}
 
-	return &Client{
-		httpClient: &http.Client{
-			Timeout:   30 * time.Second,
-			Transport: transport,
-		},
-		insecureSkipVerify: insecureSkipVerify,
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		logger.Debug("Using proxy for GIH API", "proxy", proxyURL.Redacted())
+	}
+	return transport, nil
+}
+
+// appendCADir adds the certificates of every PEM file in dir to pool. Files
+// without certificates (keys, READMEs) are skipped, but the directory must
+// provide at least one.
+func appendCADir(pool *x509.CertPool, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read CA directory: %w", err)
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		// Follows symlinks, e.g. c_rehash links
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Debug("No certificates in file, skipping", "file", path)
+			continue
+		}
+		logger.Debug("Loaded custom CA certificate", "file", path)
+		loaded++
+	}
+
+	if loaded == 0 {
+		return fmt.Errorf("no certificates found in CA directory %s", dir)
 	}
+	return nil
+}
+
+// SetRetryPolicy replaces the retry policy used for all API requests.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	c.retry = policy
+}
+
+// SetRateLimiter paces file downloads with l; nil disables the limit. API
+// listing requests are not limited.
+func (c *Client) SetRateLimiter(l *transfer.Limiter) {
+	c.limiter = l
 }
 
-func (c *Client) FetchLogFiles(host, port, startDate, endDate string) ([]LogFile, error) {
-	apiURL := fmt.Sprintf("https://%s:%s/api/dns/query/logs?start=%s&end=%s",
-		host, port, startDate, endDate)
+func (c *Client) FetchLogFiles(ctx context.Context, server Server, startDate, endDate string) ([]LogFile, error) {
+	apiURL := fmt.Sprintf("%s/api/dns/query/logs?start=%s&end=%s",
+		server.BaseURL(), startDate, endDate)
 
 	logger.Debug("Fetching log files", "url", apiURL)
 
-	respBytes, err := c.httpGet(apiURL)
+	respBytes, err := c.httpGet(ctx, apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("API request failed: %w", err)
 	}
@@ -92,22 +273,36 @@ func (c *Client) FetchLogFiles(host, port, startDate, endDate string) ([]LogFile
 		return nil, fmt.Errorf("API returned error: %s", apiResp.Message)
 	}
 
+	// Fields added by a newer schema are ignored; the ones validated here
+	// are still required.
+	if apiResp.version() > SupportedSchemaVersion {
+		logger.Warn("GIH API schema version is newer than supported",
+			"host", server.Name,
+			"schema_version", apiResp.version(),
+			"supported_version", SupportedSchemaVersion,
+		)
+	}
+	if err := apiResp.validate(); err != nil {
+		return nil, fmt.Errorf("invalid API response (schema version %d): %w", apiResp.version(), err)
+	}
+
 	logger.Info("Fetched log files",
-		"host", host,
+		"host", server.Name,
 		"count", apiResp.Data.Count,
 		"start_date", apiResp.Data.StartDate,
 		"end_date", apiResp.Data.EndDate,
+		"schema_version", apiResp.version(),
 	)
 
 	return apiResp.Data.Files, nil
 }
 
-func (c *Client) DownloadFile(host, port, downloadURL string) ([]byte, error) {
-	fullURL := fmt.Sprintf("https://%s:%s%s", host, port, downloadURL)
+func (c *Client) DownloadFile(ctx context.Context, server Server, downloadURL string) ([]byte, error) {
+	fullURL := server.BaseURL() + downloadURL
 
 	logger.Debug("Downloading file", "url", fullURL)
 
-	content, err := c.httpGet(fullURL)
+	content, err := c.httpGet(ctx, fullURL)
 	if err != nil {
 		return nil, fmt.Errorf("download failed: %w", err)
 	}
@@ -117,19 +312,183 @@ func (c *Client) DownloadFile(host, port, downloadURL string) ([]byte, error) {
 	return content, nil
 }
 
-func (c *Client) httpGet(url string) ([]byte, error) {
-	resp, err := c.httpClient.Get(url)
+// DownloadFileStream opens a download and returns the response body without
+// buffering it, so large files can be consumed as they arrive. The caller
+// must close the returned reader.
+func (c *Client) DownloadFileStream(ctx context.Context, server Server, downloadURL string) (io.ReadCloser, error) {
+	body, _, err := c.openDownload(ctx, server, downloadURL, Validators{})
+	return body, err
+}
+
+// openDownload is DownloadFileStream with a conditional GET when since is
+// not zero. It also returns the validators of the response.
+func (c *Client) openDownload(ctx context.Context, server Server, downloadURL string, since Validators) (io.ReadCloser, Validators, error) {
+	fullURL := server.BaseURL() + downloadURL
+
+	logger.Debug("Streaming file", "url", fullURL)
+
+	resp, err := c.httpGetStream(ctx, fullURL, since)
+	if err != nil {
+		if errors.Is(err, ErrNotModified) {
+			return nil, Validators{}, err
+		}
+		return nil, Validators{}, fmt.Errorf("download failed: %w", err)
+	}
+
+	body := resp.Body
+	if c.limiter != nil {
+		body = limitedBody{Reader: c.limiter.Reader(body), Closer: body}
+	}
+	return body, validatorsOf(resp), nil
+}
+
+// Download streams file into store after verifying its size and checksum.
+// store must read the reader to the end and must not keep anything when
+// reading fails. A truncated transfer is downloaded again according to the
+// retry policy; truncated counts those transfers.
+func (c *Client) Download(ctx context.Context, server Server, file LogFile, store func(io.Reader) error) (truncated int, err error) {
+	return c.DownloadIfModified(ctx, server, file, Validators{}, func(r io.Reader, _ Validators) error {
+		return store(r)
+	})
+}
+
+// DownloadIfModified is Download with a conditional GET: when since is not
+// zero and the server reports the file unchanged, ErrNotModified is
+// returned without calling store. store receives the validators of the
+// version it reads, to be passed as since next time.
+func (c *Client) DownloadIfModified(ctx context.Context, server Server, file LogFile, since Validators, store func(io.Reader, Validators) error) (truncated int, err error) {
+	for attempt := 1; ; attempt++ {
+		body, validators, err := c.openDownload(ctx, server, file.DownloadURL, since)
+		if err != nil {
+			return truncated, err
+		}
+		err = store(file.Verify(body), validators)
+		body.Close()
+		if !errors.Is(err, ErrSizeMismatch) {
+			return truncated, err
+		}
+
+		truncated++
+		if attempt >= c.retry.Attempts || ctx.Err() != nil {
+			return truncated, err
+		}
+
+		delay := c.retry.delay(attempt)
+		logger.Warn("Truncated download, downloading again",
+			"host", server.Name,
+			"filename", file.Filename,
+			"attempt", attempt+1,
+			"max_attempts", c.retry.Attempts,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return truncated, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) httpGet(ctx context.Context, url string) ([]byte, error) {
+	resp, err := c.httpGetStream(ctx, url, Validators{})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	return io.ReadAll(resp.Body)
+}
+
+// httpGetStream issues a GET, retrying according to the client's retry
+// policy until a 200 response is received. Only establishing the response
+// is retried; errors while reading the body are left to the caller.
+// Cancelling ctx aborts both the request and any pending retry delay. The
+// request is conditional on since, see Validators.
+func (c *Client) httpGetStream(ctx context.Context, url string, since Validators) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 1; attempt <= c.retry.Attempts; attempt++ {
+		if attempt > 1 {
+			delay := c.retry.delay(attempt - 1)
+			logger.Debug("Retrying API request",
+				"url", url,
+				"attempt", attempt,
+				"max_attempts", c.retry.Attempts,
+				"delay", delay.String(),
+				"error", lastErr,
+			)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		resp, err := c.doGet(ctx, url, since, attempt)
+		if err == nil {
+			return resp, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil || !isRetryable(err) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// doGet issues one GET; attempt is its number, counting retries, for the
+// request trace.
+func (c *Client) doGet(ctx context.Context, url string, since Validators, attempt int) (*http.Response, error) {
+	var trace *requestTrace
+	if c.trace {
+		trace = newRequestTrace()
+		ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := c.authFor(req.URL.Hostname())
+	auth.apply(req)
+	since.apply(req)
+
+	resp, err := c.httpClientFor(req.URL.Hostname()).Do(req)
+	if err != nil {
+		if trace != nil {
+			trace.log(req, attempt, auth, nil, nil, err)
+		}
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		if trace != nil {
+			trace.log(req, attempt, auth, resp, body, nil)
+		}
+		return nil, &statusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
-	return io.ReadAll(resp.Body)
+	if trace != nil {
+		trace.log(req, attempt, auth, resp, nil, nil)
+	}
+	return resp, nil
+}
+
+// limitedBody reads through a rate limiter and closes the response body.
+type limitedBody struct {
+	io.Reader
+	io.Closer
 }
 
 func GetLastWeekDates() (startDate, endDate string) {
@@ -160,14 +519,7 @@ func GetDateRange(daysBack int) (startDate, endDate string) {
 
 func (c *Client) Close() {
 	c.httpClient.CloseIdleConnections()
-}
-
-// EnableDebugLogging enables HTTP request/response debugging
-func (c *Client) EnableDebugLogging() {
-	if file, err := os.OpenFile("/tmp/gihftp-http-debug.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
-		transport := c.httpClient.Transport.(*http.Transport)
-		transport.Proxy = http.ProxyFromEnvironment
-		// Note: For full request/response logging, consider using httputil.DumpRequest/DumpResponse
-		logger.Info("HTTP debug logging enabled", "logfile", file.Name())
+	for _, client := range c.serverClients {
+		client.CloseIdleConnections()
 	}
 }
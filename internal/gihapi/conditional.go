@@ -0,0 +1,40 @@
+package gihapi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNotModified is returned by a conditional download when the server
+// reports that the file has not changed since it was last downloaded
+// (HTTP 304).
+var ErrNotModified = errors.New("not modified")
+
+// Validators identify the version of a downloaded file by the ETag and
+// Last-Modified response headers. Either may be empty.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// IsZero reports whether the server sent neither header.
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// apply makes req conditional on the file having changed.
+func (v Validators) apply(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+func validatorsOf(resp *http.Response) Validators {
+	return Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
@@ -0,0 +1,60 @@
+package gihapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Discover resolves the DNS record name into GIH servers. A name whose
+// first label starts with an underscore, such as _gihapi._tcp.example.com,
+// is an SRV record: every target becomes a server with the record's port.
+// Any other name is a TXT record whose strings list server entries in the
+// --gih-servers syntax, separated by commas or spaces. Servers without a
+// scheme or port of their own get those of defaults.
+func Discover(ctx context.Context, resolver *net.Resolver, name string, defaults Defaults) ([]Server, error) {
+	var entries []string
+	if strings.HasPrefix(name, "_") {
+		_, records, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("SRV lookup of %s failed: %w", name, err)
+		}
+		for _, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			if host == "" {
+				// "." means the service is not available at this domain
+				continue
+			}
+			entry := host
+			if _, defaultPort := defaults(host); fmt.Sprint(r.Port) != defaultPort {
+				entry = net.JoinHostPort(host, fmt.Sprint(r.Port))
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		records, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("TXT lookup of %s failed: %w", name, err)
+		}
+		for _, r := range records {
+			entries = append(entries, strings.FieldsFunc(r, func(c rune) bool {
+				return c == ',' || c == ' ' || c == '\t'
+			})...)
+		}
+	}
+
+	var servers []Server
+	for _, entry := range entries {
+		server, err := ParseServerWith(entry, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		servers = append(servers, server)
+	}
+
+	// Keep the order stable between runs; SRV answers are shuffled
+	sort.Slice(servers, func(i, k int) bool { return servers[i].Name < servers[k].Name })
+	return servers, nil
+}
@@ -0,0 +1,87 @@
+package gihapi
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how failed API requests are retried. Attempts is the
+// total number of tries, so 1 disables retrying. Each delay doubles the
+// previous one, capped at MaxDelay, and is randomized by +/- Jitter
+// (a fraction between 0 and 1).
+type RetryPolicy struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Jitter       float64
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:     3,
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     30 * time.Second,
+		Jitter:       0.2,
+	}
+}
+
+// delay returns the wait before the given retry (1 for the first retry).
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < retry && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		spread := float64(d) * p.Jitter
+		d = time.Duration(float64(d) + (rand.Float64()*2-1)*spread)
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	return d
+}
+
+// ErrUnauthorized is returned when the server rejects the credentials
+// (HTTP 401 or 403).
+var ErrUnauthorized = errors.New("unauthorized")
+
+// statusError is returned for non-200 responses.
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *statusError) Unwrap() error {
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		return ErrUnauthorized
+	}
+	if e.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+	return nil
+}
+
+// isRetryable reports whether a failed request may succeed when repeated.
+// Transport errors, throttling and server errors are retried; other client
+// errors are not.
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests ||
+			se.StatusCode == http.StatusRequestTimeout ||
+			se.StatusCode >= 500
+	}
+	return true
+}
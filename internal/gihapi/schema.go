@@ -0,0 +1,118 @@
+package gihapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// SupportedSchemaVersion is the newest response schema this client knows.
+// Version 1 responses carry no schema_version field; version 2 adds a
+// checksum to every file.
+const SupportedSchemaVersion = 2
+
+// ErrSizeMismatch is returned when a download is shorter or longer than the
+// size reported by the server, usually because the transfer was cut off.
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// ErrChecksumMismatch is returned when a downloaded file does not match the
+// checksum reported by the server.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// version returns the schema version of the response.
+func (r *APIResponse) version() int {
+	if r.SchemaVersion == 0 {
+		return 1
+	}
+	return r.SchemaVersion
+}
+
+// validate checks that every file carries the fields required by the
+// response's schema version.
+func (r *APIResponse) validate() error {
+	for i, file := range r.Data.Files {
+		switch {
+		case file.Filename == "":
+			return fmt.Errorf("file %d: missing filename", i)
+		case file.DownloadURL == "":
+			return fmt.Errorf("file %s: missing download_url", file.Filename)
+		case file.Size < 0:
+			return fmt.Errorf("file %s: negative size %d", file.Filename, file.Size)
+		case file.Checksum == "" && r.version() >= 2:
+			return fmt.Errorf("file %s: missing checksum (schema version %d)", file.Filename, r.version())
+		}
+		if file.Checksum != "" {
+			if _, err := parseChecksum(file.Checksum); err != nil {
+				return fmt.Errorf("file %s: %w", file.Filename, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseChecksum decodes a "sha256:<hex>" or bare hex SHA256 checksum.
+func parseChecksum(checksum string) ([]byte, error) {
+	algorithm, digest, found := strings.Cut(checksum, ":")
+	if !found {
+		algorithm, digest = "sha256", checksum
+	}
+	if !strings.EqualFold(algorithm, "sha256") {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid sha256 checksum %q", digest)
+	}
+	return sum, nil
+}
+
+// Verify returns r wrapped so that reading it to the end fails with
+// ErrSizeMismatch when the byte count differs from the reported size, or
+// with ErrChecksumMismatch when the content differs from the reported
+// checksum. A zero size is treated as not reported.
+func (f LogFile) Verify(r io.Reader) io.Reader {
+	v := &verifyingReader{r: r, file: f}
+	if f.Checksum != "" {
+		// An invalid checksum is rejected by validate before any download
+		if want, err := parseChecksum(f.Checksum); err == nil {
+			v.hash, v.want = sha256.New(), want
+		}
+	}
+	return v
+}
+
+type verifyingReader struct {
+	r    io.Reader
+	file LogFile
+	n    int64
+	hash hash.Hash
+	want []byte
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.n += int64(n)
+	if v.hash != nil {
+		v.hash.Write(b[:n])
+	}
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return n, fmt.Errorf("%w for %s: connection closed after %d of %d bytes", ErrSizeMismatch, v.file.Filename, v.n, v.file.Size)
+	case err != io.EOF:
+		return n, err
+	case v.file.Size > 0 && v.n != int64(v.file.Size):
+		return n, fmt.Errorf("%w for %s: got %d bytes, expected %d", ErrSizeMismatch, v.file.Filename, v.n, v.file.Size)
+	case v.hash != nil:
+		if got := v.hash.Sum(nil); !bytes.Equal(got, v.want) {
+			return n, fmt.Errorf("%w for %s: expected sha256 %x, got %x", ErrChecksumMismatch, v.file.Filename, v.want, got)
+		}
+	}
+	return n, err
+}
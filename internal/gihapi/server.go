@@ -0,0 +1,83 @@
+package gihapi
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Server identifies one GIH API endpoint.
+type Server struct {
+	// Name is the entry as configured; it keys state, reports and metrics.
+	Name   string
+	Scheme string
+	Host   string
+	Port   string
+}
+
+// Defaults returns the scheme and port of a server on host whose entry
+// names neither.
+type Defaults func(host string) (scheme, port string)
+
+// ParseServerWith is ParseServer with the defaults looked up by host, so
+// that they can differ between servers.
+func ParseServerWith(entry string, defaults Defaults) (Server, error) {
+	s, err := ParseServer(entry, "", "")
+	if err != nil {
+		return Server{}, err
+	}
+	scheme, port := defaults(s.Host)
+	if s.Scheme == "" {
+		s.Scheme = scheme
+	}
+	if s.Port == "" {
+		s.Port = port
+	}
+	return s, nil
+}
+
+// ParseServer parses a server entry of the form "host", "host:port" or
+// "scheme://host[:port]". The scheme defaults to defaultScheme and the port
+// to defaultPort.
+func ParseServer(entry, defaultScheme, defaultPort string) (Server, error) {
+	entry = strings.TrimSpace(entry)
+	s := Server{Name: entry, Scheme: defaultScheme, Port: defaultPort}
+
+	hostPort := entry
+	if strings.Contains(entry, "://") {
+		u, err := url.Parse(entry)
+		if err != nil {
+			return Server{}, fmt.Errorf("invalid GIH server %q: %w", entry, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return Server{}, fmt.Errorf("invalid GIH server %q: scheme must be http or https", entry)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return Server{}, fmt.Errorf("invalid GIH server %q: paths are not supported", entry)
+		}
+		s.Scheme = u.Scheme
+		hostPort = u.Host
+	}
+
+	if host, port, err := net.SplitHostPort(hostPort); err == nil {
+		s.Host, s.Port = host, port
+	} else {
+		s.Host = strings.Trim(hostPort, "[]")
+	}
+
+	if s.Host == "" {
+		return Server{}, fmt.Errorf("invalid GIH server %q: missing host", entry)
+	}
+
+	return s, nil
+}
+
+// BaseURL returns scheme://host:port without a trailing slash.
+func (s Server) BaseURL() string {
+	return fmt.Sprintf("%s://%s", s.Scheme, net.JoinHostPort(s.Host, s.Port))
+}
+
+func (s Server) String() string {
+	return s.Name
+}
@@ -0,0 +1,167 @@
+package gihapi
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/redact"
+)
+
+// traceBodyLimit caps the part of an error response body that a traced
+// request logs. Successful response bodies (file lists and log files) are
+// never logged.
+const traceBodyLimit = 512
+
+// SetHTTPTrace turns request tracing on or off. A traced request logs its
+// method, URL, attempt, status and the time spent resolving, connecting,
+// in the TLS handshake and waiting for the first response byte. Credential
+// headers are redacted.
+func (c *Client) SetHTTPTrace(enabled bool) {
+	c.trace = enabled
+}
+
+// requestTrace collects the timings of one request through httptrace. The
+// hooks may run on other goroutines (dialing several addresses in parallel,
+// or a dial left running after the request gave up), so every field after
+// start is guarded by mu.
+type requestTrace struct {
+	start time.Time
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dns          time.Duration
+	connectStart time.Time
+	connect      time.Duration
+	tlsStart     time.Time
+	tls          time.Duration
+	firstByte    time.Duration
+	reused       bool
+	remote       string
+	tlsVersion   string
+}
+
+func newRequestTrace() *requestTrace {
+	return &requestTrace{start: time.Now()}
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.set(func() { t.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.set(func() { t.dns = time.Since(t.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			t.set(func() { t.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			t.set(func() { t.connect = time.Since(t.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			t.set(func() { t.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, _ error) {
+			t.set(func() {
+				t.tls = time.Since(t.tlsStart)
+				t.tlsVersion = tls.VersionName(state.Version)
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(func() {
+				t.reused = info.Reused
+				if addr := info.Conn.RemoteAddr(); addr != nil {
+					t.remote = addr.String()
+				}
+			})
+		},
+		GotFirstResponseByte: func() {
+			t.set(func() { t.firstByte = time.Since(t.start) })
+		},
+	}
+}
+
+// set runs f, which updates the fields of t, under t.mu.
+func (t *requestTrace) set(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f()
+}
+
+// log records the outcome of req: resp with body (read for error statuses
+// only) or err.
+func (t *requestTrace) log(req *http.Request, attempt int, auth Auth, resp *http.Response, body []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	args := []any{
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"attempt", attempt,
+		"request_headers", redactedHeaders(req.Header, auth),
+		"remote_addr", t.remote,
+		"reused_conn", t.reused,
+		"dns_ms", t.dns.Milliseconds(),
+		"connect_ms", t.connect.Milliseconds(),
+		"tls_ms", t.tls.Milliseconds(),
+		"first_byte_ms", t.firstByte.Milliseconds(),
+		"total_ms", time.Since(t.start).Milliseconds(),
+	}
+	if t.tlsVersion != "" {
+		args = append(args, "tls_version", t.tlsVersion)
+	}
+	if err != nil {
+		logger.Info("HTTP request failed", append(args, "error", err)...)
+		return
+	}
+
+	args = append(args,
+		"status", resp.StatusCode,
+		"proto", resp.Proto,
+		"content_length", resp.ContentLength,
+	)
+	if resp.StatusCode != http.StatusOK {
+		args = append(args, "body", capBody(body))
+	}
+	logger.Info("HTTP request", args...)
+}
+
+// redactedHeaders renders h as "Name: value" pairs in name order, with the
+// values of credential headers (including the one auth is sent in)
+// replaced.
+func redactedHeaders(h http.Header, auth Auth) string {
+	secret := map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true}
+	if auth.Header != "" {
+		secret[http.CanonicalHeaderKey(auth.Header)] = true
+	}
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ",")
+		if secret[name] {
+			value = redact.Mask
+		}
+		pairs = append(pairs, name+": "+value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// capBody returns body cut to traceBodyLimit bytes.
+func capBody(body []byte) string {
+	if len(body) <= traceBodyLimit {
+		return string(body)
+	}
+	return string(body[:traceBodyLimit]) + "...(truncated)"
+}
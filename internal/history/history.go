@@ -0,0 +1,118 @@
+// Package history keeps an append-only record of every run, one JSON object
+// per line, so operators can audit what was delivered without the logs.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultFilename is the history file name inside the work directory.
+const DefaultFilename = "gihftp-history.jsonl"
+
+// maxLineSize bounds one history line; longer lines are skipped.
+const maxLineSize = 1024 * 1024
+
+// Entry is the record of one run.
+type Entry struct {
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Command         string    `json:"command"`
+	StartDate       string    `json:"start_date,omitempty"`
+	EndDate         string    `json:"end_date,omitempty"`
+	ExitCode        int       `json:"exit_code"`
+
+	// Outcome is the notification event of the run: success, partial,
+	// anomaly, empty or failure
+	Outcome string `json:"outcome"`
+
+	Servers         int   `json:"servers"`
+	ServersFailed   int   `json:"servers_failed"`
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+	TotalRequests   int   `json:"total_requests"`
+	UniqueDomains   int   `json:"unique_domains"`
+
+	// Merged file and where it was delivered. Daily granularity lists its
+	// files in Outputs; OutputBytes is their total size.
+	Output        string   `json:"output,omitempty"`
+	Outputs       []string `json:"outputs,omitempty"`
+	OutputBytes   int64    `json:"output_bytes,omitempty"`
+	OutputSHA256  string   `json:"output_sha256,omitempty"`
+	Delivered     []string `json:"delivered,omitempty"`
+	FailedTargets []string `json:"failed_targets,omitempty"`
+}
+
+// FullyDelivered reports whether the run delivered the output for its date
+// range to every upload target.
+func (e Entry) FullyDelivered() bool {
+	return e.StartDate != "" && len(e.Delivered) > 0 && len(e.FailedTargets) == 0
+}
+
+// Append adds e as the last line of the history file at path.
+func Append(path string, e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create history directory: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return f.Close()
+}
+
+// Read returns the entries of the history file at path, oldest first. A
+// missing file yields no entries. Lines that cannot be parsed, e.g. one cut
+// short by a crash, are skipped and counted in skipped.
+func Read(path string) (entries []Entry, skipped int, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read history file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read history file %s: %w", path, err)
+	}
+	return entries, skipped, nil
+}
+
+// Last returns the last n entries, or all of them when n <= 0.
+func Last(entries []Entry, n int) []Entry {
+	if n <= 0 || n >= len(entries) {
+		return entries
+	}
+	return entries[len(entries)-n:]
+}
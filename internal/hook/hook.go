@@ -0,0 +1,116 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/logger"
+)
+
+// Hook is a user command run at a fixed point of a run, e.g. before the
+// merged file is uploaded.
+type Hook struct {
+	// Name identifies the hook in logs, e.g. pre-upload
+	Name string
+
+	// Command is run with sh -c
+	Command string
+
+	// Dir is the working directory of the command
+	Dir string
+
+	// Timeout kills the command when it runs longer (0 = no limit)
+	Timeout time.Duration
+}
+
+// Run executes the hook with the variables in env added to the environment
+// of gihftp. Every line the command writes to stdout or
+// stderr is logged. A non-zero exit status, a timeout or a cancelled ctx is
+// returned as an error.
+func (h Hook) Run(ctx context.Context, env map[string]string) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Dir = h.Dir
+	cmd.Env = append(os.Environ(), environ(env)...)
+	// Output pipes stay open while children of the shell run; do not wait
+	// for them forever once the shell is killed
+	cmd.WaitDelay = 5 * time.Second
+
+	stdout := &lineLogger{hook: h.Name, stream: "stdout"}
+	stderr := &lineLogger{hook: h.Name, stream: "stderr"}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	logger.Info("Running hook", "hook", h.Name, "command", h.Command)
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook timed out after %s", h.Name, h.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook: %w", h.Name, err)
+	}
+
+	logger.Info("Hook completed", "hook", h.Name, "duration_seconds", time.Since(start).Seconds())
+	return nil
+}
+
+// lineLogger logs every line written to it.
+type lineLogger struct {
+	hook   string
+	stream string
+	buf    []byte
+}
+
+// maxLine bounds the buffered part of a line without newline.
+const maxLine = 4096
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) > maxLine {
+		l.flush()
+	}
+	return len(p), nil
+}
+
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		l.log(l.buf)
+		l.buf = nil
+	}
+}
+
+func (l *lineLogger) log(line []byte) {
+	logger.Info("Hook output", "hook", l.hook, "stream", l.stream, "line", strings.TrimRight(string(line), "\r"))
+}
+
+func environ(env map[string]string) []string {
+	vars := make([]string, 0, len(env))
+	for name, value := range env {
+		vars = append(vars, name+"="+strings.ReplaceAll(value, "\x00", ""))
+	}
+	sort.Strings(vars)
+	return vars
+}
@@ -0,0 +1,253 @@
+// Package httpupload sends files to an HTTP(S) endpoint with PUT or POST,
+// as a raw body or a multipart form, e.g. to S3 presigned URLs.
+package httpupload
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/proxy"
+	"gih-ftp/internal/transfer"
+)
+
+// ErrStatus is returned when the endpoint answers with a status that is
+// not one of the success codes.
+var ErrStatus = errors.New("unexpected HTTP status")
+
+// bodyLimit caps the part of an error response body put into the error.
+const bodyLimit = 512
+
+// Timeouts of an upload. The transfer of the body itself is not limited, as
+// that would cap the file size by the link speed, but connecting and the
+// answer after the body was sent are.
+const (
+	dialTimeout     = 10 * time.Second
+	responseTimeout = 5 * time.Minute
+)
+
+type Client struct {
+	method         string
+	header         http.Header
+	multipartField string
+	successCodes   []int
+	dialer         proxy.Dialer
+	limiter        *transfer.Limiter
+}
+
+// NewClient returns a client sending files with method (PUT or POST) as
+// the raw request body.
+func NewClient(method string) *Client {
+	return &Client{method: method, header: make(http.Header)}
+}
+
+// SetHeader adds a request header, e.g. Authorization.
+func (c *Client) SetHeader(name, value string) {
+	c.header.Add(name, value)
+}
+
+// SetMultipart sends files as a multipart/form-data body with the file in
+// field instead of the raw body. An empty field disables multipart.
+func (c *Client) SetMultipart(field string) {
+	c.multipartField = field
+}
+
+// SetSuccessCodes sets the statuses that count as success. Without codes
+// every 2xx status does.
+func (c *Client) SetSuccessCodes(codes []int) {
+	c.successCodes = codes
+}
+
+// SetDialer routes the connections through d, e.g. a proxy dialer.
+func (c *Client) SetDialer(d proxy.Dialer) {
+	c.dialer = d
+}
+
+// SetRateLimiter paces uploads with l; nil disables the limit.
+func (c *Client) SetRateLimiter(l *transfer.Limiter) {
+	c.limiter = l
+}
+
+// Upload sends localPath to rawURL and checks the response status.
+func (c *Client) Upload(ctx context.Context, localPath, rawURL string) error {
+	logger.Info("Starting HTTP upload",
+		"local_file", localPath,
+		"url", Display(rawURL),
+		"method", c.method,
+	)
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	startTime := time.Now()
+	src := transfer.Progress(c.limiter.Reader(file), localPath, info.Size())
+	req, err := c.request(ctx, rawURL, src, info.Size(), filepath.Base(localPath))
+	if err != nil {
+		return hideURL(err, rawURL)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP upload failed: %w", hideURL(err, rawURL))
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, bodyLimit))
+
+	if !c.success(resp.StatusCode) {
+		return fmt.Errorf("%w %s: %s", ErrStatus, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	duration := time.Since(startTime)
+	logger.Info("HTTP upload completed",
+		"bytes_uploaded", info.Size(),
+		"status", resp.StatusCode,
+		"duration_seconds", duration.Seconds(),
+		"speed_mbps", fmt.Sprintf("%.2f", float64(info.Size())/duration.Seconds()/(1024*1024)),
+	)
+	return nil
+}
+
+// request builds the upload request. A raw body has a known length, which
+// presigned URLs require; a multipart body is streamed.
+func (c *Client) request(ctx context.Context, rawURL string, src io.Reader, size int64, name string) (*http.Request, error) {
+	if c.multipartField == "" {
+		req, err := http.NewRequestWithContext(ctx, c.method, rawURL, src)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header = c.header.Clone()
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, nil
+	}
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile(c.multipartField, name)
+		if err == nil {
+			_, err = io.Copy(part, src)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, c.method, rawURL, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	req.Header = c.header.Clone()
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+func (c *Client) success(code int) bool {
+	if len(c.successCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	return slices.Contains(c.successCodes, code)
+}
+
+func (c *Client) httpClient() *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: responseTimeout,
+	}
+	if c.dialer != nil {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			return c.dialer.DialContext(ctx, network, address)
+		}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// hideURL replaces the URL in a *url.Error with its Display form, as the
+// query string of a presigned URL is a credential.
+func hideURL(err error, rawURL string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = Display(rawURL)
+	}
+	return err
+}
+
+// VerifyReachable connects to the host of rawURL (with a TLS handshake for
+// https) without sending a request, which would need a valid upload.
+func (c *Client) VerifyReachable(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var conn net.Conn
+	if c.dialer != nil {
+		conn, err = c.dialer.DialContext(ctx, "tcp", address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return fmt.Errorf("HTTP connect failed: %w", err)
+	}
+	defer conn.Close()
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+	}
+
+	logger.Info("HTTP endpoint reachable", "host", u.Host)
+	return nil
+}
+
+// Display returns rawURL without its query string, which carries the
+// signature of presigned URLs, for logs and reports.
+func Display(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.Redacted()
+}
@@ -0,0 +1,91 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFilename is the lock file name inside the work directory.
+const DefaultFilename = "gihftp.lock"
+
+// ErrLocked is returned when another process holds the lock.
+var ErrLocked = errors.New("another instance is running")
+
+// pollInterval is how often a waiting Acquire retries.
+const pollInterval = 500 * time.Millisecond
+
+// Lock is an advisory lock on a file (flock, or LockFileEx on Windows). The
+// kernel releases it when the process exits, so a crashed run never leaves a
+// stale lock behind.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the lock on path, creating the file if needed. When the lock
+// is held elsewhere it retries for up to wait (0 fails immediately) and then
+// returns ErrLocked. Cancelling ctx stops the wait.
+func Acquire(ctx context.Context, path string, wait time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("%w (lock file %s, pid %s)", ErrLocked, path, holder(path))
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	// The PID is informational only; the lock is what counts
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return &Lock{file: file}, nil
+}
+
+// Release unlocks and closes the lock file. The file itself is kept, since
+// removing it could race with a process that just opened it.
+func (l *Lock) Release() error {
+	if l == nil {
+		return nil
+	}
+	unlock(l.file)
+	return l.file.Close()
+}
+
+// holder returns the PID written by the process holding the lock.
+func holder(path string) string {
+	data, err := os.ReadFile(path)
+	pid := strings.TrimSpace(string(data))
+	if err != nil || pid == "" {
+		return "unknown"
+	}
+	return pid
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is where the locked byte lies. Locking past the PID keeps the
+// PID readable by processes waiting for the lock.
+const lockOffset = 1 << 30
+
+// tryLock takes an exclusive LockFileEx lock on file without blocking. It
+// returns false when another process holds it.
+func tryLock(file *os.File) (bool, error) {
+	overlapped := &windows.Overlapped{Offset: lockOffset}
+	err := windows.LockFileEx(windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(file *os.File) {
+	overlapped := &windows.Overlapped{Offset: lockOffset}
+	windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+}
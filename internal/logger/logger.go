@@ -1,17 +1,36 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+
+	"gih-ftp/internal/redact"
 )
 
 var Log *slog.Logger
 
-func Init(level string) {
+// LevelTrace is below debug; it adds HTTP request tracing.
+const LevelTrace = slog.LevelDebug - 4
+
+// Options selects where and how log records are written. An empty Format
+// means text and an empty File means Output, or stdout when Output is nil.
+type Options struct {
+	Format     string
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	Output     io.Writer
+}
+
+func Init(level string, opts Options) error {
 	var logLevel slog.Level
 
 	switch strings.ToLower(level) {
+	case "trace":
+		logLevel = LevelTrace
 	case "debug":
 		logLevel = slog.LevelDebug
 	case "info":
@@ -22,13 +41,50 @@ func Init(level string) {
 		logLevel = slog.LevelInfo
 	}
 
-	opts := &slog.HandlerOptions{
-		Level: logLevel,
+	handlerOpts := &slog.HandlerOptions{
+		Level:       logLevel,
+		ReplaceAttr: redactAttr,
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.Output != nil {
+		out = opts.Output
+	}
+	if opts.File != "" {
+		file, err := openRotatingFile(opts.File, int64(opts.MaxSizeMB)*1024*1024, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	var handler slog.Handler
+	if strings.ToLower(opts.Format) == "json" {
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(out, handlerOpts)
 	}
 
-	handler := slog.NewTextHandler(os.Stdout, opts)
 	Log = slog.New(handler)
 	slog.SetDefault(Log)
+	return nil
+}
+
+// redactAttr masks secrets in the message and in attribute values that
+// are strings, errors or Stringers (URLs, for example).
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	switch v := a.Value; v.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redact.String(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			a.Value = slog.StringValue(redact.String(x.Error()))
+		case fmt.Stringer:
+			a.Value = slog.StringValue(redact.String(x.String()))
+		}
+	}
+	return a
 }
 
 func Debug(msg string, args ...any) {
@@ -0,0 +1,101 @@
+package merger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compressions of the merged output and of downloaded log files.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// CompressionExtension returns the file name suffix for a compression.
+func CompressionExtension(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// nopWriteCloser lets uncompressed output share the compressed code path.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression reports the compression of the data in r from its magic
+// bytes, falling back to the extension of name (.gz, .zst) when r is too
+// short to tell. The returned reader yields all of r, including the bytes
+// that were inspected.
+func DetectCompression(r io.Reader, name string) (string, io.Reader) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip, br
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd, br
+	case len(head) == len(zstdMagic):
+		return CompressionNone, br
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return CompressionGzip, br
+	case strings.HasSuffix(name, ".zst"):
+		return CompressionZstd, br
+	}
+	return CompressionNone, br
+}
+
+// NewDecompressor returns a reader that decompresses r. The caller must
+// close it; closing does not close r.
+func NewDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone, "":
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
@@ -0,0 +1,582 @@
+package merger
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gih-ftp/internal/diskspace"
+	"gih-ftp/internal/logger"
+)
+
+// Supported merge engines.
+const (
+	EngineMemory = "memory"
+	EngineDisk   = "disk"
+)
+
+// DefaultSpillEntries is the number of distinct domains the disk engine
+// keeps in memory before writing a sorted run to disk.
+const DefaultSpillEntries = 1000000
+
+// store accumulates domain counts and, when tracked, client sketches.
+type store interface {
+	// add adds count requests and the clients (nil when not tracked) to
+	// domain. The store takes ownership of clients.
+	add(domain string, count int, clients *hll) error
+	// each calls fn for every domain in descending count order, ties
+	// broken by domain name.
+	each(fn func(DomainStats) error) error
+	// visit calls fn for every stored entry in no particular order. A
+	// domain may be reported more than once; the counts add up and the
+	// client sketches are merged. The sketches still belong to the store.
+	visit(fn func(domain string, count int, clients *hll) error) error
+	// eachDomain calls fn for every domain once, with its total count and
+	// clients, in ascending domain order. The sketches still belong to
+	// the store.
+	eachDomain(fn func(domain string, count int, clients *hll) error) error
+	// size estimates the bytes of the entries held in memory.
+	size() int64
+	close() error
+}
+
+func lessStats(a, b DomainStats) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Domain < b.Domain
+}
+
+// memoryStore keeps every domain in a table.
+type memoryStore struct {
+	data    *table
+	clients map[string]*hll
+
+	// Bytes of the client sketches
+	clientBytes int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: newTable()}
+}
+
+func (s *memoryStore) add(domain string, count int, clients *hll) error {
+	if _, err := s.data.add(domain, count); err != nil {
+		return err
+	}
+	var grown int64
+	s.clients, grown = addClients(s.clients, domain, clients)
+	s.clientBytes += grown
+	return nil
+}
+
+// addClients merges clients into the sketch of domain in m, creating m on
+// first use, and returns m and by how many bytes it grew.
+func addClients(m map[string]*hll, domain string, clients *hll) (map[string]*hll, int64) {
+	if clients == nil {
+		return m, 0
+	}
+	if m == nil {
+		m = make(map[string]*hll)
+	}
+	current, ok := m[domain]
+	if !ok {
+		m[domain] = clients
+		return m, entryOverhead + clients.bytes()
+	}
+	before := current.bytes()
+	current.merge(clients)
+	return m, current.bytes() - before
+}
+
+func (s *memoryStore) each(fn func(DomainStats) error) error {
+	return eachSorted(s.data, s.clients, fn)
+}
+
+// eachSorted calls fn for every domain of data in descending count order.
+// The DomainStats are built one at a time, so only the table is held in
+// memory.
+func eachSorted(data *table, clients map[string]*hll, fn func(DomainStats) error) error {
+	for _, off := range data.sorted(data.byCount) {
+		domain := string(data.key(off))
+		sketch := clients[domain]
+		if err := fn(DomainStats{Domain: domain, Count: data.count(off), Clients: sketch.estimate(), sketch: sketch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitTable calls fn for every domain of data in no particular order.
+func visitTable(data *table, clients map[string]*hll, fn func(domain string, count int, clients *hll) error) error {
+	return data.each(func(key []byte, count int) error {
+		domain := string(key)
+		return fn(domain, count, clients[domain])
+	})
+}
+
+func (s *memoryStore) visit(fn func(domain string, count int, clients *hll) error) error {
+	return visitTable(s.data, s.clients, fn)
+}
+
+func (s *memoryStore) eachDomain(fn func(domain string, count int, clients *hll) error) error {
+	return visitTableSorted(s.data, s.clients, fn)
+}
+
+// visitTableSorted calls fn for every domain of data in ascending domain
+// order.
+func visitTableSorted(data *table, clients map[string]*hll, fn func(domain string, count int, clients *hll) error) error {
+	for _, off := range data.sorted(data.byDomain) {
+		domain := string(data.key(off))
+		if err := fn(domain, data.count(off), clients[domain]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) size() int64 {
+	return s.data.bytes() + s.clientBytes
+}
+
+func (s *memoryStore) close() error {
+	s.data = newTable()
+	s.clients = nil
+	s.clientBytes = 0
+	return nil
+}
+
+// diskStore buffers up to limit domains in memory and spills them to disk
+// as runs sorted by domain. Reading merges the runs, summing counts per
+// domain, re-sorts the totals into runs ordered by count and merges those.
+// Memory use is bounded by limit plus one buffered line per run.
+type diskStore struct {
+	parent string
+	dir    string
+	limit  int
+	buf    *table
+
+	// Client sketches of the domains in buf and their bytes
+	clients     map[string]*hll
+	clientBytes int64
+
+	domainRuns []string
+	countRuns  []string
+	dirty      bool
+	seq        int
+
+	// space reserves the runs in the work directory, nil for no check
+	space *diskspace.Guard
+}
+
+func newDiskStore(parent string, limit int, space *diskspace.Guard) *diskStore {
+	if limit <= 0 {
+		limit = DefaultSpillEntries
+	}
+	return &diskStore{
+		parent: parent,
+		limit:  limit,
+		buf:    newTable(),
+		space:  space,
+	}
+}
+
+func (s *diskStore) add(domain string, count int, clients *hll) error {
+	if _, err := s.buf.add(domain, count); err != nil {
+		return err
+	}
+	var grown int64
+	s.clients, grown = addClients(s.clients, domain, clients)
+	s.clientBytes += grown
+	s.dirty = true
+	if s.buf.len() >= s.limit {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the buffer as a domain-sorted run.
+func (s *diskStore) spill() error {
+	if s.buf.len() == 0 {
+		return nil
+	}
+
+	domains := s.buf.sorted(s.buf.byDomain)
+	path, err := s.writeRun("domains", func(w *bufio.Writer) error {
+		for _, off := range domains {
+			domain := string(s.buf.key(off))
+			if err := writeRunLine(w, DomainStats{Domain: domain, Count: s.buf.count(off), sketch: s.clients[domain]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Spilled merge run to disk", "file", path, "domains", len(domains))
+	s.domainRuns = append(s.domainRuns, path)
+	s.buf = newTable()
+	s.clients = nil
+	s.clientBytes = 0
+	return nil
+}
+
+// writeRunLine writes stat as a domain|count line, followed by the client
+// sketch when clients are tracked.
+func writeRunLine(w *bufio.Writer, stat DomainStats) error {
+	var err error
+	if stat.sketch != nil {
+		_, err = fmt.Fprintf(w, "%s|%d|%s\n", stat.Domain, stat.Count, stat.sketch)
+	} else {
+		_, err = fmt.Fprintf(w, "%s|%d\n", stat.Domain, stat.Count)
+	}
+	return err
+}
+
+// add sums the counts and merges the client sketches of two entries of the
+// same domain.
+func (stat *DomainStats) add(other DomainStats) {
+	stat.Count += other.Count
+	if stat.sketch == nil {
+		stat.sketch = other.sketch
+	} else {
+		stat.sketch.merge(other.sketch)
+	}
+}
+
+func (s *diskStore) writeRun(kind string, write func(*bufio.Writer) error) (string, error) {
+	if s.dir == "" {
+		if s.parent != "" && s.parent != "." {
+			if err := os.MkdirAll(s.parent, 0755); err != nil {
+				return "", fmt.Errorf("failed to create work directory: %w", err)
+			}
+		}
+		dir, err := os.MkdirTemp(s.parent, ".merge-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create merge directory: %w", err)
+		}
+		s.dir = dir
+	}
+
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%s-%05d", kind, s.seq))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create merge run: %w", err)
+	}
+	guarded := s.space.Writer(file)
+	defer guarded.Done()
+
+	w := bufio.NewWriter(guarded)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		s.removeRuns([]string{path})
+		return "", fmt.Errorf("failed to write merge run: %w", err)
+	}
+	return path, file.Close()
+}
+
+func (s *diskStore) each(fn func(DomainStats) error) error {
+	// Nothing was spilled: sort in memory like the memory engine
+	if len(s.domainRuns) == 0 {
+		return eachSorted(s.buf, s.clients, fn)
+	}
+
+	if s.dirty {
+		if err := s.buildCountRuns(); err != nil {
+			return err
+		}
+	}
+
+	return mergeRuns(s.countRuns, lessStats, fn)
+}
+
+// buildCountRuns sums the domain runs and writes the totals as runs sorted
+// by count.
+func (s *diskStore) buildCountRuns() error {
+	if err := s.spill(); err != nil {
+		return err
+	}
+	s.removeRuns(s.countRuns)
+	s.countRuns = nil
+
+	var chunk []DomainStats
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		sort.Slice(chunk, func(i, j int) bool {
+			return lessStats(chunk[i], chunk[j])
+		})
+		path, err := s.writeRun("counts", func(w *bufio.Writer) error {
+			for _, stat := range chunk {
+				if err := writeRunLine(w, stat); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		s.countRuns = append(s.countRuns, path)
+		chunk = chunk[:0]
+		return nil
+	}
+
+	var current DomainStats
+	byDomain := func(a, b DomainStats) bool { return a.Domain < b.Domain }
+	err := mergeRuns(s.domainRuns, byDomain, func(stat DomainStats) error {
+		if stat.Domain == current.Domain {
+			current.add(stat)
+			return nil
+		}
+		if current.Domain != "" {
+			chunk = append(chunk, current)
+			if len(chunk) >= s.limit {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		current = stat
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if current.Domain != "" {
+		chunk = append(chunk, current)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Keep a single domain run so that later additions can be merged again
+	if len(s.domainRuns) > 1 {
+		if err := s.compactDomainRuns(); err != nil {
+			return err
+		}
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// compactDomainRuns replaces all domain runs by one summed run.
+func (s *diskStore) compactDomainRuns() error {
+	old := s.domainRuns
+	byDomain := func(a, b DomainStats) bool { return a.Domain < b.Domain }
+
+	path, err := s.writeRun("domains", func(w *bufio.Writer) error {
+		var current DomainStats
+		err := mergeRuns(old, byDomain, func(stat DomainStats) error {
+			if stat.Domain == current.Domain {
+				current.add(stat)
+				return nil
+			}
+			if current.Domain != "" {
+				if err := writeRunLine(w, current); err != nil {
+					return err
+				}
+			}
+			current = stat
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if current.Domain != "" {
+			err = writeRunLine(w, current)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeRuns(old)
+	s.domainRuns = []string{path}
+	return nil
+}
+
+// visit reports the buffer and then every domain run as written, without
+// summing across runs.
+func (s *diskStore) visit(fn func(domain string, count int, clients *hll) error) error {
+	if err := visitTable(s.buf, s.clients, fn); err != nil {
+		return err
+	}
+	byDomain := func(a, b DomainStats) bool { return a.Domain < b.Domain }
+	return mergeRuns(s.domainRuns, byDomain, func(stat DomainStats) error {
+		return fn(stat.Domain, stat.Count, stat.sketch)
+	})
+}
+
+// eachDomain spills the buffer and merges the domain runs, summing the
+// entries of each domain.
+func (s *diskStore) eachDomain(fn func(domain string, count int, clients *hll) error) error {
+	if len(s.domainRuns) == 0 {
+		return visitTableSorted(s.buf, s.clients, fn)
+	}
+	if err := s.spill(); err != nil {
+		return err
+	}
+
+	var current DomainStats
+	byDomain := func(a, b DomainStats) bool { return a.Domain < b.Domain }
+	err := mergeRuns(s.domainRuns, byDomain, func(stat DomainStats) error {
+		if stat.Domain == current.Domain {
+			current.add(stat)
+			return nil
+		}
+		if current.Domain != "" {
+			if err := fn(current.Domain, current.Count, current.sketch); err != nil {
+				return err
+			}
+		}
+		current = stat
+		return nil
+	})
+	if err != nil || current.Domain == "" {
+		return err
+	}
+	return fn(current.Domain, current.Count, current.sketch)
+}
+
+func (s *diskStore) size() int64 {
+	return s.buf.bytes() + s.clientBytes
+}
+
+// removeRuns deletes the run files at paths and gives their space back.
+func (s *diskStore) removeRuns(paths []string) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.Remove(path) == nil && err == nil {
+			s.space.Release(info.Size())
+		}
+	}
+}
+
+func (s *diskStore) close() error {
+	s.buf = newTable()
+	s.clients = nil
+	s.clientBytes = 0
+	s.removeRuns(s.domainRuns)
+	s.removeRuns(s.countRuns)
+	s.domainRuns, s.countRuns = nil, nil
+	s.dirty = false
+	if s.dir == "" {
+		return nil
+	}
+	dir := s.dir
+	s.dir = ""
+	return os.RemoveAll(dir)
+}
+
+// runReader reads domain|count lines, with the client sketch as an
+// optional third column, from a run file.
+type runReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	current DomainStats
+}
+
+func (r *runReader) next() (bool, error) {
+	if !r.scanner.Scan() {
+		return false, r.scanner.Err()
+	}
+
+	line := r.scanner.Text()
+	fields := strings.Split(line, "|")
+	if len(fields) < 2 || len(fields) > 3 {
+		return false, fmt.Errorf("corrupt merge run %s: %q", r.file.Name(), line)
+	}
+	count, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, fmt.Errorf("corrupt merge run %s: %q", r.file.Name(), line)
+	}
+	r.current = DomainStats{Domain: fields[0], Count: count}
+
+	if len(fields) == 3 {
+		if r.current.sketch, err = parseSketch(fields[2]); err != nil {
+			return false, fmt.Errorf("corrupt merge run %s: %q", r.file.Name(), line)
+		}
+		r.current.Clients = r.current.sketch.estimate()
+	}
+	return true, nil
+}
+
+type runHeap struct {
+	readers []*runReader
+	less    func(a, b DomainStats) bool
+}
+
+func (h *runHeap) Len() int           { return len(h.readers) }
+func (h *runHeap) Less(i, j int) bool { return h.less(h.readers[i].current, h.readers[j].current) }
+func (h *runHeap) Swap(i, j int)      { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runHeap) Push(x any)         { h.readers = append(h.readers, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
+
+// mergeRuns performs a k-way merge of sorted run files, calling fn for
+// every entry in the order given by less.
+func mergeRuns(paths []string, less func(a, b DomainStats) bool, fn func(DomainStats) error) error {
+	h := &runHeap{less: less}
+	defer func() {
+		for _, r := range h.readers {
+			r.file.Close()
+		}
+	}()
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open merge run: %w", err)
+		}
+		r := &runReader{file: file, scanner: bufio.NewScanner(file)}
+		ok, err := r.next()
+		if err != nil || !ok {
+			file.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.readers[0]
+		if err := fn(r.current); err != nil {
+			return err
+		}
+
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			r.file.Close()
+			heap.Pop(h)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package merger
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Filter decides which domains are kept during merging. When an allowlist
+// is loaded only matching domains are kept; blocklist matches are always
+// dropped.
+//
+// Rule files contain one rule per line; blank lines and lines starting with
+// '#' are ignored:
+//
+//	exact:example.com          the domain itself
+//	suffix:corp.example.com    the domain and all of its subdomains
+//	regex:\.in-addr\.arpa$     Go regular expression
+//	*.corp.example.com         shorthand for subdomains only
+//	example.com                shorthand for exact
+//
+// Matching is case-insensitive.
+type Filter struct {
+	allow *ruleSet
+	block *ruleSet
+}
+
+type ruleSet struct {
+	exact    map[string]bool
+	suffixes []string
+	patterns []*regexp.Regexp
+}
+
+// LoadFilter builds a filter from optional allowlist and blocklist files.
+// An empty path skips that list.
+func LoadFilter(allowPath, blockPath string) (*Filter, error) {
+	f := &Filter{}
+
+	var err error
+	if allowPath != "" {
+		if f.allow, err = loadRuleSet(allowPath); err != nil {
+			return nil, fmt.Errorf("failed to load allowlist: %w", err)
+		}
+	}
+	if blockPath != "" {
+		if f.block, err = loadRuleSet(blockPath); err != nil {
+			return nil, fmt.Errorf("failed to load blocklist: %w", err)
+		}
+	}
+
+	return f, nil
+}
+
+// Allowed reports whether domain passes the filter.
+func (f *Filter) Allowed(domain string) bool {
+	if f == nil {
+		return true
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if f.allow != nil && !f.allow.matches(domain) {
+		return false
+	}
+	if f.block != nil && f.block.matches(domain) {
+		return false
+	}
+	return true
+}
+
+func loadRuleSet(path string) (*ruleSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rs := &ruleSet{exact: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := rs.add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (rs *ruleSet) add(rule string) error {
+	kind, value, hasKind := strings.Cut(rule, ":")
+	if !hasKind {
+		kind, value = "exact", rule
+		if strings.HasPrefix(rule, "*.") {
+			kind, value = "subdomain", strings.TrimPrefix(rule, "*")
+		}
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fmt.Errorf("empty rule")
+	}
+
+	switch kind {
+	case "exact":
+		rs.exact[strings.ToLower(strings.TrimSuffix(value, "."))] = true
+	case "suffix":
+		value = strings.ToLower(strings.Trim(value, "."))
+		rs.exact[value] = true
+		rs.suffixes = append(rs.suffixes, "."+value)
+	case "subdomain":
+		rs.suffixes = append(rs.suffixes, strings.ToLower(value))
+	case "regex":
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		rs.patterns = append(rs.patterns, re)
+	default:
+		return fmt.Errorf("unknown rule type %q (expected exact, suffix or regex)", kind)
+	}
+
+	return nil
+}
+
+func (rs *ruleSet) matches(domain string) bool {
+	if rs.exact[domain] {
+		return true
+	}
+	for _, suffix := range rs.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	for _, re := range rs.patterns {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,363 @@
+package merger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Supported output formats.
+const (
+	// FormatPipe writes domain|count lines (the format GIH expects).
+	FormatPipe = "pipe"
+	// FormatCSV writes a domain,count header followed by one row per domain.
+	FormatCSV = "csv"
+	// FormatJSONL writes one {"domain":...,"count":...} object per line.
+	FormatJSONL = "jsonl"
+)
+
+// FormatExtension returns the file extension conventionally used for format.
+func FormatExtension(format string) string {
+	switch format {
+	case FormatCSV:
+		return ".csv"
+	case FormatJSONL:
+		return ".jsonl"
+	default:
+		return ".txt"
+	}
+}
+
+// Output columns. Domain and count are always written; pct (the share of
+// the domain in all requests of the file, in percent) and cumpct (the share
+// of the domain and all busier ones) let the receiver cut the list at a
+// share of the traffic. qtype is the query type and needs
+// SetQTypeBreakdown; clients is the estimated number of distinct clients and
+// needs SetClientTracking.
+const (
+	ColumnDomain  = "domain"
+	ColumnQType   = "qtype"
+	ColumnCount   = "count"
+	ColumnPct     = "pct"
+	ColumnCumPct  = "cumpct"
+	ColumnClients = "clients"
+
+	// columnSketch is the encoded client sketch that SaveToFile keeps for
+	// AddReader
+	columnSketch = "sketch"
+)
+
+var defaultColumns = []string{ColumnDomain, ColumnCount}
+
+// Layout adjusts how records of the pipe and csv formats are written for
+// parsers that expect more than domain|count. The zero Layout writes the
+// formats unchanged. Counts are always written with ASCII digits, whatever
+// the locale of the host.
+type Layout struct {
+	// Columns in the order they are written (default domain, count)
+	Columns []string
+
+	// Separator between columns (default "|" for pipe, "," for
+	// csv, where it must be a single character)
+	Separator string
+
+	// Thousands groups the digits of counts with this string, e.g. "," for
+	// 1,234,567 (default: no grouping)
+	Thousands string
+
+	// Pad domains (left aligned) and the numeric columns (right aligned)
+	// to these widths for fixed-width columns, pipe format only (0 = no padding)
+	DomainWidth int
+	CountWidth  int
+
+	// Header writes a line with the column names first in pipe format; csv
+	// always starts with one
+	Header bool
+
+	// NoFinalNewline leaves out the line break after the last record, in
+	// any format
+	NoFinalNewline bool
+}
+
+// columns returns the columns of the layout and checks that they are known
+// and include domain and count.
+func (l Layout) columns() ([]string, error) {
+	if len(l.Columns) == 0 {
+		return defaultColumns, nil
+	}
+	seen := make(map[string]bool, len(l.Columns))
+	for _, column := range l.Columns {
+		switch column {
+		case ColumnDomain, ColumnQType, ColumnCount, ColumnPct, ColumnCumPct, ColumnClients, columnSketch:
+		default:
+			return nil, fmt.Errorf("unsupported output column: %s", column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("duplicate output column: %s", column)
+		}
+		seen[column] = true
+	}
+	if !seen[ColumnDomain] || !seen[ColumnCount] {
+		return nil, fmt.Errorf("output columns must include domain and count")
+	}
+	return l.Columns, nil
+}
+
+// Validate checks the columns of the layout like SaveAs does.
+func (l Layout) Validate() error {
+	_, err := l.columns()
+	return err
+}
+
+// Shares reports whether the layout has a pct or cumpct column, which need
+// the total of the file before the first record is written.
+func (l Layout) Shares() bool {
+	for _, column := range l.Columns {
+		if column == ColumnPct || column == ColumnCumPct {
+			return true
+		}
+	}
+	return false
+}
+
+// field formats the column of r.
+func (l Layout) field(column string, r record) string {
+	switch column {
+	case ColumnDomain:
+		return r.Domain
+	case ColumnQType:
+		return r.QType
+	case ColumnCount:
+		return l.count(r.Count)
+	case ColumnPct:
+		return strconv.FormatFloat(r.pct, 'f', sharePrecision, 64)
+	case ColumnCumPct:
+		return strconv.FormatFloat(r.cumPct, 'f', sharePrecision, 64)
+	case ColumnClients:
+		return l.count(r.Clients)
+	default:
+		if r.sketch == nil {
+			return ""
+		}
+		return r.sketch.String()
+	}
+}
+
+// qtypeWidth is the width of the qtype column of fixed-width output, enough
+// for CNAME or TYPE65.
+const qtypeWidth = 6
+
+// sharePrecision is the number of decimals of the pct and cumpct columns.
+const sharePrecision = 4
+
+// record is a domain with its share of the total requests of the file and
+// the cumulative share of the domains up to and including it.
+type record struct {
+	DomainStats
+	pct, cumPct float64
+}
+
+// shares computes the shares of records written in descending count order.
+type shares struct {
+	total      int
+	cumulative int
+}
+
+func (s *shares) record(stat DomainStats) record {
+	r := record{DomainStats: stat}
+	if s.total > 0 {
+		s.cumulative += stat.Count
+		r.pct = 100 * float64(stat.Count) / float64(s.total)
+		r.cumPct = 100 * float64(s.cumulative) / float64(s.total)
+	}
+	return r
+}
+
+// count formats n with the thousands separator of the layout.
+func (l Layout) count(n int) string {
+	s := strconv.Itoa(n)
+	if l.Thousands == "" || len(s) <= 3 {
+		return s
+	}
+	var b strings.Builder
+	if n < 0 {
+		b.WriteByte('-')
+		s = s[1:]
+	}
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteString(l.Thousands)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// recordWriter writes domain statistics in one output format.
+type recordWriter interface {
+	write(r record) error
+	flush() error
+}
+
+func newRecordWriter(w io.Writer, format string, layout Layout) (recordWriter, error) {
+	columns, err := layout.columns()
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatPipe, "":
+		if layout.Separator == "" {
+			layout.Separator = "|"
+		}
+		p := &pipeWriter{w: w, layout: layout, columns: columns}
+		if layout.Header {
+			if err := p.line(func(column string) string { return column }); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if layout.Separator != "" {
+			comma, size := utf8.DecodeRuneInString(layout.Separator)
+			if size != len(layout.Separator) {
+				return nil, fmt.Errorf("csv separator must be a single character: %q", layout.Separator)
+			}
+			cw.Comma = comma
+		}
+		if err := cw.Write(columns); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw, layout: layout, columns: columns}, nil
+	case FormatJSONL:
+		return &jsonlWriter{enc: json.NewEncoder(w), columns: columns}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+type pipeWriter struct {
+	w       io.Writer
+	layout  Layout
+	columns []string
+}
+
+func (p *pipeWriter) write(r record) error {
+	return p.line(func(column string) string { return p.layout.field(column, r) })
+}
+
+// line writes the value of each column, padded to its width.
+func (p *pipeWriter) line(value func(column string) string) error {
+	var b strings.Builder
+	for i, column := range p.columns {
+		if i > 0 {
+			b.WriteString(p.layout.Separator)
+		}
+		switch {
+		case column == ColumnDomain:
+			fmt.Fprintf(&b, "%-*s", p.layout.DomainWidth, value(column))
+		case column == ColumnQType && (p.layout.DomainWidth > 0 || p.layout.CountWidth > 0):
+			fmt.Fprintf(&b, "%-*s", qtypeWidth, value(column))
+		default:
+			fmt.Fprintf(&b, "%*s", p.layout.CountWidth, value(column))
+		}
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(p.w, b.String())
+	return err
+}
+
+func (p *pipeWriter) flush() error { return nil }
+
+type csvWriter struct {
+	w       *csv.Writer
+	layout  Layout
+	columns []string
+}
+
+func (c *csvWriter) write(r record) error {
+	fields := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		fields[i] = c.layout.field(column, r)
+	}
+	return c.w.Write(fields)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+type jsonlRecord struct {
+	Domain  string   `json:"domain"`
+	QType   *string  `json:"qtype,omitempty"`
+	Count   int      `json:"count"`
+	Pct     *float64 `json:"pct,omitempty"`
+	CumPct  *float64 `json:"cumpct,omitempty"`
+	Clients *int     `json:"clients,omitempty"`
+}
+
+func (j *jsonlWriter) write(r record) error {
+	rec := jsonlRecord{Domain: r.Domain, Count: r.Count}
+	for _, column := range j.columns {
+		switch column {
+		case ColumnQType:
+			rec.QType = &r.QType
+		case ColumnPct:
+			pct := roundShare(r.pct)
+			rec.Pct = &pct
+		case ColumnCumPct:
+			cumPct := roundShare(r.cumPct)
+			rec.CumPct = &cumPct
+		case ColumnClients:
+			rec.Clients = &r.Clients
+		}
+	}
+	return j.enc.Encode(rec)
+}
+
+func (j *jsonlWriter) flush() error { return nil }
+
+func roundShare(share float64) float64 {
+	scale := math.Pow10(sharePrecision)
+	return math.Round(share*scale) / scale
+}
+
+// finalNewlineWriter holds back a line break at the end of each write and
+// only passes it on when more data follows, so the output ends without
+// one.
+type finalNewlineWriter struct {
+	w       io.Writer
+	pending bool
+}
+
+func (f *finalNewlineWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.pending {
+		if _, err := f.w.Write([]byte{'\n'}); err != nil {
+			return 0, err
+		}
+		f.pending = false
+	}
+	data := p
+	if data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+		f.pending = true
+	}
+	if _, err := f.w.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,102 @@
+package merger
+
+import (
+	"sync/atomic"
+
+	"gih-ftp/internal/logger"
+)
+
+// Approximate memory of one entry of the client sketch map besides the
+// domain itself, and of a sketch besides its hashes or registers.
+const (
+	entryOverhead  = 48
+	sketchOverhead = 64
+)
+
+// minSpillEntries is the smallest buffer the disk engine shrinks to when
+// spilling for a memory budget.
+const minSpillEntries = 1024
+
+// MemoryBudget caps the memory that the domain counts of a set of mergers
+// hold together. A merger whose addition exceeds the budget spills its own
+// counts to disk: a memory engine merger continues with the disk engine.
+// The accounting is an estimate of the stored counts, not of the whole
+// process.
+type MemoryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewMemoryBudget returns a budget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Used returns the bytes currently accounted to the budget.
+func (b *MemoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// add accounts delta bytes and reports whether the budget is exceeded.
+func (b *MemoryBudget) add(delta int64) bool {
+	return b.used.Add(delta) > b.limit
+}
+
+// SetMemoryBudget accounts the counts of m to b, shared with other
+// mergers. It must be called before any content is added.
+func (m *Merger) SetMemoryBudget(b *MemoryBudget) {
+	m.budget = b
+}
+
+// account updates the budget with the current size of the store and spills
+// the store when the budget is exceeded. m.mu must be held.
+func (m *Merger) account() error {
+	if m.budget == nil {
+		return nil
+	}
+	size := m.store.size()
+	exceeded := m.budget.add(size - m.accounted)
+	m.accounted = size
+	if !exceeded || size == 0 {
+		return nil
+	}
+
+	switch s := m.store.(type) {
+	case *memoryStore:
+		logger.Info("Merge data exceeds the memory budget, continuing with the disk engine",
+			"domains", s.data.len(),
+			"estimated_bytes", size,
+			"budget_used_bytes", m.budget.Used(),
+		)
+		ds := newDiskStore(m.workDir, max(s.data.len(), minSpillEntries), m.space)
+		ds.buf, ds.clients, ds.clientBytes = s.data, s.clients, s.clientBytes
+		s.data, s.clients, s.clientBytes = newTable(), nil, 0
+		m.store = ds
+		if err := ds.spill(); err != nil {
+			return err
+		}
+	case *diskStore:
+		logger.Debug("Merge data exceeds the memory budget, spilling to disk",
+			"domains", s.buf.len(),
+			"estimated_bytes", size,
+		)
+		s.limit = max(min(s.limit, s.buf.len()), minSpillEntries)
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	size = m.store.size()
+	m.budget.add(size - m.accounted)
+	m.accounted = size
+	return nil
+}
+
+// release returns the memory accounted for m to the budget. m.mu must be
+// held.
+func (m *Merger) release() {
+	if m.budget != nil {
+		m.budget.add(-m.accounted)
+	}
+	m.accounted = 0
+}
@@ -2,38 +2,250 @@ package merger
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"gih-ftp/internal/diskspace"
 	"gih-ftp/internal/logger"
 )
 
 type DomainStats struct {
 	Domain string
 	Count  int
+
+	// QType is the query type (A, AAAA, ...) of the count when the
+	// breakdown by query type is enabled (see SetQTypeBreakdown)
+	QType string
+
+	// Clients is the estimated number of distinct clients of the domain
+	// when they are tracked (see SetClientTracking)
+	Clients int
+
+	sketch *hll
 }
 
+// SourceStats is what one input added with AddSource contributed: the
+// lines counted, the sum of their requests and the distinct domains among
+// them, and the malformed lines skipped. Filtered and invalid lines are not
+// included in the counts. Above 65536 domains per call UniqueDomains is an
+// estimate with a standard error of about 1%.
+type SourceStats struct {
+	Source        string
+	Lines         int
+	Requests      int
+	UniqueDomains int
+	Skipped       int
+}
+
+// batchSize is the number of distinct domains AddReader collects before
+// applying them to the shared store.
+const batchSize = 4096
+
+// Merger is safe for concurrent use by multiple goroutines. Settings
+// (SetEngine, SetCompression, SetFilter) must be applied before any content
+// is added.
 type Merger struct {
-	data    map[string]int
-	workDir string
+	mu            sync.Mutex
+	store         store
+	workDir       string
+	compression   string
+	layout        Layout
+	filter        *Filter
+	normalize     normalizer
+	minCount      int
+	clients       bool
+	qtypes        map[string]bool
+	byQType       bool
+	linesFiltered int
+	linesSkipped  int
+	sources       map[string]*SourceStats
+
+	// domains holds the distinct domains of each source added with
+	// MergeSource, which may add a source in several parts
+	domains map[string]*distinct
+
+	quarantine *Quarantine
+	origin     string
+
+	// budget is shared with other mergers; accounted is what this merger
+	// added to it
+	budget    *MemoryBudget
+	accounted int64
+
+	// space reserves what is written to the work directory
+	space *diskspace.Guard
 }
 
 func New(workDir string) *Merger {
 	return &Merger{
-		data:    make(map[string]int),
+		store:   newMemoryStore(),
 		workDir: workDir,
 	}
 }
 
+// SetEngine selects where domain counts are kept: EngineMemory (a table) or
+// EngineDisk, which spills sorted runs into a temporary directory under
+// the work directory and merges them when reading. It must be called before
+// any content is added.
+func (m *Merger) SetEngine(engine string) error {
+	switch engine {
+	case EngineMemory, "":
+		m.store = newMemoryStore()
+	case EngineDisk:
+		m.store = newDiskStore(m.workDir, DefaultSpillEntries, m.space)
+	default:
+		return fmt.Errorf("unsupported merge engine: %s", engine)
+	}
+	return nil
+}
+
+// SetSpaceGuard reserves the spilled runs of the disk engine and the saved
+// files in g, shared with every other writer to the work directory.
+func (m *Merger) SetSpaceGuard(g *diskspace.Guard) {
+	m.space = g
+	if ds, ok := m.store.(*diskStore); ok {
+		ds.space = g
+	}
+}
+
+// SetCompression selects how SaveToFile compresses its output. The matching
+// extension (.gz, .zst) is appended to the file name.
+func (m *Merger) SetCompression(compression string) {
+	m.compression = compression
+}
+
+// SetLayout selects the columns, separators, padding, header line and
+// final newline of the files written by SaveAs.
+func (m *Merger) SetLayout(layout Layout) {
+	m.layout = layout
+}
+
+// SetFilter applies f to every domain added afterwards. Filtered lines are
+// counted in GetStats.
+func (m *Merger) SetFilter(f *Filter) {
+	m.filter = f
+}
+
+// SetQuarantine writes every malformed line skipped from now on to q,
+// labelled with origin (e.g. the server name) and the source it came from.
+func (m *Merger) SetQuarantine(q *Quarantine, origin string) {
+	m.quarantine = q
+	m.origin = origin
+}
+
+// SetNormalization selects how domains are rewritten before they are
+// filtered and counted: NormalizeNone, NormalizeBasic or NormalizeIDNA.
+func (m *Merger) SetNormalization(mode string) error {
+	n, err := newNormalizer(mode)
+	if err != nil {
+		return err
+	}
+	m.normalize = n
+	return nil
+}
+
+// SetClientTracking makes the merger estimate the distinct clients of
+// each domain from lines of the form domain|count|client_ip, reported as
+// DomainStats.Clients and in the clients output column. SaveToFile then
+// keeps the client sketch as a third column, so a saved result can be read
+// back without losing the clients.
+func (m *Merger) SetClientTracking(enabled bool) {
+	m.clients = enabled
+}
+
+// SetQTypes keeps only lines of the given query types (e.g. A, AAAA) from
+// inputs of the form domain|qtype|count; lines of other types are counted
+// as filtered. Lines without a query type are kept. No types keeps all.
+func (m *Merger) SetQTypes(qtypes []string) {
+	m.qtypes = nil
+	for _, qtype := range qtypes {
+		if m.qtypes == nil {
+			m.qtypes = make(map[string]bool)
+		}
+		m.qtypes[strings.ToUpper(qtype)] = true
+	}
+}
+
+// SetQTypeBreakdown counts every domain separately per query type,
+// reported as DomainStats.QType and in the qtype output column. Lines
+// without a query type are counted with an empty type.
+func (m *Merger) SetQTypeBreakdown(enabled bool) {
+	m.byQType = enabled
+}
+
+// SetMinCount drops domains with fewer than n requests when the result is
+// read or saved. Dropped domains are reported as suppressed in GetStats.
+// Counts are still accumulated, so a domain that reaches n later is kept.
+func (m *Merger) SetMinCount(n int) {
+	m.minCount = n
+}
+
 func (m *Merger) AddContent(content []byte) error {
-	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	return m.AddReader(bytes.NewReader(content))
+}
+
+// AddReader parses domain|count lines from r as they are read, so callers
+// can merge large inputs without holding them in memory. Lines may carry
+// the query type after the domain (domain|qtype|count) when SetQTypes or
+// SetQTypeBreakdown is used, and the client IP (or, in a saved result, the
+// client sketch) after the count with SetClientTracking; otherwise such
+// lines are malformed. Parsed counts are
+// batched locally and applied under the merger's lock, so several readers
+// can be added concurrently.
+func (m *Merger) AddReader(r io.Reader) error {
+	return m.addReader(r, "")
+}
+
+// AddSource is AddReader for one named input (e.g. a GIH server), whose
+// contribution is reported in GetStats under "sources". Its distinct domains
+// are counted exactly up to distinctLimit and estimated beyond, so memory
+// stays bounded; adding the same source twice sums both calls.
+func (m *Merger) AddSource(source string, r io.Reader) error {
+	return m.addReader(r, source)
+}
+
+func (m *Merger) addReader(r io.Reader, source string) error {
+	scanner := bufio.NewScanner(r)
 	linesProcessed := 0
 	linesSkipped := 0
+	linesFiltered := 0
+	requests := 0
+
+	var seen *distinct
+	if source != "" {
+		seen = &distinct{}
+	}
+
+	// The query type column is read when it is filtered or counted
+	qtypeColumn := m.byQType || m.qtypes != nil
+
+	batch := make(map[string]int)
+	var batchClients map[string]*hll
+	if m.clients {
+		batchClients = make(map[string]*hll)
+	}
+	flush := func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for domain, count := range batch {
+			if err := m.store.add(domain, count, batchClients[domain]); err != nil {
+				return err
+			}
+		}
+		clear(batch)
+		clear(batchClients)
+		return m.account()
+	}
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -42,19 +254,22 @@ func (m *Merger) AddContent(content []byte) error {
 			continue
 		}
 
-		parts := strings.Split(line, "|")
-		if len(parts) != 2 {
+		domain, qtype, countStr, client, ok := splitLine(line, qtypeColumn, m.clients)
+		if !ok {
 			linesSkipped++
 			logger.Debug("Skipping invalid line", "line", line)
+			m.quarantine.Write(m.origin, source, "invalid line", line)
 			continue
 		}
 
-		domain := strings.TrimSpace(parts[0])
-		countStr := strings.TrimSpace(parts[1])
+		if m.normalize != nil {
+			domain = m.normalize(domain)
+		}
 
 		if !isValidDomain(domain) {
 			linesSkipped++
 			logger.Debug("Skipping invalid domain", "domain", domain)
+			m.quarantine.Write(m.origin, source, "invalid domain", line)
 			continue
 		}
 
@@ -62,12 +277,79 @@ func (m *Merger) AddContent(content []byte) error {
 		if err != nil {
 			linesSkipped++
 			logger.Debug("Skipping line with invalid count", "line", line, "error", err)
+			m.quarantine.Write(m.origin, source, "invalid count", line)
+			continue
+		}
+
+		if qtype != "" && !ValidQType(qtype) {
+			linesSkipped++
+			logger.Debug("Skipping line with invalid query type", "line", line)
+			m.quarantine.Write(m.origin, source, "invalid qtype", line)
 			continue
 		}
 
-		m.data[domain] += count
+		var clients *hll
+		var clientHash uint64
+		if m.clients {
+			clients, clientHash, err = parseClient(client)
+			if err != nil {
+				linesSkipped++
+				logger.Debug("Skipping line with invalid client", "line", line, "error", err)
+				m.quarantine.Write(m.origin, source, "invalid client", line)
+				continue
+			}
+		}
+
+		if !m.filter.Allowed(domain) || (m.qtypes != nil && qtype != "" && !m.qtypes[qtype]) {
+			linesFiltered++
+			continue
+		}
+		if seen != nil {
+			seen.add(domain)
+		}
+		if m.byQType {
+			domain = qtypeKey(domain, qtype)
+		}
+
+		batch[domain] += count
+		switch {
+		case clients != nil:
+			batchClients, _ = addClients(batchClients, domain, clients)
+		case clientHash != 0:
+			sketch, ok := batchClients[domain]
+			if !ok {
+				sketch = &hll{}
+				batchClients[domain] = sketch
+			}
+			sketch.add(clientHash)
+		}
 		linesProcessed++
+		requests += count
+
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.linesFiltered += linesFiltered
+	m.linesSkipped += linesSkipped
+	if source != "" {
+		m.addSourceStats(SourceStats{
+			Source:        source,
+			Lines:         linesProcessed,
+			Requests:      requests,
+			UniqueDomains: seen.count(),
+			Skipped:       linesSkipped,
+		})
 	}
+	m.mu.Unlock()
 
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("error reading content: %w", err)
@@ -76,45 +358,249 @@ func (m *Merger) AddContent(content []byte) error {
 	logger.Debug("Processed content",
 		"lines_processed", linesProcessed,
 		"lines_skipped", linesSkipped,
-		"unique_domains", len(m.data),
+		"lines_filtered", linesFiltered,
 	)
 
 	return nil
 }
 
-func (m *Merger) GetSortedStats() []DomainStats {
-	stats := make([]DomainStats, 0, len(m.data))
+// Merge adds all counts of other to m, so per-goroutine mergers can be
+// combined once their downloads finish. other is left unchanged; filters
+// are not applied again.
+func (m *Merger) Merge(other *Merger) error {
+	if other == m {
+		return fmt.Errorf("cannot merge a merger into itself")
+	}
 
-	for domain, count := range m.data {
-		stats = append(stats, DomainStats{
-			Domain: domain,
-			Count:  count,
-		})
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	added := 0
+	err := other.store.visit(func(domain string, count int, clients *hll) error {
+		return m.addMerged(&added, domain, count, clients)
+	})
+	if err == nil {
+		err = m.account()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to merge: %w", err)
+	}
+	m.linesFiltered += other.linesFiltered
+	m.linesSkipped += other.linesSkipped
+	for _, s := range other.sources {
+		m.addSourceStats(*s)
+	}
+	return nil
+}
+
+// MergeSource adds all counts of other to m as the input source, with the
+// same filtering and source statistics as saving other with SaveToFile and
+// adding the file with AddSource, but without the file. other is left
+// unchanged. A source may be added in several parts; its unique domains are
+// counted once across them.
+func (m *Merger) MergeSource(source string, other *Merger) error {
+	if other == m {
+		return fmt.Errorf("cannot merge a merger into itself")
 	}
 
-	// Sort by count (descending)
-	sort.Slice(stats, func(i, j int) bool {
-		return stats[i].Count > stats[j].Count
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.domains == nil {
+		m.domains = make(map[string]*distinct)
+	}
+	seen, ok := m.domains[source]
+	if !ok {
+		seen = &distinct{}
+		m.domains[source] = seen
+	}
+	before := seen.count()
+
+	stats := SourceStats{Source: source}
+	added := 0
+	// In domain order, so that the query types of a domain count as one
+	// domain
+	var domains domainCounter
+	err := other.store.eachDomain(func(domain string, count int, clients *hll) error {
+		d, _ := splitQTypeKey(domain)
+		if !m.filter.Allowed(d) {
+			m.linesFiltered++
+			return nil
+		}
+		stats.Lines++
+		stats.Requests += count
+		if domains.add(domain) {
+			seen.add(d)
+		}
+		return m.addMerged(&added, domain, count, clients)
 	})
+	stats.UniqueDomains = max(seen.count()-before, 0)
+	if err == nil {
+		err = m.account()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to merge: %w", err)
+	}
+	m.addSourceStats(stats)
+	return nil
+}
 
+// addMerged adds an entry of another merger, whose sketch stays with the
+// other merger, and updates the memory budget every batchSize entries
+// counted in added. m.mu must be held.
+func (m *Merger) addMerged(added *int, domain string, count int, clients *hll) error {
+	if err := m.store.add(domain, count, clients.clone()); err != nil {
+		return err
+	}
+	if *added++; *added%batchSize == 0 {
+		return m.account()
+	}
+	return nil
+}
+
+// addSourceStats adds s to the totals of its source. m.mu must be held.
+func (m *Merger) addSourceStats(s SourceStats) {
+	if m.sources == nil {
+		m.sources = make(map[string]*SourceStats)
+	}
+	total, ok := m.sources[s.Source]
+	if !ok {
+		total = &SourceStats{Source: s.Source}
+		m.sources[s.Source] = total
+	}
+	total.Lines += s.Lines
+	total.Requests += s.Requests
+	total.UniqueDomains += s.UniqueDomains
+	total.Skipped += s.Skipped
+}
+
+// sourceStats returns the per-source totals ordered by source name. m.mu
+// must be held.
+func (m *Merger) sourceStats() []SourceStats {
+	stats := make([]SourceStats, 0, len(m.sources))
+	for _, s := range m.sources {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Source < stats[j].Source })
 	return stats
 }
 
-func (m *Merger) SaveToFile(filename string) (string, error) {
-	// Ensure work directory exists
-	if m.workDir != "" && m.workDir != "." {
-		if err := os.MkdirAll(m.workDir, 0755); err != nil {
-			return "", fmt.Errorf("failed to create work directory: %w", err)
+// Sources returns what each input added with AddSource contributed,
+// ordered by source name.
+func (m *Merger) Sources() []SourceStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sourceStats()
+}
+
+// GetSortedStats returns all domains in descending count order. With the
+// disk engine this loads the whole result into memory.
+func (m *Merger) GetSortedStats() []DomainStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats []DomainStats
+	m.each(func(stat DomainStats) error {
+		if stat.Count >= m.minCount {
+			stats = append(stats, stat)
+		}
+		return nil
+	})
+	return stats
+}
+
+// each walks the store like store.each, with the query type split off the
+// key when the breakdown is enabled.
+func (m *Merger) each(fn func(DomainStats) error) error {
+	if !m.byQType {
+		return m.store.each(fn)
+	}
+	return m.store.each(func(stat DomainStats) error {
+		stat.Domain, stat.QType = splitQTypeKey(stat.Domain)
+		return fn(stat)
+	})
+}
+
+// errStop ends a store walk early.
+var errStop = errors.New("stop")
+
+// Top returns the n domains with the most requests, in descending count
+// order. Unlike GetSortedStats it keeps only n domains in memory.
+func (m *Merger) Top(n int) []DomainStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats []DomainStats
+	if n <= 0 {
+		return stats
+	}
+	m.each(func(stat DomainStats) error {
+		// Counts only decrease from here on
+		if stat.Count < m.minCount {
+			return errStop
 		}
+		stats = append(stats, stat)
+		if len(stats) == n {
+			return errStop
+		}
+		return nil
+	})
+	return stats
+}
+
+// SaveToFile writes the merged data as domain|count lines, which AddReader
+// reads back. The query type (with the breakdown by query type) and the
+// client sketch (with client tracking) are kept as extra columns. The
+// layout does not apply.
+func (m *Merger) SaveToFile(filename string) (string, error) {
+	layout := Layout{Columns: []string{ColumnDomain}}
+	if m.byQType {
+		layout.Columns = append(layout.Columns, ColumnQType)
 	}
+	layout.Columns = append(layout.Columns, ColumnCount)
+	if m.clients {
+		layout.Columns = append(layout.Columns, columnSketch)
+	}
+	return m.save(filename, FormatPipe, layout)
+}
 
+// SaveAs writes the merged data in the given format (FormatPipe, FormatCSV
+// or FormatJSONL) to filename and returns its path. A relative filename is
+// placed in the work directory.
+func (m *Merger) SaveAs(filename, format string) (string, error) {
+	return m.save(filename, format, m.layout)
+}
+
+func (m *Merger) save(filename, format string, layout Layout) (string, error) {
 	// Generate filename with timestamp if not provided
 	if filename == "" {
 		filename = fmt.Sprintf("MERGED_WEEK_%s.log", time.Now().Format("20060102_150405"))
 	}
 
 	// Build full path
-	fullPath := filepath.Join(m.workDir, filename)
+	fullPath := filename + CompressionExtension(m.compression)
+	if !filepath.IsAbs(fullPath) {
+		fullPath = filepath.Join(m.workDir, fullPath)
+	}
+
+	// Ensure the target directory exists
+	if dir := filepath.Dir(fullPath); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	// An existing file is replaced, which gives its space back
+	space := m.space
+	if !space.Contains(fullPath) {
+		space = nil
+	} else if info, err := os.Stat(fullPath); err == nil {
+		space.Release(info.Size())
+	}
 
 	// Create file
 	file, err := os.Create(fullPath)
@@ -122,64 +608,205 @@ func (m *Merger) SaveToFile(filename string) (string, error) {
 		return "", fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
+	guarded := space.Writer(file)
+	defer guarded.Done()
 
-	// Get sorted stats
-	stats := m.GetSortedStats()
+	compressor, err := newCompressor(guarded, m.compression)
+	if err != nil {
+		return "", err
+	}
+	writer := bufio.NewWriter(compressor)
+	var out io.Writer = writer
+	if layout.NoFinalNewline {
+		out = &finalNewlineWriter{w: writer}
+	}
+	records, err := newRecordWriter(out, format, layout)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The shares need the total of the written domains up front
+	var shares shares
+	if layout.Shares() {
+		s, err := m.summarize()
+		if err != nil {
+			return "", fmt.Errorf("failed to read merged data: %w", err)
+		}
+		shares.total = s.totalRequests
+	}
 
-	// Write to file
-	for _, stat := range stats {
-		if _, err := fmt.Fprintf(file, "%s|%d\n", stat.Domain, stat.Count); err != nil {
-			return "", fmt.Errorf("failed to write to file: %w", err)
+	// Write domains in descending count order
+	summary := summary{minCount: m.minCount}
+	err = m.each(func(stat DomainStats) error {
+		if !summary.add(stat) {
+			return nil
 		}
+		return records.write(shares.record(stat))
+	})
+	if err == nil {
+		err = m.countDomains(&summary)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	if err := records.flush(); err != nil {
+		return "", fmt.Errorf("failed to write to file: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write to file: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish compression: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to close file: %w", err)
 	}
 
 	logger.Info("Merge completed",
 		"file", fullPath,
-		"unique_domains", len(stats),
-		"total_requests", m.getTotalRequests(stats),
+		"unique_domains", summary.uniqueDomains,
+		"total_requests", summary.totalRequests,
+		"suppressed_domains", summary.suppressedDomains,
 	)
 
 	return fullPath, nil
 }
 
-func (m *Merger) getTotalRequests(stats []DomainStats) int {
-	total := 0
-	for _, stat := range stats {
-		total += stat.Count
+// summary accumulates statistics while domains are visited in descending
+// count order. Domains below minCount are counted as suppressed. With the
+// breakdown by query type the visited rows are domain/query type pairs, to
+// which minCount applies; countDomains then counts the domains.
+type summary struct {
+	minCount           int
+	uniqueDomains      int
+	totalRequests      int
+	top                DomainStats
+	suppressedDomains  int
+	suppressedRequests int
+}
+
+// add records stat and reports whether it passes the threshold.
+func (s *summary) add(stat DomainStats) bool {
+	if stat.Count < s.minCount {
+		s.suppressedDomains++
+		s.suppressedRequests += stat.Count
+		return false
+	}
+	if s.uniqueDomains == 0 {
+		s.top = stat
 	}
-	return total
+	s.uniqueDomains++
+	s.totalRequests += stat.Count
+	return true
 }
 
-func (m *Merger) GetStats() map[string]interface{} {
-	stats := m.GetSortedStats()
-	return map[string]interface{}{
-		"unique_domains":  len(stats),
-		"total_requests":  m.getTotalRequests(stats),
-		"top_domain":      m.getTopDomain(stats),
-		"top_domain_hits": m.getTopDomainHits(stats),
+func (m *Merger) summarize() (summary, error) {
+	s := summary{minCount: m.minCount}
+	err := m.each(func(stat DomainStats) error {
+		s.add(stat)
+		return nil
+	})
+	if err == nil {
+		err = m.countDomains(&s)
 	}
+	return s, err
 }
 
-func (m *Merger) getTopDomain(stats []DomainStats) string {
-	if len(stats) > 0 {
-		return stats[0].Domain
+// countDomains replaces the unique and suppressed rows of s by distinct
+// domains when the rows are domain/query type pairs: a domain is unique when
+// one of its pairs reaches minCount and suppressed when none does. The
+// suppressed requests remain those of all suppressed pairs. m.mu must be
+// held.
+func (m *Merger) countDomains(s *summary) error {
+	if !m.byQType {
+		return nil
 	}
-	return "N/A"
+
+	s.uniqueDomains, s.suppressedDomains = 0, 0
+	var domains domainCounter
+	pending, kept := false, false
+	finish := func() {
+		switch {
+		case !pending:
+		case kept:
+			s.uniqueDomains++
+		default:
+			s.suppressedDomains++
+		}
+	}
+	err := m.store.eachDomain(func(key string, count int, _ *hll) error {
+		if domains.add(key) {
+			finish()
+			pending, kept = true, false
+		}
+		kept = kept || count >= m.minCount
+		return nil
+	})
+	finish()
+	return err
 }
 
-func (m *Merger) getTopDomainHits(stats []DomainStats) int {
-	if len(stats) > 0 {
-		return stats[0].Count
+func (m *Merger) GetStats() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.summarize()
+	if err != nil {
+		logger.Error("Failed to read merged data", "error", err)
+	}
+
+	topDomain := "N/A"
+	if s.uniqueDomains > 0 {
+		topDomain = s.top.Domain
+	}
+
+	return map[string]interface{}{
+		"unique_domains":  s.uniqueDomains,
+		"total_requests":  s.totalRequests,
+		"top_domain":      topDomain,
+		"top_domain_hits": s.top.Count,
+		"filtered_lines":  m.linesFiltered,
+		"skipped_lines":   m.linesSkipped,
+
+		"suppressed_domains":  s.suppressedDomains,
+		"suppressed_requests": s.suppressedRequests,
+
+		"sources": m.sourceStats(),
 	}
-	return 0
 }
 
+// Clear discards all data, including temporary files of the disk engine.
 func (m *Merger) Clear() {
-	m.data = make(map[string]int)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store.close()
+	m.linesFiltered = 0
+	m.linesSkipped = 0
+	m.sources = nil
 }
 
+// Close removes temporary files kept by the disk engine.
+func (m *Merger) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.release()
+	return m.store.close()
+}
+
+// GetDomainCount returns the number of distinct domains written by SaveAs,
+// however many query types they have.
 func (m *Merger) GetDomainCount() int {
-	return len(m.data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, _ := m.summarize()
+	return s.uniqueDomains
 }
 
 func isValidDomain(d string) bool {
@@ -187,6 +814,11 @@ func isValidDomain(d string) bool {
 		return false
 	}
 
+	// Whitespace would also clash with qtypeSeparator
+	if strings.IndexFunc(d, unicode.IsSpace) >= 0 {
+		return false
+	}
+
 	if strings.Contains(d, "#") {
 		return false
 	}
@@ -0,0 +1,63 @@
+package merger
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Supported domain normalization modes.
+const (
+	// NormalizeNone keeps domains exactly as logged.
+	NormalizeNone = "none"
+	// NormalizeBasic lowercases domains and strips the trailing dot.
+	NormalizeBasic = "basic"
+	// NormalizeIDNA additionally converts internationalized names to
+	// punycode (xn--...).
+	NormalizeIDNA = "idna"
+)
+
+// normalizer rewrites domains before they are filtered and counted, so
+// spellings that differ only in case or a trailing dot are merged.
+type normalizer func(domain string) string
+
+func newNormalizer(mode string) (normalizer, error) {
+	switch mode {
+	case NormalizeNone, "":
+		return nil, nil
+	case NormalizeBasic:
+		return normalizeBasic, nil
+	case NormalizeIDNA:
+		return normalizeIDNA, nil
+	default:
+		return nil, fmt.Errorf("unsupported domain normalization: %s", mode)
+	}
+}
+
+func normalizeBasic(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// normalizeIDNA converts non-ASCII labels to punycode. Names that cannot be
+// converted are kept in their basic form rather than dropped.
+func normalizeIDNA(domain string) string {
+	domain = normalizeBasic(domain)
+	if isASCII(domain) {
+		return domain
+	}
+	ascii, err := idna.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+	return strings.ToLower(ascii)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package merger
+
+import (
+	"strings"
+)
+
+// qtypeSeparator joins domain and query type in the keys of the store when
+// the breakdown by query type is enabled. isValidDomain rejects domains
+// containing it.
+const qtypeSeparator = " "
+
+func qtypeKey(domain, qtype string) string {
+	if qtype == "" {
+		return domain
+	}
+	return domain + qtypeSeparator + qtype
+}
+
+func splitQTypeKey(key string) (domain, qtype string) {
+	domain, qtype, _ = strings.Cut(key, qtypeSeparator)
+	return domain, qtype
+}
+
+// splitLine splits an input line into its columns: domain|count, with the
+// query type after the domain when qtypeColumn is set and the client after
+// the count when clientColumn is set (domain|qtype|count|client). Lines
+// without a query type or client (domain|count, or with both columns
+// configured domain|qtype|count) are accepted too. Any other number of
+// columns makes the line malformed, so that extra columns are only read
+// when the feature they belong to is on.
+func splitLine(line string, qtypeColumn, clientColumn bool) (domain, qtype, count, client string, ok bool) {
+	parts := strings.Split(line, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	switch {
+	case len(parts) == 2:
+		domain, count = parts[0], parts[1]
+	case len(parts) == 3 && qtypeColumn:
+		domain, qtype, count = parts[0], parts[1], parts[2]
+	case len(parts) == 3 && clientColumn:
+		domain, count, client = parts[0], parts[1], parts[2]
+	case len(parts) == 4 && qtypeColumn && clientColumn:
+		domain, qtype, count, client = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return "", "", "", "", false
+	}
+	return domain, strings.ToUpper(qtype), count, client, true
+}
+
+// ValidQType reports whether qtype is a query type name such as A, AAAA or
+// TYPE65: an upper-case letter followed by letters and digits.
+func ValidQType(qtype string) bool {
+	if qtype == "" || len(qtype) > 16 || qtype[0] < 'A' || qtype[0] > 'Z' {
+		return false
+	}
+	return strings.Trim(qtype, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") == ""
+}
+
+// domainCounter counts the distinct domains among store keys visited in
+// key order. The keys of a domain are adjacent in that order, as the
+// separator sorts before every character of a domain.
+type domainCounter struct {
+	last string
+	n    int
+}
+
+// add counts the domain of key unless it is the domain of the previous key
+// and reports whether it was new.
+func (c *domainCounter) add(key string) bool {
+	domain, _ := splitQTypeKey(key)
+	if c.n > 0 && domain == c.last {
+		return false
+	}
+	c.last = domain
+	c.n++
+	return true
+}
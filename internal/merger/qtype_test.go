@@ -0,0 +1,94 @@
+package merger
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gih-ftp/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init("error", logger.Options{})
+	os.Exit(m.Run())
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line                   string
+		qtypeColumn, clientCol bool
+		domain, qtype, count   string
+		client                 string
+		ok                     bool
+	}{
+		{line: "foo.com|5", domain: "foo.com", count: "5", ok: true},
+		{line: "foo.com|TXT|5"},
+		{line: "foo.com|5|junk"},
+		{line: "foo.com|a|5|192.0.2.1"},
+		{line: "foo.com|txt|5", qtypeColumn: true, domain: "foo.com", qtype: "TXT", count: "5", ok: true},
+		{line: "foo.com|5|192.0.2.1", clientCol: true, domain: "foo.com", count: "5", client: "192.0.2.1", ok: true},
+		// The layout comes from the configured columns, not the values
+		{line: "foo.com|65|5", qtypeColumn: true, domain: "foo.com", qtype: "65", count: "5", ok: true},
+		{line: "foo.com|5|42", clientCol: true, domain: "foo.com", count: "5", client: "42", ok: true},
+		{line: "foo.com|A|5", qtypeColumn: true, clientCol: true, domain: "foo.com", qtype: "A", count: "5", ok: true},
+		{line: "foo.com|A|5|192.0.2.1", qtypeColumn: true, clientCol: true, domain: "foo.com", qtype: "A", count: "5", client: "192.0.2.1", ok: true},
+		{line: "foo.com|A|5|192.0.2.1", qtypeColumn: true},
+		{line: "foo.com|A|5|192.0.2.1|x", qtypeColumn: true, clientCol: true},
+	}
+	for _, tt := range tests {
+		domain, qtype, count, client, ok := splitLine(tt.line, tt.qtypeColumn, tt.clientCol)
+		if ok != tt.ok || domain != tt.domain || qtype != tt.qtype || count != tt.count || client != tt.client {
+			t.Errorf("splitLine(%q, %v, %v) = %q, %q, %q, %q, %v, want %q, %q, %q, %q, %v",
+				tt.line, tt.qtypeColumn, tt.clientCol, domain, qtype, count, client, ok,
+				tt.domain, tt.qtype, tt.count, tt.client, tt.ok)
+		}
+	}
+}
+
+// merge adds input to a new merger set up by setup and returns its domains
+// as domain[/qtype]=count in descending count order, and its skipped lines.
+func merge(t *testing.T, input string, setup func(*Merger)) ([]string, int) {
+	t.Helper()
+	m := New(t.TempDir())
+	defer m.Close()
+	if setup != nil {
+		setup(m)
+	}
+	if err := m.AddReader(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, stat := range m.GetSortedStats() {
+		key := stat.Domain
+		if stat.QType != "" {
+			key += "/" + stat.QType
+		}
+		got = append(got, key+"="+strconv.Itoa(stat.Count))
+	}
+	return got, m.GetStats()["skipped_lines"].(int)
+}
+
+func TestThreeColumnLinesNeedTheirFeature(t *testing.T) {
+	input := "foo.com|7\nfoo.com|TXT|5\nbar.com|5|junk\n"
+
+	got, skipped := merge(t, input, nil)
+	if want := []string{"foo.com=7"}; !slices.Equal(got, want) || skipped != 2 {
+		t.Errorf("without the breakdown got %v with %d skipped, want %v with 2 skipped", got, skipped, want)
+	}
+
+	got, skipped = merge(t, input, func(m *Merger) { m.SetQTypeBreakdown(true) })
+	if want := []string{"foo.com=7", "foo.com/TXT=5"}; !slices.Equal(got, want) || skipped != 1 {
+		t.Errorf("with the breakdown got %v with %d skipped, want %v with 1 skipped", got, skipped, want)
+	}
+}
+
+func TestDomainWithSpaceIsSkipped(t *testing.T) {
+	input := "foo bar.com|A|5\nfoo.com|A|3\n"
+	got, skipped := merge(t, input, func(m *Merger) { m.SetQTypeBreakdown(true) })
+	if want := []string{"foo.com/A=3"}; !slices.Equal(got, want) || skipped != 1 {
+		t.Errorf("got %v with %d skipped, want %v with 1 skipped", got, skipped, want)
+	}
+}
@@ -0,0 +1,113 @@
+package merger
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gih-ftp/internal/logger"
+)
+
+// Quarantine collects the malformed lines skipped while merging in a file,
+// one tab-separated "origin source reason line" record per line. The file
+// is only created once the first line is written. A nil Quarantine discards
+// everything.
+type Quarantine struct {
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	lines int
+	err   error
+}
+
+func NewQuarantine(path string) *Quarantine {
+	return &Quarantine{path: path}
+}
+
+// Write records one skipped line. Write errors are logged once; further
+// lines are dropped.
+func (q *Quarantine) Write(origin, source, reason, line string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return
+	}
+	if q.file == nil {
+		if err := q.open(); err != nil {
+			q.err = err
+			logger.Warn("Failed to open quarantine file, malformed lines are not kept", "file", q.path, "error", err)
+			return
+		}
+	}
+
+	if origin == "" {
+		origin = "-"
+	}
+	if source == "" {
+		source = "-"
+	}
+	if _, err := fmt.Fprintf(q.w, "%s\t%s\t%s\t%s\n", origin, source, reason, strings.ReplaceAll(line, "\t", " ")); err != nil {
+		q.err = err
+		logger.Warn("Failed to write quarantine file, malformed lines are not kept", "file", q.path, "error", err)
+		return
+	}
+	q.lines++
+}
+
+func (q *Quarantine) open() error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.file = file
+	q.w = bufio.NewWriter(file)
+	return nil
+}
+
+// Path returns the quarantine file.
+func (q *Quarantine) Path() string {
+	return q.path
+}
+
+// Lines returns how many lines were written.
+func (q *Quarantine) Lines() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lines
+}
+
+// Close flushes and closes the file, if it was created.
+func (q *Quarantine) Close() error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+	err := q.w.Flush()
+	if cerr := q.file.Close(); err == nil {
+		err = cerr
+	}
+	q.file = nil
+	return err
+}
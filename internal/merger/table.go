@@ -0,0 +1,211 @@
+package merger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"slices"
+)
+
+// The arena of a table is made of chunks of chunkSize bytes, so that it
+// grows without copying and an offset fits in 32 bits.
+const (
+	chunkBits      = 20
+	chunkSize      = 1 << chunkBits
+	maxChunks      = 1 << (32 - chunkBits)
+	firstChunkSize = 4096
+)
+
+// bigCount marks an entry whose count does not fit in 32 bits and is kept
+// in table.big instead.
+const bigCount uint32 = math.MaxUint32
+
+// table maps domains to counts with far less memory than a Go map: every
+// domain is stored once in an arena as a 32-bit count, its length and its
+// bytes, and the open-addressing hash table (linear probing) only holds
+// 32-bit arena offsets. Keys are compared in the arena, so no string is
+// kept per domain. Entries are never removed.
+type table struct {
+	seed maphash.Seed
+
+	// slots holds the arena offset of an entry plus one, 0 when empty; its
+	// length is a power of two
+	slots []uint32
+	n     int
+
+	chunks [][]byte
+
+	// big holds the counts outside 0..bigCount-1, by arena offset
+	big map[uint32]int
+}
+
+func newTable() *table {
+	return &table{seed: maphash.MakeSeed()}
+}
+
+// len returns the number of domains.
+func (t *table) len() int {
+	return t.n
+}
+
+// bytes returns the memory held by t.
+func (t *table) bytes() int64 {
+	size := int64(4*cap(t.slots)) + int64(48*len(t.big))
+	for _, chunk := range t.chunks {
+		size += int64(cap(chunk))
+	}
+	return size
+}
+
+// add adds count to domain and returns by how many bytes t grew.
+func (t *table) add(domain string, count int) (int64, error) {
+	if t.slots == nil {
+		t.slots = make([]uint32, 16)
+	}
+
+	h := maphash.String(t.seed, domain)
+	mask := uint64(len(t.slots) - 1)
+	for i := h & mask; t.slots[i] != 0; i = (i + 1) & mask {
+		off := t.slots[i] - 1
+		if string(t.key(off)) == domain {
+			t.setCount(off, t.count(off)+count)
+			return 0, nil
+		}
+	}
+
+	before := t.bytes()
+	off, err := t.append(domain)
+	if err != nil {
+		return 0, err
+	}
+	t.setCount(off, count)
+	// Grow at a load of 4/5
+	if (t.n+1)*5 > len(t.slots)*4 {
+		t.grow()
+	}
+	t.place(h, off+1)
+	t.n++
+	return t.bytes() - before, nil
+}
+
+// place stores the slot value v in the first free slot for hash h.
+func (t *table) place(h uint64, v uint32) {
+	mask := uint64(len(t.slots) - 1)
+	i := h & mask
+	for t.slots[i] != 0 {
+		i = (i + 1) & mask
+	}
+	t.slots[i] = v
+}
+
+func (t *table) grow() {
+	old := t.slots
+	t.slots = make([]uint32, 2*len(old))
+	for _, v := range old {
+		if v != 0 {
+			t.place(maphash.Bytes(t.seed, t.key(v-1)), v)
+		}
+	}
+}
+
+// append adds an entry for domain to the arena and returns its offset.
+func (t *table) append(domain string) (uint32, error) {
+	need := 4 + binary.MaxVarintLen64 + len(domain)
+	last := len(t.chunks) - 1
+	if last < 0 || len(t.chunks[last])+need > chunkSize {
+		if len(t.chunks) == maxChunks {
+			return 0, fmt.Errorf("merge data exceeds %d GB of domains, use the disk engine", maxChunks*chunkSize>>30)
+		}
+		// The first chunk grows like a slice, so small tables stay small
+		size := chunkSize
+		if last < 0 {
+			size = firstChunkSize
+		}
+		t.chunks = append(t.chunks, make([]byte, 0, size))
+		last++
+	}
+
+	chunk := t.chunks[last]
+	off := uint32(last)<<chunkBits | uint32(len(chunk))
+	chunk = binary.LittleEndian.AppendUint32(chunk, 0)
+	chunk = binary.AppendUvarint(chunk, uint64(len(domain)))
+	t.chunks[last] = append(chunk, domain...)
+	return off, nil
+}
+
+// entry returns the arena from the entry at off on.
+func (t *table) entry(off uint32) []byte {
+	return t.chunks[off>>chunkBits][off&(chunkSize-1):]
+}
+
+func (t *table) key(off uint32) []byte {
+	e := t.entry(off)[4:]
+	n, size := binary.Uvarint(e)
+	return e[size : size+int(n)]
+}
+
+func (t *table) count(off uint32) int {
+	c := binary.LittleEndian.Uint32(t.entry(off))
+	if c == bigCount {
+		return t.big[off]
+	}
+	return int(c)
+}
+
+func (t *table) setCount(off uint32, count int) {
+	// Compared as uint64, as int may be 32 bits wide
+	if count >= 0 && uint64(count) < uint64(bigCount) {
+		binary.LittleEndian.PutUint32(t.entry(off), uint32(count))
+		delete(t.big, off)
+		return
+	}
+	if t.big == nil {
+		t.big = make(map[uint32]int)
+	}
+	binary.LittleEndian.PutUint32(t.entry(off), bigCount)
+	t.big[off] = count
+}
+
+// each calls fn for every domain in no particular order. The key is only
+// valid during the call.
+func (t *table) each(fn func(key []byte, count int) error) error {
+	for _, v := range t.slots {
+		if v == 0 {
+			continue
+		}
+		if err := fn(t.key(v-1), t.count(v-1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sorted returns the offsets of all entries ordered by cmp.
+func (t *table) sorted(cmp func(a, b uint32) int) []uint32 {
+	offs := make([]uint32, 0, t.n)
+	for _, v := range t.slots {
+		if v != 0 {
+			offs = append(offs, v-1)
+		}
+	}
+	slices.SortFunc(offs, cmp)
+	return offs
+}
+
+// byCount orders entries like lessStats: descending count, ties by domain.
+func (t *table) byCount(a, b uint32) int {
+	if ca, cb := t.count(a), t.count(b); ca != cb {
+		if ca > cb {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(t.key(a), t.key(b))
+}
+
+// byDomain orders entries by domain.
+func (t *table) byDomain(a, b uint32) int {
+	return bytes.Compare(t.key(a), t.key(b))
+}
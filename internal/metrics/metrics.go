@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric names exported by the service.
+const (
+	RunDuration          = "gihftp_run_duration_seconds"
+	RunExitCode          = "gihftp_run_exit_code"
+	DownloadedBytes      = "gihftp_downloaded_bytes"
+	UploadedBytes        = "gihftp_uploaded_bytes"
+	UniqueDomains        = "gihftp_unique_domains"
+	TotalRequests        = "gihftp_total_requests"
+	ServerFailures       = "gihftp_server_failures_total"
+	LastSuccessTimestamp = "gihftp_last_success_timestamp_seconds"
+	StageDuration        = "gihftp_stage_duration_seconds"
+	ServerFetchDuration  = "gihftp_server_fetch_duration_seconds"
+	UploadDuration       = "gihftp_upload_duration_seconds"
+)
+
+type definition struct {
+	kind string
+	help string
+}
+
+var definitions = map[string]definition{
+	RunDuration:          {"gauge", "Duration of the last run in seconds."},
+	RunExitCode:          {"gauge", "Exit code of the last run."},
+	DownloadedBytes:      {"gauge", "Bytes downloaded from GIH servers in the last run."},
+	UploadedBytes:        {"gauge", "Bytes uploaded to the remote server in the last run."},
+	UniqueDomains:        {"gauge", "Unique domains in the last merged file."},
+	TotalRequests:        {"gauge", "Total requests in the last merged file."},
+	ServerFailures:       {"counter", "Failed fetches per GIH server."},
+	LastSuccessTimestamp: {"gauge", "Unix timestamp of the last successful run."},
+	StageDuration:        {"gauge", "Duration of each stage (fetch, merge, save, upload) of the last run in seconds."},
+	ServerFetchDuration:  {"gauge", "Duration of the fetch from each GIH server in the last run in seconds."},
+	UploadDuration:       {"gauge", "Duration of the upload to each target in the last run in seconds."},
+}
+
+// Registry holds the current value of every sample, keyed by metric name and
+// rendered label set.
+type Registry struct {
+	mu      sync.Mutex
+	samples map[string]map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{samples: make(map[string]map[string]float64)}
+}
+
+// Default is the registry used by the package-level helpers.
+var Default = NewRegistry()
+
+func Set(name string, value float64, labels ...string) {
+	Default.Set(name, value, labels...)
+}
+
+func Add(name string, delta float64, labels ...string) {
+	Default.Add(name, delta, labels...)
+}
+
+// Reset removes every sample of name from the Default registry.
+func Reset(name string) {
+	Default.Reset(name)
+}
+
+// Set stores value for the sample identified by name and the given
+// label key/value pairs.
+func (r *Registry) Set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name)[renderLabels(labels)] = value
+}
+
+// Add increments the sample identified by name and labels by delta.
+func (r *Registry) Add(name string, delta float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name)[renderLabels(labels)] += delta
+}
+
+// Reset removes every sample of name, so that label sets of an earlier run
+// (a server or target no longer configured) are not exported any more.
+func (r *Registry) Reset(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.samples, name)
+}
+
+func (r *Registry) series(name string) map[string]float64 {
+	s, ok := r.samples[name]
+	if !ok {
+		s = make(map[string]float64)
+		r.samples[name] = s
+	}
+	return s
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", labels[i], strconv.Quote(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText writes all samples in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.samples))
+	for name := range r.samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		if def, ok := definitions[name]; ok {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, def.help)
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, def.kind)
+		}
+
+		series := r.samples[name]
+		keys := make([]string, 0, len(series))
+		for k := range series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(bw, "%s%s %s\n", name, k, strconv.FormatFloat(series[k], 'g', -1, 64))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves the registry for Prometheus scraping.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// WriteTextfile atomically replaces path with the current samples, for the
+// node_exporter textfile collector.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gihftp-metrics-*")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := r.WriteText(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadTextfile restores samples that must survive between one-shot runs
+// (the last success timestamp and failure counters) from a textfile written
+// by a previous run. A missing file is not an error.
+func (r *Registry) LoadTextfile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		series, valueStr, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			continue
+		}
+
+		name, labels := series, ""
+		if i := strings.IndexByte(series, '{'); i >= 0 {
+			name, labels = series[:i], series[i:]
+		}
+
+		if name == LastSuccessTimestamp || name == ServerFailures {
+			r.series(name)[labels] = value
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,241 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/report"
+)
+
+// Event classifies a finished run.
+type Event string
+
+const (
+	EventSuccess Event = "success"
+	EventPartial Event = "partial"
+	EventFailure Event = "failure"
+	EventAnomaly Event = "anomaly"
+	EventEmpty   Event = "empty"
+)
+
+// Message is what gets delivered to every backend.
+type Message struct {
+	Event   Event
+	Subject string
+	Text    string
+	Report  *report.Report
+}
+
+// Notifier delivers a message to one backend.
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// NewMessage builds a human-readable summary of the report.
+func NewMessage(event Event, rep *report.Report) Message {
+	hostname, _ := os.Hostname()
+
+	subject := fmt.Sprintf("[gihftp] %s on %s (exit code %d)", strings.ToUpper(string(event)), hostname, rep.ExitCode)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GIH-FTP run %s on %s\n", event, hostname)
+	fmt.Fprintf(&b, "Date range: %s - %s\n", rep.StartDate, rep.EndDate)
+	fmt.Fprintf(&b, "Exit code: %d, duration: %.1fs\n", rep.ExitCode, rep.DurationSeconds)
+
+	for _, s := range rep.Servers {
+		status := "ok"
+		if s.Error != "" {
+			status = "FAILED: " + s.Error
+		}
+		fmt.Fprintf(&b, "Server %s: %d files, %d failed, %s\n", s.Host, s.Files, s.FilesFailed, status)
+	}
+
+	if rep.Merge != nil {
+		fmt.Fprintf(&b, "Unique domains: %d, total requests: %d\n", rep.Merge.UniqueDomains, rep.Merge.TotalRequests)
+	}
+	for _, a := range rep.Anomalies {
+		scope := "Total"
+		if a.Server != "" {
+			scope = "Server " + a.Server
+		}
+		fmt.Fprintf(&b, "%s %s changed %+.1f%%: %d -> %d\n", scope, a.Metric, a.ChangePercent, a.Previous, a.Current)
+	}
+	if d := rep.TopDiff; d != nil {
+		fmt.Fprintf(&b, "Top %d compared with %s - %s:", d.Top, d.PreviousStartDate, d.PreviousEndDate)
+		if d.Empty() {
+			b.WriteString(" no changes")
+		}
+		b.WriteString("\n")
+		for _, c := range d.Entered {
+			fmt.Fprintf(&b, "  entered: %s (#%d, %d requests)\n", c.Name(), c.Rank, c.Count)
+		}
+		for _, c := range d.Dropped {
+			fmt.Fprintf(&b, "  dropped: %s (was #%d)\n", c.Name(), c.PreviousRank)
+		}
+		for _, c := range d.Moved {
+			fmt.Fprintf(&b, "  moved: %s #%d -> #%d\n", c.Name(), c.PreviousRank, c.Rank)
+		}
+	}
+	if rep.Output != nil {
+		fmt.Fprintf(&b, "Output: %s (%d bytes)\n", rep.Output.Path, rep.Output.Size)
+	}
+	for _, o := range rep.Outputs {
+		fmt.Fprintf(&b, "Output: %s (%d bytes)\n", o.Path, o.Size)
+	}
+	for _, u := range rep.Uploads {
+		if u.Error != "" {
+			fmt.Fprintf(&b, "Upload to %s (%s) FAILED: %s\n", u.Target, u.Host, u.Error)
+		} else if u.Skipped {
+			fmt.Fprintf(&b, "Already uploaded to %s (%s) by an earlier run\n", u.Target, u.Host)
+		} else {
+			fmt.Fprintf(&b, "Uploaded to %s (%s): %s\n", u.Target, u.Host, strings.Join(u.RemotePaths, ", "))
+		}
+	}
+
+	return Message{
+		Event:   event,
+		Subject: subject,
+		Text:    b.String(),
+		Report:  rep,
+	}
+}
+
+// Webhook posts a JSON payload with a "text" field, which Slack and Teams
+// incoming webhooks render as a message. The event and full report are
+// included for generic receivers.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *Webhook) Notify(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(map[string]any{
+		"text":   msg.Subject + "\n" + msg.Text,
+		"event":  msg.Event,
+		"report": msg.Report,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// SMTP sends a plain-text e-mail. STARTTLS is used when the server offers
+// it; authentication is only attempted when Username is set.
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTP) Notify(_ context.Context, msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			host = s.Addr
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(b.String())); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+
+	return nil
+}
+
+// Dispatcher sends messages for the subscribed events to all backends.
+type Dispatcher struct {
+	events    map[Event]bool
+	notifiers []Notifier
+}
+
+// NewDispatcher subscribes to the given events.
+func NewDispatcher(events []Event, notifiers ...Notifier) *Dispatcher {
+	d := &Dispatcher{events: make(map[Event]bool), notifiers: notifiers}
+	for _, e := range events {
+		d.events[e] = true
+	}
+	return d
+}
+
+// Enabled reports whether any backend is configured.
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.notifiers) > 0
+}
+
+// Dispatch delivers msg to every backend if its event is subscribed and
+// returns the errors of the backends that failed.
+func (d *Dispatcher) Dispatch(ctx context.Context, msg Message) []error {
+	if !d.Enabled() || !d.events[msg.Event] {
+		return nil
+	}
+
+	var errs []error
+	for _, n := range d.notifiers {
+		if err := n.Notify(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ParseEvents parses a comma-separated list of event names.
+func ParseEvents(list string) ([]Event, error) {
+	var events []Event
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch Event(name) {
+		case EventSuccess, EventPartial, EventFailure, EventAnomaly, EventEmpty:
+			events = append(events, Event(name))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown event %q (must be success, partial, failure, anomaly or empty)", name)
+		}
+	}
+	return events, nil
+}
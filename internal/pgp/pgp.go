@@ -0,0 +1,98 @@
+// Package pgp encrypts files to OpenPGP public keys so that gpg --decrypt
+// can read them.
+package pgp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Suffix is appended to the name of an encrypted file.
+const Suffix = ".gpg"
+
+// armorPrefix starts an ASCII-armored key file.
+const armorPrefix = "-----BEGIN PGP"
+
+// IsKeyFile reports whether data looks like an OpenPGP key, ASCII-armored
+// or binary (a packet with the tag bit set).
+func IsKeyFile(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte(armorPrefix)) || (len(data) > 0 && data[0]&0x80 != 0)
+}
+
+// ReadKeys reads the public keys exported with gpg --export from path. RSA,
+// ElGamal and Curve25519 (cv25519) encryption keys are supported.
+func ReadKeys(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	var keys openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armorPrefix)) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s contains no public key", path)
+	}
+
+	// Encrypt refuses keys without a usable encryption key; check it here
+	// so a bad key is reported before any work is done
+	for _, key := range keys {
+		w, err := openpgp.Encrypt(io.Discard, []*openpgp.Entity{key}, nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encrypt to key %s in %s: %w", key.PrimaryKey.KeyIdString(), path, err)
+		}
+		w.Close()
+	}
+	return keys, nil
+}
+
+// EncryptFile encrypts path to path+Suffix for every key and returns the new
+// file. A partially written file is removed on failure.
+func EncryptFile(path string, keys openpgp.EntityList) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	target := path + Suffix
+	dst, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+	err = encrypt(dst, src, filepath.Base(path), keys)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	return target, nil
+}
+
+func encrypt(dst io.Writer, src io.Reader, name string, keys openpgp.EntityList) error {
+	hints := &openpgp.FileHints{IsBinary: true, FileName: name}
+	w, err := openpgp.Encrypt(dst, keys, nil, hints, &packet.Config{})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,23 @@
+package pipeline
+
+// Exit codes of gihftp. Stages return them so that the reason a run stopped
+// reaches cron and systemd unchanged.
+const (
+	ExitSuccess      = 0
+	ExitConfigError  = 1
+	ExitFetchError   = 2
+	ExitMergeError   = 3
+	ExitUploadError  = 4
+	ExitPartialError = 5
+	ExitCheckError   = 6
+	ExitVerifyError  = 7
+	ExitInterrupted  = 8
+	ExitAnomaly      = 9
+	ExitLocked       = 10
+	ExitNoData       = 11
+	ExitAuthError    = 12
+	ExitHostKeyError = 13
+	ExitNetworkError = 14
+	ExitHookError    = 15
+	ExitTimeout      = 16
+)
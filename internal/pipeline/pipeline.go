@@ -0,0 +1,71 @@
+// Package pipeline runs the fetch, merge and upload stages of a full run in
+// order. The stages are interfaces, so the orchestration does not depend on
+// the GIH API, FTP or SFTP clients and can be driven with fakes.
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"gih-ftp/internal/logger"
+)
+
+// Fetcher downloads the logs of the date range from every GIH server.
+type Fetcher interface {
+	// Fetch returns the number of servers fetched and failed. An exit code
+	// other than ExitSuccess stops the run.
+	Fetch(ctx context.Context) (succeeded, failed, exitCode int)
+}
+
+// Merger writes the merged output files of the fetched logs.
+type Merger interface {
+	// Merge returns the files to upload; complete is false when some
+	// servers failed to fetch.
+	Merge(ctx context.Context, complete bool) (files []string, exitCode int)
+}
+
+// Uploader delivers the merged files to the upload targets.
+type Uploader interface {
+	Upload(ctx context.Context, files []string, complete bool) (exitCode int)
+}
+
+// Pipeline is one full run.
+type Pipeline struct {
+	Fetcher  Fetcher
+	Merger   Merger
+	Uploader Uploader
+
+	// StartedAt is when the run started, for the completion log
+	StartedAt time.Time
+}
+
+// Run fetches, merges and uploads, stopping at the first stage that fails,
+// and returns the exit code of the run. A run that uploaded the logs of
+// only some servers returns ExitPartialError.
+func (p *Pipeline) Run(ctx context.Context) int {
+	succeeded, failed, exitCode := p.Fetcher.Fetch(ctx)
+	if exitCode != ExitSuccess {
+		return exitCode
+	}
+	complete := failed == 0
+
+	files, exitCode := p.Merger.Merge(ctx, complete)
+	if exitCode != ExitSuccess {
+		return exitCode
+	}
+
+	if exitCode := p.Uploader.Upload(ctx, files, complete); exitCode != ExitSuccess {
+		return exitCode
+	}
+
+	logger.Info("Weekly processing completed",
+		"duration_seconds", time.Since(p.StartedAt).Seconds(),
+		"servers_success", succeeded,
+		"servers_failed", failed,
+	)
+
+	if !complete {
+		return ExitPartialError
+	}
+	return ExitSuccess
+}
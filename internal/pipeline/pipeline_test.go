@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"gih-ftp/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init("error", logger.Options{})
+	os.Exit(m.Run())
+}
+
+// fakeStages records how the pipeline drives its stages.
+type fakeStages struct {
+	succeeded, failed int
+	fetchExit         int
+	mergeExit         int
+	uploadExit        int
+	files             []string
+
+	calls          []string
+	mergeComplete  bool
+	uploadComplete bool
+	uploaded       []string
+}
+
+func (f *fakeStages) Fetch(ctx context.Context) (int, int, int) {
+	f.calls = append(f.calls, "fetch")
+	return f.succeeded, f.failed, f.fetchExit
+}
+
+func (f *fakeStages) Merge(ctx context.Context, complete bool) ([]string, int) {
+	f.calls = append(f.calls, "merge")
+	f.mergeComplete = complete
+	return f.files, f.mergeExit
+}
+
+func (f *fakeStages) Upload(ctx context.Context, files []string, complete bool) int {
+	f.calls = append(f.calls, "upload")
+	f.uploadComplete = complete
+	f.uploaded = files
+	return f.uploadExit
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		stages   fakeStages
+		want     int
+		calls    []string
+		complete bool
+	}{
+		{
+			name:     "complete",
+			stages:   fakeStages{succeeded: 2, files: []string{"a.log", "a.log.sha256"}},
+			want:     ExitSuccess,
+			calls:    []string{"fetch", "merge", "upload"},
+			complete: true,
+		},
+		{
+			name:     "some servers failed",
+			stages:   fakeStages{succeeded: 1, failed: 1, files: []string{"a.log"}},
+			want:     ExitPartialError,
+			calls:    []string{"fetch", "merge", "upload"},
+			complete: false,
+		},
+		{
+			name:   "fetch fails",
+			stages: fakeStages{fetchExit: ExitFetchError},
+			want:   ExitFetchError,
+			calls:  []string{"fetch"},
+		},
+		{
+			name:   "merge fails",
+			stages: fakeStages{succeeded: 2, mergeExit: ExitNoData},
+			want:   ExitNoData,
+			calls:  []string{"fetch", "merge"},
+		},
+		{
+			name:   "upload fails",
+			stages: fakeStages{succeeded: 1, failed: 1, files: []string{"a.log"}, uploadExit: ExitUploadError},
+			want:   ExitUploadError,
+			calls:  []string{"fetch", "merge", "upload"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &tt.stages
+			p := &Pipeline{Fetcher: f, Merger: f, Uploader: f, StartedAt: time.Now()}
+
+			if got := p.Run(context.Background()); got != tt.want {
+				t.Errorf("Run() = %d, want %d", got, tt.want)
+			}
+			if !slices.Equal(f.calls, tt.calls) {
+				t.Errorf("stages run = %v, want %v", f.calls, tt.calls)
+			}
+			if len(tt.calls) < 3 {
+				return
+			}
+			if f.mergeComplete != tt.complete || f.uploadComplete != tt.complete {
+				t.Errorf("complete passed to merge %v and upload %v, want %v", f.mergeComplete, f.uploadComplete, tt.complete)
+			}
+			if !slices.Equal(f.uploaded, f.files) {
+				t.Errorf("uploaded %v, want the merged files %v", f.uploaded, f.files)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+// Package progress draws live progress bars for the servers and files of a
+// fetch on a terminal.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Interval is the time between two redraws.
+const Interval = 200 * time.Millisecond
+
+// speedWindow is the period the current transfer speed is averaged over.
+const speedWindow = 5 * time.Second
+
+const barWidth = 24
+
+// Default is the display used by ForServer. It is nil, and every bar a
+// no-op, unless progress output is enabled.
+var Default *Display
+
+// ForServer returns the bar of host on Default.
+func ForServer(host string) *Server {
+	return Default.Server(host)
+}
+
+// Display draws one line per server, one per file being transferred and
+// the current transfer speed, redrawing them in place every Interval. Log
+// lines written through LogWriter appear above the bars. All methods of a
+// nil Display do nothing.
+type Display struct {
+	out *os.File
+
+	mu      sync.Mutex
+	servers []*Server
+	drawn   int
+	total   int64
+	samples []sample
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// New returns a display drawing on out, which should be a terminal.
+func New(out *os.File) *Display {
+	return &Display{out: out}
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Start redraws the display every Interval until Stop is called.
+func (d *Display) Start() {
+	if d == nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.mu.Lock()
+				d.redraw()
+				d.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop draws the display a last time and leaves it on the screen.
+func (d *Display) Stop() {
+	if d == nil || d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.stopped
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stop = nil
+	d.redraw()
+	d.drawn = 0
+}
+
+// Server returns the bar of host, adding it in the waiting state the first
+// time.
+func (d *Display) Server(host string) *Server {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.servers {
+		if s.host == host {
+			return s
+		}
+	}
+	s := &Server{d: d, host: host, state: "waiting"}
+	d.servers = append(d.servers, s)
+	return s
+}
+
+// LogWriter returns w wrapped so that every write first clears the bars and
+// draws them again below the written lines.
+func (d *Display) LogWriter(w io.Writer) io.Writer {
+	return &logWriter{d: d, w: w}
+}
+
+type logWriter struct {
+	d *Display
+	w io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.d.mu.Lock()
+	defer l.d.mu.Unlock()
+	l.d.clear()
+	n, err := l.w.Write(p)
+	if l.d.stop != nil {
+		l.d.redraw()
+	}
+	return n, err
+}
+
+// clear removes the lines of the last draw; the cursor is left where the
+// first of them was.
+func (d *Display) clear() {
+	if d.drawn > 0 {
+		fmt.Fprintf(d.out, "\r\x1b[%dA\x1b[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+func (d *Display) redraw() {
+	now := time.Now()
+	d.samples = append(d.samples, sample{at: now, bytes: d.total})
+	for len(d.samples) > 2 && now.Sub(d.samples[1].at) >= speedWindow {
+		d.samples = d.samples[1:]
+	}
+
+	width := 80
+	if w, _, err := term.GetSize(int(d.out.Fd())); err == nil && w > 0 {
+		width = w
+	}
+
+	// File names are indented below their server
+	nameWidth := 0
+	for _, s := range d.servers {
+		nameWidth = max(nameWidth, len(s.host))
+		for _, f := range s.active {
+			nameWidth = max(nameWidth, len(f.name)+2)
+		}
+	}
+
+	var lines []string
+	for _, s := range d.servers {
+		lines = append(lines, s.line(nameWidth, now))
+		for _, f := range s.active {
+			lines = append(lines, f.line(nameWidth))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Speed: %s/s  Downloaded: %s", formatBytes(int64(d.speed())), formatBytes(d.total)))
+
+	var b strings.Builder
+	for _, line := range lines {
+		// A wrapped line would throw off clear
+		if len(line) >= width {
+			line = line[:width-1]
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K\n")
+	}
+
+	d.clear()
+	io.WriteString(d.out, b.String())
+	d.drawn = len(lines)
+}
+
+// speed returns the bytes per second transferred over the last speedWindow.
+func (d *Display) speed() float64 {
+	first, last := d.samples[0], d.samples[len(d.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// Server is the progress of fetching one server: the files merged so far
+// and the files being transferred. All methods of a nil Server do nothing.
+type Server struct {
+	d     *Display
+	host  string
+	state string
+
+	files     int
+	filesDone int
+	bytes     int64
+	started   time.Time
+	finished  time.Time
+	active    []*file
+}
+
+// Start marks the server as being fetched.
+func (s *Server) Start() {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.state = "listing"
+	s.started = time.Now()
+}
+
+// SetFiles sets the number of log files the server has for the range.
+func (s *Server) SetFiles(files int) {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.state = "fetching"
+	s.files = files
+}
+
+// SetFilesDone sets the number of files merged (or failed) so far.
+func (s *Server) SetFilesDone(n int) {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.filesDone = n
+}
+
+// Finish marks the server as done, or failed when err is not nil.
+func (s *Server) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.state = "done"
+	if err != nil {
+		s.state = "failed"
+	}
+	s.finished = time.Now()
+	s.active = nil
+}
+
+// Reader returns r wrapped so that reading it shows a bar for the file name
+// of size bytes below the server. The bar is removed once r is read to the
+// end or fails.
+func (s *Server) Reader(r io.Reader, name string, size int64) io.Reader {
+	if s == nil {
+		return r
+	}
+	f := &file{s: s, r: r, name: name, size: size}
+	s.d.mu.Lock()
+	s.active = append(s.active, f)
+	s.d.mu.Unlock()
+	return f
+}
+
+func (s *Server) line(nameWidth int, now time.Time) string {
+	fraction := 0.0
+	if s.files > 0 {
+		fraction = float64(s.filesDone) / float64(s.files)
+	}
+	if s.state == "done" {
+		fraction = 1
+	}
+
+	elapsed := time.Duration(0)
+	switch {
+	case !s.finished.IsZero():
+		elapsed = s.finished.Sub(s.started)
+	case !s.started.IsZero():
+		elapsed = now.Sub(s.started)
+	}
+
+	return fmt.Sprintf("%-*s  %s  %3d/%d files  %10s  %-8s %s",
+		nameWidth, s.host, bar(fraction), s.filesDone, s.files,
+		formatBytes(s.bytes), s.state, elapsed.Round(time.Second))
+}
+
+// file is a transfer shown below its server.
+type file struct {
+	s    *Server
+	r    io.Reader
+	name string
+	size int64
+	done int64
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+
+	d := f.s.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f.done += int64(n)
+	f.s.bytes += int64(n)
+	d.total += int64(n)
+	if err != nil {
+		for i, active := range f.s.active {
+			if active == f {
+				f.s.active = append(f.s.active[:i], f.s.active[i+1:]...)
+				break
+			}
+		}
+	}
+	return n, err
+}
+
+func (f *file) line(nameWidth int) string {
+	fraction := 0.0
+	if f.size > 0 {
+		fraction = min(float64(f.done)/float64(f.size), 1)
+	}
+	return fmt.Sprintf("  %-*s  %s  %3.0f%%  %s / %s",
+		nameWidth-2, f.name, bar(fraction), fraction*100,
+		formatBytes(f.done), formatBytes(f.size))
+}
+
+// bar renders fraction (0 to 1) as a bar of barWidth cells.
+func bar(fraction float64) string {
+	filled := int(fraction * barWidth)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", barWidth-filled) + "]"
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,443 @@
+package publish
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kafka publishes to a topic of a Kafka cluster (0.11 or later). It speaks
+// the small part of the wire protocol a producer of single messages needs:
+// Metadata to find the partition leaders and Produce with a record batch.
+// Messages go to a random partition and are acknowledged by all in-sync
+// replicas.
+type Kafka struct {
+	// Brokers are host:port addresses to look up the topic with
+	Brokers []string
+	Topic   string
+
+	// TLS encrypts the connections to the brokers
+	TLS bool
+
+	// User and Password log in with SASL/PLAIN when User is set
+	User     string
+	Password string
+
+	Timeout time.Duration
+}
+
+// Kafka API keys and the versions used.
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+
+	produceVersion  = 3
+	metadataVersion = 1
+)
+
+// Kafka error codes that are handled or named.
+const (
+	errLeaderNotAvailable = 5
+)
+
+var kafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	29: "topic authorization failed",
+	33: "unsupported SASL mechanism",
+	35: "unsupported version",
+	58: "SASL authentication failed",
+	87: "invalid record",
+}
+
+// kafkaError is an error code returned by a broker.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if text, ok := kafkaErrors[int16(e)]; ok {
+		return fmt.Sprintf("kafka: %s (error code %d)", text, int16(e))
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+func (k *Kafka) String() string {
+	return "kafka:" + k.Topic
+}
+
+// Publish looks up the leader of a partition of the topic through the
+// first reachable broker and produces msg to it.
+func (k *Kafka) Publish(ctx context.Context, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout(k.Timeout))
+	defer cancel()
+
+	var errs []error
+	for _, broker := range k.Brokers {
+		err := k.publishVia(ctx, broker, msg)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", broker, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("kafka publish failed: %w", errors.Join(errs...))
+}
+
+func (k *Kafka) publishVia(ctx context.Context, broker string, msg []byte) error {
+	conn, err := k.dial(ctx, broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	leader, partition, err := conn.leader(ctx, k.Topic)
+	if err != nil {
+		return err
+	}
+
+	if leader != broker {
+		leaderConn, err := k.dial(ctx, leader)
+		if err != nil {
+			return fmt.Errorf("leader %s: %w", leader, err)
+		}
+		defer leaderConn.Close()
+		conn = leaderConn
+	}
+	return conn.produce(k.Topic, partition, msg, time.Now(), timeout(k.Timeout))
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	net.Conn
+	correlationID int32
+}
+
+func (k *Kafka) dial(ctx context.Context, address string) (*kafkaConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if k.TLS {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	c := &kafkaConn{Conn: conn}
+	if k.User != "" {
+		if err := c.saslPlain(k.User, k.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// saslPlain logs in with SASL/PLAIN.
+func (c *kafkaConn) saslPlain(user, password string) error {
+	var req encoder
+	req.str("PLAIN")
+	resp, err := c.roundTrip(apiSaslHandshake, 1, req)
+	if err != nil {
+		return err
+	}
+	d := decoder{b: resp}
+	if code := d.i16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	req = nil
+	req.bytes([]byte("\x00" + user + "\x00" + password))
+	if resp, err = c.roundTrip(apiSaslAuthenticate, 0, req); err != nil {
+		return err
+	}
+	d = decoder{b: resp}
+	code, message := d.i16(), d.nullableStr()
+	if d.err != nil {
+		return d.err
+	}
+	if code != 0 && message != "" {
+		return fmt.Errorf("%w: %s", kafkaError(code), message)
+	}
+	if code != 0 {
+		return kafkaError(code)
+	}
+	return nil
+}
+
+// leader returns the address of the leader of a random partition of topic
+// that has one. A topic created on first use has no leader yet for a
+// moment; the lookup is repeated until ctx ends.
+func (c *kafkaConn) leader(ctx context.Context, topic string) (string, int32, error) {
+	for {
+		address, partition, err := c.lookup(topic)
+		var kerr kafkaError
+		if !errors.As(err, &kerr) || kerr != errLeaderNotAvailable {
+			return address, partition, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", 0, err
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (c *kafkaConn) lookup(topic string) (string, int32, error) {
+	var req encoder
+	req.i32(1)
+	req.str(topic)
+	resp, err := c.roundTrip(apiMetadata, metadataVersion, req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	d := decoder{b: resp}
+	brokers := make(map[int32]string)
+	for n := d.i32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.i32(), d.str(), d.i32()
+		d.nullableStr() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.i32() // controller
+
+	var leaders []int32
+	var partitions []int32
+	var topicErr int16
+	for n := d.i32(); n > 0 && d.err == nil; n-- {
+		code, name := d.i16(), d.str()
+		d.i8() // is internal
+		for p := d.i32(); p > 0 && d.err == nil; p-- {
+			partitionErr, index, leader := d.i16(), d.i32(), d.i32()
+			d.skipInt32Array() // replicas
+			d.skipInt32Array() // in-sync replicas
+			if name == topic && partitionErr == 0 && leader >= 0 {
+				leaders = append(leaders, leader)
+				partitions = append(partitions, index)
+			}
+		}
+		if name == topic {
+			topicErr = code
+		}
+	}
+	if d.err != nil {
+		return "", 0, d.err
+	}
+	if topicErr != 0 {
+		return "", 0, kafkaError(topicErr)
+	}
+	if len(partitions) == 0 {
+		return "", 0, kafkaError(errLeaderNotAvailable)
+	}
+
+	i := rand.IntN(len(partitions))
+	address, ok := brokers[leaders[i]]
+	if !ok {
+		return "", 0, fmt.Errorf("kafka: leader %d of partition %d is not a known broker", leaders[i], partitions[i])
+	}
+	return address, partitions[i], nil
+}
+
+// produce writes msg with timestamp ts to partition and waits for all
+// in-sync replicas.
+func (c *kafkaConn) produce(topic string, partition int32, msg []byte, ts time.Time, timeout time.Duration) error {
+	var req encoder
+	req.i16(-1) // no transactional id
+	req.i16(-1) // acks: all in-sync replicas
+	req.i32(int32(timeout.Milliseconds()))
+	req.i32(1)
+	req.str(topic)
+	req.i32(1)
+	req.i32(partition)
+	req.bytes(recordBatch(msg, ts))
+
+	resp, err := c.roundTrip(apiProduce, produceVersion, req)
+	if err != nil {
+		return err
+	}
+	d := decoder{b: resp}
+	for n := d.i32(); n > 0 && d.err == nil; n-- {
+		d.str()
+		for p := d.i32(); p > 0 && d.err == nil; p-- {
+			d.i32()
+			code := d.i16()
+			d.i64() // base offset
+			d.i64() // log append time
+			if code != 0 && d.err == nil {
+				return kafkaError(code)
+			}
+		}
+	}
+	return d.err
+}
+
+// roundTrip sends a request with the v1 header and returns the response
+// body after the correlation id.
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body encoder) ([]byte, error) {
+	c.correlationID++
+
+	var req encoder
+	req.i32(0) // size, set below
+	req.i16(apiKey)
+	req.i16(apiVersion)
+	req.i32(c.correlationID)
+	req.str("gihftp")
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != c.correlationID {
+		return nil, errors.New("kafka: response does not match the request")
+	}
+	return resp[4:], nil
+}
+
+// recordBatch encodes msg as a record batch (message format v2) of one
+// record without key.
+func recordBatch(msg []byte, ts time.Time) []byte {
+	var record []byte
+	record = append(record, 0)               // attributes
+	record = binary.AppendVarint(record, 0)  // timestamp delta
+	record = binary.AppendVarint(record, 0)  // offset delta
+	record = binary.AppendVarint(record, -1) // key length
+	record = binary.AppendVarint(record, int64(len(msg)))
+	record = append(record, msg...)
+	record = binary.AppendVarint(record, 0) // headers
+
+	// The CRC covers everything from the attributes on
+	var tail encoder
+	tail.i16(0) // attributes
+	tail.i32(0) // last offset delta
+	tail.i64(ts.UnixMilli())
+	tail.i64(ts.UnixMilli())
+	tail.i64(-1) // producer id
+	tail.i16(-1) // producer epoch
+	tail.i32(-1) // base sequence
+	tail.i32(1)  // records
+	tail = binary.AppendVarint(tail, int64(len(record)))
+	tail = append(tail, record...)
+
+	var batch encoder
+	batch.i64(0)                            // base offset
+	batch.i32(int32(4 + 1 + 4 + len(tail))) // length after this field
+	batch.i32(-1)                           // partition leader epoch
+	batch = append(batch, 2)                // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, crc32.MakeTable(crc32.Castagnoli)))
+	return append(batch, tail...)
+}
+
+// encoder appends big-endian protocol fields.
+type encoder []byte
+
+func (e *encoder) i16(v int16) { *e = binary.BigEndian.AppendUint16(*e, uint16(v)) }
+func (e *encoder) i32(v int32) { *e = binary.BigEndian.AppendUint32(*e, uint32(v)) }
+func (e *encoder) i64(v int64) { *e = binary.BigEndian.AppendUint64(*e, uint64(v)) }
+
+func (e *encoder) str(s string) {
+	e.i16(int16(len(s)))
+	*e = append(*e, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.i32(int32(len(b)))
+	*e = append(*e, b...)
+}
+
+// decoder reads big-endian protocol fields. After the first short read
+// err is set and every field reads as zero.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errors.New("kafka: short response")
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) i8() int8 {
+	if p := d.next(1); p != nil {
+		return int8(p[0])
+	}
+	return 0
+}
+
+func (d *decoder) i16() int16 {
+	if p := d.next(2); p != nil {
+		return int16(binary.BigEndian.Uint16(p))
+	}
+	return 0
+}
+
+func (d *decoder) i32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(binary.BigEndian.Uint32(p))
+	}
+	return 0
+}
+
+func (d *decoder) i64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(binary.BigEndian.Uint64(p))
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.i16())))
+}
+
+func (d *decoder) nullableStr() string {
+	n := d.i16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) skipInt32Array() {
+	n := d.i32()
+	d.next(int(n) * 4)
+}
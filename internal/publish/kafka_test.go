@@ -0,0 +1,202 @@
+package publish
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures were encoded with github.com/twmb/franz-go/pkg/kmsg, with
+// the client id "gihftp", and the record batch checked by decoding it with
+// kmsg again.
+const (
+	fixtureTime = 1700000000000
+	fixtureMsg  = `{"source":"gihftp","unique_domains":3}`
+
+	recordBatchFixture = `
+		00000000000000000000005effffffff021161ade20000000000000000018bcf
+		e568000000018bcfe56800ffffffffffffffffffffffffffff00000001580000
+		00014c7b22736f75726365223a22676968667470222c22756e697175655f646f
+		6d61696e73223a337d00`
+
+	// Metadata v1 for the topic dns-stats
+	metadataRequestFixture = `
+		0000001f00030001000000010006676968667470000000010009646e732d7374
+		617473`
+
+	// Brokers 1 (kafka-1:9092) and 2 (kafka-2:9093); the topic "other"
+	// comes first, then dns-stats with partition 3 led by broker 2
+	metadataResponseFixture = `
+		0000009200000001000000020000000100076b61666b612d3100002384ffff00
+		00000200076b61666b612d3200002385ffff0000000100000002000000056f74
+		6865720000000001000000000000000000010000000100000001000000010000
+		000100000009646e732d73746174730000000001000000000003000000020000
+		00020000000200000001000000020000000200000001`
+
+	// dns-stats with error code 3, unknown topic or partition
+	metadataUnknownTopicFixture = `
+		0000003500000001000000010000000100076b61666b612d3100002384ffff00
+		0000010000000100030009646e732d73746174730000000000`
+
+	// Produce v3 of recordBatchFixture to dns-stats partition 3, acks -1,
+	// timeout 10s
+	produceRequestFixture = `
+		0000009d00000003000000010006676968667470ffffffff0000271000000001
+		0009646e732d737461747300000001000000030000006a000000000000000000
+		00005effffffff021161ade20000000000000000018bcfe568000000018bcfe5
+		6800ffffffffffffffffffffffffffff0000000158000000014c7b22736f7572
+		6365223a22676968667470222c22756e697175655f646f6d61696e73223a337d
+		00`
+
+	// Base offset 42
+	produceResponseFixture = `
+		0000003100000001000000010009646e732d7374617473000000010000000300
+		00000000000000002affffffffffffffff00000000`
+
+	// Error code 19, not enough replicas
+	produceNotEnoughReplicasFixture = `
+		0000003100000001000000010009646e732d7374617473000000010000000300
+		13ffffffffffffffffffffffffffffffff00000000`
+
+	saslHandshakeRequestFixture = `
+		00000017001100010000000100066769686674700005504c41494e`
+	saslHandshakeResponseFixture = `
+		00000011000000010000000000010005504c41494e`
+
+	// User gihftp, password s3cret
+	saslAuthenticateRequestFixture = `
+		00000022002400000000000200066769686674700000000e0067696866747000
+		733363726574`
+	saslAuthenticateResponseFixture = `
+		0000000c000000020000ffff00000000`
+
+	// Error code 58 with an error message
+	saslAuthenticateFailedFixture = `
+		0000003f00000002003a003341757468656e7469636174696f6e206661696c65
+		643a20496e76616c696420757365726e616d65206f722070617373776f726400
+		000000`
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// exchange is one request a fake broker expects and its response.
+type exchange struct {
+	request, response string
+}
+
+// fakeBroker returns a connection to a broker that checks each request
+// against the next exchange and answers with its response.
+func fakeBroker(t *testing.T, exchanges ...exchange) *kafkaConn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		defer server.Close()
+		for _, e := range exchanges {
+			want := unhex(t, e.request)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Errorf("reading request: %v", err)
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("request\n got %x\nwant %x", got, want)
+				return
+			}
+			if _, err := server.Write(unhex(t, e.response)); err != nil {
+				t.Errorf("writing response: %v", err)
+				return
+			}
+		}
+	}()
+	return &kafkaConn{Conn: client}
+}
+
+func TestRecordBatch(t *testing.T) {
+	got := recordBatch([]byte(fixtureMsg), time.UnixMilli(fixtureTime))
+	if want := unhex(t, recordBatchFixture); !bytes.Equal(got, want) {
+		t.Errorf("recordBatch\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c := fakeBroker(t, exchange{metadataRequestFixture, metadataResponseFixture})
+	address, partition, err := c.lookup("dns-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "kafka-2:9093" || partition != 3 {
+		t.Errorf("lookup = %s, %d, want kafka-2:9093, 3", address, partition)
+	}
+}
+
+func TestLookupUnknownTopic(t *testing.T) {
+	c := fakeBroker(t, exchange{metadataRequestFixture, metadataUnknownTopicFixture})
+	_, _, err := c.lookup("dns-stats")
+	if kerr := kafkaError(0); !errors.As(err, &kerr) || kerr != 3 {
+		t.Errorf("lookup error = %v, want error code 3", err)
+	}
+}
+
+func TestProduce(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		code     kafkaError
+	}{
+		{"acknowledged", produceResponseFixture, 0},
+		{"not enough replicas", produceNotEnoughReplicasFixture, 19},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeBroker(t, exchange{produceRequestFixture, tt.response})
+			err := c.produce("dns-stats", 3, []byte(fixtureMsg), time.UnixMilli(fixtureTime), 10*time.Second)
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if kerr := kafkaError(0); !errors.As(err, &kerr) || kerr != tt.code {
+				t.Errorf("produce error = %v, want error code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestSASLPlain(t *testing.T) {
+	c := fakeBroker(t,
+		exchange{saslHandshakeRequestFixture, saslHandshakeResponseFixture},
+		exchange{saslAuthenticateRequestFixture, saslAuthenticateResponseFixture},
+	)
+	if err := c.saslPlain("gihftp", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSASLPlainFailed(t *testing.T) {
+	c := fakeBroker(t,
+		exchange{saslHandshakeRequestFixture, saslHandshakeResponseFixture},
+		exchange{saslAuthenticateRequestFixture, saslAuthenticateFailedFixture},
+	)
+	err := c.saslPlain("gihftp", "s3cret")
+	if kerr := kafkaError(0); !errors.As(err, &kerr) || kerr != 58 {
+		t.Fatalf("saslPlain error = %v, want error code 58", err)
+	}
+	if !strings.Contains(err.Error(), "Invalid username or password") {
+		t.Errorf("saslPlain error %q lacks the broker's message", err)
+	}
+}
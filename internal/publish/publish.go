@@ -0,0 +1,61 @@
+// Package publish sends the statistics of a merge as a JSON message to a
+// message queue (Kafka or NATS) for downstream analytics.
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"gih-ftp/internal/report"
+)
+
+// Publisher sends one message to a queue.
+type Publisher interface {
+	Publish(ctx context.Context, msg []byte) error
+
+	// String names the destination in logs, e.g. kafka:gih-stats
+	String() string
+}
+
+// Domain is one entry of the top domains of a message. QType is set when
+// domains are counted per query type.
+type Domain struct {
+	Domain string `json:"domain"`
+	QType  string `json:"qtype,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// Stats is the message published after a merge: the merge statistics of
+// the run report plus the busiest domains.
+type Stats struct {
+	Host      string    `json:"host"`
+	Version   string    `json:"version"`
+	MergedAt  time.Time `json:"merged_at"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+
+	*report.Merge
+
+	TopDomains []Domain `json:"top_domains,omitempty"`
+}
+
+// NewStats returns the message for the merge of startDate to endDate.
+func NewStats(version, startDate, endDate string, merge *report.Merge, top []Domain) *Stats {
+	host, _ := os.Hostname()
+	return &Stats{
+		Host:       host,
+		Version:    version,
+		MergedAt:   time.Now().UTC(),
+		StartDate:  startDate,
+		EndDate:    endDate,
+		Merge:      merge,
+		TopDomains: top,
+	}
+}
+
+// Marshal encodes s as the JSON message body.
+func (s *Stats) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
@@ -0,0 +1,48 @@
+// Package remotepath builds paths on the FTP/SFTP server. Remote paths always
+// use "/" as the separator, unlike path/filepath, which follows the local
+// operating system and produces backslashes on Windows.
+package remotepath
+
+import (
+	"path"
+	"strings"
+)
+
+// Join joins path elements with "/".
+func Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// Dir returns all but the last element of p.
+func Dir(p string) string {
+	return path.Dir(p)
+}
+
+// Base returns the last element of p.
+func Base(p string) string {
+	return path.Base(p)
+}
+
+// Clean returns the shortest equivalent of p.
+func Clean(p string) string {
+	return path.Clean(p)
+}
+
+// Prefixes returns dir and each of its parents, outermost first, e.g.
+// "/a/b" gives "/a" and "/a/b". The root and "." are left out.
+func Prefixes(dir string) []string {
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+
+	var prefixes []string
+	for _, segment := range strings.Split(dir, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		current = path.Join(current, segment)
+		prefixes = append(prefixes, current)
+	}
+	return prefixes
+}
@@ -0,0 +1,293 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Server describes the fetch result for one GIH server.
+type Server struct {
+	Host           string `json:"host"`
+	Files          int    `json:"files"`
+	FilesFailed    int    `json:"files_failed"`
+	CachedFiles    int    `json:"cached_files,omitempty"`
+	TruncatedFiles int    `json:"truncated_files,omitempty"`
+	Bytes          int64  `json:"bytes"`
+	Reused         bool   `json:"reused,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	// ErrorCode classifies Error: auth, host_key, network, verify, no_space
+	// or timeout
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// Days is what the server's log files of each date contributed; Lines
+	// and SkippedLines are their totals
+	Days         []ServerDay `json:"days,omitempty"`
+	Lines        int         `json:"lines,omitempty"`
+	SkippedLines int         `json:"skipped_lines,omitempty"`
+
+	// DurationSeconds is the time the fetch of the server took, FileTimings
+	// where it went for each downloaded file
+	DurationSeconds float64      `json:"duration_seconds,omitempty"`
+	FileTimings     []FileTiming `json:"file_timings,omitempty"`
+}
+
+// FileTiming is the time spent on one log file of a server. OpenSeconds is
+// the wait until the file could be read: its download into the cache, or
+// the response headers without the cache. MergeSeconds covers reading the
+// file into the merger, including the transfer when it is streamed. File
+// timings are only kept in the report and deliberately not exported as
+// Prometheus metrics, where a label per file name would grow the number of
+// series without bound.
+type FileTiming struct {
+	Filename     string  `json:"filename"`
+	Bytes        int64   `json:"bytes"`
+	Cached       bool    `json:"cached,omitempty"`
+	OpenSeconds  float64 `json:"open_seconds"`
+	MergeSeconds float64 `json:"merge_seconds"`
+}
+
+// Timings breaks the duration of a run down by stage, in seconds. Fetch
+// includes merging the logs of each server as they arrive; Merge combines
+// the servers and computes the statistics; Save writes the merged file
+// with its checksum, signature and parts. A stage that did not run is 0.
+type Timings struct {
+	Fetch  float64 `json:"fetch_seconds"`
+	Merge  float64 `json:"merge_seconds"`
+	Save   float64 `json:"save_seconds"`
+	Upload float64 `json:"upload_seconds"`
+}
+
+// ServerDay is what the log files of one date contributed to a server's
+// data, before domain filters. SkippedLines counts malformed lines.
+type ServerDay struct {
+	Date          string `json:"date"`
+	Lines         int    `json:"lines"`
+	Requests      int    `json:"requests"`
+	UniqueDomains int    `json:"unique_domains"`
+	SkippedLines  int    `json:"skipped_lines,omitempty"`
+}
+
+// Day sums the contributions of all servers for one date of the range.
+// Missing lists the servers that delivered no requests for the date.
+type Day struct {
+	Date     string   `json:"date"`
+	Requests int      `json:"requests"`
+	Servers  int      `json:"servers"`
+	Missing  []string `json:"missing,omitempty"`
+}
+
+// Merge holds the statistics of the merged data set.
+type Merge struct {
+	UniqueDomains int    `json:"unique_domains"`
+	TotalRequests int    `json:"total_requests"`
+	TopDomain     string `json:"top_domain"`
+	TopDomainHits int    `json:"top_domain_hits"`
+	FilteredLines int    `json:"filtered_lines"`
+
+	// Malformed lines skipped, from all servers (or input files)
+	SkippedLines int `json:"skipped_lines"`
+
+	// Domains (and their requests) left out by the min-count threshold
+	SuppressedDomains  int `json:"suppressed_domains"`
+	SuppressedRequests int `json:"suppressed_requests"`
+
+	// What each server (or input file) contributed
+	Sources []Source `json:"sources,omitempty"`
+
+	// What each date of the range contributed
+	Days []Day `json:"days,omitempty"`
+}
+
+// Source describes the contribution of one merge input.
+type Source struct {
+	Source        string `json:"source"`
+	Lines         int    `json:"lines"`
+	Requests      int    `json:"requests"`
+	UniqueDomains int    `json:"unique_domains"`
+	SkippedLines  int    `json:"skipped_lines,omitempty"`
+}
+
+// Output describes the merged file.
+type Output struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// Encrypted is set for age encrypted files; Signature is the detached
+	// GPG signature uploaded with the file
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// Parts are the pieces the file was uploaded in (--split-size); Path
+	// then names the file they reassemble to
+	Parts []string `json:"parts,omitempty"`
+}
+
+// Upload describes the delivery to one upload target.
+type Upload struct {
+	Target          string   `json:"target"`
+	Protocol        string   `json:"protocol"`
+	Host            string   `json:"host"`
+	RemotePaths     []string `json:"remote_paths"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	Error           string   `json:"error,omitempty"`
+
+	// ErrorCode classifies Error: auth, host_key, network, verify, no_space
+	// or timeout
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// RemotePruned counts old remote files deleted or archived after the
+	// upload (--remote-retention-weeks).
+	RemotePruned int `json:"remote_pruned,omitempty"`
+
+	// Transport is the protocol the files were delivered with. It differs
+	// from Protocol when --upload-fallback switched protocols.
+	Transport string `json:"transport,omitempty"`
+
+	// Attempts counts the tries under the retry policy of the target.
+	// A failure of an Optional target does not fail the run.
+	Attempts int  `json:"attempts,omitempty"`
+	Optional bool `json:"optional,omitempty"`
+
+	// Skipped is set when an earlier run already delivered the merged
+	// files of the range to the target.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// Report is the machine-readable summary of a single run.
+type Report struct {
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Timings         Timings   `json:"timings"`
+	StartDate       string    `json:"start_date,omitempty"`
+	EndDate         string    `json:"end_date,omitempty"`
+	Servers         []*Server `json:"servers"`
+	Merge           *Merge    `json:"merge,omitempty"`
+	Output          *Output   `json:"output,omitempty"`
+
+	// Outputs lists the per-day files of --granularity=daily instead of
+	// Output
+	Outputs []*Output `json:"outputs,omitempty"`
+
+	Uploads   []*Upload `json:"uploads,omitempty"`
+	Anomalies []Anomaly `json:"anomalies,omitempty"`
+	TopDiff   *TopDiff  `json:"top_diff,omitempty"`
+
+	// Quarantine is the file the malformed lines were written to
+	// (--quarantine-dir), when there were any
+	Quarantine string `json:"quarantine,omitempty"`
+
+	ExitCode int `json:"exit_code"`
+}
+
+// Anomaly is a value that changed more than --anomaly-threshold percent
+// compared with the previously uploaded range.
+type Anomaly struct {
+	// Server is empty for the totals of the merged file
+	Server        string  `json:"server,omitempty"`
+	Metric        string  `json:"metric"`
+	Previous      int     `json:"previous"`
+	Current       int     `json:"current"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+// TopDiff compares the top domains of the range with those of the
+// previously uploaded range (--top-diff).
+type TopDiff struct {
+	// Path is the delta file written to the work directory
+	Path string `json:"path,omitempty"`
+
+	Top               int    `json:"top"`
+	PreviousStartDate string `json:"previous_start_date"`
+	PreviousEndDate   string `json:"previous_end_date"`
+
+	Entered []TopChange `json:"entered"`
+	Dropped []TopChange `json:"dropped"`
+	Moved   []TopChange `json:"moved"`
+}
+
+// TopChange is a domain that entered, left or moved within the top list.
+// Ranks start at 1; a zero rank means outside the top list.
+type TopChange struct {
+	Domain        string `json:"domain"`
+	QType         string `json:"qtype,omitempty"`
+	Rank          int    `json:"rank,omitempty"`
+	PreviousRank  int    `json:"previous_rank,omitempty"`
+	Count         int    `json:"count,omitempty"`
+	PreviousCount int    `json:"previous_count,omitempty"`
+}
+
+// Name returns the domain, followed by the query type when set.
+func (c TopChange) Name() string {
+	if c.QType == "" {
+		return c.Domain
+	}
+	return c.Domain + " " + c.QType
+}
+
+// Empty reports whether nothing changed.
+func (d *TopDiff) Empty() bool {
+	return len(d.Entered) == 0 && len(d.Dropped) == 0 && len(d.Moved) == 0
+}
+
+func New() *Report {
+	return &Report{
+		StartedAt: time.Now().UTC(),
+		Servers:   []*Server{},
+	}
+}
+
+// AddServer appends and returns a result entry for host.
+func (r *Report) AddServer(host string) *Server {
+	s := &Server{Host: host}
+	r.Servers = append(r.Servers, s)
+	return s
+}
+
+// AddUpload appends and returns a result entry for an upload target.
+func (r *Report) AddUpload(target, protocol, host string) *Upload {
+	u := &Upload{Target: target, Protocol: protocol, Host: host, RemotePaths: []string{}}
+	r.Uploads = append(r.Uploads, u)
+	return u
+}
+
+// Finish records the exit code and the total duration.
+func (r *Report) Finish(exitCode int) {
+	r.FinishedAt = time.Now().UTC()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.ExitCode = exitCode
+}
+
+// Redact replaces the error messages of the servers and uploads with
+// mask(message), so that credentials they echo are not written out.
+func (r *Report) Redact(mask func(string) string) {
+	for _, s := range r.Servers {
+		s.Error = mask(s.Error)
+	}
+	for _, u := range r.Uploads {
+		u.Error = mask(u.Error)
+	}
+}
+
+// Write stores the report as indented JSON, replacing path atomically.
+func (r *Report) Write(path string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
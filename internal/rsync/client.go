@@ -0,0 +1,306 @@
+// Package rsync uploads files by running the rsync command over ssh, for
+// destinations that want rsync's delta transfer and resume of interrupted
+// uploads. Authentication uses the SSH keys and agent of the SFTP client.
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/remotepath"
+)
+
+// ErrAuth is returned when the server rejects the SSH login.
+var ErrAuth = errors.New("SSH authentication failed")
+
+// ErrHostKey is returned when ssh cannot verify the host key, e.g. because
+// it changed.
+var ErrHostKey = errors.New("host key verification failed")
+
+// ErrNoSpace is returned when the remote filesystem is full.
+var ErrNoSpace = errors.New("not enough space on remote server")
+
+// ErrNoRemoteRsync is returned when the server has no rsync to talk to.
+var ErrNoRemoteRsync = errors.New("rsync is not installed on remote server")
+
+// PartialDir keeps interrupted uploads next to their destination so the
+// next attempt resumes them.
+const PartialDir = ".rsync-partial"
+
+// ioTimeout stops a transfer when no data moves for this long.
+const ioTimeout = 5 * time.Minute
+
+type Client struct {
+	host               string
+	user               string
+	keyPath            string
+	insecureSkipVerify bool
+	hostKeyCache       string
+	knownHosts         string
+	bytesPerSecond     float64
+	fileMode           os.FileMode
+	owner              string
+	preserveMTime      bool
+}
+
+// NewClient returns a client logging in as user on host (host[:port]) with
+// the comma-separated keys in keyPath and the keys of ssh-agent.
+func NewClient(host, user, keyPath string, insecureSkipVerify bool) *Client {
+	return &Client{
+		host:               host,
+		user:               user,
+		keyPath:            keyPath,
+		insecureSkipVerify: insecureSkipVerify,
+	}
+}
+
+// SetHostKeyCache sets the file host keys are trusted on first use in,
+// the same file the SFTP client uses.
+func (c *Client) SetHostKeyCache(path string) {
+	c.hostKeyCache = path
+}
+
+// SetKnownHosts sets the known_hosts file the host key must be in. Unknown
+// hosts are then rejected instead of trusted on first use.
+func (c *Client) SetKnownHosts(path string) {
+	c.knownHosts = path
+}
+
+// SetRateLimit caps the upload rate in bytes per second; zero disables
+// the limit.
+func (c *Client) SetRateLimit(bytesPerSecond float64) {
+	c.bytesPerSecond = bytesPerSecond
+}
+
+// SetFileMode gives uploaded files mode. Zero leaves the mode to the
+// server.
+func (c *Client) SetFileMode(mode os.FileMode) {
+	c.fileMode = mode
+}
+
+// SetOwner gives uploaded files the numeric uid and gid.
+func (c *Client) SetOwner(uid, gid int) {
+	c.owner = fmt.Sprintf("%d:%d", uid, gid)
+}
+
+// SetPreserveMTime gives uploaded files the modification time of the local
+// file.
+func (c *Client) SetPreserveMTime(enabled bool) {
+	c.preserveMTime = enabled
+}
+
+// Upload sends localPath to remotePath, creating the remote directory. An
+// upload interrupted earlier is resumed from PartialDir.
+func (c *Client) Upload(ctx context.Context, localPath, remotePath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	logger.Info("Starting rsync upload",
+		"local_file", localPath,
+		"remote_path", remotePath,
+		"size_bytes", info.Size(),
+	)
+
+	args := []string{"--partial-dir=" + PartialDir}
+	if c.preserveMTime {
+		args = append(args, "--times")
+	}
+	if c.fileMode != 0 {
+		args = append(args, "--perms", fmt.Sprintf("--chmod=F%04o", c.fileMode.Perm()))
+	}
+	if c.owner != "" {
+		args = append(args, "--owner", "--group", "--numeric-ids", "--chown="+c.owner)
+	}
+	if c.bytesPerSecond > 0 {
+		args = append(args, "--bwlimit="+strconv.Itoa(max(1, int(c.bytesPerSecond/1024))))
+	}
+	args = append(args, "--", localPath, c.remote(remotePath))
+
+	startTime := time.Now()
+	if err := c.run(ctx, remotepath.Dir(remotePath), args); err != nil {
+		return err
+	}
+
+	duration := time.Since(startTime)
+	logger.Info("rsync upload completed",
+		"bytes_uploaded", info.Size(),
+		"duration_seconds", duration.Seconds(),
+		"speed_mbps", fmt.Sprintf("%.2f", float64(info.Size())/duration.Seconds()/(1024*1024)),
+	)
+	return nil
+}
+
+// VerifyReachable logs in and lists dir, creating it when missing. It
+// proves the login and the remote rsync, not that dir is writable.
+func (c *Client) VerifyReachable(ctx context.Context, dir string) error {
+	if err := c.run(ctx, dir, []string{"--list-only", "--", c.remote(dir + "/")}); err != nil {
+		return err
+	}
+	logger.Info("rsync login verified", "host", c.host, "dir", dir)
+	return nil
+}
+
+// run runs rsync with args after the connection options. The remote rsync
+// first creates dir, which rsync itself only does for the last level.
+func (c *Client) run(ctx context.Context, dir string, args []string) error {
+	base := []string{
+		"--rsh=" + c.sshCommand(),
+		"--timeout=" + strconv.Itoa(int(ioTimeout.Seconds())),
+		"--protect-args",
+	}
+	if dir != "" && dir != "." && dir != "/" {
+		base = append(base, "--rsync-path=mkdir -p "+shellQuote(dir)+" && rsync")
+	}
+
+	cmd := exec.CommandContext(ctx, "rsync", append(base, args...)...)
+	var stderr output
+	cmd.Stderr = &stderr
+	// ssh may leave the pipes open briefly after rsync is killed
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+	lines := stderr.lines()
+	for _, line := range lines {
+		logger.Debug("rsync output", "line", line)
+	}
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// ssh reports the reason first; rsync then adds a generic last line
+	if line := lineWith(lines, "Permission denied ("); line != "" {
+		return fmt.Errorf("%w: %s", ErrAuth, line)
+	}
+	if line := lineWith(lines, "Host key verification failed"); line != "" {
+		return fmt.Errorf("%w for %s", ErrHostKey, c.host)
+	}
+	if line := lineWith(lines, "No space left on device"); line != "" {
+		return fmt.Errorf("%w: %s", ErrNoSpace, line)
+	}
+	// bash and dash word it differently
+	for _, missing := range []string{"rsync: command not found", "rsync: not found"} {
+		if line := lineWith(lines, missing); line != "" {
+			return fmt.Errorf("%w: %s", ErrNoRemoteRsync, line)
+		}
+	}
+	if len(lines) > 0 {
+		return fmt.Errorf("rsync failed: %w: %s", err, lines[len(lines)-1])
+	}
+	return fmt.Errorf("rsync failed: %w", err)
+}
+
+// sshCommand returns the remote shell command for --rsh. rsync splits it
+// on spaces and honours single quotes.
+func (c *Client) sshCommand() string {
+	args := []string{"ssh",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=15",
+		"-o", "ServerAliveInterval=30",
+	}
+	if _, port, err := net.SplitHostPort(c.host); err == nil {
+		args = append(args, "-p", port)
+	}
+	for _, keyPath := range strings.Split(c.keyPath, ",") {
+		if keyPath = strings.TrimSpace(keyPath); keyPath != "" {
+			args = append(args, "-i", expandPath(keyPath))
+		}
+	}
+
+	switch {
+	case c.insecureSkipVerify:
+		logger.Warn("SSH host key verification is DISABLED - this is insecure!")
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	case c.knownHosts != "":
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+expandPath(c.knownHosts))
+	default:
+		// New keys are written to the first file, the TOFU cache
+		files := expandPath("$HOME/.ssh/known_hosts")
+		if c.hostKeyCache != "" {
+			files = expandPath(c.hostKeyCache) + " " + files
+		}
+		args = append(args, "-o", "StrictHostKeyChecking=accept-new", "-o", "UserKnownHostsFile="+files)
+	}
+
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " '\"") {
+			args[i] = "'" + arg + "'"
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// remote returns the rsync destination of path on the server.
+func (c *Client) remote(path string) string {
+	host := c.host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if c.user != "" {
+		host = c.user + "@" + host
+	}
+	return host + ":" + path
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func expandPath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = "$HOME" + p[1:]
+	}
+	return os.ExpandEnv(p)
+}
+
+// lineWith returns the first line containing substr, or "".
+func lineWith(lines []string, substr string) string {
+	for _, line := range lines {
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
+
+// output keeps the stderr of rsync for the log and the error.
+type output struct {
+	strings.Builder
+}
+
+// maxOutput bounds the kept output of a chatty or broken rsync.
+const maxOutput = 64 * 1024
+
+func (o *output) Write(p []byte) (int, error) {
+	if o.Len() < maxOutput {
+		o.Builder.Write(p)
+	}
+	return len(p), nil
+}
+
+// lines returns the non-empty lines written.
+func (o *output) lines() []string {
+	var lines []string
+	for _, line := range strings.Split(o.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Blackout is a set of recurring windows, e.g. business hours, during which
+// work is deferred.
+type Blackout []window
+
+// window covers start to end (minutes since midnight) on the given days. A
+// window with end <= start runs past midnight into the next day.
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// ParseBlackout parses a comma-separated list of windows of the form
+// "[days ]HH:MM-HH:MM", e.g. "mon-fri 08:00-20:00, sat 10:00-14:00". days
+// is a weekday or a range of weekdays and defaults to every day. A window
+// that ends at or before its start ends on the next day.
+func ParseBlackout(spec string) (Blackout, error) {
+	var b Blackout
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, w)
+	}
+	return b, nil
+}
+
+func parseWindow(spec string) (window, error) {
+	var w window
+
+	fields := strings.Fields(spec)
+	var days, clock string
+	switch len(fields) {
+	case 1:
+		days, clock = "*", fields[0]
+	case 2:
+		days, clock = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("invalid blackout window %q (expected [days ]HH:MM-HH:MM)", spec)
+	}
+
+	if days == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		first, last, isRange := strings.Cut(days, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return w, fmt.Errorf("invalid weekday in blackout window %q: %s", spec, first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return w, fmt.Errorf("invalid weekday in blackout window %q: %s", spec, last)
+			}
+		}
+		// A range may wrap around the week, e.g. fri-mon
+		for d := from; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	startClock, endClock, ok := strings.Cut(clock, "-")
+	if !ok {
+		return w, fmt.Errorf("invalid blackout window %q (expected [days ]HH:MM-HH:MM)", spec)
+	}
+	hour, minute, err := parseClock(startClock)
+	if err != nil {
+		return w, err
+	}
+	w.start = hour*60 + minute
+	if hour, minute, err = parseClock(endClock); err != nil {
+		return w, err
+	}
+	w.end = hour*60 + minute
+
+	return w, nil
+}
+
+// Until returns the end of the blackout t falls in, or the zero time when
+// t is outside every window. Windows that overlap or follow each other
+// without a gap count as one.
+func (b Blackout) Until(t time.Time) time.Time {
+	end := time.Time{}
+	// Each step moves at least to the end of a window; a week of windows
+	// without a gap never ends
+	for i := 0; i < 7*len(b)+1; i++ {
+		next := b.endAt(t)
+		if next.IsZero() {
+			return end
+		}
+		end, t = next, next
+	}
+	return end
+}
+
+// endAt returns the latest end of the windows containing t.
+func (b Blackout) endAt(t time.Time) time.Time {
+	var end time.Time
+	for _, w := range b {
+		if e := w.endAt(t); e.After(end) {
+			end = e
+		}
+	}
+	return end
+}
+
+// endAt returns the end of the window when it contains t, or the zero time.
+func (w window) endAt(t time.Time) time.Time {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	at := func(dayOffset, minutes int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+dayOffset, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+
+	if w.end > w.start {
+		if w.days[day] && minute >= w.start && minute < w.end {
+			return at(0, w.end)
+		}
+		return time.Time{}
+	}
+
+	// Past midnight: the part before midnight belongs to day, the part
+	// after it to the day before
+	if w.days[day] && minute >= w.start {
+		return at(1, w.end)
+	}
+	if w.days[yesterday] && minute < w.end {
+		return at(0, w.end)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,228 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule reports the next activation time after a given instant.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// maxLookahead bounds the search for the next matching minute so that an
+// expression that can never fire (e.g. "0 0 31 2 *") does not loop forever.
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"sun":       time.Sunday,
+	"monday":    time.Monday,
+	"mon":       time.Monday,
+	"tuesday":   time.Tuesday,
+	"tue":       time.Tuesday,
+	"wednesday": time.Wednesday,
+	"wed":       time.Wednesday,
+	"thursday":  time.Thursday,
+	"thu":       time.Thursday,
+	"friday":    time.Friday,
+	"fri":       time.Friday,
+	"saturday":  time.Saturday,
+	"sat":       time.Saturday,
+}
+
+// Parse accepts either a standard 5-field cron expression
+// ("minute hour day-of-month month day-of-week") or one of the shorthand
+// forms "weekly@<day>-HH:MM" and "daily@HH:MM".
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	lower := strings.ToLower(expr)
+	switch {
+	case strings.HasPrefix(lower, "weekly@"):
+		return parseWeekly(strings.TrimPrefix(lower, "weekly@"))
+	case strings.HasPrefix(lower, "daily@"):
+		hour, minute, err := parseClock(strings.TrimPrefix(lower, "daily@"))
+		if err != nil {
+			return nil, err
+		}
+		return parseCron(fmt.Sprintf("%d %d * * *", minute, hour))
+	}
+
+	return parseCron(expr)
+}
+
+func parseWeekly(spec string) (Schedule, error) {
+	day, clock, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid weekly schedule %q (expected weekly@<day>-HH:MM)", spec)
+	}
+
+	weekday, ok := weekdays[day]
+	if !ok {
+		return nil, fmt.Errorf("invalid weekday: %s", day)
+	}
+
+	hour, minute, err := parseClock(clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCron(fmt.Sprintf("%d %d * * %d", minute, hour, weekday))
+}
+
+func parseClock(clock string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", clock)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// cronSchedule is a parsed 5-field cron expression. Each field is a set of
+// allowed values indexed by value.
+type cronSchedule struct {
+	minute  []bool
+	hour    []bool
+	dom     []bool
+	month   []bool
+	dow     []bool
+	domStar bool
+	dowStar bool
+}
+
+func parseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q (expected 5 fields)", expr)
+	}
+
+	s := &cronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute field: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour field: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day-of-month field: %w", err)
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month field: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day-of-week field: %w", err)
+	}
+
+	// Both 0 and 7 mean Sunday
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+
+	return s, nil
+}
+
+// parseField parses a comma-separated list of values, ranges (a-b) and
+// steps (*/n, a-b/n).
+func parseField(field string, min, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			loStr, hiStr, isRange := strings.Cut(rangePart, "-")
+
+			n, err := strconv.Atoi(loStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", loStr)
+			}
+			lo, hi = n, n
+
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return nil, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range %q (allowed %d-%d)", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			allowed[v] = true
+		}
+	}
+
+	return allowed, nil
+}
+
+// Next returns the first minute strictly after the given time that matches
+// the expression, or the zero time if none exists within the lookahead.
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(maxLookahead)
+
+	for t.Before(limit) {
+		if !s.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule that when both day-of-month and
+// day-of-week are restricted, a day matching either one fires.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom[t.Day()]
+	dowMatch := s.dow[int(t.Weekday())]
+
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dowMatch
+	case s.dowStar:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// FilePrefix refers to the encrypted secrets file.
+const FilePrefix = "secret"
+
+// PassphraseEnv holds the passphrase of the secrets file; it wins over a
+// passphrase file.
+const PassphraseEnv = "GIHFTP_SECRETS_PASSPHRASE"
+
+// fileHeader starts every secrets file and is authenticated with the
+// content, so a file of another version is never misread.
+const fileHeader = "gihftp-secrets v1"
+
+// scrypt parameters and sizes of the random salt and AES-GCM nonce.
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	saltSize  = 16
+	nonceSize = 12
+)
+
+// ErrDecrypt is returned for a wrong passphrase or a corrupted file.
+var ErrDecrypt = errors.New("cannot decrypt secrets file (wrong passphrase or corrupted file)")
+
+// File is a decrypted secrets file: "name = value" lines encrypted with
+// AES-256-GCM under a key derived from a passphrase with scrypt.
+type File struct {
+	secrets map[string]string
+}
+
+// OpenFile reads and decrypts the secrets file at path.
+func OpenFile(path string, passphrase []byte) (*File, error) {
+	data, err := ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+
+	plaintext, err := Decrypt(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	secrets, err := Parse(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &File{secrets: secrets}, nil
+}
+
+func (f *File) Lookup(name string) (string, error) {
+	secret, ok := f.secrets[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+// Names returns the names of all secrets in the file, sorted.
+func (f *File) Names() []string {
+	names := make([]string, 0, len(f.secrets))
+	for name := range f.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Passphrase returns the secrets file passphrase from PassphraseEnv or, if
+// that is not set, from file.
+func Passphrase(file string) ([]byte, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if file == "" {
+		return nil, fmt.Errorf("secrets file passphrase not set (use %s or --secrets-passphrase-file)", PassphraseEnv)
+	}
+
+	data, err := ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets passphrase file: %w", err)
+	}
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("secrets passphrase file %s is empty", file)
+	}
+	return passphrase, nil
+}
+
+// Parse reads "name = value" lines. Blank lines and lines starting with #
+// are skipped; the value is taken verbatim after trimming spaces.
+func Parse(plaintext []byte) (map[string]string, error) {
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(plaintext))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("line %d: expected name = value", lineNo)
+		}
+		secrets[name] = strings.TrimSpace(value)
+	}
+	return secrets, scanner.Err()
+}
+
+// Encrypt returns plaintext as the content of a secrets file.
+func Encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := append(salt, nonce...)
+	payload = aead.Seal(payload, nonce, plaintext, []byte(fileHeader))
+	return []byte(fileHeader + "\n" + base64.StdEncoding.EncodeToString(payload) + "\n"), nil
+}
+
+// Decrypt returns the plaintext of a secrets file.
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	header, body, _ := strings.Cut(string(data), "\n")
+	if strings.TrimSpace(header) != fileHeader {
+		return nil, fmt.Errorf("not a secrets file (expected %q header)", fileHeader)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+	if err != nil || len(payload) < saltSize+nonceSize {
+		return nil, ErrDecrypt
+	}
+	salt, nonce, ciphertext := payload[:saltSize], payload[saltSize:saltSize+nonceSize], payload[saltSize+nonceSize:]
+
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(fileHeader))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,16 @@
+package secrets
+
+// KeyringPrefix refers to the OS keyring: Secret Service (secret-tool) on
+// Linux, the Keychain on macOS and the Credential Manager on Windows.
+const KeyringPrefix = "keyring"
+
+// KeyringService is the service secrets are stored under. On Windows the
+// credential target is "<KeyringService>:<name>".
+const KeyringService = "gihftp"
+
+// Keyring looks up secrets in the OS keyring.
+type Keyring struct{}
+
+func (Keyring) Lookup(name string) (string, error) {
+	return keyringLookup(KeyringService, name)
+}
@@ -0,0 +1,29 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringLookup reads the secret stored with
+// secret-tool store --label=gihftp service <service> account <name>.
+func keyringLookup(service, name string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", service, "account", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return "", fmt.Errorf("secret-tool not found (install libsecret-tools): %w", err)
+	case errors.As(err, &exitErr) && stderr.Len() == 0:
+		return "", ErrNotFound
+	case err != nil:
+		return "", fmt.Errorf("secret-tool: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
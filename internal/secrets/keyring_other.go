@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package secrets
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func keyringLookup(service, name string) (string, error) {
+	return "", fmt.Errorf("OS keyring is not supported on %s", runtime.GOOS)
+}
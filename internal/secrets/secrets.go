@@ -0,0 +1,108 @@
+// Package secrets resolves passwords and tokens that are kept out of the
+// config file. A setting refers to a secret as "<provider>:<name>", e.g.
+// "keyring:ftp-password" for the OS keyring, "secret:ftp-password" for the
+// encrypted secrets file or "vault:secret/data/gihftp#ftp_password" for
+// HashiCorp Vault. A value that only looks like a reference is written with
+// the "literal:" prefix, e.g. "literal:secret:abc" for the password
+// "secret:abc".
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// ErrNotFound is returned when a provider has no secret of that name.
+var ErrNotFound = errors.New("secret not found")
+
+// ErrInsecurePermissions is returned for secret files other users can read
+// or modify.
+var ErrInsecurePermissions = errors.New("insecure file permissions")
+
+// LiteralPrefix marks a value that is used as written, without the prefix,
+// even when it looks like a reference.
+const LiteralPrefix = "literal"
+
+// Provider looks up secrets by name.
+type Provider interface {
+	Lookup(name string) (string, error)
+}
+
+// Resolver maps reference prefixes to providers.
+type Resolver struct {
+	providers map[string]Provider
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{providers: make(map[string]Provider)}
+}
+
+// Register makes values of the form "<prefix>:<name>" resolve through p.
+func (r *Resolver) Register(prefix string, p Provider) {
+	r.providers[prefix] = p
+}
+
+// IsReference reports whether value refers to a secret of a known provider.
+func IsReference(value string) bool {
+	prefix, _, found := strings.Cut(value, ":")
+	return found && (prefix == KeyringPrefix || prefix == FilePrefix || prefix == VaultPrefix)
+}
+
+// Resolve returns value unchanged unless it is a reference, which is looked
+// up in the provider registered for its prefix. The "literal:" prefix is
+// removed.
+func (r *Resolver) Resolve(value string) (string, error) {
+	if literal, ok := strings.CutPrefix(value, LiteralPrefix+":"); ok {
+		return literal, nil
+	}
+	if !IsReference(value) {
+		return value, nil
+	}
+
+	prefix, name, _ := strings.Cut(value, ":")
+	p, ok := r.providers[prefix]
+	if !ok {
+		switch prefix {
+		case FilePrefix:
+			return "", fmt.Errorf("%s: no secrets file configured (use --secrets-file)", value)
+		case VaultPrefix:
+			return "", fmt.Errorf("%s: no Vault address configured (use --vault-addr or VAULT_ADDR)", value)
+		}
+		return "", fmt.Errorf("%s: no %s provider", value, prefix)
+	}
+
+	secret, err := p.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", value, err)
+	}
+	return secret, nil
+}
+
+// CheckPermissions refuses files that other users can access or that the
+// group can modify; 0600 and 0640 are accepted. Windows ACLs are not
+// checked.
+func CheckPermissions(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0o027 != 0 {
+		return fmt.Errorf("%w on %s (%#o): run chmod 600 %s", ErrInsecurePermissions, path, perm, path)
+	}
+	return nil
+}
+
+// ReadFile reads a file holding secrets after checking its permissions.
+func ReadFile(path string) ([]byte, error) {
+	if err := CheckPermissions(path); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VaultPrefix refers to a HashiCorp Vault secret as "<path>#<field>", e.g.
+// vault:secret/data/gihftp#ftp_password. KV version 1 and 2 are supported;
+// for version 2 the path includes "data/".
+const VaultPrefix = "vault"
+
+// VaultOptions configures the Vault client. Token is read on first use
+// from VAULT_TOKEN, TokenFile or ~/.vault-token, in that order.
+type VaultOptions struct {
+	Addr      string
+	TokenFile string
+	Namespace string
+	CACert    string
+	Timeout   time.Duration
+}
+
+// Vault looks up secrets over the Vault HTTP API. Each path is read once;
+// further fields of the same secret come from the cache.
+type Vault struct {
+	opts   VaultOptions
+	client *http.Client
+	token  string
+	cache  map[string]map[string]any
+}
+
+func NewVault(opts VaultOptions) (*Vault, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Vault{
+		opts:   opts,
+		client: &http.Client{Transport: transport, Timeout: opts.Timeout},
+		cache:  make(map[string]map[string]any),
+	}, nil
+}
+
+func (v *Vault) Lookup(ref string) (string, error) {
+	path, field, found := strings.Cut(ref, "#")
+	if !found || path == "" || field == "" {
+		return "", fmt.Errorf("expected <path>#<field>")
+	}
+
+	data, ok := v.cache[path]
+	if !ok {
+		var err error
+		if data, err = v.read(path); err != nil {
+			return "", err
+		}
+		v.cache[path] = data
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", ErrNotFound
+	}
+	secret, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s is not a string", field)
+	}
+	return secret, nil
+}
+
+// read fetches the secret at path and returns its key/value data.
+func (v *Vault) read(path string) (map[string]any, error) {
+	if v.token == "" {
+		token, err := vaultToken(v.opts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		v.token = token
+	}
+
+	url := strings.TrimRight(v.opts.Addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.opts.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("Vault returned %s: %s", resp.Status, vaultErrors(resp.Body))
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid Vault response: %w", err)
+	}
+
+	// KV version 2 nests the secret under data.data next to data.metadata
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return data, nil
+}
+
+// vaultErrors returns the messages of a Vault error response.
+func vaultErrors(r io.Reader) string {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r, 64*1024)).Decode(&body); err != nil || len(body.Errors) == 0 {
+		return "no details"
+	}
+	return strings.Join(body.Errors, "; ")
+}
+
+// vaultToken returns the token from VAULT_TOKEN, tokenFile or the token
+// the vault CLI stored in ~/.vault-token.
+func vaultToken(tokenFile string) (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	if tokenFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.New("Vault token not set (use VAULT_TOKEN or --vault-token-file)")
+		}
+		tokenFile = filepath.Join(home, ".vault-token")
+		if _, err := os.Stat(tokenFile); err != nil {
+			return "", errors.New("Vault token not set (use VAULT_TOKEN or --vault-token-file)")
+		}
+	}
+
+	data, err := ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Vault token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,136 @@
+// Package selftest provides in-process stand-ins for GIH servers and an
+// SFTP upload target, so that `gihftp selftest` can exercise a whole run
+// without touching production endpoints.
+package selftest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/gihapi"
+)
+
+// API is a fake GIH server answering the log list and download requests
+// over HTTPS with generated logs.
+type API struct {
+	name    string
+	started time.Time
+	server  *httptest.Server
+}
+
+// NewAPI starts a fake GIH server. name makes its logs differ from those
+// of other servers.
+func NewAPI(name string) *API {
+	a := &API{name: name, started: time.Now()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/dns/query/logs", a.serveList)
+	mux.HandleFunc("/download/", a.serveDownload)
+	a.server = httptest.NewTLSServer(mux)
+	return a
+}
+
+// URL returns the server address in the scheme://host:port form accepted by
+// --gih-servers.
+func (a *API) URL() string {
+	return a.server.URL
+}
+
+// CACert returns the self-signed certificate of the server as PEM, for
+// --gih-ca-cert.
+func (a *API) CACert() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.server.Certificate().Raw})
+}
+
+// Close stops the server.
+func (a *API) Close() {
+	a.server.Close()
+}
+
+func (a *API) serveList(w http.ResponseWriter, r *http.Request) {
+	start, err := time.Parse(config.DateLayout, r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "invalid start date", http.StatusBadRequest)
+		return
+	}
+	end, err := time.Parse(config.DateLayout, r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	resp := gihapi.APIResponse{Status: true, Message: "ok", SchemaVersion: gihapi.SupportedSchemaVersion}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(config.DateLayout)
+		content := a.logs(date)
+		sum := sha256.Sum256([]byte(content))
+		resp.Data.Files = append(resp.Data.Files, gihapi.LogFile{
+			Date:        date,
+			Filename:    date + ".log",
+			DownloadURL: "/download/" + date + ".log",
+			Size:        len(content),
+			Checksum:    "sha256:" + hex.EncodeToString(sum[:]),
+		})
+	}
+	resp.Data.Count = len(resp.Data.Files)
+	resp.Data.StartDate = start.Format(config.DateLayout)
+	resp.Data.EndDate = end.Format(config.DateLayout)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *API) serveDownload(w http.ResponseWriter, r *http.Request) {
+	date := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/download/"), ".log")
+	if _, err := time.Parse(config.DateLayout, date); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// ServeContent answers conditional requests with 304 Not Modified
+	content := a.logs(date)
+	sum := sha256.Sum256([]byte(content))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, r, date+".log", a.started, strings.NewReader(content))
+}
+
+// logs returns the log file of date. Every file has one domain shared by
+// all servers, listed twice, one domain of its own and one malformed line.
+func (a *API) logs(date string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "example.com|%d\n", sharedRequests)
+	fmt.Fprintf(&b, "example.com|%d\n", repeatedRequests)
+	fmt.Fprintf(&b, "d%s.%s.example.org|%d\n", date, a.name, ownRequests)
+	b.WriteString("this line is malformed\n")
+	return b.String()
+}
+
+const (
+	sharedRequests   = 10
+	repeatedRequests = 5
+	ownRequests      = 2
+)
+
+// Totals is what merging the logs of the fake servers yields.
+type Totals struct {
+	Requests      int
+	UniqueDomains int
+	SkippedLines  int
+}
+
+// Expect returns the totals of merging the logs of servers fake servers
+// over days dates.
+func Expect(servers, days int) Totals {
+	files := servers * days
+	return Totals{
+		Requests:      files * (sharedRequests + repeatedRequests + ownRequests),
+		UniqueDomains: 1 + files,
+		SkippedLines:  files,
+	}
+}
@@ -0,0 +1,159 @@
+package selftest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPServer is an SSH server on a loopback port whose SFTP subsystem
+// stores files in memory. It accepts one user with a password.
+type SFTPServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	files    sftp.Handlers
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+// NewSFTPServer starts an SFTP server with a new host key.
+func NewSFTPServer(user, password string) (*SFTPServer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if meta.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SFTPServer{
+		listener: listener,
+		config:   config,
+		hostKey:  signer.PublicKey(),
+		files:    sftp.InMemHandler(),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *SFTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// HostKeyFingerprint returns the SHA256 fingerprint of the host key, for
+// --ssh-host-fingerprint.
+func (s *SFTPServer) HostKeyFingerprint() string {
+	return ssh.FingerprintSHA256(s.hostKey)
+}
+
+// ReadFile returns the content of an uploaded file.
+func (s *SFTPServer) ReadFile(path string) ([]byte, error) {
+	req := sftp.NewRequest("Get", path)
+	req.Flags = 0x1 // SSH_FXF_READ
+	file, err := s.files.FileGet.Fileread(req)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.NewSectionReader(file, 0, math.MaxInt64))
+}
+
+// Close stops the server and closes open connections.
+func (s *SFTPServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *SFTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *SFTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+// session serves the sftp subsystem; exec requests (such as the sha256sum
+// of --verify-remote-checksum) are refused.
+func (s *SFTPServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		server := sftp.NewRequestServer(channel, s.files)
+		server.Serve()
+		server.Close()
+		return
+	}
+}
@@ -0,0 +1,58 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/sftp"
+
+	"gih-ftp/internal/logger"
+)
+
+// Owner is the numeric user and group an uploaded file is given.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// SetFileMode makes Upload change the mode of the uploaded file. Zero
+// leaves the mode to the server (and its umask).
+func (c *Client) SetFileMode(mode os.FileMode) {
+	c.fileMode = mode
+}
+
+// SetOwner makes Upload change the owner of the uploaded file, which
+// usually needs a privileged login. Nil leaves the owner alone.
+func (c *Client) SetOwner(owner *Owner) {
+	c.owner = owner
+}
+
+// SetPreserveMTime makes Upload give the uploaded file the modification
+// time of the local file.
+func (c *Client) SetPreserveMTime(enabled bool) {
+	c.preserveMTime = enabled
+}
+
+// setAttributes applies the configured mode, owner and modification time
+// of the local file to remotePath.
+func (c *Client) setAttributes(sftpClient *sftp.Client, local os.FileInfo, remotePath string) error {
+	if c.fileMode != 0 {
+		if err := sftpClient.Chmod(remotePath, c.fileMode.Perm()); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", remotePath, err)
+		}
+		logger.Debug("Remote file mode set", "remote_path", remotePath, "mode", fmt.Sprintf("%04o", c.fileMode.Perm()))
+	}
+	if c.owner != nil {
+		if err := sftpClient.Chown(remotePath, c.owner.UID, c.owner.GID); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %w", remotePath, err)
+		}
+		logger.Debug("Remote file owner set", "remote_path", remotePath, "uid", c.owner.UID, "gid", c.owner.GID)
+	}
+	if c.preserveMTime {
+		if err := sftpClient.Chtimes(remotePath, local.ModTime(), local.ModTime()); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", remotePath, err)
+		}
+		logger.Debug("Remote modification time set", "remote_path", remotePath, "mtime", local.ModTime())
+	}
+	return nil
+}
@@ -1,29 +1,73 @@
 package sftp
 
 import (
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 
+	"gih-ftp/internal/checksum"
 	"gih-ftp/internal/logger"
+	"gih-ftp/internal/proxy"
+	"gih-ftp/internal/remotepath"
+	"gih-ftp/internal/transfer"
 )
 
+// ErrVerifyFailed is returned when the uploaded file does not match the
+// local file.
+var ErrVerifyFailed = errors.New("upload verification failed")
+
+// ErrHostKeyMismatch is returned when the server presents a host key other
+// than the pinned, known or previously trusted one.
+var ErrHostKeyMismatch = errors.New("host key mismatch")
+
+// ErrAuth is returned when the server rejects every authentication method.
+var ErrAuth = errors.New("SSH authentication failed")
+
 type Client struct {
 	host               string
 	user               string
 	password           string
 	keyPath            string
 	insecureSkipVerify bool
+	verifySize         bool
+	verifyChecksum     bool
+	atomic             bool
+	dialer             proxy.Dialer
+	passphraseFile     string
+	passphrase         string
+	hostKeyCache       string
+	knownHosts         string
+	hostFingerprint    string
+	limiter            *transfer.Limiter
+	fileMode           os.FileMode
+	owner              *Owner
+	preserveMTime      bool
+
+	// Session opened by Connect and reused until Close
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+// Transfer is one file of an UploadMany call.
+type Transfer struct {
+	LocalPath  string
+	RemotePath string
 }
 
+// TempSuffix is appended to the remote name while an atomic upload is in
+// progress.
+const TempSuffix = ".part"
+
 func NewClient(host, user, password, keyPath string, insecureSkipVerify bool) *Client {
 	return &Client{
 		host:               host,
@@ -34,44 +78,156 @@ func NewClient(host, user, password, keyPath string, insecureSkipVerify bool) *C
 	}
 }
 
-func (c *Client) Upload(localPath, remotePath string) error {
-	logger.Info("Starting SFTP upload",
-		"local_file", localPath,
-		"remote_path", remotePath,
-		"host", c.host,
-	)
+// SetPassphraseFile sets a file holding the passphrase of an encrypted
+// private key. SSH_KEY_PASSPHRASE and SetPassphrase take precedence.
+func (c *Client) SetPassphraseFile(path string) {
+	c.passphraseFile = path
+}
 
-	// Load SSH config
-	sshConfig, err := c.getSSHConfig()
+// SetPassphrase sets the passphrase of an encrypted private key, e.g. one
+// resolved from a secrets store.
+func (c *Client) SetPassphrase(passphrase string) {
+	c.passphrase = passphrase
+}
+
+// SetHostKeyCache persists host keys trusted on first use in path, so
+// that a changed key is detected across runs. Without it keys are only
+// remembered for the lifetime of the process.
+func (c *Client) SetHostKeyCache(path string) {
+	c.hostKeyCache = path
+}
+
+// SetKnownHosts replaces $HOME/.ssh/known_hosts as the known_hosts file.
+// Unlike the default, a configured file must exist; there is no fallback
+// to trust on first use.
+func (c *Client) SetKnownHosts(path string) {
+	c.knownHosts = path
+}
+
+// SetHostFingerprint pins the expected host key (e.g. "SHA256:..."). A
+// pinned fingerprint replaces known_hosts and trust on first use.
+func (c *Client) SetHostFingerprint(fingerprint string) {
+	c.hostFingerprint = fingerprint
+}
+
+// SetDialer routes the SSH connection through d, e.g. a proxy dialer.
+func (c *Client) SetDialer(d proxy.Dialer) {
+	c.dialer = d
+}
+
+// SetVerifySize makes Upload compare the remote file size with the local
+// file after the transfer.
+func (c *Client) SetVerifySize(enabled bool) {
+	c.verifySize = enabled
+}
+
+// SetVerifyChecksum makes Upload run sha256sum on the remote host over the
+// SSH connection and compare it with the local checksum. The remote account
+// needs shell access for this to work.
+func (c *Client) SetVerifyChecksum(enabled bool) {
+	c.verifyChecksum = enabled
+}
+
+// SetRateLimiter paces uploads with l; nil disables the limit.
+func (c *Client) SetRateLimiter(l *transfer.Limiter) {
+	c.limiter = l
+}
+
+// SetAtomic makes Upload write to <remotePath>.part and rename it to the
+// final name only after the transfer (and verification) succeeded.
+func (c *Client) SetAtomic(enabled bool) {
+	c.atomic = enabled
+}
+
+// Connect opens the SSH connection and SFTP session that later calls reuse
+// until Close. Without Connect every call opens its own connection. ctx
+// bounds the connection setup only.
+func (c *Client) Connect(ctx context.Context) error {
+	if c.sftpClient != nil {
+		return nil
+	}
+
+	sshClient, sftpClient, err := c.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create SSH config: %w", err)
+		return err
 	}
+	c.sshClient, c.sftpClient = sshClient, sftpClient
 
-	// Connect to SSH server
-	hostPort := c.host
-	if _, _, err := net.SplitHostPort(hostPort); err != nil {
-		// No port specified, add default SSH port
-		hostPort = net.JoinHostPort(hostPort, "22")
+	logger.Debug("SFTP session opened", "host", c.host)
+	return nil
+}
+
+// Close ends the session opened by Connect.
+func (c *Client) Close() error {
+	if c.sftpClient == nil {
+		return nil
 	}
 
-	logger.Debug("Connecting to SSH server", "host", hostPort)
+	c.sftpClient.Close()
+	err := c.sshClient.Close()
+	c.sshClient, c.sftpClient = nil, nil
+	return err
+}
+
+// session returns the connection opened by Connect, or a new one that
+// release closes again.
+func (c *Client) session(ctx context.Context) (sshClient *ssh.Client, sftpClient *sftp.Client, release func(), err error) {
+	if c.sftpClient != nil {
+		return c.sshClient, c.sftpClient, func() {}, nil
+	}
 
-	sshClient, err := ssh.Dial("tcp", hostPort, sshConfig)
+	sshClient, sftpClient, err = c.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("SSH connection failed: %w", err)
+		return nil, nil, nil, err
 	}
-	defer sshClient.Close()
+	return sshClient, sftpClient, func() {
+		sftpClient.Close()
+		sshClient.Close()
+	}, nil
+}
 
-	logger.Debug("SSH connection established")
+// Upload copies localPath to remotePath. When ctx is done the transfer
+// stops and the partially written remote file is removed.
+func (c *Client) Upload(ctx context.Context, localPath, remotePath string) error {
+	sshClient, sftpClient, release, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	// Create SFTP client
-	sftpClient, err := sftp.NewClient(sshClient)
+	if err := checkSpace(sftpClient, []Transfer{{LocalPath: localPath, RemotePath: remotePath}}); err != nil {
+		return err
+	}
+	return c.upload(ctx, sshClient, sftpClient, localPath, remotePath)
+}
+
+// UploadMany uploads transfers in order over a single connection and stops
+// at the first failure. It returns the number of files uploaded. Nothing is
+// uploaded when the files do not fit in the remote free space.
+func (c *Client) UploadMany(ctx context.Context, transfers []Transfer) (int, error) {
+	sshClient, sftpClient, release, err := c.session(ctx)
 	if err != nil {
-		return fmt.Errorf("SFTP client creation failed: %w", err)
+		return 0, err
 	}
-	defer sftpClient.Close()
+	defer release()
 
-	logger.Debug("SFTP client created")
+	if err := checkSpace(sftpClient, transfers); err != nil {
+		return 0, err
+	}
+	for i, t := range transfers {
+		if err := c.upload(ctx, sshClient, sftpClient, t.LocalPath, t.RemotePath); err != nil {
+			return i, fmt.Errorf("%s: %w", t.LocalPath, err)
+		}
+	}
+	return len(transfers), nil
+}
+
+func (c *Client) upload(ctx context.Context, sshClient *ssh.Client, sftpClient *sftp.Client, localPath, remotePath string) error {
+	logger.Info("Starting SFTP upload",
+		"local_file", localPath,
+		"remote_path", remotePath,
+		"host", c.host,
+	)
 
 	// Open local file
 	localFile, err := os.Open(localPath)
@@ -92,15 +248,20 @@ func (c *Client) Upload(localPath, remotePath string) error {
 	)
 
 	// Ensure remote directory exists
-	remoteDir := filepath.Dir(remotePath)
-	if err := sftpClient.MkdirAll(remoteDir); err != nil {
-		return fmt.Errorf("failed to create remote directory: %w", err)
+	remoteDir := remotepath.Dir(remotePath)
+	if err := ensureDir(sftpClient, remoteDir); err != nil {
+		return err
 	}
 
 	logger.Debug("Remote directory ensured", "path", remoteDir)
 
+	uploadPath := remotePath
+	if c.atomic {
+		uploadPath = remotePath + TempSuffix
+	}
+
 	// Create remote file
-	remoteFile, err := sftpClient.Create(remotePath)
+	remoteFile, err := sftpClient.Create(uploadPath)
 	if err != nil {
 		return fmt.Errorf("failed to create remote file: %w", err)
 	}
@@ -108,11 +269,34 @@ func (c *Client) Upload(localPath, remotePath string) error {
 
 	// Copy file with progress tracking
 	startTime := time.Now()
-	written, err := io.Copy(remoteFile, localFile)
+	var src io.Reader = &contextReader{ctx: ctx, r: localFile}
+	src = transfer.Progress(c.limiter.Reader(src), localPath, fileInfo.Size())
+	written, err := io.Copy(remoteFile, src)
+	if err == nil {
+		err = remoteFile.Close()
+	}
+	if err == nil {
+		err = c.verify(ctx, sshClient, sftpClient, localPath, fileInfo.Size(), uploadPath)
+	}
+	// Before the rename, so the final name never has other attributes
+	if err == nil {
+		err = c.setAttributes(sftpClient, fileInfo, uploadPath)
+	}
 	if err != nil {
+		if c.atomic || ctx.Err() != nil {
+			remoteFile.Close()
+			sftpClient.Remove(uploadPath)
+		}
 		return fmt.Errorf("file upload failed: %w", err)
 	}
 
+	if c.atomic {
+		if err := rename(sftpClient, uploadPath, remotePath); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", uploadPath, remotePath, err)
+		}
+		logger.Debug("Renamed temporary upload", "from", uploadPath, "to", remotePath)
+	}
+
 	duration := time.Since(startTime)
 	speedMBps := float64(written) / duration.Seconds() / (1024 * 1024)
 
@@ -125,6 +309,77 @@ func (c *Client) Upload(localPath, remotePath string) error {
 	return nil
 }
 
+// rename moves from to to, replacing an existing file. The POSIX rename
+// extension is atomic; servers without it need the target removed first.
+func rename(sftpClient *sftp.Client, from, to string) error {
+	if err := sftpClient.PosixRename(from, to); err == nil {
+		return nil
+	}
+
+	sftpClient.Remove(to)
+	return sftpClient.Rename(from, to)
+}
+
+func (c *Client) verify(ctx context.Context, sshClient *ssh.Client, sftpClient *sftp.Client, localPath string, localSize int64, remotePath string) error {
+	if c.verifySize {
+		info, err := sftpClient.Stat(remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		if info.Size() != localSize {
+			return fmt.Errorf("%w: remote size %d, local size %d", ErrVerifyFailed, info.Size(), localSize)
+		}
+		logger.Debug("Remote file size verified", "size_bytes", localSize)
+	}
+
+	if c.verifyChecksum {
+		localSum, err := checksum.File(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to compute local checksum: %w", err)
+		}
+
+		remoteSum, err := remoteChecksum(ctx, sshClient, remotePath)
+		if err != nil {
+			return fmt.Errorf("failed to compute remote checksum: %w", err)
+		}
+
+		if remoteSum != localSum {
+			return fmt.Errorf("%w: remote sha256 %s, local sha256 %s", ErrVerifyFailed, remoteSum, localSum)
+		}
+		logger.Info("Remote checksum verified", "sha256", localSum)
+	}
+
+	return nil
+}
+
+// remoteChecksum runs sha256sum on the remote host. The session is closed
+// when ctx is done.
+func remoteChecksum(ctx context.Context, sshClient *ssh.Client, remotePath string) (string, error) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	quoted := "'" + strings.ReplaceAll(remotePath, "'", `'\''`) + "'"
+	output, err := session.Output("sha256sum -- " + quoted)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty sha256sum output")
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
 func (c *Client) getSSHConfig() (*ssh.ClientConfig, error) {
 	config := &ssh.ClientConfig{
 		User:    c.user,
@@ -140,14 +395,25 @@ func (c *Client) getSSHConfig() (*ssh.ClientConfig, error) {
 		logger.Debug("Using password authentication")
 	}
 
-	// Try key-based auth if key path is provided
+	// Try key-based auth with every candidate key that can be loaded
 	if c.keyPath != "" {
-		keyAuth, err := c.loadPrivateKey(c.keyPath)
-		if err != nil {
-			logger.Warn("Failed to load SSH private key", "error", err)
-		} else {
-			authMethods = append(authMethods, keyAuth)
-			logger.Debug("Using key-based authentication", "key_path", c.keyPath)
+		var signers []ssh.Signer
+		for _, keyPath := range strings.Split(c.keyPath, ",") {
+			keyPath = strings.TrimSpace(keyPath)
+			if keyPath == "" {
+				continue
+			}
+
+			signer, err := c.loadPrivateKey(keyPath)
+			if err != nil {
+				logger.Warn("Failed to load SSH private key", "key_path", keyPath, "error", err)
+				continue
+			}
+			signers = append(signers, signer)
+			logger.Debug("Using key-based authentication", "key_path", keyPath)
+		}
+		if len(signers) > 0 {
+			authMethods = append(authMethods, ssh.PublicKeys(signers...))
 		}
 	}
 
@@ -161,13 +427,19 @@ func (c *Client) getSSHConfig() (*ssh.ClientConfig, error) {
 	if c.insecureSkipVerify {
 		logger.Warn("SSH host key verification is DISABLED - this is insecure!")
 		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else if c.hostFingerprint != "" {
+		config.HostKeyCallback = c.pinnedHostKey()
+		logger.Debug("Using pinned host key fingerprint", "fingerprint", c.hostFingerprint)
 	} else {
 		hostKeyCallback, err := c.getHostKeyCallback()
-		if err != nil {
+		switch {
+		case err != nil && c.knownHosts != "":
+			return nil, err
+		case err != nil:
 			logger.Warn("Failed to load known_hosts, falling back to fingerprint verification",
 				"error", err)
 			config.HostKeyCallback = c.trustOnFirstUse()
-		} else {
+		default:
 			config.HostKeyCallback = hostKeyCallback
 			logger.Debug("Using known_hosts for host key verification")
 		}
@@ -176,9 +448,8 @@ func (c *Client) getSSHConfig() (*ssh.ClientConfig, error) {
 	return config, nil
 }
 
-func (c *Client) loadPrivateKey(keyPath string) (ssh.AuthMethod, error) {
-	// Expand environment variables
-	expandedPath := os.ExpandEnv(keyPath)
+func (c *Client) loadPrivateKey(keyPath string) (ssh.Signer, error) {
+	expandedPath := expandPath(keyPath)
 
 	key, err := os.ReadFile(expandedPath)
 	if err != nil {
@@ -187,25 +458,55 @@ func (c *Client) loadPrivateKey(keyPath string) (ssh.AuthMethod, error) {
 
 	// Try without passphrase first
 	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		// If it fails, try with passphrase from environment
-		passphrase := os.Getenv("SSH_KEY_PASSPHRASE")
-		if passphrase != "" {
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse private key with passphrase: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to parse private key (try setting SSH_KEY_PASSPHRASE env var): %w", err)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
 		}
+		return signer, nil
+	}
+
+	passphrase, err := c.keyPassphrase(expandedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key with passphrase: %w", err)
+	}
+
+	return signer, nil
+}
+
+// expandPath expands environment variables and a leading ~ in a local path.
+// $HOME and ~ resolve to the user's home directory, which is %USERPROFILE%
+// on Windows where HOME is usually not set, so the default key and
+// known_hosts locations ($HOME/.ssh/...) work there too.
+func expandPath(p string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
 	}
 
-	return ssh.PublicKeys(signer), nil
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, `~\`) {
+		p = "$HOME" + p[1:]
+	}
+	p = os.Expand(p, func(name string) string {
+		if name == "HOME" {
+			return home
+		}
+		return os.Getenv(name)
+	})
+	return filepath.FromSlash(p)
 }
 
 func (c *Client) getHostKeyCallback() (ssh.HostKeyCallback, error) {
 	// Try to load known_hosts file
-	knownHostsPath := os.ExpandEnv("$HOME/.ssh/known_hosts")
+	knownHostsPath := expandPath("$HOME/.ssh/known_hosts")
+	if c.knownHosts != "" {
+		knownHostsPath = expandPath(c.knownHosts)
+	}
 
 	if _, err := os.Stat(knownHostsPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("known_hosts file not found: %s", knownHostsPath)
@@ -216,12 +517,35 @@ func (c *Client) getHostKeyCallback() (ssh.HostKeyCallback, error) {
 		return nil, fmt.Errorf("failed to parse known_hosts: %w", err)
 	}
 
-	return callback, nil
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return fmt.Errorf("%w: %w", ErrHostKeyMismatch, err)
+		}
+		return err
+	}, nil
+}
+
+func (c *Client) pinnedHostKey() ssh.HostKeyCallback {
+	want := strings.TrimPrefix(c.hostFingerprint, "SHA256:")
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if strings.TrimPrefix(fingerprint, "SHA256:") != want {
+			return fmt.Errorf("%w for %s: expected SHA256:%s, got %s", ErrHostKeyMismatch, hostname, want, fingerprint)
+		}
+		return nil
+	}
 }
 
 // trustOnFirstUse implements a TOFU (Trust On First Use) policy
 // This is more secure than InsecureIgnoreHostKey but less secure than known_hosts
 func (c *Client) trustOnFirstUse() ssh.HostKeyCallback {
+	if c.hostKeyCache != "" {
+		return c.checkHostKeyCache
+	}
+
 	trustedKeys := make(map[string]ssh.PublicKey)
 
 	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
@@ -229,8 +553,8 @@ func (c *Client) trustOnFirstUse() ssh.HostKeyCallback {
 
 		if trustedKey, exists := trustedKeys[hostname]; exists {
 			if !keyEqual(trustedKey, key) {
-				return fmt.Errorf("WARNING: Remote host identification has changed! (MITM attack?) Expected: %s, Got: %s",
-					ssh.FingerprintSHA256(trustedKey), fingerprint)
+				return fmt.Errorf("%w: WARNING: Remote host identification has changed! (MITM attack?) Expected: %s, Got: %s",
+					ErrHostKeyMismatch, ssh.FingerprintSHA256(trustedKey), fingerprint)
 			}
 			return nil
 		}
@@ -251,7 +575,7 @@ func keyEqual(a, b ssh.PublicKey) bool {
 }
 
 // GetHostFingerprint returns the SSH host key fingerprint for verification
-func (c *Client) GetHostFingerprint() (string, error) {
+func (c *Client) GetHostFingerprint(ctx context.Context) (string, error) {
 	config := &ssh.ClientConfig{
 		User:    c.user,
 		Auth:    []ssh.AuthMethod{ssh.Password("dummy")}, // Won't be used
@@ -267,56 +591,218 @@ func (c *Client) GetHostFingerprint() (string, error) {
 		hostPort = net.JoinHostPort(hostPort, "22")
 	}
 
-	conn, err := ssh.Dial("tcp", hostPort, config)
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
 	if err != nil {
-		// Connection will fail, but we can still get the key from the error
 		return "", fmt.Errorf("could not get host fingerprint: %w", err)
 	}
 	defer conn.Close()
 
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostPort, config)
+	if err != nil {
+		// Connection will fail, but we can still get the key from the error
+		return "", fmt.Errorf("could not get host fingerprint: %w", err)
+	}
+	ssh.NewClient(sshConn, chans, reqs).Close()
+
 	return "", fmt.Errorf("unexpected success")
 }
 
 // VerifyConnection tests the SFTP connection without uploading
-func (c *Client) VerifyConnection() error {
-	sshConfig, err := c.getSSHConfig()
+func (c *Client) VerifyConnection(ctx context.Context) error {
+	sshClient, sftpClient, err := c.dial(ctx)
 	if err != nil {
 		return err
 	}
+	defer sshClient.Close()
+	defer sftpClient.Close()
+
+	logger.Info("SFTP connection verified successfully", "host", c.host)
+	return nil
+}
+
+// VerifyWritable tests the SFTP connection and checks that remoteDir accepts
+// uploads by creating and removing a small probe file.
+func (c *Client) VerifyWritable(ctx context.Context, remoteDir string) error {
+	_, sftpClient, release, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := ensureDir(sftpClient, remoteDir); err != nil {
+		return err
+	}
+
+	probePath := remotepath.Join(remoteDir, fmt.Sprintf(".gihftp-check-%d", time.Now().UnixNano()))
+	probe, err := sftpClient.Create(probePath)
+	if err != nil {
+		return fmt.Errorf("remote directory not writable: %w", err)
+	}
+	_, err = probe.Write([]byte("gihftp connectivity check\n"))
+	probe.Close()
+	if err != nil {
+		return fmt.Errorf("remote directory not writable: %w", err)
+	}
+
+	if err := sftpClient.Remove(probePath); err != nil {
+		return fmt.Errorf("failed to remove probe file %s: %w", probePath, err)
+	}
+
+	logger.Info("SFTP connection verified successfully", "host", c.host)
+	return nil
+}
+
+// Prune walks remoteDir and deletes every file for which expired returns
+// true, or moves it into archiveDir when archiveDir is set. archiveDir
+// itself is not walked. It returns the paths of the files handled.
+func (c *Client) Prune(ctx context.Context, remoteDir string, expired func(name string) bool, archiveDir string) ([]string, error) {
+	_, sftpClient, release, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var old []string
+	walker := sftpClient.Walk(remoteDir)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", walker.Path(), err)
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			if archiveDir != "" && remotepath.Clean(walker.Path()) == remotepath.Clean(archiveDir) {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if info.Mode().IsRegular() && expired(info.Name()) {
+			old = append(old, walker.Path())
+		}
+	}
+
+	if archiveDir != "" && len(old) > 0 {
+		if err := ensureDir(sftpClient, archiveDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var pruned []string
+	for _, remotePath := range old {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		if archiveDir != "" {
+			err = rename(sftpClient, remotePath, remotepath.Join(archiveDir, remotepath.Base(remotePath)))
+		} else {
+			err = sftpClient.Remove(remotePath)
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune %s: %w", remotePath, err)
+		}
+		pruned = append(pruned, remotePath)
+	}
+
+	return pruned, nil
+}
+
+// dial opens an SSH connection and an SFTP session on top of it. Cancelling
+// ctx aborts the connection setup.
+func (c *Client) dial(ctx context.Context) (*ssh.Client, *sftp.Client, error) {
+	sshConfig, err := c.getSSHConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create SSH config: %w", err)
+	}
 
 	hostPort := c.host
 	if _, _, err := net.SplitHostPort(hostPort); err != nil {
 		hostPort = net.JoinHostPort(hostPort, "22")
 	}
 
-	sshClient, err := ssh.Dial("tcp", hostPort, sshConfig)
+	logger.Debug("Connecting to SSH server", "host", hostPort)
+
+	var dialer proxy.Dialer = &net.Dialer{Timeout: sshConfig.Timeout}
+	if c.dialer != nil {
+		dialer = c.dialer
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, sshConfig.Timeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", hostPort)
 	if err != nil {
-		return fmt.Errorf("SSH connection test failed: %w", err)
+		return nil, nil, fmt.Errorf("SSH connection failed: %w", err)
 	}
-	defer sshClient.Close()
+
+	// The handshake has no context of its own; closing the connection
+	// ends it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostPort, sshConfig)
+	if !stop() && err == nil {
+		sshConn.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("SSH connection failed: %w", ctx.Err())
+		}
+		// x/crypto/ssh has no typed error for rejected credentials
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, nil, fmt.Errorf("SSH connection failed: %w: %w", ErrAuth, err)
+		}
+		return nil, nil, fmt.Errorf("SSH connection failed: %w", err)
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
 
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
-		return fmt.Errorf("SFTP client test failed: %w", err)
+		sshClient.Close()
+		return nil, nil, fmt.Errorf("SFTP client creation failed: %w", err)
 	}
-	defer sftpClient.Close()
 
-	logger.Info("SFTP connection verified successfully", "host", c.host)
-	return nil
+	return sshClient, sftpClient, nil
 }
 
-// computeChecksum calculates SHA256 checksum of a file
-func computeChecksum(filepath string) (string, error) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+// contextReader fails reads once ctx is done, which ends an io.Copy at the
+// next chunk.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
+	return r.r.Read(p)
+}
+
+// ensureDir creates dir and its missing parents one segment at a time.
+// Existing directories are accepted; any other failure, such as a
+// permission error or a file in the way, names the segment it occurred at.
+func ensureDir(client *sftp.Client, dir string) error {
+	for _, current := range remotepath.Prefixes(dir) {
+		info, err := client.Stat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("failed to create remote directory %s: a file with that name exists", current)
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to access remote directory %s: %w", current, err)
+		}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+		if err := client.Mkdir(current); err != nil {
+			// Another client may have created it in the meantime
+			if info, statErr := client.Stat(current); statErr == nil && info.IsDir() {
+				continue
+			}
+			return fmt.Errorf("failed to create remote directory %s: %w", current, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gih-ftp/internal/logger"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultHostKeyCache is the file name, inside the work directory, where
+// host keys accepted on first use are stored.
+const DefaultHostKeyCache = "gihftp-known-hosts"
+
+var hostKeyCacheMu sync.Mutex
+
+// checkHostKeyCache verifies key against the host key cache file in
+// known_hosts format. An unknown host is trusted and appended; a host whose
+// key differs from the stored one is refused.
+func (c *Client) checkHostKeyCache(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	hostKeyCacheMu.Lock()
+	defer hostKeyCacheMu.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	if _, err := os.Stat(c.hostKeyCache); err == nil {
+		callback, err := knownhosts.New(c.hostKeyCache)
+		if err != nil {
+			return fmt.Errorf("failed to parse host key cache %s: %w", c.hostKeyCache, err)
+		}
+
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("%w: WARNING: Remote host identification has changed! (MITM attack?) Expected: %s, Got: %s (remove the entry from %s if the change is legitimate)",
+				ErrHostKeyMismatch, ssh.FingerprintSHA256(keyErr.Want[0].Key), fingerprint, c.hostKeyCache)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read host key cache: %w", err)
+	}
+
+	logger.Warn("SSH host not in known_hosts, trusting on first use (TOFU)",
+		"host", hostname,
+		"fingerprint", fingerprint,
+		"cache", c.hostKeyCache,
+	)
+
+	return appendHostKey(c.hostKeyCache, hostname, key)
+}
+
+func appendHostKey(path, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create host key cache directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open host key cache: %w", err)
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(file, line); err != nil {
+		return fmt.Errorf("failed to write host key cache: %w", err)
+	}
+
+	return nil
+}
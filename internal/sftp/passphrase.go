@@ -0,0 +1,61 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"gih-ftp/internal/secrets"
+
+	"golang.org/x/term"
+)
+
+// Passphrases entered at the terminal are remembered per key so that a run
+// uploading several files (or a daemon) asks only once.
+var (
+	promptMu sync.Mutex
+	prompted = make(map[string][]byte)
+)
+
+// keyPassphrase returns the passphrase for an encrypted key from, in order,
+// SSH_KEY_PASSPHRASE, the configured passphrase, the configured passphrase
+// file, or an interactive prompt when stdin is a terminal.
+func (c *Client) keyPassphrase(keyPath string) ([]byte, error) {
+	if passphrase := os.Getenv("SSH_KEY_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if c.passphrase != "" {
+		return []byte(c.passphrase), nil
+	}
+
+	if c.passphraseFile != "" {
+		data, err := secrets.ReadFile(expandPath(c.passphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key passphrase file: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("private key %s is encrypted (set SSH_KEY_PASSPHRASE or --ssh-key-passphrase-file)", keyPath)
+	}
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	if passphrase, ok := prompted[keyPath]; ok {
+		return passphrase, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", keyPath)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	prompted[keyPath] = passphrase
+	return passphrase, nil
+}
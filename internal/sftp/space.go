@@ -0,0 +1,76 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/remotepath"
+)
+
+// ErrNoSpace is returned when the files to upload do not fit in the free
+// space of the remote filesystem.
+var ErrNoSpace = errors.New("not enough space on remote server")
+
+// checkSpace fails with ErrNoSpace when transfers do not fit in the space
+// and inodes available to the user on the remote filesystems, as reported
+// by the statvfs@openssh.com extension. Servers without the extension, or
+// that report no blocks (e.g. cloud storage gateways), are not checked.
+// Per-user quotas are not visible through statvfs.
+func checkSpace(client *sftp.Client, transfers []Transfer) error {
+	needed := make(map[string]int64)
+	files := make(map[string]uint64)
+	var dirs []string
+	for _, t := range transfers {
+		info, err := os.Stat(t.LocalPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat local file: %w", err)
+		}
+		dir := remotepath.Dir(t.RemotePath)
+		if _, ok := needed[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		needed[dir] += info.Size()
+		files[dir]++
+	}
+
+	for _, dir := range dirs {
+		vfs, err := statVFS(client, dir)
+		if err != nil {
+			logger.Debug("Remote free space not checked", "path", dir, "error", err)
+			return nil
+		}
+		if vfs.Blocks == 0 {
+			continue
+		}
+
+		free := vfs.Frsize * vfs.Bavail
+		if uint64(needed[dir]) > free {
+			return fmt.Errorf("%w: %d bytes needed, %d bytes free in %s", ErrNoSpace, needed[dir], free, dir)
+		}
+		if vfs.Files > 0 && files[dir] > vfs.Favail {
+			return fmt.Errorf("%w: %d files to create, %d inodes free in %s", ErrNoSpace, files[dir], vfs.Favail, dir)
+		}
+		logger.Debug("Remote free space checked", "path", dir, "bytes_needed", needed[dir], "bytes_free", free)
+	}
+	return nil
+}
+
+// statVFS returns the filesystem statistics of dir or, when it does not
+// exist yet, of its closest existing parent.
+func statVFS(client *sftp.Client, dir string) (*sftp.StatVFS, error) {
+	prefixes := remotepath.Prefixes(dir)
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		if _, err := client.Stat(prefixes[i]); err == nil {
+			return client.StatVFS(prefixes[i])
+		}
+	}
+	if strings.HasPrefix(dir, "/") {
+		return client.StatVFS("/")
+	}
+	return client.StatVFS(".")
+}
@@ -0,0 +1,93 @@
+// Package signing creates detached OpenPGP signatures that gpg --verify
+// accepts.
+package signing
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gih-ftp/internal/secrets"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Suffix is appended to the name of a signed file for its ASCII-armored
+// detached signature.
+const Suffix = ".asc"
+
+// Signer signs with the primary key of an OpenPGP secret key.
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// LoadKey reads the secret key exported with gpg --export-secret-keys
+// (ASCII-armored or binary) from path, which must not be readable by other
+// users. The first key of the file is used;
+// an encrypted key is decrypted with passphrase. RSA, DSA, ECDSA and EdDSA
+// (ed25519) keys are supported.
+func LoadKey(path, passphrase string) (*Signer, error) {
+	data, err := secrets.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	var keys openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+
+	var entity *openpgp.Entity
+	for _, e := range keys {
+		if e.PrivateKey != nil {
+			entity = e
+			break
+		}
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("%s contains no secret key (export it with gpg --export-secret-keys)", path)
+	}
+
+	if entity.PrivateKey.Encrypted {
+		if passphrase == "" {
+			return nil, fmt.Errorf("signing key %s is encrypted, but no passphrase is set", path)
+		}
+		if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt signing key %s: %w", path, err)
+		}
+	}
+	return &Signer{entity: entity}, nil
+}
+
+// KeyID returns the long key ID of the signing key, as gpg prints it.
+func (s *Signer) KeyID() string {
+	return s.entity.PrivateKey.KeyIdString()
+}
+
+// SignFile writes the detached signature of path to path+Suffix and returns
+// its name.
+func (s *Signer) SignFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var sig strings.Builder
+	if err := openpgp.ArmoredDetachSign(&sig, s.entity, file, &packet.Config{}); err != nil {
+		return "", fmt.Errorf("failed to sign %s: %w", path, err)
+	}
+
+	target := path + Suffix
+	if err := os.WriteFile(target, []byte(sig.String()+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return target, nil
+}
@@ -0,0 +1,93 @@
+// Package split cuts a file into numbered parts of a maximum size, for
+// upload servers that reject large files.
+package split
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ManifestSuffix is appended to the name of a split file to form the
+// sha256sum-compatible manifest of its parts.
+const ManifestSuffix = ".parts.sha256"
+
+// PartName returns the name of part n (from 1) of count parts of name, e.g.
+// name-part01. Part numbers have at least two digits.
+func PartName(name string, n, count int) string {
+	width := max(2, len(strconv.Itoa(count)))
+	return fmt.Sprintf("%s-part%0*d", name, width, n)
+}
+
+// File splits path into parts of at most size bytes next to it and writes
+// the manifest of the parts. It returns the parts in order; concatenating
+// them restores path, which is left in place. A file of at most size bytes
+// is not split and nil is returned.
+func File(path string, size int64) (parts []string, manifest string, err error) {
+	if size <= 0 {
+		return nil, "", fmt.Errorf("invalid part size %d", size)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.Size() <= size {
+		return nil, "", nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer in.Close()
+
+	// Parts already written are removed when a later one fails
+	defer func() {
+		if err != nil {
+			for _, part := range parts {
+				os.Remove(part)
+			}
+			parts = nil
+		}
+	}()
+
+	count := int((info.Size() + size - 1) / size)
+	var lines strings.Builder
+	for n := 1; n <= count; n++ {
+		part := PartName(path, n, count)
+		parts = append(parts, part)
+
+		digest, err := writePart(part, io.LimitReader(in, size))
+		if err != nil {
+			return parts, "", err
+		}
+		fmt.Fprintf(&lines, "%s  %s\n", digest, filepath.Base(part))
+	}
+
+	manifest = path + ManifestSuffix
+	if err := os.WriteFile(manifest, []byte(lines.String()), 0644); err != nil {
+		return parts, "", fmt.Errorf("failed to write parts manifest: %w", err)
+	}
+	return parts, manifest, nil
+}
+
+// writePart copies r to path and returns the SHA256 of what was written.
+func writePart(path string, r io.Reader) (string, error) {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create part: %w", err)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), r)
+	err = errors.Join(err, out.Close())
+	if err != nil {
+		return "", fmt.Errorf("failed to write part %s: %w", filepath.Base(path), err)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,251 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// DefaultFilename is the state file name inside the work directory.
+const DefaultFilename = "gihftp-state.json"
+
+// Upload records a successfully delivered date range.
+type Upload struct {
+	StartDate  string    `json:"start_date"`
+	EndDate    string    `json:"end_date"`
+	Filename   string    `json:"filename"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Fetch records which servers already completed fetching a date range and
+// where their partial aggregate was saved.
+type Fetch struct {
+	StartDate string            `json:"start_date"`
+	EndDate   string            `json:"end_date"`
+	Servers   map[string]string `json:"servers"`
+
+	// Days holds what each server's log files of each date contributed
+	Days map[string]map[string]DayCount `json:"days,omitempty"`
+}
+
+// DayCount is what the log files of one date contributed to a fetch,
+// including the malformed lines skipped.
+type DayCount struct {
+	Lines         int `json:"lines"`
+	Requests      int `json:"requests"`
+	UniqueDomains int `json:"unique_domains"`
+	Skipped       int `json:"skipped"`
+}
+
+// Merge records the merged file(s) built for a date range, so that the
+// upload stage can run separately from fetch and merge.
+type Merge struct {
+	StartDate string   `json:"start_date"`
+	EndDate   string   `json:"end_date"`
+	Files     []string `json:"files"`
+
+	// Complete is false when some servers were missing from the merge
+	Complete bool `json:"complete"`
+
+	// Delivered lists the upload targets that already received Files, so
+	// that a retry after a partial delivery skips them
+	Delivered []string `json:"delivered,omitempty"`
+
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Summary is the size of a merged range. The summary of the last uploaded
+// range is kept so that the next range can be compared with it.
+type Summary struct {
+	StartDate     string                   `json:"start_date"`
+	EndDate       string                   `json:"end_date"`
+	TotalRequests int                      `json:"total_requests"`
+	UniqueDomains int                      `json:"unique_domains"`
+	Servers       map[string]ServerSummary `json:"servers,omitempty"`
+
+	// Top lists the busiest domains in descending order, with --top-diff
+	Top []TopDomain `json:"top,omitempty"`
+}
+
+// TopDomain is one domain of the top list of a Summary. QType is set when
+// domains are counted per query type.
+type TopDomain struct {
+	Domain string `json:"domain"`
+	QType  string `json:"qtype,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// ServerSummary is the contribution of one server to a Summary.
+type ServerSummary struct {
+	Requests      int `json:"requests"`
+	UniqueDomains int `json:"unique_domains"`
+}
+
+// State is persisted between runs so that a repeated invocation for the same
+// range does not upload twice and can resume an interrupted fetch.
+type State struct {
+	LastUpload  *Upload  `json:"last_upload,omitempty"`
+	LastSummary *Summary `json:"last_summary,omitempty"`
+	Fetch       *Fetch   `json:"fetch,omitempty"`
+	Merge       *Merge   `json:"merge,omitempty"`
+
+	path string
+}
+
+// Load reads the state file at path. A missing file yields an empty state.
+func Load(path string) (*State, error) {
+	s := &State{path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Save atomically writes the state back to its file.
+func (s *State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// Uploaded reports whether the given range was the last one delivered.
+func (s *State) Uploaded(startDate, endDate string) bool {
+	return s.LastUpload != nil &&
+		s.LastUpload.StartDate == startDate &&
+		s.LastUpload.EndDate == endDate
+}
+
+// RecordUpload marks the range as delivered, keeps the summary of its merge
+// as LastSummary and forgets its fetch and merge progress.
+func (s *State) RecordUpload(startDate, endDate, filename string) {
+	s.LastUpload = &Upload{
+		StartDate:  startDate,
+		EndDate:    endDate,
+		Filename:   filename,
+		UploadedAt: time.Now().UTC(),
+	}
+	if s.Merge != nil && s.Merge.Summary != nil {
+		s.LastSummary = s.Merge.Summary
+	}
+	s.Fetch = nil
+	s.Merge = nil
+}
+
+// CompletedFetch returns the partial file saved for host in the given range.
+func (s *State) CompletedFetch(startDate, endDate, host string) (string, bool) {
+	if s.Fetch == nil || s.Fetch.StartDate != startDate || s.Fetch.EndDate != endDate {
+		return "", false
+	}
+	path, ok := s.Fetch.Servers[host]
+	return path, ok
+}
+
+// RecordFetch marks host as fetched for the range, with what each date
+// contributed. Progress recorded for a different range is discarded.
+func (s *State) RecordFetch(startDate, endDate, host, partialPath string, days map[string]DayCount) {
+	if s.Fetch == nil || s.Fetch.StartDate != startDate || s.Fetch.EndDate != endDate {
+		s.Fetch = &Fetch{
+			StartDate: startDate,
+			EndDate:   endDate,
+			Servers:   make(map[string]string),
+		}
+	}
+	s.Fetch.Servers[host] = partialPath
+	if s.Fetch.Days == nil {
+		s.Fetch.Days = make(map[string]map[string]DayCount)
+	}
+	s.Fetch.Days[host] = days
+}
+
+// FetchDays returns what each date contributed to the recorded fetch of
+// host, or nil when it is not known (e.g. recorded by an older version).
+func (s *State) FetchDays(host string) map[string]DayCount {
+	if s.Fetch == nil {
+		return nil
+	}
+	return s.Fetch.Days[host]
+}
+
+// PartialFiles returns the partial files recorded for the current fetch.
+func (s *State) PartialFiles() []string {
+	if s.Fetch == nil {
+		return nil
+	}
+
+	files := make([]string, 0, len(s.Fetch.Servers))
+	for _, path := range s.Fetch.Servers {
+		files = append(files, path)
+	}
+	return files
+}
+
+// RecordMerge remembers the files produced by merging the range and their
+// summary. complete reports whether every server contributed. The targets
+// delivered to are kept when a complete merge of the range is merged again,
+// which yields the same data.
+func (s *State) RecordMerge(startDate, endDate string, files []string, complete bool, summary *Summary) {
+	var delivered []string
+	if prev, ok := s.MergedFiles(startDate, endDate); ok && prev.Complete && complete {
+		delivered = prev.Delivered
+	}
+	s.Merge = &Merge{
+		StartDate: startDate,
+		EndDate:   endDate,
+		Files:     files,
+		Complete:  complete,
+		Summary:   summary,
+		Delivered: delivered,
+	}
+}
+
+// RecordDelivery marks the merged files of the range as delivered to
+// target.
+func (s *State) RecordDelivery(startDate, endDate, target string) {
+	merge, ok := s.MergedFiles(startDate, endDate)
+	if !ok || slices.Contains(merge.Delivered, target) {
+		return
+	}
+	merge.Delivered = append(merge.Delivered, target)
+}
+
+// DeliveredTo reports whether the merged files of the range were already
+// delivered to target.
+func (s *State) DeliveredTo(startDate, endDate, target string) bool {
+	merge, ok := s.MergedFiles(startDate, endDate)
+	return ok && slices.Contains(merge.Delivered, target)
+}
+
+// MergedFiles returns the files recorded by RecordMerge for the range.
+func (s *State) MergedFiles(startDate, endDate string) (*Merge, bool) {
+	if s.Merge == nil || s.Merge.StartDate != startDate || s.Merge.EndDate != endDate {
+		return nil, false
+	}
+	return s.Merge, true
+}
@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MB is the unit of the --max-*-rate options.
+const MB = 1024 * 1024
+
+// Limiter paces transfers to a fixed number of bytes per second. All readers
+// wrapped with the same Limiter share its rate. A nil Limiter does not
+// limit.
+type Limiter struct {
+	rate float64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewLimiter returns a limiter for bytesPerSecond, or nil when the rate is
+// not positive.
+func NewLimiter(bytesPerSecond float64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{rate: bytesPerSecond}
+}
+
+// chunk caps single reads so that one call never stalls for much longer than
+// a tenth of a second.
+func (l *Limiter) chunk() int {
+	n := int(l.rate / 10)
+	if n < 1024 {
+		n = 1024
+	}
+	return n
+}
+
+// wait accounts for n transferred bytes and sleeps until the transfer is
+// back under the rate.
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Reader returns r paced by l. With a nil Limiter r is returned unchanged.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if max := r.l.chunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"gih-ftp/internal/logger"
+)
+
+// ProgressThreshold is the size from which transfers log their progress.
+const ProgressThreshold = 100 * MB
+
+// ProgressInterval is the time between two progress log lines.
+const ProgressInterval = 10 * time.Second
+
+// Progress returns r wrapped so that reading it logs the progress of the
+// transfer every ProgressInterval. Transfers smaller than ProgressThreshold
+// (or of unknown size) are not logged and r is returned unchanged.
+func Progress(r io.Reader, name string, total int64) io.Reader {
+	if total < ProgressThreshold {
+		return r
+	}
+	now := time.Now()
+	return &progressReader{r: r, name: name, total: total, start: now, last: now}
+}
+
+type progressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+
+	if now := time.Now(); now.Sub(p.last) >= ProgressInterval {
+		p.last = now
+		elapsed := now.Sub(p.start).Seconds()
+		logger.Info("Transfer progress",
+			"file", p.name,
+			"bytes", p.done,
+			"total_bytes", p.total,
+			"percent", fmt.Sprintf("%.1f", float64(p.done)*100/float64(p.total)),
+			"speed_mbps", fmt.Sprintf("%.2f", float64(p.done)/elapsed/MB),
+		)
+	}
+
+	return n, err
+}
@@ -1,34 +1,94 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"time"
 
+	"gih-ftp/internal/archive"
+	"gih-ftp/internal/cache"
 	"gih-ftp/internal/config"
+	"gih-ftp/internal/diskspace"
 	ftpclient "gih-ftp/internal/ftp"
 	"gih-ftp/internal/gihapi"
+	"gih-ftp/internal/httpupload"
+	"gih-ftp/internal/lock"
 	"gih-ftp/internal/logger"
 	"gih-ftp/internal/merger"
+	"gih-ftp/internal/metrics"
+	"gih-ftp/internal/notify"
+	"gih-ftp/internal/pipeline"
+	"gih-ftp/internal/progress"
+	"gih-ftp/internal/proxy"
+	"gih-ftp/internal/redact"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/rsync"
 	sftpclient "gih-ftp/internal/sftp"
+	"gih-ftp/internal/state"
+	"gih-ftp/internal/transfer"
 )
 
+// Exit codes; see package pipeline.
 const (
-	ExitSuccess      = 0
-	ExitConfigError  = 1
-	ExitFetchError   = 2
-	ExitMergeError   = 3
-	ExitUploadError  = 4
-	ExitPartialError = 5
+	ExitSuccess      = pipeline.ExitSuccess
+	ExitConfigError  = pipeline.ExitConfigError
+	ExitFetchError   = pipeline.ExitFetchError
+	ExitMergeError   = pipeline.ExitMergeError
+	ExitUploadError  = pipeline.ExitUploadError
+	ExitPartialError = pipeline.ExitPartialError
+	ExitCheckError   = pipeline.ExitCheckError
+	ExitVerifyError  = pipeline.ExitVerifyError
+	ExitInterrupted  = pipeline.ExitInterrupted
+	ExitAnomaly      = pipeline.ExitAnomaly
+	ExitLocked       = pipeline.ExitLocked
+	ExitNoData       = pipeline.ExitNoData
+	ExitAuthError    = pipeline.ExitAuthError
+	ExitHostKeyError = pipeline.ExitHostKeyError
+	ExitNetworkError = pipeline.ExitNetworkError
+	ExitHookError    = pipeline.ExitHookError
+	ExitTimeout      = pipeline.ExitTimeout
 )
 
+const version = "2.0.0"
+
 func main() {
+	// Subcommands are given as the first argument, before any flags. Without
+	// one the full run is performed.
+	command := "run"
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Printf("gihftp %s\n", version)
+		os.Exit(ExitSuccess)
+	} else if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		os.Exit(runSecrets(os.Args[2:]))
+	} else if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(runSelftest(os.Args[2:]))
+	} else if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	} else if len(os.Args) > 1 && (commands[os.Args[1]] != nil || os.Args[1] == "check" || os.Args[1] == "history") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	} else if len(os.Args) > 1 && os.Args[1] == "config" {
+		if len(os.Args) < 3 || os.Args[2] != "validate" {
+			fmt.Fprintf(os.Stderr, "Usage: %s config validate [--config=FILE] [flags]\n", os.Args[0])
+			os.Exit(ExitConfigError)
+		}
+		command = "config validate"
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	// Load configuration (from flags or config file)
+	if command == "history" {
+		os.Exit(runHistory())
+	}
 	cfg, err := config.Load()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Configuration error: %s\n", redact.String(err.Error()))
 		fmt.Fprintf(os.Stderr, "\nUsage examples:\n")
 		fmt.Fprintf(os.Stderr, "  Using config file:\n")
 		fmt.Fprintf(os.Stderr, "    %s --config=/etc/gihftp.conf\n\n", os.Args[0])
@@ -40,134 +100,718 @@ func main() {
 		fmt.Fprintf(os.Stderr, "      --ftp-log-dir=/var/log/uploads/ \\\n")
 		fmt.Fprintf(os.Stderr, "      --ssh-key=/root/.ssh/id_rsa \\\n")
 		fmt.Fprintf(os.Stderr, "      --work-dir=/tmp/logmerger\n\n")
+		fmt.Fprintf(os.Stderr, "  Single stages (fetch, merge, upload) instead of a full run:\n")
+		fmt.Fprintf(os.Stderr, "    %s fetch --config=/etc/gihftp.conf\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s merge --config=/etc/gihftp.conf\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "    %s upload --config=/etc/gihftp.conf\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Preflight connectivity check:\n")
+		fmt.Fprintf(os.Stderr, "    %s check --config=/etc/gihftp.conf\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Past runs:\n")
+		fmt.Fprintf(os.Stderr, "    %s history --config=/etc/gihftp.conf --last=10\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Config file validation:\n")
+		fmt.Fprintf(os.Stderr, "    %s config validate --config=/etc/gihftp.conf\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  End-to-end self-test against built-in fake servers:\n")
+		fmt.Fprintf(os.Stderr, "    %s selftest\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Merge benchmark on local sample logs:\n")
+		fmt.Fprintf(os.Stderr, "    %s bench --input-dir=/path/to/logs --cpuprofile=cpu.pprof\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  Password can be provided via FTP_PASSWORD environment variable\n")
 		os.Exit(ExitConfigError)
 	}
 
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration validation failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Configuration validation failed: %s\n", redact.String(err.Error()))
 		os.Exit(ExitConfigError)
 	}
 
-	// Initialize logger
-	logger.Init(cfg.LogLevel)
+	if command == "config validate" {
+		printConfigSummary(cfg)
+		os.Exit(ExitSuccess)
+	}
+
+	redact.SetSecrets(cfg.Secrets())
+
+	// Initialize logger; with progress bars on stdout the logs go to stderr
+	display := progressDisplay(cfg)
+	logOpts := logger.Options{
+		Format:     cfg.LogFormat,
+		File:       cfg.LogFile,
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		MaxBackups: cfg.LogMaxBackups,
+	}
+	if display != nil {
+		logOpts.Output = display.LogWriter(os.Stderr)
+	}
+	if err := logger.Init(cfg.LogLevel, logOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Logger initialization failed: %v\n", err)
+		os.Exit(ExitConfigError)
+	}
 
 	logger.Info("GIH-FTP Service Starting",
-		"version", "2.0.0",
+		"version", version,
+		"command", command,
 		"gih_servers", fmt.Sprintf("%v", cfg.GIHServers),
-		"ftp_host", cfg.FTPHost,
+		"gih_discover", fmt.Sprintf("%v", cfg.GIHDiscover),
+		"upload_targets", len(cfg.UploadTargets),
 		"work_dir", cfg.WorkDir,
 	)
+	for _, warning := range cfg.Deprecated {
+		logger.Warn(warning)
+	}
+	setMemoryLimit(cfg)
+
+	if cfg.UploadFile != "" && command != "upload" {
+		logger.Error("--file can only be used with the upload subcommand")
+		os.Exit(ExitConfigError)
+	}
+	if cfg.InputDir != "" && command != "merge" {
+		logger.Error("--input-dir can only be used with the merge subcommand")
+		os.Exit(ExitConfigError)
+	}
 
-	// Run main process
-	exitCode := run(cfg)
+	// The root context of every network operation; cancelled by SIGINT and
+	// SIGTERM
+	ctx, stop := withSignals(context.Background())
+
+	if command == "check" {
+		exitCode := runCheck(ctx, cfg)
+		stop()
+		os.Exit(exitCode)
+	}
 
-	if exitCode == ExitSuccess {
+	if cfg.MetricsTextfile != "" {
+		if err := metrics.Default.LoadTextfile(cfg.MetricsTextfile); err != nil {
+			logger.Warn("Failed to load previous metrics", "file", cfg.MetricsTextfile, "error", err)
+		}
+	}
+
+	// One instance per work directory; a daemon holds the lock for its
+	// whole lifetime. os.Exit skips defers, so the lock is released
+	// explicitly (the kernel would drop it at exit anyway).
+	lockPath := filepath.Join(cfg.WorkDir, lock.DefaultFilename)
+	if cfg.WaitLock > 0 {
+		logger.Debug("Acquiring lock", "file", lockPath, "wait", cfg.WaitLock.String())
+	}
+	runLock, err := lock.Acquire(ctx, lockPath, cfg.WaitLock)
+	if err != nil {
+		logger.Error("Cannot acquire lock", "error", err)
+		stop()
+		if interrupted(ctx) {
+			os.Exit(ExitInterrupted)
+		}
+		os.Exit(ExitLocked)
+	}
+
+	if cfg.Daemon {
+		if command != "run" {
+			logger.Error("Daemon mode is only supported for full runs", "command", command)
+			os.Exit(ExitConfigError)
+		}
+		exitCode := runDaemon(ctx, cfg)
+		stop()
+		runLock.Release()
+		os.Exit(exitCode)
+	}
+
+	progress.Default = display
+	display.Start()
+	rep := runOnce(ctx, cfg, command)
+	display.Stop()
+	if display != nil {
+		printSummary(rep)
+	}
+	exitCode := rep.ExitCode
+	stop()
+	runLock.Release()
+
+	switch exitCode {
+	case ExitSuccess:
 		logger.Info("GIH-FTP Service completed successfully")
-	} else {
+	case ExitAnomaly:
+		logger.Warn("GIH-FTP Service completed with anomaly warnings", "exit_code", exitCode)
+	case ExitNoData:
+		logger.Warn("GIH-FTP Service found no data for the date range", "exit_code", exitCode)
+	default:
 		logger.Error("GIH-FTP Service completed with errors", "exit_code", exitCode)
 	}
 
 	os.Exit(exitCode)
 }
 
-func run(cfg *config.Config) int {
-	startTime := time.Now()
+// runOnce performs one invocation of the command's stage, bounded by the run
+// deadline, writes the configured run artifacts (JSON report, metrics
+// textfile, history) and returns the finished report.
+func runOnce(ctx context.Context, cfg *config.Config, command string) *report.Report {
+	rep := report.New()
+	workDirSpace = diskspace.New(cfg.WorkDir, cfg.MaxWorkDirBytes)
 
-	// Create GIH API client
-	apiClient := gihapi.NewClient(cfg.InsecureSkipVerify)
-	defer apiClient.Close()
+	metrics.Set(metrics.DownloadedBytes, 0)
+	metrics.Set(metrics.UploadedBytes, 0)
+	metrics.Reset(metrics.StageDuration)
+	metrics.Reset(metrics.ServerFetchDuration)
+	metrics.Reset(metrics.UploadDuration)
 
-	startDate, endDate := getLastWeekRange()
-	logger.Info("Fetching logs for last week",
-		"start_date", startDate,
-		"end_date", endDate,
+	if cfg.RunDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunDeadline)
+		defer cancel()
+	}
+
+	if a := localArchive(cfg); a != nil {
+		if removed, err := a.Prune(time.Now()); err != nil {
+			logger.Warn("Failed to prune archive", "dir", cfg.ArchiveDir, "error", err)
+		} else if removed > 0 {
+			logger.Info("Pruned archive", "dir", cfg.ArchiveDir, "days_removed", removed)
+		}
+	}
+
+	exitCode := commands[command](ctx, cfg, rep)
+	succeeded := exitCode == ExitSuccess
+
+	// The run itself succeeded; the distinct codes make the warning visible
+	// to cron and systemd.
+	if succeeded {
+		switch {
+		case rep.Merge != nil && rep.Merge.TotalRequests == 0:
+			exitCode = ExitNoData
+		case len(rep.Anomalies) > 0:
+			exitCode = ExitAnomaly
+		}
+	}
+
+	metrics.Set(metrics.RunDuration, time.Since(rep.StartedAt).Seconds())
+	metrics.Set(metrics.RunExitCode, float64(exitCode))
+	recordTimings(rep.Timings)
+	if succeeded {
+		metrics.Set(metrics.LastSuccessTimestamp, float64(time.Now().Unix()))
+	}
+
+	rep.Finish(exitCode)
+	rep.Redact(redact.String)
+
+	if cfg.Report != "" {
+		if err := rep.Write(cfg.Report); err != nil {
+			logger.Warn("Failed to write run report", "file", cfg.Report, "error", err)
+		}
+	}
+	writeMetricsTextfile(cfg)
+	recordHistory(cfg, command, rep)
+	sendNotifications(cfg, rep)
+
+	return rep
+}
+
+// recordTimings logs the stage timings of a run and exports them as
+// metrics.
+func recordTimings(t report.Timings) {
+	logger.Info("Stage timings",
+		"fetch_seconds", t.Fetch,
+		"merge_seconds", t.Merge,
+		"save_seconds", t.Save,
+		"upload_seconds", t.Upload,
 	)
+	metrics.Set(metrics.StageDuration, t.Fetch, "stage", "fetch")
+	metrics.Set(metrics.StageDuration, t.Merge, "stage", "merge")
+	metrics.Set(metrics.StageDuration, t.Save, "stage", "save")
+	metrics.Set(metrics.StageDuration, t.Upload, "stage", "upload")
+}
+
+// printConfigSummary reports the effective settings of a valid
+// configuration for `gihftp config validate`. Secrets are not printed.
+func printConfigSummary(cfg *config.Config) {
+	source := cfg.ConfigFile
+	if source == "" {
+		source = "(flags only)"
+	}
+
+	fmt.Printf("Configuration is valid: %s\n", source)
+	fmt.Printf("  GIH servers:    %v\n", cfg.GIHServers)
+	for _, source := range serverSources(cfg) {
+		fmt.Printf("  GIH discovery:  %s %s\n", source.kind, source.name)
+	}
+	for _, target := range cfg.UploadTargets {
+		if target.Protocol == "https" {
+			fmt.Printf("  Upload target:  %s %s %s\n", target.Name, target.Method, httpupload.Display(target.URL))
+			continue
+		}
+		fmt.Printf("  Upload target:  %s %s://%s%s\n", target.Name, target.Protocol, target.Host, target.LogDir)
+	}
+	fmt.Printf("  Work dir:       %s\n", cfg.WorkDir)
+	if cfg.Daemon {
+		fmt.Printf("  Schedule:       %s\n", cfg.Schedule)
+	}
+}
+
+func sendNotifications(cfg *config.Config, rep *report.Report) {
+	events, _ := notify.ParseEvents(cfg.NotifyOn)
+
+	var notifiers []notify.Notifier
+	if cfg.NotifyWebhook != "" {
+		notifiers = append(notifiers, &notify.Webhook{URL: cfg.NotifyWebhook})
+	}
+	if cfg.NotifySMTPHost != "" {
+		notifiers = append(notifiers, &notify.SMTP{
+			Addr:     cfg.NotifySMTPHost,
+			From:     cfg.NotifySMTPFrom,
+			To:       cfg.NotifySMTPTo,
+			Username: cfg.NotifySMTPUser,
+			Password: cfg.NotifySMTPPass,
+		})
+	}
+
+	dispatcher := notify.NewDispatcher(events, notifiers...)
+	if !dispatcher.Enabled() {
+		return
+	}
+
+	// Not derived from the run's context: an interrupted run is reported too
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, err := range dispatcher.Dispatch(ctx, notify.NewMessage(runEvent(rep.ExitCode), rep)) {
+		logger.Warn("Failed to send notification", "error", err)
+	}
+}
+
+// runEvent classifies a run by its exit code.
+func runEvent(exitCode int) notify.Event {
+	switch exitCode {
+	case ExitSuccess:
+		return notify.EventSuccess
+	case ExitPartialError:
+		return notify.EventPartial
+	case ExitAnomaly:
+		return notify.EventAnomaly
+	case ExitNoData:
+		return notify.EventEmpty
+	}
+	return notify.EventFailure
+}
+
+// newAPIClient creates a GIH API client configured from cfg.
+func newAPIClient(cfg *config.Config) (*gihapi.Client, error) {
+	apiClient, err := gihapi.NewClient(gihapi.Options{
+		InsecureSkipVerify: cfg.GIHInsecureTLS,
+		CACert:             cfg.GIHCACert,
+		CADir:              cfg.GIHCADir,
+		ClientCert:         cfg.GIHClientCert,
+		ClientKey:          cfg.GIHClientKey,
+		Proxy:              cfg.ProxyURL(),
+		DialTimeout:        cfg.GIHDialTimeout,
+		TLSTimeout:         cfg.GIHTLSTimeout,
+		ResponseTimeout:    cfg.GIHResponseTimeout,
+		IdleTimeout:        cfg.GIHIdleTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apiClient.SetRetryPolicy(gihapi.RetryPolicy{
+		Attempts:     cfg.RetryAttempts,
+		InitialDelay: cfg.RetryInitialDelay,
+		MaxDelay:     cfg.RetryMaxDelay,
+		Jitter:       cfg.RetryJitter,
+	})
+
+	apiClient.SetRateLimiter(transfer.NewLimiter(cfg.MaxDownloadRate * transfer.MB))
+	apiClient.SetHTTPTrace(cfg.HTTPDebug)
+
+	apiClient.SetAuth(gihapi.Auth{Token: cfg.GIHAPIToken, Header: cfg.GIHAPIKeyHeader})
+	for host, token := range cfg.GIHServerTokens {
+		apiClient.SetServerAuth(host, gihapi.Auth{Token: token, Header: cfg.GIHAPIKeyHeader})
+	}
+	for host, override := range cfg.GIHServerOverrides {
+		if override.CACert == "" {
+			continue
+		}
+		if err := apiClient.SetServerCACert(host, override.CACert); err != nil {
+			apiClient.Close()
+			return nil, err
+		}
+	}
 
-	m := merger.New(cfg.WorkDir)
+	return apiClient, nil
+}
 
-	successCount := 0
-	failureCount := 0
+// fetchFromServerResumable fetches host into its own partial aggregate
+// (one per day for daily granularity), saves it in the work directory and
+// records it in the state file before merging it into out (unless out is
+// nil). Malformed lines go to q, which may be nil. When the state shows host
+// already completed the same range, the saved partial is merged instead of
+// fetching again.
+func fetchFromServerResumable(ctx context.Context, cfg *config.Config, st *state.State, apiClient *gihapi.Client, out *dayMergers, q *merger.Quarantine, server gihapi.Server, startDate, endDate string, result *report.Server) error {
+	host := server.Name
+	if !cfg.Force {
+		if partial, ok := st.CompletedFetch(startDate, endDate, host); ok {
+			var err error
+			if out != nil {
+				err = mergePartial(out, host, partial)
+			} else {
+				_, err = os.Stat(partial)
+			}
+			if err == nil {
+				logger.Info("Reusing completed fetch from previous run", "host", host, "file", partial)
+				result.Reused = true
+				setServerDays(result, st.FetchDays(host))
+				return nil
+			}
+			logger.Warn("Cannot reuse previous fetch, fetching again", "host", host, "error", err)
+		}
+	}
 
-	for _, host := range cfg.GIHServers {
-		err := fetchFromServerWeekly(apiClient, m, host, cfg.GIHAPIPort, startDate, endDate)
+	dir := partialDir(cfg, startDate, endDate)
+	create := func() (*merger.Merger, error) {
+		m, err := newMerger(cfg, dir)
 		if err != nil {
-			logger.Error("Weekly fetch failed",
-				"host", host,
-				"error", err)
-			failureCount++
-		} else {
-			successCount++
+			return nil, err
 		}
+		m.SetQuarantine(q, host)
+		return m, nil
+	}
+	sm := newDayMergers(cfg.Granularity == "daily", create)
+	if cfg.Stream && out != nil {
+		sm = newStreamMergers(out, host, create)
 	}
+	defer sm.Close()
 
-	if successCount == 0 {
-		logger.Error("No successful fetch from any server")
-		return ExitFetchError
+	if err := fetchFromServer(ctx, cfg, apiClient, sm, server, startDate, endDate, result); err != nil {
+		return err
 	}
 
-	stats := m.GetStats()
-	logger.Info("Weekly merge statistics",
-		"week_start", startDate,
-		"week_end", endDate,
-		"unique_domains", stats["unique_domains"],
-		"total_requests", stats["total_requests"],
-		"top_domain", stats["top_domain"],
-		"top_domain_hits", stats["top_domain_hits"],
-	)
+	// With --stream the files went straight into the combined result, so a
+	// later run has nothing to resume from
+	days := dayCounts(sm)
+	if cfg.Stream && out != nil {
+		setServerDays(result, days)
+		logSkippedLines(result)
+		return nil
+	}
 
-	uploadDate := time.Now().Format("20060102")
-	filename := fmt.Sprintf("NETINTERNET-GIH-DNS_250k-%s.txt", uploadDate)
-	outputPath, err := m.SaveToFile(filename)
+	partial, err := savePartial(sm, dir, host)
 	if err != nil {
-		logger.Error("Failed to save weekly merged file", "error", err)
-		return ExitMergeError
+		return fmt.Errorf("failed to save partial result: %w", err)
 	}
 
-	logger.Info("Weekly merged file created",
-		"file", outputPath,
-		"week_start", startDate,
-		"week_end", endDate,
-	)
+	if out != nil {
+		if err := mergePartial(out, host, partial); err != nil {
+			return err
+		}
+	}
 
-	if err := uploadToFTP(cfg, outputPath); err != nil {
-		logger.Error("FTP upload failed",
-			"file", outputPath,
-			"error", err)
-		return ExitUploadError
+	setServerDays(result, days)
+	logSkippedLines(result)
+	st.RecordFetch(startDate, endDate, host, partial, days)
+	if err := st.Save(); err != nil {
+		logger.Warn("Failed to save state", "error", err)
 	}
 
-	if cfg.CleanupAfter {
-		if err := os.Remove(outputPath); err != nil {
-			logger.Warn("Failed to remove temp file", "file", outputPath)
-		} else {
-			logger.Info("Temp file removed", "file", outputPath)
+	return nil
+}
+
+func newMerger(cfg *config.Config, workDir string) (*merger.Merger, error) {
+	m := merger.New(workDir)
+	if err := m.SetEngine(cfg.MergeEngine); err != nil {
+		return nil, err
+	}
+	if err := m.SetNormalization(cfg.NormalizeDomains); err != nil {
+		return nil, err
+	}
+	m.SetQTypes(cfg.QTypes)
+	m.SetQTypeBreakdown(cfg.QTypeBreakdown())
+	m.SetClientTracking(cfg.TrackClients())
+	if memoryBudget != nil {
+		m.SetMemoryBudget(memoryBudget)
+	}
+	m.SetSpaceGuard(workDirSpace)
+	return m, nil
+}
+
+// workDirSpace is the free space and --max-workdir-bytes check shared by
+// every writer to the work directory during a run, set by runOnce.
+var workDirSpace *diskspace.Guard
+
+// reserveCopy reserves room in the work directory for a file as large as
+// path written next to it, such as its encrypted copy or its parts. Files
+// outside the work directory get a nil reservation.
+func reserveCopy(path string) (*diskspace.Reservation, error) {
+	if !workDirSpace.Contains(path) {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return workDirSpace.Reserve(info.Size())
+}
+
+// removeWorkFile removes path and gives its space in the work directory
+// back.
+func removeWorkFile(path string) error {
+	info, statErr := os.Stat(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if statErr == nil && workDirSpace.Contains(path) {
+		workDirSpace.Release(info.Size())
+	}
+	return nil
+}
+
+// memoryBudget is shared by all mergers of the process, nil without
+// --max-memory-mb.
+var memoryBudget *merger.MemoryBudget
+
+// setMemoryLimit applies --max-memory-mb: the soft memory limit of the
+// runtime, which makes the garbage collector work harder near it, and the
+// budget of the merge data, half of it to leave room for downloads, sorting
+// and the collector.
+func setMemoryLimit(cfg *config.Config) {
+	if cfg.MaxMemoryMB <= 0 {
+		return
+	}
+	limit := int64(cfg.MaxMemoryMB) << 20
+	debug.SetMemoryLimit(limit)
+	memoryBudget = merger.NewMemoryBudget(limit / 2)
+	logger.Debug("Memory limit set", "limit_mb", cfg.MaxMemoryMB, "merge_budget_mb", cfg.MaxMemoryMB/2)
+}
+
+// partialDir holds per-server partial aggregates for a date range.
+func partialDir(cfg *config.Config, startDate, endDate string) string {
+	return filepath.Join(cfg.WorkDir, "partial", startDate+"-"+endDate)
+}
+
+// mergeFile adds the saved partial result of source to m.
+func mergeFile(m *merger.Merger, source, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return m.AddSource(source, file)
+}
+
+// mergeLogFile adds one log file to m, decompressing gzip and zstd files
+// first. A non-empty source is tracked in the per-source statistics.
+func mergeLogFile(m *merger.Merger, source string, r io.Reader, filename string) error {
+	compression, r := merger.DetectCompression(r, filename)
+	if compression != merger.CompressionNone {
+		logger.Debug("Decompressing log file", "filename", filename, "compression", compression)
+	}
+
+	dec, err := merger.NewDecompressor(r, compression)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", filename, err)
+	}
+	defer dec.Close()
+
+	return m.AddSource(source, dec)
+}
+
+// mergeVerified merges a streamed log file of day into a scratch merger and
+// adds it to sm only once the file was read completely and its size and
+// checksum verified, so that a truncated or corrupt file leaves no counts
+// behind. Files read from the cache were verified before they were stored.
+func mergeVerified(sm *dayMergers, day string, r io.Reader, filename string) error {
+	scratch, err := sm.create()
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+
+	if err := mergeLogFile(scratch, day, r, filename); err != nil {
+		return err
+	}
+	return sm.add(day, scratch)
+}
+
+// safeFilename replaces characters that are not safe in file names.
+func safeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
 		}
+	}, name)
+}
+
+func stateFilePath(cfg *config.Config) string {
+	if cfg.StateFile != "" {
+		return cfg.StateFile
 	}
+	return filepath.Join(cfg.WorkDir, state.DefaultFilename)
+}
 
-	duration := time.Since(startTime)
-	logger.Info("Weekly processing completed",
-		"duration_seconds", duration.Seconds(),
-		"servers_success", successCount,
-		"servers_failed", failureCount,
-	)
+// fetchFromServer runs fetchFromServerWeekly bounded by the per-server
+// timeout, if one is configured.
+func fetchFromServer(ctx context.Context, cfg *config.Config, apiClient *gihapi.Client, sm *dayMergers, server gihapi.Server, startDate, endDate string, result *report.Server) error {
+	if cfg.ServerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ServerTimeout)
+		defer cancel()
+	}
 
-	if failureCount > 0 {
-		return ExitPartialError
+	return fetchFromServerWeekly(ctx, apiClient, downloadCache(cfg), workDirSpace, sm, server, startDate, endDate, cfg.DownloadConcurrency, result)
+}
+
+// downloadCache returns the cache for downloaded log files, or nil when
+// caching is disabled.
+func downloadCache(cfg *config.Config) *cache.Cache {
+	if cfg.NoCache {
+		return nil
 	}
+	return cache.New(filepath.Join(cfg.WorkDir, cache.DefaultDirname), cfg.CacheTTL)
+}
 
-	return ExitSuccess
+// localArchive returns the archive for uploaded files, or nil when
+// --archive-dir is not set.
+func localArchive(cfg *config.Config) *archive.Archive {
+	if cfg.ArchiveDir == "" {
+		return nil
+	}
+	return archive.New(cfg.ArchiveDir, cfg.ArchiveRetentionDays)
+}
+
+// download is the outcome of opening one log file.
+type download struct {
+	body      io.ReadCloser
+	cached    bool
+	truncated int
+	err       error
+}
+
+// openLogFile returns the contents of file, from dc when a fresh copy is
+// cached and otherwise by downloading it. An expired copy is revalidated
+// with a conditional request and reused when the server reports it
+// unchanged. Downloads are written to the cache completely before they are
+// read, so a failed transfer never reaches the merger half-read and a
+// truncated one can be downloaded again; without a cache it only fails
+// when read, and mergeVerified keeps its counts out of the result. A
+// download into the cache first reserves the size of the file in space.
+// cached reports whether the download was skipped.
+func openLogFile(ctx context.Context, apiClient *gihapi.Client, dc *cache.Cache, space *diskspace.Guard, server gihapi.Server, file gihapi.LogFile) download {
+	if dc == nil {
+		body, err := apiClient.DownloadFileStream(ctx, server, file.DownloadURL)
+		if err != nil {
+			return download{err: err}
+		}
+		r := transfer.Progress(body, file.Filename, int64(file.Size))
+		r = progress.ForServer(server.Name).Reader(r, file.Filename, int64(file.Size))
+		return download{body: struct {
+			io.Reader
+			io.Closer
+		}{file.Verify(r), body}}
+	}
+
+	if f, ok := dc.Open(server.Name, file.Filename, file.Size); ok {
+		return download{body: f, cached: true}
+	}
+
+	var since gihapi.Validators
+	var reserved *diskspace.Reservation
+	if meta, ok := dc.Stale(server.Name, file.Filename, file.Size); ok {
+		since = gihapi.Validators{ETag: meta.ETag, LastModified: meta.LastModified}
+	} else {
+		var err error
+		if reserved, err = space.Reserve(int64(file.Size)); err != nil {
+			return download{err: err}
+		}
+	}
+
+	var path string
+	truncated, err := apiClient.DownloadIfModified(ctx, server, file, since, func(r io.Reader, v gihapi.Validators) error {
+		var err error
+		meta := cache.Meta{ETag: v.ETag, LastModified: v.LastModified}
+		r = transfer.Progress(r, file.Filename, int64(file.Size))
+		r = progress.ForServer(server.Name).Reader(r, file.Filename, int64(file.Size))
+		path, err = dc.Store(server.Name, file.Filename, file.Size, meta, r)
+		if err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+		return nil
+	})
+	var stored int64
+	if info, statErr := os.Stat(path); path != "" && statErr == nil {
+		stored = info.Size()
+	}
+	reserved.Done(stored)
+	if errors.Is(err, gihapi.ErrNotModified) {
+		logger.Debug("Log file not modified, using cached copy", "host", server.Name, "filename", file.Filename)
+		f, err := dc.Refresh(server.Name, file.Filename, file.Size)
+		if err != nil {
+			return download{err: err}
+		}
+		return download{body: f, cached: true}
+	}
+	if err != nil {
+		return download{truncated: truncated, err: err}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return download{truncated: truncated, err: err}
+	}
+	return download{body: f, truncated: truncated}
+}
+
+// openLogFiles opens files with up to concurrency downloads in flight and
+// returns one channel per file, in the order of files, each delivering that
+// file's download. Without a cache a download is an open response that
+// is only read when merged, so files are then opened one at a time, each
+// after the previous one was closed.
+func openLogFiles(ctx context.Context, apiClient *gihapi.Client, dc *cache.Cache, space *diskspace.Guard, server gihapi.Server, files []gihapi.LogFile, concurrency int) []chan download {
+	if dc == nil || concurrency < 1 {
+		concurrency = 1
+	}
+
+	downloads := make([]chan download, len(files))
+	for i := range downloads {
+		downloads[i] = make(chan download, 1)
+	}
+
+	go func() {
+		slots := make(chan struct{}, concurrency)
+		for i, file := range files {
+			slots <- struct{}{}
+			go func() {
+				d := openLogFile(ctx, apiClient, dc, space, server, file)
+				// Without a cache the slot is held until the body is read
+				if dc == nil && d.err == nil {
+					d.body = releaseOnClose{ReadCloser: d.body, release: func() { <-slots }}
+				} else {
+					<-slots
+				}
+				downloads[i] <- d
+			}()
+		}
+	}()
+
+	return downloads
+}
+
+// releaseOnClose calls release once the body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
 }
 
-func fetchFromServerWeekly(apiClient *gihapi.Client, m *merger.Merger, host, port, startDate, endDate string) error {
+func fetchFromServerWeekly(ctx context.Context, apiClient *gihapi.Client, dc *cache.Cache, space *diskspace.Guard, sm *dayMergers, server gihapi.Server, startDate, endDate string, concurrency int, result *report.Server) error {
+	host := server.Name
 	logger.Info("Fetching weekly logs from server",
 		"host", host,
 		"start_date", startDate,
 		"end_date", endDate,
 	)
 
-	files, err := apiClient.FetchLogFiles(host, port, startDate, endDate)
+	files, err := apiClient.FetchLogFiles(ctx, server, startDate, endDate)
 	if err != nil {
 		return fmt.Errorf("failed to fetch weekly log list: %w", err)
 	}
@@ -184,85 +828,415 @@ func fetchFromServerWeekly(apiClient *gihapi.Client, m *merger.Merger, host, por
 		"host", host,
 		"file_count", len(files),
 	)
+	result.Files = len(files)
+	bar := progress.ForServer(host)
+	bar.SetFiles(len(files))
 
+	// The merged data is at most as large as the logs; the cache needs a
+	// copy of every file it does not hold yet
+	var need int64
 	for _, file := range files {
+		need += int64(file.Size)
+		if dc != nil && !dc.Has(server.Name, file.Filename, file.Size) {
+			need += int64(file.Size)
+		}
+	}
+	if err := space.Check(need); err != nil {
+		return err
+	}
+	logger.Debug("Work directory has room for fetch", "host", host, "estimated_bytes", need)
+
+	start := time.Now()
+	var downloaded int64
+
+	// Files are merged in order as their downloads complete. Downloads
+	// still pending when the fetch is aborted are closed here.
+	downloads := openLogFiles(ctx, apiClient, dc, space, server, files, concurrency)
+	next := 0
+	defer func() {
+		for _, ch := range downloads[next:] {
+			if d := <-ch; d.err == nil {
+				d.body.Close()
+			}
+		}
+	}()
+
+	for i, file := range files {
+		bar.SetFilesDone(i)
 		logger.Debug("Downloading log file",
 			"host", host,
 			"filename", file.Filename,
 		)
 
-		content, err := apiClient.DownloadFile(host, port, file.DownloadURL)
-		if err != nil {
+		openStart := time.Now()
+		d := <-downloads[i]
+		next = i + 1
+		opened := time.Since(openStart)
+		result.TruncatedFiles += d.truncated
+		if ctx.Err() != nil {
+			if d.err == nil {
+				d.body.Close()
+			}
+			return fmt.Errorf("fetch aborted: %w", ctx.Err())
+		}
+		if errors.Is(d.err, diskspace.ErrNoSpace) {
+			return d.err
+		}
+		if d.err != nil {
 			logger.Error("Failed to download log",
 				"host", host,
 				"filename", file.Filename,
-				"error", err)
+				"error", d.err)
+			result.FilesFailed++
 			continue
 		}
 
-		if err := m.AddContent(content); err != nil {
+		if d.cached {
+			logger.Debug("Using cached log file", "host", host, "filename", file.Filename)
+			result.CachedFiles++
+		}
+
+		var m *merger.Merger
+		if dc != nil {
+			if m, err = sm.get(file.Date); err != nil {
+				d.body.Close()
+				logger.Error("Failed to merge log",
+					"host", host,
+					"filename", file.Filename,
+					"error", err)
+				result.FilesFailed++
+				continue
+			}
+		}
+
+		counter := &countingReader{r: d.body}
+		mergeStart := time.Now()
+		if dc == nil {
+			err = mergeVerified(sm, file.Date, counter, file.Filename)
+		} else {
+			err = mergeLogFile(m, file.Date, counter, file.Filename)
+		}
+		d.body.Close()
+		timing := report.FileTiming{
+			Filename:     file.Filename,
+			Bytes:        counter.n,
+			Cached:       d.cached,
+			OpenSeconds:  opened.Seconds(),
+			MergeSeconds: time.Since(mergeStart).Seconds(),
+		}
+		result.FileTimings = append(result.FileTimings, timing)
+		logger.Debug("Log file merged",
+			"host", host,
+			"filename", file.Filename,
+			"bytes", timing.Bytes,
+			"open_seconds", timing.OpenSeconds,
+			"merge_seconds", timing.MergeSeconds,
+		)
+		if !d.cached {
+			metrics.Add(metrics.DownloadedBytes, float64(counter.n))
+			downloaded += counter.n
+		}
+		result.Bytes += counter.n
+		if ctx.Err() != nil {
+			return fmt.Errorf("fetch aborted while reading %s: %w", file.Filename, ctx.Err())
+		}
+		if errors.Is(err, diskspace.ErrNoSpace) {
+			return err
+		}
+		if err != nil {
+			if errors.Is(err, gihapi.ErrSizeMismatch) {
+				result.TruncatedFiles++
+			}
 			logger.Error("Failed to merge log",
 				"host", host,
 				"filename", file.Filename,
 				"error", err)
+			result.FilesFailed++
 			continue
 		}
 	}
+	bar.SetFilesDone(len(files))
+
+	if downloaded > 0 {
+		elapsed := time.Since(start).Seconds()
+		logger.Info("Server download completed",
+			"host", host,
+			"bytes", downloaded,
+			"duration_seconds", elapsed,
+			"speed_mbps", fmt.Sprintf("%.2f", float64(downloaded)/elapsed/transfer.MB),
+			"concurrency", concurrency,
+		)
+	}
 
 	return nil
 }
 
-func uploadToSFTP(cfg *config.Config, localPath string) error {
-	logger.Info("Uploading to SFTP server")
+// remotePathFor returns the remote path a local file is uploaded to.
+func remotePathFor(target config.UploadTarget, localPath string) string {
+	return target.RemotePath(filepath.Base(localPath), time.Now())
+}
 
-	// Create SFTP client
-	sftpClient := sftpclient.NewClient(
-		cfg.FTPHost,
-		cfg.FTPUser,
-		cfg.FTPPassword,
-		cfg.SSHKeyPath,
-		cfg.InsecureSkipVerify,
+// upload delivers files to target in order and returns the number uploaded
+// before the first failure.
+func upload(ctx context.Context, cfg *config.Config, target config.UploadTarget, files []string) (int, error) {
+	switch target.Protocol {
+	case "sftp":
+		return uploadToSFTP(ctx, cfg, target, files)
+	case "https":
+		return uploadToHTTPS(ctx, cfg, target, files)
+	case "rsync":
+		return uploadToRsync(ctx, cfg, target, files)
+	}
+	return uploadToFTP(ctx, cfg, target, files)
+}
+
+func newSFTPClient(cfg *config.Config, target config.UploadTarget) (*sftpclient.Client, error) {
+	client := sftpclient.NewClient(
+		target.Host,
+		target.User,
+		target.Password,
+		target.SSHKeyPath,
+		cfg.SSHInsecureHostKey,
 	)
+	client.SetPassphraseFile(cfg.SSHKeyPassphraseFile)
+	client.SetPassphrase(cfg.SSHKeyPassphrase)
+	client.SetHostKeyCache(hostKeyCachePath(cfg))
+	client.SetKnownHosts(cfg.SSHKnownHosts)
+	client.SetHostFingerprint(target.HostFingerprint)
 
-	// Build remote path
-	filename := filepath.Base(localPath)
-	remotePath := filepath.Join(cfg.FTPLogDir, filename)
+	if proxyURL := cfg.ProxyURL(); proxyURL != "" {
+		dialer, err := proxy.New(proxyURL, 15*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		client.SetDialer(dialer)
+	}
+
+	return client, nil
+}
 
-	// Upload file
-	if err := sftpClient.Upload(localPath, remotePath); err != nil {
-		return fmt.Errorf("SFTP upload failed: %w", err)
+// newRsyncClient returns an rsync client with the SSH settings of the SFTP
+// client. ssh cannot be given a password or key passphrase, so only keys
+// without one and ssh-agent log in.
+func newRsyncClient(cfg *config.Config, target config.UploadTarget) *rsync.Client {
+	client := rsync.NewClient(target.Host, target.User, target.SSHKeyPath, cfg.SSHInsecureHostKey)
+	client.SetHostKeyCache(hostKeyCachePath(cfg))
+	client.SetKnownHosts(cfg.SSHKnownHosts)
+	return client
+}
+
+func hostKeyCachePath(cfg *config.Config) string {
+	if cfg.SSHHostKeyCache != "" {
+		return cfg.SSHHostKeyCache
 	}
+	return filepath.Join(cfg.WorkDir, sftpclient.DefaultHostKeyCache)
+}
 
-	logger.Info("SFTP upload successful",
-		"local_path", localPath,
-		"remote_path", remotePath,
+func newFTPClient(cfg *config.Config, target config.UploadTarget) (*ftpclient.Client, error) {
+	client := ftpclient.NewClient(
+		normalizeFTPHost(target.Host),
+		target.User,
+		target.Password,
 	)
 
-	return nil
+	if proxyURL := cfg.ProxyURL(); proxyURL != "" {
+		dialer, err := proxy.New(proxyURL, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		client.SetDialer(dialer)
+	}
+
+	minPort, maxPort, err := cfg.FTPActivePortRange()
+	if err != nil {
+		return nil, err
+	}
+	client.SetMode(cfg.FTPMode)
+	client.SetDisableEPSV(cfg.FTPDisableEPSV)
+	client.SetActivePorts(minPort, maxPort)
+	client.SetDataTimeout(cfg.FTPDataTimeout)
+
+	return client, nil
 }
 
-func uploadToFTP(cfg *config.Config, localPath string) error {
-	logger.Info("Uploading to FTP server")
+// uploadToSFTP sends all files over one SSH connection.
+func uploadToSFTP(ctx context.Context, cfg *config.Config, target config.UploadTarget, files []string) (int, error) {
+	logger.Info("Uploading to SFTP server", "target", target.Name)
 
-	ftpClient := ftpclient.NewClient(
-		normalizeFTPHost(cfg.FTPHost),
-		cfg.FTPUser,
-		cfg.FTPPassword,
-	)
+	sftpClient, err := newSFTPClient(cfg, target)
+	if err != nil {
+		return 0, err
+	}
+	sftpClient.SetVerifySize(cfg.VerifyUpload)
+	sftpClient.SetVerifyChecksum(cfg.VerifyRemoteChecksum)
+	sftpClient.SetAtomic(cfg.AtomicUpload)
+	sftpClient.SetRateLimiter(transfer.NewLimiter(cfg.MaxUploadRate * transfer.MB))
+	sftpClient.SetPreserveMTime(target.PreserveMTime)
+	// Checked by Validate
+	mode, _ := target.Mode()
+	sftpClient.SetFileMode(mode)
+	if uid, gid, ok, _ := target.Owner(); ok {
+		sftpClient.SetOwner(&sftpclient.Owner{UID: uid, GID: gid})
+	}
 
-	filename := filepath.Base(localPath)
-	remotePath := filepath.Join(cfg.FTPLogDir, filename)
+	if err := sftpClient.Connect(ctx); err != nil {
+		return 0, fmt.Errorf("SFTP upload failed: %w", err)
+	}
+	defer sftpClient.Close()
 
-	if err := ftpClient.Upload(localPath, remotePath); err != nil {
-		return fmt.Errorf("FTP upload failed: %w", err)
+	transfers := make([]sftpclient.Transfer, len(files))
+	for i, localPath := range files {
+		transfers[i] = sftpclient.Transfer{LocalPath: localPath, RemotePath: remotePathFor(target, localPath)}
 	}
 
-	logger.Info("FTP upload successful",
-		"local_path", localPath,
-		"remote_path", remotePath,
-	)
+	n, err := sftpClient.UploadMany(ctx, transfers)
+	for _, t := range transfers[:n] {
+		logger.Info("SFTP upload successful",
+			"target", target.Name,
+			"local_path", t.LocalPath,
+			"remote_path", t.RemotePath,
+		)
+	}
+	if err != nil {
+		return n, fmt.Errorf("SFTP upload failed: %w", err)
+	}
 
-	return nil
+	return n, nil
+}
+
+func uploadToFTP(ctx context.Context, cfg *config.Config, target config.UploadTarget, files []string) (int, error) {
+	logger.Info("Uploading to FTP server", "target", target.Name)
+
+	ftpClient, err := newFTPClient(cfg, target)
+	if err != nil {
+		return 0, err
+	}
+	ftpClient.SetVerifySize(cfg.VerifyUpload)
+	ftpClient.SetAtomic(cfg.AtomicUpload)
+	ftpClient.SetResume(cfg.UploadResume)
+	ftpClient.SetRateLimiter(transfer.NewLimiter(cfg.MaxUploadRate * transfer.MB))
+	ftpClient.SetPreserveMTime(target.PreserveMTime)
+	// Checked by Validate
+	mode, _ := target.Mode()
+	ftpClient.SetFileMode(mode)
+
+	for i, localPath := range files {
+		remotePath := remotePathFor(target, localPath)
+
+		if err := ftpClient.Upload(ctx, localPath, remotePath); err != nil {
+			return i, fmt.Errorf("FTP upload failed: %w", err)
+		}
+
+		logger.Info("FTP upload successful",
+			"target", target.Name,
+			"local_path", localPath,
+			"remote_path", remotePath,
+		)
+	}
+
+	return len(files), nil
+}
+
+func newHTTPUploadClient(cfg *config.Config, target config.UploadTarget) (*httpupload.Client, error) {
+	client := httpupload.NewClient(target.Method)
+	for _, header := range target.Headers {
+		name, value, _ := strings.Cut(header, ":")
+		client.SetHeader(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	client.SetMultipart(target.MultipartField)
+	// Checked by Validate
+	codes, _ := target.Statuses()
+	client.SetSuccessCodes(codes)
+
+	if proxyURL := cfg.ProxyURL(); proxyURL != "" {
+		dialer, err := proxy.New(proxyURL, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		client.SetDialer(dialer)
+	}
+	return client, nil
+}
+
+func uploadToHTTPS(ctx context.Context, cfg *config.Config, target config.UploadTarget, files []string) (int, error) {
+	logger.Info("Uploading to HTTPS endpoint", "target", target.Name)
+
+	// A raw body sent to the same URL again would replace the last file
+	if target.SingleURL() && target.MultipartField == "" && len(files) > 1 {
+		return 0, fmt.Errorf("HTTPS upload failed: url of target %s has no {{.Filename}} but %d files are to be sent", target.Name, len(files))
+	}
+
+	client, err := newHTTPUploadClient(cfg, target)
+	if err != nil {
+		return 0, err
+	}
+	client.SetRateLimiter(transfer.NewLimiter(cfg.MaxUploadRate * transfer.MB))
+
+	for i, localPath := range files {
+		uploadURL := target.UploadURL(filepath.Base(localPath), time.Now())
+		if err := client.Upload(ctx, localPath, uploadURL); err != nil {
+			return i, fmt.Errorf("HTTPS upload failed: %w", err)
+		}
+
+		logger.Info("HTTPS upload successful",
+			"target", target.Name,
+			"local_path", localPath,
+			"url", httpupload.Display(uploadURL),
+		)
+	}
+
+	return len(files), nil
+}
+
+// uploadToRsync runs rsync over ssh once per file.
+func uploadToRsync(ctx context.Context, cfg *config.Config, target config.UploadTarget, files []string) (int, error) {
+	logger.Info("Uploading with rsync", "target", target.Name)
+
+	client := newRsyncClient(cfg, target)
+	client.SetRateLimit(cfg.MaxUploadRate * transfer.MB)
+	client.SetPreserveMTime(target.PreserveMTime)
+	// Checked by Validate
+	mode, _ := target.Mode()
+	client.SetFileMode(mode)
+	if uid, gid, ok, _ := target.Owner(); ok {
+		client.SetOwner(uid, gid)
+	}
+
+	for i, localPath := range files {
+		remotePath := remotePathFor(target, localPath)
+		if err := client.Upload(ctx, localPath, remotePath); err != nil {
+			return i, fmt.Errorf("rsync upload failed: %w", err)
+		}
+
+		logger.Info("rsync upload successful",
+			"target", target.Name,
+			"local_path", localPath,
+			"remote_path", remotePath,
+		)
+	}
+
+	return len(files), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeMetricsTextfile(cfg *config.Config) {
+	if cfg.MetricsTextfile == "" {
+		return
+	}
+	if err := metrics.Default.WriteTextfile(cfg.MetricsTextfile); err != nil {
+		logger.Warn("Failed to write metrics textfile", "file", cfg.MetricsTextfile, "error", err)
+	}
 }
 
 func normalizeFTPHost(host string) string {
@@ -272,6 +1246,22 @@ func normalizeFTPHost(host string) string {
 	return host
 }
 
+// getDateRange returns the configured date range, defaulting to last week.
+func getDateRange(cfg *config.Config) (startDate, endDate string) {
+	switch {
+	case cfg.StartDate != "":
+		endDate = cfg.EndDate
+		if endDate == "" {
+			endDate = time.Now().AddDate(0, 0, -1).Format(config.DateLayout)
+		}
+		return cfg.StartDate, endDate
+	case cfg.DaysBack > 0:
+		return gihapi.GetDateRange(cfg.DaysBack)
+	default:
+		return getLastWeekRange()
+	}
+}
+
 func getLastWeekRange() (startDate, endDate string) {
 	now := time.Now()
 
@@ -27,6 +27,11 @@ echo "🧹 Cleaning old releases..."
 rm -rf "${RELEASE_DIR}"
 mkdir -p "${RELEASE_DIR}"
 
+# 32 bit platformlarda taşan sabitleri de yakalamak için vet
+echo "🔍 Running go vet..."
+go vet ./...
+GOARCH=386 go vet ./...
+
 # Her platform için build
 for platform in "${PLATFORMS[@]}"; do
     GOOS="${platform%/*}"
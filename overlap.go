@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/history"
+	"gih-ftp/internal/logger"
+)
+
+// excludeDelivered keeps a backfill from counting the same requests twice.
+// Days at either end of the job's range that earlier runs already delivered
+// are dropped from the range. It returns false with the exit code when there
+// is nothing left to do or when delivered days lie inside the range, which
+// cannot be left out of one contiguous fetch. --allow-overlap and --force
+// skip the check.
+func (j *job) excludeDelivered() (int, bool) {
+	if j.cfg.AllowOverlap || j.cfg.Force {
+		return ExitSuccess, true
+	}
+
+	delivered := j.deliveredDays()
+	days := rangeDays(j.startDate, j.endDate)
+	if len(delivered) == 0 || len(days) == 0 {
+		return ExitSuccess, true
+	}
+
+	first, last := 0, len(days)-1
+	for first <= last && delivered[days[first]] {
+		first++
+	}
+	for last >= first && delivered[days[last]] {
+		last--
+	}
+
+	if first > last {
+		logger.Info("All days of the date range were already delivered, skipping (use --allow-overlap to fetch them again)",
+			"start_date", j.startDate,
+			"end_date", j.endDate,
+		)
+		return ExitSuccess, false
+	}
+
+	var inside []string
+	for _, day := range days[first : last+1] {
+		if delivered[day] {
+			inside = append(inside, day)
+		}
+	}
+	if len(inside) > 0 {
+		logger.Error("Date range contains days already delivered by earlier runs; their requests would be counted twice (split the range or use --allow-overlap)",
+			"start_date", j.startDate,
+			"end_date", j.endDate,
+			"delivered_days", strings.Join(inside, ","),
+		)
+		return ExitConfigError, false
+	}
+
+	if first > 0 || last < len(days)-1 {
+		excluded := append(append([]string{}, days[:first]...), days[last+1:]...)
+		logger.Warn("Excluding days already delivered by earlier runs from the date range (use --allow-overlap to fetch them again)",
+			"requested_start_date", j.startDate,
+			"requested_end_date", j.endDate,
+			"start_date", days[first],
+			"end_date", days[last],
+			"excluded_days", strings.Join(excluded, ","),
+		)
+		j.startDate, j.endDate = days[first], days[last]
+		j.rep.StartDate, j.rep.EndDate = j.startDate, j.endDate
+	}
+	return ExitSuccess, true
+}
+
+// deliveredDays returns the days of the job's range that the run history or
+// the state file record as delivered to every upload target.
+func (j *job) deliveredDays() map[string]bool {
+	delivered := make(map[string]bool)
+	add := func(startDate, endDate string) {
+		// Dates are YYYYMMDD, so they compare as strings
+		if endDate < j.startDate || startDate > j.endDate {
+			return
+		}
+		for _, day := range rangeDays(startDate, endDate) {
+			delivered[day] = true
+		}
+	}
+
+	path := historyFilePath(j.cfg)
+	entries, _, err := history.Read(path)
+	if err != nil {
+		logger.Warn("Failed to read run history, cannot check for overlapping ranges", "file", path, "error", err)
+	}
+	for _, e := range entries {
+		if e.FullyDelivered() {
+			add(e.StartDate, e.EndDate)
+		}
+	}
+	if j.st != nil && j.st.LastUpload != nil {
+		add(j.st.LastUpload.StartDate, j.st.LastUpload.EndDate)
+	}
+	return delivered
+}
+
+// rangeDays lists the days from startDate to endDate inclusive.
+func rangeDays(startDate, endDate string) []string {
+	start, err := time.Parse(config.DateLayout, startDate)
+	if err != nil {
+		return nil
+	}
+	end, err := time.Parse(config.DateLayout, endDate)
+	if err != nil {
+		return nil
+	}
+
+	var days []string
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format(config.DateLayout))
+	}
+	return days
+}
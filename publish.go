@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/publish"
+)
+
+// newPublishers returns the configured queues for merge statistics.
+func newPublishers(cfg *config.Config) []publish.Publisher {
+	var publishers []publish.Publisher
+	if len(cfg.PublishKafkaBrokers) > 0 {
+		publishers = append(publishers, &publish.Kafka{
+			Brokers:  cfg.PublishKafkaBrokers,
+			Topic:    cfg.PublishKafkaTopic,
+			TLS:      cfg.PublishKafkaTLS,
+			User:     cfg.PublishKafkaUser,
+			Password: cfg.PublishKafkaPass,
+		})
+	}
+	if cfg.PublishNATSURL != "" {
+		publishers = append(publishers, &publish.NATS{
+			URL:     cfg.PublishNATSURL,
+			Subject: cfg.PublishNATSSubject,
+		})
+	}
+	return publishers
+}
+
+// publishStats sends the statistics of the saved merge m, with its top
+// domains, to the configured queues. A failed publish is only logged: the
+// merged file is what the run delivers.
+func (j *job) publishStats(m *merger.Merger) {
+	publishers := newPublishers(j.cfg)
+	if len(publishers) == 0 || j.rep.Merge == nil {
+		return
+	}
+
+	var top []publish.Domain
+	for _, stat := range m.Top(j.cfg.PublishTopDomains) {
+		top = append(top, publish.Domain{Domain: stat.Domain, QType: stat.QType, Count: stat.Count})
+	}
+	msg, err := publish.NewStats(version, j.startDate, j.endDate, j.rep.Merge, top).Marshal()
+	if err != nil {
+		logger.Warn("Failed to encode merge statistics", "error", err)
+		return
+	}
+
+	// Not derived from the run's context, like notifications
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, p := range publishers {
+		if err := p.Publish(ctx, msg); err != nil {
+			logger.Warn("Failed to publish merge statistics", "destination", p.String(), "error", err)
+			continue
+		}
+		logger.Info("Merge statistics published", "destination", p.String(), "bytes", len(msg))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gih-ftp/internal/age"
+	"gih-ftp/internal/checksum"
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/pgp"
+	"gih-ftp/internal/secrets"
+	"gih-ftp/internal/signing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// sealer encrypts merged files to the OpenPGP keys or age recipients and
+// signs what is uploaded (--encrypt-recipient, --gpg-sign-key).
+type sealer struct {
+	pgpKeys    openpgp.EntityList
+	recipients []*age.Recipient
+	signer     *signing.Signer
+}
+
+// newSealer returns nil when neither encryption nor signing is configured.
+func newSealer(cfg *config.Config) (*sealer, error) {
+	if len(cfg.EncryptRecipients) == 0 && cfg.GPGSignKey == "" {
+		return nil, nil
+	}
+
+	s := &sealer{}
+	for _, recipient := range cfg.EncryptRecipients {
+		if !age.IsRecipient(recipient) {
+			if err := s.addRecipientFile(recipient); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		r, err := age.ParseRecipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		s.recipients = append(s.recipients, r)
+	}
+	if len(s.pgpKeys) > 0 && len(s.recipients) > 0 {
+		return nil, fmt.Errorf("cannot encrypt to both OpenPGP keys and age recipients")
+	}
+
+	if cfg.GPGSignKey != "" {
+		passphrase, err := gpgPassphrase(cfg)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := signing.LoadKey(cfg.GPGSignKey, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+	}
+	return s, nil
+}
+
+// addRecipientFile adds the OpenPGP public keys or the age recipients in
+// path, depending on what the file holds.
+func (s *sealer) addRecipientFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read encryption key: %w", err)
+	}
+
+	if pgp.IsKeyFile(data) {
+		keys, err := pgp.ReadKeys(path)
+		if err != nil {
+			return err
+		}
+		s.pgpKeys = append(s.pgpKeys, keys...)
+		return nil
+	}
+
+	recipients, err := age.ReadRecipientsFile(path)
+	if err != nil {
+		return err
+	}
+	s.recipients = append(s.recipients, recipients...)
+	return nil
+}
+
+// encrypted reports whether uploaded files are encrypted.
+func (s *sealer) encrypted() bool {
+	return s != nil && (len(s.pgpKeys) > 0 || len(s.recipients) > 0)
+}
+
+func gpgPassphrase(cfg *config.Config) (string, error) {
+	if cfg.GPGPassphrase != "" || cfg.GPGPassphraseFile == "" {
+		return cfg.GPGPassphrase, nil
+	}
+	data, err := secrets.ReadFile(cfg.GPGPassphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GPG passphrase file: %w", err)
+	}
+	return string(bytes.TrimRight(data, "\r\n")), nil
+}
+
+// seal encrypts path to path.gpg or path.age, removing path unless keep is
+// set, and signs the file to upload. It returns the file to upload and its
+// signature (empty without signing).
+func (s *sealer) seal(path string, keep bool) (string, string, error) {
+	if s.encrypted() {
+		reserved, err := reserveCopy(path)
+		if err != nil {
+			return "", "", err
+		}
+		var encrypted string
+		if len(s.pgpKeys) > 0 {
+			encrypted, err = pgp.EncryptFile(path, s.pgpKeys)
+		} else {
+			encrypted, err = age.EncryptFile(path, s.recipients)
+		}
+		var written int64
+		if info, statErr := os.Stat(encrypted); err == nil && statErr == nil {
+			written = info.Size()
+		}
+		reserved.Done(written)
+		if err != nil {
+			return "", "", err
+		}
+		logger.Info("Merged file encrypted", "file", encrypted, "recipients", len(s.pgpKeys)+len(s.recipients))
+		if !keep {
+			if err := removeWorkFile(path); err != nil {
+				logger.Warn("Failed to remove unencrypted file", "file", path, "error", err)
+			}
+		}
+		path = encrypted
+	}
+
+	if s.signer == nil {
+		return path, "", nil
+	}
+	signature, err := s.signer.SignFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	logger.Info("Detached signature created", "file", signature, "key_id", s.signer.KeyID())
+	return path, signature, nil
+}
+
+// isSidecar reports whether path is a checksum manifest or a signature
+// uploaded alongside a merged file rather than a merged file itself.
+func isSidecar(path string) bool {
+	return strings.HasSuffix(path, checksum.ManifestSuffix) || strings.HasSuffix(path, signing.Suffix)
+}
+
+// initSealer loads the encryption and signing keys, so that a bad key is
+// reported before any work is done. It logs the error and returns false.
+func (j *job) initSealer() bool {
+	s, err := newSealer(j.cfg)
+	if err != nil {
+		logger.Error("Cannot set up encryption or signing", "error", err)
+		return false
+	}
+	j.sealer = s
+	return true
+}
+
+// seal encrypts and signs a merged file when configured; see sealer.seal.
+func (j *job) seal(path string, keep bool) (string, string, error) {
+	if j.sealer == nil {
+		return path, "", nil
+	}
+	return j.sealer.seal(path, keep)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gih-ftp/internal/secrets"
+)
+
+// runSecrets implements `gihftp secrets encrypt|list`, which create and
+// inspect the encrypted secrets file. It runs without loading the config.
+func runSecrets(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s secrets encrypt --in=PLAIN --out=FILE [--passphrase-file=FILE]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s secrets list --file=FILE [--passphrase-file=FILE]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "PLAIN holds \"name = value\" lines. The passphrase is read from %s or --passphrase-file.\n", secrets.PassphraseEnv)
+		return ExitConfigError
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	fs := flag.NewFlagSet("secrets "+args[0], flag.ContinueOnError)
+	in := fs.String("in", "", "Plaintext file with name = value lines")
+	out := fs.String("out", "", "Encrypted secrets file to write")
+	file := fs.String("file", "", "Encrypted secrets file to read")
+	passphraseFile := fs.String("passphrase-file", "", "File holding the passphrase")
+	if err := fs.Parse(args[1:]); err != nil {
+		return ExitConfigError
+	}
+
+	passphrase, err := secrets.Passphrase(*passphraseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+
+	switch args[0] {
+	case "encrypt":
+		if *in == "" || *out == "" {
+			return usage()
+		}
+		err = encryptSecrets(*in, *out, passphrase)
+	case "list":
+		if *file == "" {
+			return usage()
+		}
+		err = listSecrets(*file, passphrase)
+	default:
+		return usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+	return ExitSuccess
+}
+
+// encryptSecrets encrypts the plaintext file in into out (mode 0600).
+func encryptSecrets(in, out string, passphrase []byte) error {
+	plaintext, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	entries, err := secrets.Parse(plaintext)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	data, err := secrets.Encrypt(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(out, data, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Encrypted %d secrets into %s; delete %s when done\n", len(entries), out, in)
+	return nil
+}
+
+// listSecrets prints the names, never the values, of the secrets in file.
+func listSecrets(file string, passphrase []byte) error {
+	f, err := secrets.OpenFile(file, passphrase)
+	if err != nil {
+		return err
+	}
+	for _, name := range f.Names() {
+		fmt.Println(name)
+	}
+	return nil
+}
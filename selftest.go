@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/selftest"
+)
+
+// selftestServers is the number of fake GIH servers of a self-test.
+const selftestServers = 2
+
+// selftestEnv lists the environment variables besides GIHFTP_* that the
+// configuration reads; the self-test clears them so that no production
+// setting leaks into it.
+var selftestEnv = []string{
+	"GIH_API_TOKEN",
+	"FTP_PASSWORD",
+	"SSH_KEY_PASSPHRASE",
+	"GPG_PASSPHRASE",
+	"NOTIFY_SMTP_PASSWORD",
+	"VAULT_ADDR",
+	"VAULT_TOKEN",
+	"VAULT_NAMESPACE",
+	"VAULT_CACERT",
+	"CONSUL_HTTP_ADDR",
+	"CONSUL_HTTP_TOKEN",
+	"CONSUL_CACERT",
+}
+
+// runSelftest implements `gihftp selftest`: a full run against fake GIH
+// servers and an in-memory SFTP server started in the process, in a
+// temporary work directory. The config file, GIHFTP_* variables and
+// secrets of the installation are ignored, so no production endpoint is
+// contacted. The results are printed as a table like `gihftp check`.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	days := fs.Int("days", 2, "Number of days of logs to fetch")
+	keep := fs.Bool("keep", false, "Keep the temporary work directory")
+	logLevel := fs.String("log-level", "error", "Log level of the run (debug, info, error)")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if *days < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --days must be at least 1\n")
+		return ExitConfigError
+	}
+
+	dir, err := os.MkdirTemp("", "gihftp-selftest-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+	if *keep {
+		defer fmt.Printf("\nWork directory kept: %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	var apis []*selftest.API
+	for i := 1; i <= selftestServers; i++ {
+		api := selftest.NewAPI(fmt.Sprintf("gih%d", i))
+		defer api.Close()
+		apis = append(apis, api)
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+	sftpServer, err := selftest.NewSFTPServer("selftest", password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to start SFTP server: %v\n", err)
+		return ExitConfigError
+	}
+	defer sftpServer.Close()
+
+	cfg, err := selftestConfig(dir, apis, sftpServer, password, *days, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return ExitConfigError
+	}
+	if err := logger.Init(cfg.LogLevel, logger.Options{Format: cfg.LogFormat}); err != nil {
+		fmt.Fprintf(os.Stderr, "Logger initialization failed: %v\n", err)
+		return ExitConfigError
+	}
+
+	ctx, stop := withSignals(context.Background())
+	rep := runOnce(ctx, cfg, "run")
+	stop()
+
+	results := selftestResults(rep, sftpServer, selftest.Expect(len(apis), *days))
+	if failed := printResults(results); failed > 0 {
+		fmt.Printf("\nSelf-test failed: %d of %d checks\n", failed, len(results))
+		return ExitCheckError
+	}
+	fmt.Printf("\nSelf-test passed: %d checks\n", len(results))
+	return ExitSuccess
+}
+
+// selftestConfig loads the configuration of a self-test from flags alone,
+// with an empty config file in dir taking the place of /etc/gihftp.conf.
+func selftestConfig(dir string, apis []*selftest.API, sftpServer *selftest.SFTPServer, password string, days int, logLevel string) (*config.Config, error) {
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, config.EnvPrefix) || strings.HasPrefix(name, "FTP_PASSWORD_") {
+			os.Unsetenv(name)
+		}
+	}
+	for _, name := range selftestEnv {
+		os.Unsetenv(name)
+	}
+	os.Setenv("FTP_PASSWORD", password)
+
+	configFile := filepath.Join(dir, "gihftp.conf")
+	if err := os.WriteFile(configFile, []byte("# gihftp selftest\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	var servers []string
+	var bundle []byte
+	for _, api := range apis {
+		servers = append(servers, api.URL())
+		bundle = append(bundle, api.CACert()...)
+	}
+	caCert := filepath.Join(dir, "gih-ca.pem")
+	if err := os.WriteFile(caCert, bundle, 0644); err != nil {
+		return nil, err
+	}
+
+	workDir := filepath.Join(dir, "work")
+	if err := os.Mkdir(workDir, 0755); err != nil {
+		return nil, err
+	}
+
+	os.Args = []string{
+		os.Args[0],
+		"--config=" + configFile,
+		"--gih-servers=" + strings.Join(servers, ","),
+		"--gih-ca-cert=" + caCert,
+		"--upload-protocol=sftp",
+		"--ftp-host=" + sftpServer.Addr(),
+		"--ftp-user=selftest",
+		"--ftp-log-dir=/uploads/",
+		"--ssh-host-fingerprint=" + sftpServer.HostKeyFingerprint(),
+		"--work-dir=" + workDir,
+		fmt.Sprintf("--days-back=%d", days),
+		"--checksum",
+		"--log-level=" + logLevel,
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("configuration error: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+	return cfg, nil
+}
+
+// selftestResults checks the report of a self-test run against what the
+// fake servers served.
+func selftestResults(rep *report.Report, sftpServer *selftest.SFTPServer, want selftest.Totals) []checkResult {
+	var results []checkResult
+
+	for _, server := range rep.Servers {
+		var err error
+		if server.Error != "" {
+			err = errors.New(server.Error)
+		} else if server.Files == 0 {
+			err = errors.New("no files downloaded")
+		}
+		results = append(results, checkResult{
+			target: server.Host,
+			check:  fmt.Sprintf("fetch %d files", server.Files),
+			err:    err,
+		})
+	}
+
+	var mergeErr, skipErr error
+	if rep.Merge == nil {
+		mergeErr = errors.New("nothing merged")
+		skipErr = mergeErr
+	} else {
+		if rep.Merge.TotalRequests != want.Requests || rep.Merge.UniqueDomains != want.UniqueDomains {
+			mergeErr = fmt.Errorf("got %d requests and %d domains", rep.Merge.TotalRequests, rep.Merge.UniqueDomains)
+		}
+		if rep.Merge.SkippedLines != want.SkippedLines {
+			skipErr = fmt.Errorf("got %d skipped lines", rep.Merge.SkippedLines)
+		}
+	}
+	results = append(results,
+		checkResult{
+			target: "merge",
+			check:  fmt.Sprintf("%d requests, %d domains", want.Requests, want.UniqueDomains),
+			err:    mergeErr,
+		},
+		checkResult{
+			target: "merge",
+			check:  fmt.Sprintf("skip %d malformed lines", want.SkippedLines),
+			err:    skipErr,
+		},
+	)
+
+	for _, upload := range rep.Uploads {
+		results = append(results, checkResult{
+			target: fmt.Sprintf("%s (%s)", upload.Host, upload.Target),
+			check:  fmt.Sprintf("%s upload", upload.Protocol),
+			err:    selftestUpload(rep, upload, sftpServer),
+		})
+	}
+
+	var exitErr error
+	if rep.ExitCode != ExitSuccess {
+		exitErr = fmt.Errorf("exit code %d", rep.ExitCode)
+	}
+	results = append(results, checkResult{
+		target: "run",
+		check:  fmt.Sprintf("exit code %d", ExitSuccess),
+		err:    exitErr,
+	})
+	return results
+}
+
+// selftestUpload verifies that the merged file arrived intact on the SFTP
+// server along with its checksum manifest.
+func selftestUpload(rep *report.Report, upload *report.Upload, sftpServer *selftest.SFTPServer) error {
+	if upload.Error != "" {
+		return errors.New(upload.Error)
+	}
+	if rep.Output == nil || len(upload.RemotePaths) == 0 {
+		return errors.New("no file uploaded")
+	}
+
+	for i, path := range upload.RemotePaths {
+		data, err := sftpServer.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if i > 0 {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if digest := hex.EncodeToString(sum[:]); digest != rep.Output.SHA256 {
+			return fmt.Errorf("%s: SHA256 %s does not match the merged file", path, digest)
+		}
+	}
+	return nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
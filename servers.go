@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/discovery"
+	"gih-ftp/internal/gihapi"
+	"gih-ftp/internal/logger"
+)
+
+// discoverTimeout bounds the lookups of one discovery source.
+const discoverTimeout = 10 * time.Second
+
+// serverSource is a place GIH servers are discovered from at run time.
+type serverSource struct {
+	kind, name string
+	lookup     func(ctx context.Context) ([]gihapi.Server, error)
+}
+
+// serverSources returns the --gih-discover records and the Consul and
+// Kubernetes discovery providers of cfg.
+func serverSources(cfg *config.Config) []serverSource {
+	var sources []serverSource
+	for _, name := range cfg.GIHDiscover {
+		sources = append(sources, serverSource{"dns", name, func(ctx context.Context) ([]gihapi.Server, error) {
+			return gihapi.Discover(ctx, net.DefaultResolver, name, cfg.ServerDefaults)
+		}})
+	}
+	if service := cfg.GIHDiscoverConsul; service != "" {
+		opts := discovery.ConsulOptions{
+			Addr:       cfg.ConsulAddr,
+			Token:      cfg.ConsulToken,
+			Datacenter: cfg.ConsulDatacenter,
+			Tag:        cfg.ConsulTag,
+			CACert:     cfg.ConsulCACert,
+		}
+		sources = append(sources, serverSource{"consul", service, func(ctx context.Context) ([]gihapi.Server, error) {
+			return discovery.Consul(ctx, opts, service, cfg.ServerDefaults)
+		}})
+	}
+	if selector := cfg.GIHDiscoverK8s; selector != "" {
+		opts := discovery.KubernetesOptions{Namespace: cfg.K8sNamespace, PortName: cfg.K8sPortName}
+		sources = append(sources, serverSource{"kubernetes", selector, func(ctx context.Context) ([]gihapi.Server, error) {
+			return discovery.Kubernetes(ctx, opts, selector, cfg.ServerDefaults)
+		}})
+	}
+	return sources
+}
+
+// gihServers returns the GIH servers of a run: those of --gih-servers
+// followed by the ones found by the discovery sources. A source that fails
+// is logged and skipped, so one broken record or agent does not stop the
+// run; it is an error only when no server is left.
+func gihServers(ctx context.Context, cfg *config.Config) ([]gihapi.Server, error) {
+	servers := append([]gihapi.Server(nil), cfg.GIHServers...)
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		seen[server.BaseURL()] = true
+	}
+
+	sources := serverSources(cfg)
+	for _, source := range sources {
+		lookupCtx, cancel := context.WithTimeout(ctx, discoverTimeout)
+		discovered, err := source.lookup(lookupCtx)
+		cancel()
+		if err != nil {
+			logger.Warn("GIH server discovery failed", "source", source.kind, "name", source.name, "error", err)
+			continue
+		}
+		var added []string
+		for _, server := range discovered {
+			if seen[server.BaseURL()] {
+				continue
+			}
+			if server.Scheme == "http" && !cfg.GIHAllowHTTP {
+				logger.Warn("Skipping discovered GIH server reached over plain HTTP without --gih-allow-http",
+					"source", source.kind,
+					"server", server.BaseURL(),
+				)
+				continue
+			}
+			seen[server.BaseURL()] = true
+			servers = append(servers, server)
+			added = append(added, server.Name)
+		}
+		logger.Info("Discovered GIH servers", "source", source.kind, "name", source.name, "servers", fmt.Sprintf("%v", added))
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no GIH servers: none configured and none discovered from %d sources", len(sources))
+	}
+	for _, server := range servers {
+		if server.Scheme == "http" {
+			logger.Warn("GIH server is reached over plain HTTP: DNS logs and API credentials travel unencrypted and can be read or altered on the network; use only for lab servers",
+				"server", server.BaseURL(),
+			)
+		}
+	}
+	return servers, nil
+}
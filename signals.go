@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gih-ftp/internal/logger"
+)
+
+// errInterrupted is the cancellation cause set when SIGINT or SIGTERM is
+// received.
+var errInterrupted = errors.New("interrupted by signal")
+
+// withSignals returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so in-flight downloads and uploads stop and clean up after
+// themselves. A second signal exits immediately. stop releases the signal
+// handler.
+func withSignals(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigCh:
+			logger.Warn("Received signal, cancelling (send again to exit immediately)", "signal", sig.String())
+			cancel(errInterrupted)
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-sigCh:
+			logger.Error("Received second signal, exiting immediately", "signal", sig.String())
+			os.Exit(ExitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigCh)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// interrupted reports whether ctx was cancelled by a signal.
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
+
+// notifyReload returns a channel receiving SIGHUP, which asks a daemon to
+// reload its configuration, and a function that releases it. A signal that
+// arrives during a run is kept until the run finishes.
+func notifyReload() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch, func() { signal.Stop(ch) }
+}
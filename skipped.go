@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/report"
+)
+
+// newQuarantine returns the file receiving the malformed lines of a run
+// started at startedAt, or nil without --quarantine-dir.
+func newQuarantine(cfg *config.Config, startedAt time.Time) *merger.Quarantine {
+	if cfg.QuarantineDir == "" {
+		return nil
+	}
+	name := "gihftp-quarantine-" + startedAt.Format("20060102-150405") + ".txt"
+	return merger.NewQuarantine(filepath.Join(cfg.QuarantineDir, name))
+}
+
+// closeQuarantine closes the job's quarantine file and records it in the
+// report when lines were written to it.
+func (j *job) closeQuarantine() {
+	q := j.quarantine
+	if q == nil {
+		return
+	}
+	if err := q.Close(); err != nil {
+		logger.Warn("Failed to write quarantine file", "file", q.Path(), "error", err)
+	}
+	if lines := q.Lines(); lines > 0 {
+		logger.Info("Malformed lines quarantined", "file", q.Path(), "lines", lines)
+		j.rep.Quarantine = q.Path()
+	}
+}
+
+// logSkippedLines warns about the malformed lines of a fetched server.
+func logSkippedLines(result *report.Server) {
+	if result.SkippedLines == 0 {
+		return
+	}
+	logger.Warn("Skipped malformed lines",
+		"host", result.Host,
+		"lines", result.Lines,
+		"skipped_lines", result.SkippedLines,
+		"skipped_percent", fmt.Sprintf("%.2f", skippedPercent(result.Lines, result.SkippedLines)),
+	)
+}
+
+// skippedPercent returns the share of malformed lines among all lines read.
+func skippedPercent(lines, skipped int) float64 {
+	if skipped == 0 {
+		return 0
+	}
+	return float64(skipped) / float64(lines+skipped) * 100
+}
+
+// checkSkipped fails the merge when a server, or an input file of a local
+// merge, has more malformed lines than --max-skipped-percent allows. Such
+// data most likely comes from a broken exporter and should not be uploaded.
+func (j *job) checkSkipped() int {
+	limit := j.cfg.MaxSkippedPercent
+	if limit <= 0 {
+		return ExitSuccess
+	}
+
+	exceeded := false
+	check := func(key, name string, lines, skipped int) {
+		percent := skippedPercent(lines, skipped)
+		if percent <= limit {
+			return
+		}
+		logger.Error("Too many malformed lines",
+			key, name,
+			"lines", lines,
+			"skipped_lines", skipped,
+			"skipped_percent", fmt.Sprintf("%.2f", percent),
+			"max_skipped_percent", limit,
+		)
+		exceeded = true
+	}
+
+	for _, s := range j.rep.Servers {
+		if s.Error == "" {
+			check("host", s.Host, s.Lines, s.SkippedLines)
+		}
+	}
+	if j.rep.Merge != nil {
+		for _, s := range j.rep.Merge.Sources {
+			check("source", s.Source, s.Lines, s.SkippedLines)
+		}
+	}
+
+	if exceeded {
+		return ExitMergeError
+	}
+	return ExitSuccess
+}
@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gih-ftp/internal/checksum"
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/diskspace"
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/metrics"
+	"gih-ftp/internal/pipeline"
+	"gih-ftp/internal/progress"
+	"gih-ftp/internal/remotepath"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/rsync"
+	"gih-ftp/internal/split"
+	"gih-ftp/internal/state"
+	"gih-ftp/internal/transfer"
+)
+
+// stageFunc is the body of a subcommand; it returns the exit code.
+type stageFunc func(ctx context.Context, cfg *config.Config, rep *report.Report) int
+
+// commands maps subcommands to the stages they run. run performs all of
+// them in one process; fetch, merge and upload hand over through the state
+// file so a failed stage can be repeated on its own.
+var commands = map[string]stageFunc{
+	"run":    run,
+	"fetch":  runFetch,
+	"merge":  runMerge,
+	"upload": runUpload,
+}
+
+// job holds what the stages of one invocation share.
+type job struct {
+	cfg       *config.Config
+	rep       *report.Report
+	st        *state.State
+	startDate string
+	endDate   string
+
+	// summary of the merged file, set by merge
+	summary *state.Summary
+
+	// receives the malformed lines skipped, nil without --quarantine-dir
+	quarantine *merger.Quarantine
+
+	// encrypts and signs merged files, nil when neither is configured
+	sealer *sealer
+}
+
+func newJob(cfg *config.Config, rep *report.Report) (*job, error) {
+	startDate, endDate := getDateRange(cfg)
+	rep.StartDate, rep.EndDate = startDate, endDate
+
+	st, err := state.Load(stateFilePath(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	return &job{cfg: cfg, rep: rep, st: st, startDate: startDate, endDate: endDate}, nil
+}
+
+// alreadyUploaded reports (and logs) whether the range was delivered by an
+// earlier run and --force is not set.
+func (j *job) alreadyUploaded() bool {
+	if !j.st.Uploaded(j.startDate, j.endDate) || j.cfg.Force {
+		return false
+	}
+	logger.Info("Date range already uploaded, skipping (use --force to upload again)",
+		"start_date", j.startDate,
+		"end_date", j.endDate,
+		"file", j.st.LastUpload.Filename,
+		"uploaded_at", j.st.LastUpload.UploadedAt,
+	)
+	return true
+}
+
+func (j *job) saveState() {
+	if err := j.st.Save(); err != nil {
+		logger.Warn("Failed to save state", "error", err)
+	}
+}
+
+// run performs the whole fetch/merge/upload cycle.
+func run(ctx context.Context, cfg *config.Config, rep *report.Report) int {
+	j, err := newJob(cfg, rep)
+	if err != nil {
+		logger.Error("Failed to load state", "error", err)
+		return ExitConfigError
+	}
+	if j.alreadyUploaded() {
+		return ExitSuccess
+	}
+	if exitCode, ok := j.excludeDelivered(); !ok {
+		return exitCode
+	}
+	if !j.initSealer() {
+		return ExitConfigError
+	}
+
+	out, err := newOutputMergers(cfg)
+	if err != nil {
+		logger.Error("Failed to create merger", "error", err)
+		return ExitConfigError
+	}
+	defer out.Close()
+
+	stages := &runStages{job: j, out: out}
+	p := &pipeline.Pipeline{
+		Fetcher:   stages,
+		Merger:    stages,
+		Uploader:  stages,
+		StartedAt: rep.StartedAt,
+	}
+	return p.Run(ctx)
+}
+
+// runStages are the pipeline stages of a full run, which hand over through
+// the in-memory mergers of out.
+type runStages struct {
+	*job
+	out *dayMergers
+}
+
+func (s *runStages) Fetch(ctx context.Context) (succeeded, failed, exitCode int) {
+	s.quarantine = newQuarantine(s.cfg, s.rep.StartedAt)
+	defer s.closeQuarantine()
+	return s.fetch(ctx, s.out)
+}
+
+func (s *runStages) Merge(ctx context.Context, complete bool) ([]string, int) {
+	files, exitCode := s.mergeOutputs(s.out)
+	if exitCode != ExitSuccess {
+		return nil, exitCode
+	}
+	s.st.RecordMerge(s.startDate, s.endDate, files, complete, s.summary)
+	return files, ExitSuccess
+}
+
+func (s *runStages) Upload(ctx context.Context, files []string, complete bool) int {
+	return s.upload(ctx, files, complete)
+}
+
+// runFetch downloads every server's logs into its partial aggregate in the
+// work directory without merging or uploading.
+func runFetch(ctx context.Context, cfg *config.Config, rep *report.Report) int {
+	j, err := newJob(cfg, rep)
+	if err != nil {
+		logger.Error("Failed to load state", "error", err)
+		return ExitConfigError
+	}
+	if j.alreadyUploaded() {
+		return ExitSuccess
+	}
+	if exitCode, ok := j.excludeDelivered(); !ok {
+		return exitCode
+	}
+
+	j.quarantine = newQuarantine(cfg, rep.StartedAt)
+	successCount, failureCount, exitCode := j.fetch(ctx, nil)
+	j.closeQuarantine()
+	j.saveState()
+	if exitCode != ExitSuccess {
+		return exitCode
+	}
+
+	logger.Info("Fetch completed",
+		"servers_success", successCount,
+		"servers_failed", failureCount,
+	)
+
+	if failureCount > 0 {
+		return ExitPartialError
+	}
+	return ExitSuccess
+}
+
+// runMerge builds the merged file from the partial aggregates saved by an
+// earlier fetch, or from local files with --input-dir, without contacting
+// any server.
+func runMerge(ctx context.Context, cfg *config.Config, rep *report.Report) int {
+	if cfg.InputDir != "" {
+		j := &job{cfg: cfg, rep: rep}
+		if !j.initSealer() {
+			return ExitConfigError
+		}
+		return j.mergeLocal(cfg.InputDir, cfg.Output)
+	}
+
+	j, err := newJob(cfg, rep)
+	if err != nil {
+		logger.Error("Failed to load state", "error", err)
+		return ExitConfigError
+	}
+	if exitCode, ok := j.excludeDelivered(); !ok {
+		return exitCode
+	}
+	if !j.initSealer() {
+		return ExitConfigError
+	}
+
+	out, err := newOutputMergers(cfg)
+	if err != nil {
+		logger.Error("Failed to create merger", "error", err)
+		return ExitConfigError
+	}
+	defer out.Close()
+
+	servers, err := gihServers(ctx, cfg)
+	if err != nil {
+		logger.Error("Failed to determine GIH servers", "error", err)
+		return ExitFetchError
+	}
+
+	mergeStart := time.Now()
+	merged, missing := 0, 0
+	for _, server := range servers {
+		result := rep.AddServer(server.Name)
+		partial, ok := j.st.CompletedFetch(j.startDate, j.endDate, server.Name)
+		if !ok {
+			result.Error = "not fetched"
+			logger.Warn("No fetched data for server", "host", server.Name)
+			missing++
+			continue
+		}
+		if err := mergePartial(out, server.Name, partial); err != nil {
+			result.Error = err.Error()
+			logger.Error("Failed to read fetched data", "host", server.Name, "file", partial, "error", err)
+			missing++
+			continue
+		}
+		result.Reused = true
+		setServerDays(result, j.st.FetchDays(server.Name))
+		merged++
+	}
+	rep.Timings.Merge += time.Since(mergeStart).Seconds()
+
+	if merged == 0 {
+		logger.Error("No fetched data for date range (run gihftp fetch first)",
+			"start_date", j.startDate,
+			"end_date", j.endDate,
+		)
+		return ExitMergeError
+	}
+
+	files, exitCode := j.mergeOutputs(out)
+	if exitCode != ExitSuccess {
+		return exitCode
+	}
+	j.st.RecordMerge(j.startDate, j.endDate, files, missing == 0, j.summary)
+	j.saveState()
+
+	if missing > 0 {
+		return ExitPartialError
+	}
+	return ExitSuccess
+}
+
+// runUpload delivers the merged file recorded by an earlier merge to every
+// upload target, or the file given with --file.
+func runUpload(ctx context.Context, cfg *config.Config, rep *report.Report) int {
+	if cfg.UploadFile != "" {
+		j := &job{cfg: cfg, rep: rep}
+		if !j.initSealer() {
+			return ExitConfigError
+		}
+		return j.uploadFile(ctx, cfg.UploadFile)
+	}
+
+	j, err := newJob(cfg, rep)
+	if err != nil {
+		logger.Error("Failed to load state", "error", err)
+		return ExitConfigError
+	}
+	if j.alreadyUploaded() {
+		return ExitSuccess
+	}
+	if exitCode, ok := j.excludeDelivered(); !ok {
+		return exitCode
+	}
+
+	merge, ok := j.st.MergedFiles(j.startDate, j.endDate)
+	if !ok || len(merge.Files) == 0 {
+		logger.Error("No merged file for date range (run gihftp merge first)",
+			"start_date", j.startDate,
+			"end_date", j.endDate,
+		)
+		return ExitUploadError
+	}
+	for _, path := range merge.Files {
+		if _, err := os.Stat(path); err != nil {
+			logger.Error("Merged file is missing", "file", path, "error", err)
+			return ExitUploadError
+		}
+	}
+
+	for _, path := range merge.Files {
+		if isSidecar(path) {
+			continue
+		}
+		output := &report.Output{Path: path}
+		if info, err := os.Stat(path); err == nil {
+			output.Size = info.Size()
+		}
+		if cfg.Granularity != "daily" {
+			j.rep.Output = output
+			break
+		}
+		j.rep.Outputs = append(j.rep.Outputs, output)
+	}
+
+	if exitCode := j.upload(ctx, merge.Files, merge.Complete); exitCode != ExitSuccess {
+		return exitCode
+	}
+	if !merge.Complete {
+		return ExitPartialError
+	}
+	return ExitSuccess
+}
+
+// newOutputMerger creates a merger for the combined result of all servers,
+// applying filter (if not nil) to every domain.
+func newOutputMerger(cfg *config.Config, filter *merger.Filter) (*merger.Merger, error) {
+	m, err := newMerger(cfg, cfg.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+	m.SetCompression(cfg.Compress)
+	m.SetLayout(outputLayout(cfg))
+	m.SetMinCount(cfg.MinCount)
+	if filter != nil {
+		m.SetFilter(filter)
+	}
+	return m, nil
+}
+
+// outputLayout returns the layout of the merged file.
+func outputLayout(cfg *config.Config) merger.Layout {
+	return merger.Layout{
+		Columns:        cfg.OutputColumns,
+		Separator:      cfg.OutputSeparator,
+		Thousands:      cfg.OutputThousands,
+		DomainWidth:    cfg.OutputDomainWidth,
+		CountWidth:     cfg.OutputCountWidth,
+		Header:         cfg.OutputHeader,
+		NoFinalNewline: !cfg.OutputFinalNewline,
+	}
+}
+
+// loadDomainFilter loads the configured domain allow/blocklists, or returns
+// nil when there are none.
+func loadDomainFilter(cfg *config.Config) (*merger.Filter, error) {
+	if cfg.DomainAllowlist == "" && cfg.DomainBlocklist == "" {
+		return nil, nil
+	}
+	filter, err := merger.LoadFilter(cfg.DomainAllowlist, cfg.DomainBlocklist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load domain filter: %w", err)
+	}
+	return filter, nil
+}
+
+// fetch fetches every server, merging each completed server into out unless
+// out is nil. exitCode is ExitSuccess when at least one server succeeded.
+func (j *job) fetch(ctx context.Context, out *dayMergers) (successCount, failureCount, exitCode int) {
+	cfg := j.cfg
+	start := time.Now()
+	defer func() {
+		j.rep.Timings.Fetch += time.Since(start).Seconds()
+	}()
+
+	apiClient, err := newAPIClient(cfg)
+	if err != nil {
+		logger.Error("Failed to create GIH API client", "error", err)
+		return 0, 0, ExitConfigError
+	}
+	defer apiClient.Close()
+
+	logger.Info("Fetching logs for date range",
+		"start_date", j.startDate,
+		"end_date", j.endDate,
+	)
+
+	servers, err := gihServers(ctx, cfg)
+	if err != nil {
+		logger.Error("Failed to determine GIH servers", "error", err)
+		return 0, 0, ExitFetchError
+	}
+
+	for _, server := range servers {
+		progress.ForServer(server.Name)
+	}
+
+	var failures []error
+	noSpace := false
+	for _, server := range servers {
+		if interrupted(ctx) {
+			break
+		}
+		host := server.Name
+		result := j.rep.AddServer(host)
+		bar := progress.ForServer(host)
+		bar.Start()
+		serverStart := time.Now()
+		err := fetchFromServerResumable(ctx, cfg, j.st, apiClient, out, j.quarantine, server, j.startDate, j.endDate, result)
+		bar.Finish(err)
+		result.DurationSeconds = time.Since(serverStart).Seconds()
+		metrics.Set(metrics.ServerFetchDuration, result.DurationSeconds, "server", host)
+		if err != nil {
+			result.Error = err.Error()
+			result.ErrorCode = errorCode(err)
+			failures = append(failures, err)
+			logger.Error("Weekly fetch failed",
+				"host", host,
+				"duration_seconds", result.DurationSeconds,
+				"error", err)
+			failureCount++
+			metrics.Add(metrics.ServerFailures, 1, "server", host)
+			// The other servers would fill the same disk
+			if errors.Is(err, diskspace.ErrNoSpace) {
+				noSpace = true
+				break
+			}
+		} else {
+			logger.Info("Server fetch completed",
+				"host", host,
+				"files", result.Files,
+				"bytes", result.Bytes,
+				"reused", result.Reused,
+				"duration_seconds", result.DurationSeconds,
+			)
+			successCount++
+		}
+	}
+
+	// Pruned after fetching, so that expired entries revalidated by this
+	// run are kept
+	if dc := downloadCache(cfg); dc != nil {
+		if removed, err := dc.Prune(); err != nil {
+			logger.Warn("Failed to prune download cache", "error", err)
+		} else if removed > 0 {
+			logger.Info("Pruned download cache", "files_removed", removed)
+		}
+	}
+
+	if noSpace {
+		logger.Error("Not enough space in work directory, aborting fetch", "work_dir", cfg.WorkDir)
+		return successCount, failureCount, ExitFetchError
+	}
+	if interrupted(ctx) {
+		logger.Error("Run interrupted during fetch")
+		return successCount, failureCount, ExitInterrupted
+	}
+	if ctx.Err() != nil {
+		logger.Error("Run deadline exceeded during fetch", "deadline", cfg.RunDeadline.String())
+		return successCount, failureCount, ExitTimeout
+	}
+
+	if successCount == 0 {
+		logger.Error("No successful fetch from any server")
+		return successCount, failureCount, exitCodeFor(failures, ExitFetchError)
+	}
+
+	return successCount, failureCount, ExitSuccess
+}
+
+// mergeLocal merges the local log files matched by input (a directory or a
+// glob pattern) into output. Compressed files are decompressed. Neither the
+// state file nor any server is touched.
+func (j *job) mergeLocal(input, output string) int {
+	paths, err := inputFiles(input)
+	if err != nil {
+		logger.Error("Cannot list input files", "input", input, "error", err)
+		return ExitConfigError
+	}
+	if len(paths) == 0 {
+		logger.Error("No input files found", "input", input)
+		return ExitMergeError
+	}
+
+	if output != "" {
+		if output, err = filepath.Abs(output); err != nil {
+			logger.Error("Invalid output path", "error", err)
+			return ExitConfigError
+		}
+	}
+
+	filter, err := loadDomainFilter(j.cfg)
+	if err != nil {
+		logger.Error("Failed to create merger", "error", err)
+		return ExitConfigError
+	}
+	m, err := newOutputMerger(j.cfg, filter)
+	if err != nil {
+		logger.Error("Failed to create merger", "error", err)
+		return ExitConfigError
+	}
+	defer m.Close()
+
+	j.quarantine = newQuarantine(j.cfg, j.rep.StartedAt)
+	m.SetQuarantine(j.quarantine, "local")
+
+	logger.Info("Merging local files", "input", input, "files", len(paths))
+
+	start := time.Now()
+	for _, path := range paths {
+		if err := mergeLocalFile(m, path); err != nil {
+			j.closeQuarantine()
+			logger.Error("Failed to merge file", "file", path, "error", err)
+			return ExitMergeError
+		}
+	}
+	j.closeQuarantine()
+	j.rep.Timings.Merge += time.Since(start).Seconds()
+
+	_, exitCode := j.merge(m, output)
+	return exitCode
+}
+
+// inputFiles returns the regular files in dir, or the files matching a glob
+// pattern, in name order.
+func inputFiles(input string) ([]string, error) {
+	pattern := input
+	if info, err := os.Stat(input); err == nil && info.IsDir() {
+		pattern = filepath.Join(input, "*")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+func mergeLocalFile(m *merger.Merger, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return mergeLogFile(m, filepath.Base(path), file, filepath.Base(path))
+}
+
+// remoteArchiveDirname is the directory below the remote log directory that
+// --remote-retention-action=archive moves old files to.
+const remoteArchiveDirname = "archive"
+
+// outputPrefix starts the name of every merged file; the upload date
+// (YYYYMMDD) follows it, or the day of the data for daily granularity.
+const outputPrefix = "NETINTERNET-GIH-DNS_250k-"
+
+// outputDate returns the date in the name of a merged file (or of its
+// checksum manifest).
+func outputDate(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, outputPrefix)
+	if !ok || len(rest) < len(config.DateLayout) {
+		return "", false
+	}
+	date := rest[:len(config.DateLayout)]
+	if _, err := time.Parse(config.DateLayout, date); err != nil {
+		return "", false
+	}
+	return date, true
+}
+
+// checkAnomalies compares the merged range with the last uploaded one and
+// records the deviations beyond --anomaly-threshold in the report. A rerun
+// of the same range is not compared with itself.
+func (j *job) checkAnomalies() {
+	if j.cfg.AnomalyThreshold <= 0 || j.st == nil {
+		return
+	}
+	prev := j.st.LastSummary
+	if prev == nil || (prev.StartDate == j.startDate && prev.EndDate == j.endDate) {
+		return
+	}
+
+	j.rep.Anomalies = detectAnomalies(prev, j.summary, j.cfg.AnomalyThreshold)
+	for _, a := range j.rep.Anomalies {
+		logger.Warn("Unusual change compared with previous range",
+			"server", a.Server,
+			"metric", a.Metric,
+			"previous", a.Previous,
+			"current", a.Current,
+			"change_percent", a.ChangePercent,
+			"previous_start_date", prev.StartDate,
+			"previous_end_date", prev.EndDate,
+		)
+	}
+}
+
+// merge saves m as the merged file (plus its checksum manifest) and returns
+// the files to upload. An empty output selects the dated default name in
+// the work directory.
+func (j *job) merge(m *merger.Merger, output string) ([]string, int) {
+	if exitCode := j.summarize(m); exitCode != ExitSuccess {
+		return nil, exitCode
+	}
+
+	saved, files, exitCode := j.save(m, output)
+	if exitCode != ExitSuccess {
+		return nil, exitCode
+	}
+	j.rep.Output = saved
+	j.publishStats(m)
+	return files, ExitSuccess
+}
+
+// mergeOutputs saves the merged result of a run and returns the files to
+// upload: one file for weekly granularity, or one file per day named with
+// its date for daily granularity. The statistics and the anomaly check
+// cover all days together.
+func (j *job) mergeOutputs(out *dayMergers) ([]string, int) {
+	if !out.daily {
+		m, err := out.get("")
+		if err != nil {
+			logger.Error("Failed to create merger", "error", err)
+			return nil, ExitMergeError
+		}
+		return j.merge(m, "")
+	}
+
+	total, err := out.create()
+	if err != nil {
+		logger.Error("Failed to create merger", "error", err)
+		return nil, ExitMergeError
+	}
+	defer total.Close()
+
+	start := time.Now()
+	days := out.days()
+	for _, day := range days {
+		if err := total.Merge(out.byDay[day]); err != nil {
+			logger.Error("Failed to merge daily results", "day", day, "error", err)
+			return nil, ExitMergeError
+		}
+	}
+	j.rep.Timings.Merge += time.Since(start).Seconds()
+	if exitCode := j.summarize(total); exitCode != ExitSuccess {
+		return nil, exitCode
+	}
+	if len(days) == 0 {
+		logger.Warn("No log files for any day of the date range, no daily files created",
+			"start_date", j.startDate,
+			"end_date", j.endDate,
+		)
+		return nil, ExitNoData
+	}
+
+	var files []string
+	for _, day := range days {
+		filename := outputPrefix + day + merger.FormatExtension(j.cfg.OutputFormat)
+		saved, dayFiles, exitCode := j.save(out.byDay[day], filename)
+		if exitCode != ExitSuccess {
+			return nil, exitCode
+		}
+		j.rep.Outputs = append(j.rep.Outputs, saved)
+		files = append(files, dayFiles...)
+	}
+	j.publishStats(total)
+	return files, ExitSuccess
+}
+
+// summarize logs and reports the statistics of the merged result m and
+// compares it with the previous range.
+func (j *job) summarize(m *merger.Merger) int {
+	cfg, rep := j.cfg, j.rep
+	start := time.Now()
+	defer func() {
+		rep.Timings.Merge += time.Since(start).Seconds()
+	}()
+
+	stats := m.GetStats()
+
+	// Malformed lines are skipped by the per-server mergers before their
+	// data reaches m, or by m itself for local files
+	skippedLines := stats["skipped_lines"].(int)
+	for _, s := range rep.Servers {
+		skippedLines += s.SkippedLines
+	}
+
+	logger.Info("Weekly merge statistics",
+		"week_start", j.startDate,
+		"week_end", j.endDate,
+		"unique_domains", stats["unique_domains"],
+		"total_requests", stats["total_requests"],
+		"top_domain", stats["top_domain"],
+		"top_domain_hits", stats["top_domain_hits"],
+		"filtered_lines", stats["filtered_lines"],
+		"skipped_lines", skippedLines,
+		"suppressed_domains", stats["suppressed_domains"],
+		"suppressed_requests", stats["suppressed_requests"],
+	)
+	var sources []report.Source
+	for _, s := range stats["sources"].([]merger.SourceStats) {
+		logger.Info("Source statistics",
+			"source", s.Source,
+			"lines", s.Lines,
+			"requests", s.Requests,
+			"unique_domains", s.UniqueDomains,
+			"skipped_lines", s.Skipped,
+		)
+		sources = append(sources, report.Source{
+			Source:        s.Source,
+			Lines:         s.Lines,
+			Requests:      s.Requests,
+			UniqueDomains: s.UniqueDomains,
+			SkippedLines:  s.Skipped,
+		})
+	}
+	metrics.Set(metrics.UniqueDomains, float64(stats["unique_domains"].(int)))
+	metrics.Set(metrics.TotalRequests, float64(stats["total_requests"].(int)))
+	rep.Merge = &report.Merge{
+		UniqueDomains: stats["unique_domains"].(int),
+		TotalRequests: stats["total_requests"].(int),
+		TopDomain:     stats["top_domain"].(string),
+		TopDomainHits: stats["top_domain_hits"].(int),
+		FilteredLines: stats["filtered_lines"].(int),
+		SkippedLines:  skippedLines,
+
+		SuppressedDomains:  stats["suppressed_domains"].(int),
+		SuppressedRequests: stats["suppressed_requests"].(int),
+
+		Sources: sources,
+		Days:    j.dayBreakdown(),
+	}
+
+	if exitCode := j.checkSkipped(); exitCode != ExitSuccess {
+		return exitCode
+	}
+
+	if stats["total_requests"].(int) == 0 {
+		logger.Warn("Merged dataset is empty",
+			"week_start", j.startDate,
+			"week_end", j.endDate,
+		)
+		if cfg.FailOnEmpty {
+			logger.Error("Not creating an empty merged file (--fail-on-empty)")
+			return ExitNoData
+		}
+	}
+
+	j.summary = newSummary(j.startDate, j.endDate, stats)
+	j.checkAnomalies()
+	j.checkTopDiff(m)
+	return ExitSuccess
+}
+
+// save writes m to output (plus its checksum manifest) and returns the
+// saved file and the files to upload. An empty output selects the dated
+// default name in the work directory.
+func (j *job) save(m *merger.Merger, output string) (*report.Output, []string, int) {
+	cfg := j.cfg
+	start := time.Now()
+	defer func() {
+		j.rep.Timings.Save += time.Since(start).Seconds()
+	}()
+
+	filename := output
+	if filename == "" {
+		uploadDate := time.Now().Format("20060102")
+		filename = fmt.Sprintf("%s%s%s", outputPrefix, uploadDate, merger.FormatExtension(cfg.OutputFormat))
+	}
+	outputPath, err := m.SaveAs(filename, cfg.OutputFormat)
+	if err != nil {
+		logger.Error("Failed to save merged file", "file", filename, "error", err)
+		return nil, nil, ExitMergeError
+	}
+
+	if cfg.Granularity == "daily" {
+		// The file is named after its day
+		logger.Info("Daily merged file created", "file", outputPath)
+	} else {
+		logger.Info("Weekly merged file created",
+			"file", outputPath,
+			"week_start", j.startDate,
+			"week_end", j.endDate,
+		)
+	}
+
+	sealed, signature, err := j.seal(outputPath, false)
+	if err != nil {
+		logger.Error("Failed to encrypt or sign merged file", "file", outputPath, "error", err)
+		return nil, nil, ExitMergeError
+	}
+	outputPath = sealed
+
+	saved := &report.Output{Path: outputPath, Signature: signature, Encrypted: j.sealer.encrypted()}
+	if info, err := os.Stat(outputPath); err == nil {
+		saved.Size = info.Size()
+	}
+
+	files := []string{outputPath}
+	if signature != "" {
+		files = append(files, signature)
+	}
+
+	if cfg.Checksum {
+		manifestPath, digest, err := checksum.WriteManifest(outputPath)
+		if err != nil {
+			logger.Error("Failed to create checksum manifest", "file", outputPath, "error", err)
+			return nil, nil, ExitMergeError
+		}
+
+		logger.Info("Checksum manifest created",
+			"file", manifestPath,
+			"sha256", digest,
+		)
+		files = append(files, manifestPath)
+		saved.SHA256 = digest
+	} else if cfg.Report != "" {
+		if digest, err := checksum.File(outputPath); err == nil {
+			saved.SHA256 = digest
+		}
+	}
+
+	// The parts replace the merged file; the signature and the checksum
+	// manifest still apply to it once reassembled
+	files, parts, _, err := splitOutput(cfg, files)
+	if err != nil {
+		logger.Error("Failed to split merged file", "file", outputPath, "error", err)
+		return nil, nil, ExitMergeError
+	}
+	if parts != nil {
+		removeWorkFile(outputPath)
+		saved.Parts = parts
+	}
+
+	return saved, files, ExitSuccess
+}
+
+// uploadName returns the name of the file delivered by files: the merged
+// file itself, or with --split-size the file its parts reassemble to, as
+// named by the parts manifest.
+func uploadName(files []string) string {
+	for _, path := range files {
+		if name, ok := strings.CutSuffix(path, split.ManifestSuffix); ok {
+			return filepath.Base(name)
+		}
+	}
+	return filepath.Base(files[0])
+}
+
+// splitOutput splits files[0] into parts when it is larger than
+// --split-size. files is returned with the parts in place of files[0] and
+// the parts manifest appended, so that the manifest is uploaded last.
+// Without splitting files is returned as is and parts is nil.
+func splitOutput(cfg *config.Config, files []string) (result, parts []string, manifest string, err error) {
+	if cfg.SplitSizeMB == 0 {
+		return files, nil, "", nil
+	}
+	// The parts hold as much as the file; the manifest is negligible
+	reserved, err := reserveCopy(files[0])
+	if err != nil {
+		return files, nil, "", err
+	}
+	parts, manifest, err = split.File(files[0], int64(cfg.SplitSizeMB)*transfer.MB)
+	var written int64
+	if info, statErr := os.Stat(files[0]); err == nil && parts != nil && statErr == nil {
+		written = info.Size()
+	}
+	reserved.Done(written)
+	if err != nil || parts == nil {
+		return files, nil, "", err
+	}
+
+	logger.Info("File split into parts for upload",
+		"file", files[0],
+		"parts", len(parts),
+		"part_size_mb", cfg.SplitSizeMB,
+		"manifest", manifest,
+	)
+	result = append(append(parts[:len(parts):len(parts)], files[1:]...), manifest)
+	return result, parts, manifest, nil
+}
+
+// uploadFile pushes an existing local file (and its checksum manifest when
+// enabled) to every upload target. The state file is left untouched and the
+// file is never removed.
+func (j *job) uploadFile(ctx context.Context, path string) int {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Cannot read file to upload", "file", path, "error", err)
+		return ExitUploadError
+	}
+	sealed, signature, err := j.seal(path, true)
+	if err != nil {
+		logger.Error("Failed to encrypt or sign file", "file", path, "error", err)
+		return ExitUploadError
+	}
+	if sealed != path {
+		path = sealed
+		if info, err = os.Stat(path); err != nil {
+			logger.Error("Cannot read file to upload", "file", path, "error", err)
+			return ExitUploadError
+		}
+	}
+	j.rep.Output = &report.Output{Path: path, Size: info.Size(), Signature: signature, Encrypted: j.sealer.encrypted()}
+
+	files := []string{path}
+	if signature != "" {
+		files = append(files, signature)
+	}
+	if j.cfg.Checksum {
+		manifestPath, digest, err := checksum.WriteManifest(path)
+		if err != nil {
+			logger.Error("Failed to create checksum manifest", "file", path, "error", err)
+			return ExitMergeError
+		}
+		files = append(files, manifestPath)
+		j.rep.Output.SHA256 = digest
+	}
+
+	// The parts are removed again; the file itself is kept
+	files, parts, manifest, err := splitOutput(j.cfg, files)
+	if err != nil {
+		logger.Error("Failed to split file", "file", path, "error", err)
+		return ExitUploadError
+	}
+	if parts != nil {
+		j.rep.Output.Parts = parts
+		defer func() {
+			for _, part := range append(parts, manifest) {
+				removeWorkFile(part)
+			}
+		}()
+	}
+
+	if exitCode := j.preUploadHook(ctx, files, true); exitCode != ExitSuccess {
+		return exitCode
+	}
+
+	d := j.deliver(ctx, files)
+	if interrupted(ctx) {
+		logger.Error("Upload interrupted")
+		return ExitInterrupted
+	}
+	j.postUploadHook(ctx, files)
+
+	switch {
+	case len(d.failures) == len(j.cfg.UploadTargets):
+		return exitCodeFor(d.failures, ExitUploadError)
+	case d.requiredFailed() > 0:
+		return ExitPartialError
+	}
+	return ExitSuccess
+}
+
+// pruneRemote deletes, or moves to the remote archive directory, the merged
+// files of earlier runs on target whose upload date is older than
+// --remote-retention-weeks. Other files in the log directory are left alone.
+func pruneRemote(ctx context.Context, cfg *config.Config, target config.UploadTarget) ([]string, error) {
+	cutoff := time.Now().AddDate(0, 0, -7*cfg.RemoteRetentionWeeks).Format(config.DateLayout)
+	expired := func(name string) bool {
+		date, ok := outputDate(name)
+		return ok && date < cutoff
+	}
+
+	archiveDir := ""
+	if cfg.RemoteRetentionAction == "archive" {
+		archiveDir = remotepath.Join(target.LogDir, remoteArchiveDirname)
+	}
+
+	switch target.Protocol {
+	case "sftp", "rsync":
+		// rsync targets are pruned over SFTP with the same SSH login
+		client, err := newSFTPClient(cfg, target)
+		if err != nil {
+			return nil, err
+		}
+		return client.Prune(ctx, target.LogDir, expired, archiveDir)
+	case "https":
+		// An HTTP endpoint cannot be listed
+		return nil, nil
+	}
+
+	client, err := newFTPClient(cfg, target)
+	if err != nil {
+		return nil, err
+	}
+	return client.Prune(ctx, target.LogDir, expired, archiveDir)
+}
+
+// fallbackTarget returns target switched to the other upload protocol, or
+// false when it has none it may use: HTTPS has no other protocol, and SFTP
+// only falls back to cleartext FTP with InsecureFallback. An explicit port
+// belongs to the original protocol and is dropped, so the fallback uses its
+// default port. rsync falls back to SFTP on the same SSH port.
+func fallbackTarget(target config.UploadTarget) (config.UploadTarget, bool) {
+	switch target.Protocol {
+	case "https":
+		return target, false
+	case "rsync":
+		target.Protocol = "sftp"
+		return target, true
+	case "sftp":
+		if !target.InsecureFallback {
+			return target, false
+		}
+		target.Protocol = "ftp"
+	default:
+		target.Protocol = "sftp"
+	}
+	if host, _, err := net.SplitHostPort(target.Host); err == nil {
+		target.Host = host
+	}
+	return target, true
+}
+
+// fallbackWanted reports whether the other protocol may avoid err: the
+// target could not be reached, or an rsync target has no rsync. Failures
+// after the server was reached, e.g. a failed verification, are not tried
+// with another protocol.
+func fallbackWanted(target config.UploadTarget, err error) bool {
+	if target.Protocol == "rsync" {
+		return errors.Is(err, rsync.ErrNoRemoteRsync)
+	}
+	return connectFailed(err)
+}
+
+// archive moves uploaded files into today's archive directory and reports
+// whether they were moved. Without --archive-dir nothing is done.
+func (j *job) archive(files []string) bool {
+	a := localArchive(j.cfg)
+	if a == nil {
+		return false
+	}
+
+	archived, err := a.Store(time.Now(), files)
+	if err != nil {
+		// Files moved before the error are gone from the work directory;
+		// the rest are cleaned up as usual.
+		logger.Warn("Failed to archive uploaded files", "error", err)
+		return false
+	}
+	for _, path := range archived {
+		logger.Info("File archived", "file", path)
+	}
+	return true
+}
+
+// upload delivers files to every upload target. When complete is false some
+// servers are missing from the merged file; the range is then not recorded
+// as uploaded so that the next run can fetch the missing servers.
+func (j *job) upload(ctx context.Context, files []string, complete bool) int {
+	cfg, st := j.cfg, j.st
+
+	// The merged files are recorded in the state, so an aborted wait is
+	// delivered by the next run
+	if !waitUploadWindow(ctx, cfg) {
+		j.saveState()
+		if interrupted(ctx) {
+			logger.Error("Run interrupted while waiting for the upload window")
+			return ExitInterrupted
+		}
+		logger.Error("Run deadline exceeded while waiting for the upload window", "deadline", cfg.RunDeadline.String())
+		return ExitTimeout
+	}
+
+	if exitCode := j.preUploadHook(ctx, files, complete); exitCode != ExitSuccess {
+		j.saveState()
+		return exitCode
+	}
+
+	d := j.deliver(ctx, files)
+
+	// The merged file is rebuilt from the partials by the next run; only the
+	// fetch progress and the targets already delivered to are kept.
+	if interrupted(ctx) {
+		logger.Error("Run interrupted during upload")
+		for _, path := range files {
+			removeWorkFile(path)
+		}
+		if st.Merge != nil {
+			st.Merge.Files = nil
+		}
+		j.saveState()
+		return ExitInterrupted
+	}
+
+	j.postUploadHook(ctx, files)
+
+	if len(d.failures) == len(cfg.UploadTargets) {
+		j.saveState()
+		return exitCodeFor(d.failures, ExitUploadError)
+	}
+
+	// Keep the local file and the fetch progress until every required
+	// target has it, so the next run can deliver to the targets that
+	// failed; those that succeeded are recorded and skipped then. Optional
+	// targets that failed miss this range.
+	if d.requiredFailed() > 0 {
+		logger.Error("Upload failed for some targets",
+			"targets_failed", len(d.failures),
+			"targets_total", len(cfg.UploadTargets),
+		)
+		j.saveState()
+		return ExitPartialError
+	}
+
+	// A partial result is kept resumable: the next run refetches only the
+	// failed servers and uploads the completed file again.
+	var cleanup []string
+	archived := j.archive(files)
+	if !archived {
+		cleanup = append(cleanup, files...)
+	}
+	if complete {
+		partials := st.PartialFiles()
+		st.RecordUpload(j.startDate, j.endDate, uploadName(files))
+		cleanup = append(cleanup, partials...)
+	} else if cfg.CleanupAfter || archived {
+		st.Merge = nil
+	}
+	j.saveState()
+
+	if cfg.CleanupAfter {
+		// Partials of daily granularity are directories of per-day files
+		for _, path := range cleanup {
+			if err := os.RemoveAll(path); err != nil {
+				logger.Warn("Failed to remove temp file", "file", path)
+			} else {
+				logger.Info("Temp file removed", "file", path)
+			}
+		}
+
+		// Only succeeds once the directories are empty
+		os.Remove(partialDir(cfg, j.startDate, j.endDate))
+		os.Remove(filepath.Dir(partialDir(cfg, j.startDate, j.endDate)))
+	}
+
+	return ExitSuccess
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gih-ftp/internal/config"
+	"gih-ftp/internal/progress"
+	"gih-ftp/internal/report"
+)
+
+// progressDisplay returns the display for --progress, or nil when it is
+// off or stdout is not a terminal. A daemon never draws one.
+func progressDisplay(cfg *config.Config) *progress.Display {
+	if !cfg.Progress || cfg.Daemon || !progress.IsTerminal(os.Stdout) {
+		return nil
+	}
+	return progress.New(os.Stdout)
+}
+
+// printSummary prints a table of what every server and upload target of
+// rep did, followed by the totals of the run.
+func printSummary(rep *report.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	if len(rep.Servers) > 0 {
+		fmt.Fprintln(w, "SERVER\tFILES\tFAILED\tCACHED\tBYTES\tRESULT")
+		for _, s := range rep.Servers {
+			result := "OK"
+			switch {
+			case s.Error != "":
+				result = "FAIL " + s.Error
+			case s.Reused:
+				result = "REUSED"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", s.Host, s.Files, s.FilesFailed, s.CachedFiles, formatBytes(s.Bytes), result)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(rep.Uploads) > 0 {
+		fmt.Fprintln(w, "TARGET\tPROTOCOL\tFILES\tDURATION\tRESULT")
+		for _, u := range rep.Uploads {
+			result := "OK"
+			switch {
+			case u.Error != "" && u.Optional:
+				result = "FAIL (optional) " + u.Error
+			case u.Error != "":
+				result = "FAIL " + u.Error
+			case u.Skipped:
+				result = "SKIPPED (delivered earlier)"
+			}
+			duration := time.Duration(u.DurationSeconds * float64(time.Second)).Round(time.Millisecond)
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", u.Target, u.Protocol, len(u.RemotePaths), duration, result)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+
+	if rep.Merge != nil {
+		fmt.Printf("Merged: %d requests, %d unique domains\n", rep.Merge.TotalRequests, rep.Merge.UniqueDomains)
+	}
+	duration := time.Duration(rep.DurationSeconds * float64(time.Second)).Round(time.Second)
+	fmt.Printf("Finished in %s with exit code %d\n", duration, rep.ExitCode)
+}
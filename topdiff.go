@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gih-ftp/internal/logger"
+	"gih-ftp/internal/merger"
+	"gih-ftp/internal/report"
+	"gih-ftp/internal/state"
+)
+
+// checkTopDiff records the top domains of m in the summary and compares
+// them with the top domains of the previously uploaded range. The delta is
+// written next to the merged file and added to the report.
+func (j *job) checkTopDiff(m *merger.Merger) {
+	n := j.cfg.TopDiff
+	if n <= 0 || j.st == nil {
+		return
+	}
+	for _, stat := range m.Top(n) {
+		j.summary.Top = append(j.summary.Top, state.TopDomain{Domain: stat.Domain, QType: stat.QType, Count: stat.Count})
+	}
+
+	prev, ok := j.previousTop()
+	if !ok {
+		logger.Debug("No previous top domains to compare with")
+		return
+	}
+	if len(prev.Top) > n {
+		prev.Top = prev.Top[:n]
+	}
+
+	diff := diffTop(prev.Top, j.summary.Top, j.cfg.TopDiffRankChange)
+	diff.Top = n
+	diff.PreviousStartDate = prev.StartDate
+	diff.PreviousEndDate = prev.EndDate
+
+	path := filepath.Join(j.cfg.WorkDir, fmt.Sprintf("gihftp-topdiff-%s-%s.json", j.startDate, j.endDate))
+	if err := writeTopDiff(path, diff); err != nil {
+		logger.Warn("Failed to write top domain delta", "file", path, "error", err)
+	} else {
+		diff.Path = path
+	}
+	j.rep.TopDiff = diff
+
+	logger.Info("Top domains compared with previous range",
+		"top", n,
+		"entered", len(diff.Entered),
+		"dropped", len(diff.Dropped),
+		"moved", len(diff.Moved),
+		"previous_start_date", prev.StartDate,
+		"previous_end_date", prev.EndDate,
+		"file", diff.Path,
+	)
+}
+
+// previousTop returns the summary of the last uploaded range with its top
+// domains. State files written without --top-diff lack them; they are then
+// read from the archived copy of the uploaded file.
+func (j *job) previousTop() (*state.Summary, bool) {
+	prev := j.st.LastSummary
+	if prev == nil || (prev.StartDate == j.startDate && prev.EndDate == j.endDate) {
+		return nil, false
+	}
+	if len(prev.Top) > 0 {
+		return prev, true
+	}
+
+	// The first file of a daily upload covers one day only
+	last := j.st.LastUpload
+	if last == nil || j.cfg.ArchiveDir == "" || j.cfg.Granularity != "weekly" {
+		return nil, false
+	}
+	path := filepath.Join(j.cfg.ArchiveDir, last.UploadedAt.Local().Format("2006-01-02"), last.Filename)
+	top, err := topFromFile(path, j.cfg.TopDiff, j.cfg.OutputFormat, outputLayout(j.cfg))
+	if err != nil || len(top) == 0 {
+		logger.Debug("Previous top domains not read from archive", "file", path, "error", err)
+		return nil, false
+	}
+	return &state.Summary{StartDate: prev.StartDate, EndDate: prev.EndDate, Top: top}, true
+}
+
+// diffTop compares the top lists prev and cur (in descending order) and
+// returns the domains that entered cur, dropped out of it, or moved more
+// than rankChange places.
+func diffTop(prev, cur []state.TopDomain, rankChange int) *report.TopDiff {
+	// With the breakdown by query type an entry is a domain and type
+	key := func(d state.TopDomain) string { return d.Domain + " " + d.QType }
+	prevRank := make(map[string]int, len(prev))
+	for i, d := range prev {
+		prevRank[key(d)] = i + 1
+	}
+	curRank := make(map[string]int, len(cur))
+	for i, d := range cur {
+		curRank[key(d)] = i + 1
+	}
+
+	diff := &report.TopDiff{Entered: []report.TopChange{}, Dropped: []report.TopChange{}, Moved: []report.TopChange{}}
+	for i, d := range cur {
+		rank := i + 1
+		was, ok := prevRank[key(d)]
+		switch {
+		case !ok:
+			diff.Entered = append(diff.Entered, report.TopChange{Domain: d.Domain, QType: d.QType, Rank: rank, Count: d.Count})
+		case abs(rank-was) > rankChange:
+			diff.Moved = append(diff.Moved, report.TopChange{
+				Domain:        d.Domain,
+				QType:         d.QType,
+				Rank:          rank,
+				PreviousRank:  was,
+				Count:         d.Count,
+				PreviousCount: prev[was-1].Count,
+			})
+		}
+	}
+	for i, d := range prev {
+		if _, ok := curRank[key(d)]; !ok {
+			diff.Dropped = append(diff.Dropped, report.TopChange{Domain: d.Domain, QType: d.QType, PreviousRank: i + 1, PreviousCount: d.Count})
+		}
+	}
+	return diff
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func writeTopDiff(path string, diff *report.TopDiff) error {
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// topFromFile reads the first n domains of a merged file, which lists
+// domains in descending count order, in any output format and compression.
+// format and layout are those the file was written with.
+func topFromFile(path string, n int, format string, layout merger.Layout) ([]state.TopDomain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	compression, r := merger.DetectCompression(file, path)
+	rc, err := merger.NewDecompressor(r, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var top []state.TopDomain
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() && len(top) < n {
+		if d, ok := parseTopLine(scanner.Text(), format, layout); ok {
+			top = append(top, d)
+		}
+	}
+	return top, scanner.Err()
+}
+
+// parseTopLine parses a line of the merged file. The header and other lines
+// without a count are skipped.
+func parseTopLine(line, format string, layout merger.Layout) (state.TopDomain, bool) {
+	var d state.TopDomain
+	if format == merger.FormatJSONL {
+		err := json.Unmarshal([]byte(line), &d)
+		return d, err == nil && d.Domain != ""
+	}
+
+	var fields []string
+	if format == merger.FormatCSV {
+		r := csv.NewReader(strings.NewReader(line))
+		if layout.Separator != "" {
+			r.Comma, _ = utf8.DecodeRuneInString(layout.Separator)
+		}
+		var err error
+		if fields, err = r.Read(); err != nil {
+			return d, false
+		}
+	} else {
+		sep := layout.Separator
+		if sep == "" {
+			sep = "|"
+		}
+		fields = strings.Split(line, sep)
+	}
+
+	columns := layout.Columns
+	if len(columns) == 0 {
+		columns = []string{merger.ColumnDomain, merger.ColumnCount}
+	}
+	if len(fields) != len(columns) {
+		return d, false
+	}
+	for i, column := range columns {
+		value := strings.TrimSpace(fields[i])
+		switch column {
+		case merger.ColumnDomain:
+			d.Domain = value
+		case merger.ColumnQType:
+			d.QType = value
+		case merger.ColumnCount:
+			if layout.Thousands != "" {
+				value = strings.ReplaceAll(value, layout.Thousands, "")
+			}
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return d, false
+			}
+			d.Count = count
+		}
+	}
+	return d, d.Domain != ""
+}